@@ -17,12 +17,15 @@ import (
 	"fmt"
 	"flag"
 	"os"
+	"os/signal"
+	"syscall"
+	"context"
 	"log"
 	"time"
 	)
 
 import ds "./server"
-//import err "github.com/gvallee/syserror"
+import err "github.com/gvallee/syserror"
 
 /**
  * Main function that is used to create a binary that can be used to instantiate a data
@@ -31,31 +34,134 @@ import ds "./server"
 func main() {
 	/* Argument parsing */
 	basedir := flag.String ("basedir", "", "Data server base directory")
-	block_size := flag.Uint64 ("block-size", 1, "Block size in MB")
+	block_size_str := flag.String ("block-size", "1MiB", "Block size, with an optional unit (e.g., 4096, 64k, 1MiB)")
 	url := flag.String ("url", "127.0.0.1:88888", "URL that will be used by the server")
+	cache_size := flag.Int ("block-cache-size", ds.DefaultBlockCacheSize, "Maximum number of block files kept open")
+	auto_create := flag.Bool ("auto-create-namespaces", false, "Create unknown namespaces upon write instead of rejecting the request")
+	durability := flag.String ("durability", "write", "When written data is synced to disk: none, write, periodic or flush")
+	sync_interval := flag.Duration ("sync-interval", ds.DefaultSyncInterval, "Interval between group commits with the periodic durability policy")
+	store_type := flag.String ("store", "file", "Where blocks are stored: file (one file per block under the basedir), extent (blocks packed in container files under the basedir) or memory (volatile)")
+	memory_capacity := flag.String ("memory-capacity", "0", "Maximum amount of data kept by the memory store, with an optional unit (e.g., 16GiB); 0 for no limit")
+	checksum := flag.String ("checksum", "none", "Checksum of the blocks of new namespaces, verified on every read: none, crc32c or xxhash")
+	checksum_chunk_size := flag.String ("checksum-chunk-size", "4KiB", "Size of the chunks of a block that get their own checksum, with an optional unit")
+	compression := flag.String ("compression", "none", "Compression of the blocks of new namespaces: none, zstd, lz4 or snappy")
+	compression_chunk_size := flag.String ("compression-chunk-size", "64KiB", "Size of the chunks of a block compressed independently, with an optional unit")
+	keyfile := flag.String ("keyfile", "", "File with the keys encrypting the blocks, one key id and hexadecimal AES key per line; the highest id encrypts new data")
+	encrypt := flag.Bool ("encrypt", false, "Encrypt the blocks of new namespaces with AES-GCM, requires -keyfile")
+	dedup := flag.Bool ("dedup", false, "Store the identical blocks of new namespaces once, across namespaces")
+	scrub_interval := flag.Duration ("scrub-interval", 24 * time.Hour, "Time between two scrubs verifying all the blocks in the background; 0 to scrub only upon request")
+	scrub_rate := flag.String ("scrub-rate", "16MiB", "Maximum amount of data scrubbed per second, with an optional unit")
+	scrub_max_load := flag.Uint64 ("scrub-max-load", ds.DefaultScrubMaxLoad, "Client block operations per second above which scrubbing pauses")
+	force := flag.Bool ("force", false, "Use the basedir even if it was created with a different block size")
+	shutdown_timeout := flag.Duration ("shutdown-timeout", 30 * time.Second, "Time given to requests in progress to complete upon SIGINT/SIGTERM")
 
 	flag.Parse()
 
-	/* We check whether the basedir is valid or not */
-	_, myerror := os.Stat (*basedir)
-	if (myerror != nil) { log.Fatal (myerror) }
-	fmt.Println ("Basedir:", *basedir)
+	/* Check the block store */
+	var store ds.BlockStore = nil
+	switch *store_type {
+	case "file", "extent":
+		/* We check whether the basedir is valid or not */
+		_, myerror := os.Stat (*basedir)
+		if (myerror != nil) { log.Fatal (myerror) }
+		fmt.Println ("Basedir:", *basedir)
+		if (*store_type == "extent") { store = ds.NewExtentStore () }
+	case "memory":
+		/* Nothing is persisted */
+		*basedir = ""
+		capacity, caperr := ds.ParseSize (*memory_capacity)
+		if (caperr != nil) { log.Fatal (caperr) }
+		store = ds.NewMemoryStore (capacity)
+	default:
+		log.Fatal ("Invalid block store: ", *store_type)
+	}
+	fmt.Println ("Block store:", *store_type)
 
 	/* Check the block size */
-	fmt.Println ("Block size:", *block_size)
-	if (*block_size == 0) { log.Fatal ("Invalid block size") }
+	block_size, bserr := ds.ParseBlockSize (*block_size_str)
+	if (bserr != nil) { log.Fatal (bserr) }
+	fmt.Println ("Block size:", block_size, "bytes")
+
+	/* Check the durability policy */
+	mode, moderr := ds.ParseDurability (*durability)
+	if (moderr != err.NoErr) { log.Fatal ("Invalid durability policy: ", *durability) }
+	fmt.Println ("Durability:", mode)
+
+	/* Check the checksums */
+	algo, algoerr := ds.ParseChecksum (*checksum)
+	if (algoerr != err.NoErr) { log.Fatal ("Invalid checksum algorithm: ", *checksum) }
+	chunk_size, chunkerr := ds.ParseSize (*checksum_chunk_size)
+	if (chunkerr == nil) { chunkerr = ds.CheckChecksumChunkSize (chunk_size) }
+	if (chunkerr != nil) { log.Fatal (chunkerr) }
+	fmt.Println ("Checksum:", algo, "per", chunk_size, "bytes")
+
+	/* Check the compression */
+	compress_algo, compresserr := ds.ParseCompression (*compression)
+	if (compresserr != err.NoErr) { log.Fatal ("Invalid compression algorithm: ", *compression) }
+	compress_chunk, compresschunkerr := ds.ParseSize (*compression_chunk_size)
+	if (compresschunkerr == nil) { compresschunkerr = ds.CheckCompressionChunkSize (compress_chunk) }
+	if (compresschunkerr != nil) { log.Fatal (compresschunkerr) }
+	fmt.Println ("Compression:", compress_algo, "per", compress_chunk, "bytes")
+
+	/* Check the encryption keys */
+	var keys ds.KeyProvider = nil
+	if (*keyfile != "") {
+		kf, keyerr := ds.LoadKeyFile (*keyfile)
+		if (keyerr != nil) { log.Fatal (keyerr) }
+		keys = kf
+	}
+	if (*encrypt && keys == nil) { log.Fatal ("Encryption requires a keyfile") }
+	fmt.Println ("Encryption of new namespaces:", *encrypt)
+	fmt.Println ("Deduplication of new namespaces:", *dedup)
+
+	/* Check the scrubber's settings */
+	scrub_bytes, scruberr := ds.ParseSize (*scrub_rate)
+	if (scruberr != nil) { log.Fatal (scruberr) }
+	if (*scrub_interval < 0) { log.Fatal ("Invalid scrub interval: ", *scrub_interval) }
 
 	/* Check the URL */
 	fmt.Println ("URL:", *url)
 
 	/* From here, we know that we have all the required information to start the server */
-	myserver := ds.ServerInit (*basedir, *block_size, *url)
+	var cfg ds.ServerConfig
+	cfg.Basedir = *basedir
+	cfg.BlockSize = block_size
+	cfg.URL = *url
+	cfg.BlockCacheSize = *cache_size
+	cfg.AutoCreateNamespaces = *auto_create
+	cfg.Durability = mode
+	cfg.SyncInterval = *sync_interval
+	cfg.Force = *force
+	cfg.Store = store
+	cfg.Checksum = algo
+	cfg.ChecksumChunkSize = chunk_size
+	cfg.Compression = compress_algo
+	cfg.CompressionChunkSize = compress_chunk
+	cfg.Encrypt = *encrypt
+	cfg.Keys = keys
+	cfg.Dedup = *dedup
+	cfg.ScrubInterval = *scrub_interval
+	cfg.ScrubRate = scrub_bytes
+	cfg.ScrubMaxLoad = *scrub_max_load
+	myserver := ds.ServerInitWithConfig (&cfg)
 	if (myserver == nil) { log.Fatal ("Cannot create server") }
+	if (myserver.Start () != err.NoErr) { log.Fatal ("Cannot start server") }
+	uuid, _ := ds.GetUUID (myserver)
+	fmt.Println ("Server UUID:", uuid)
 
-	for {
-		time.Sleep (1 * time.Second)
-		if (ds.IsServerDone() == 1) { break }
+	/* Upon SIGINT/SIGTERM, we let the requests in progress complete before leaving */
+	signals := make (chan os.Signal, 1)
+	signal.Notify (signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		fmt.Println ("Received", sig, "- shutting down...")
+		ctx, cancel := context.WithTimeout (context.Background (), *shutdown_timeout)
+		ds.ServerFini (myserver, ctx)
+		cancel()
+	case <-myserver.Done():
 	}
 
+	if (myserver.Err () != err.NoErr) { log.Fatal ("Server terminated with an error: ", myserver.Err().Error()) }
+
 	fmt.Println ("All done. Bye")
 }
@@ -0,0 +1,78 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("fmt"
+	"strconv"
+	"strings")
+
+// Limits of the block size of a server or namespace, in bytes
+const (
+	MinBlockSize = 512
+	MaxBlockSize = 1024 * 1024 * 1024
+	// Block sizes must be a multiple of the alignment
+	BlockSizeAlignment = 512
+)
+
+var sizeUnits = []struct {
+	suffix	string
+	factor	uint64
+}{
+	// Longest suffixes first so that "KiB" is not taken for "B"
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"tb", 1 << 40},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30}, {"t", 1 << 40},
+	{"b", 1},
+}
+
+/**
+ * Parse a size given with an optional unit, e.g., "4096", "64k", "1MiB". Units are case
+ * insensitive and always powers of 1024: k, KB and KiB all mean 1024 bytes.
+ * @param[in]	str	Size
+ * @return	Size in bytes
+ * @return	Error describing why the size is invalid, nil otherwise
+ */
+func ParseSize (str string) (uint64, error) {
+	value := strings.ToLower (strings.TrimSpace (str))
+	var factor uint64 = 1
+	for _, unit := range sizeUnits {
+		if (strings.HasSuffix (value, unit.suffix)) {
+			value = strings.TrimSpace (strings.TrimSuffix (value, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+
+	n, myerror := strconv.ParseUint (value, 10, 64)
+	if (myerror != nil) { return 0, fmt.Errorf ("invalid size %q: expected a number of bytes with an optional unit (e.g., 4096, 64k, 1MiB)", str) }
+	if (n > ^uint64 (0) / factor) { return 0, fmt.Errorf ("invalid size %q: too large", str) }
+	return n * factor, nil
+}
+
+/**
+ * Parse a block size given with an optional unit (see ParseSize) and check it against
+ * the limits supported by the server.
+ * @param[in]	str	Block size
+ * @return	Block size in bytes
+ * @return	Error describing why the block size is invalid, nil otherwise
+ */
+func ParseBlockSize (str string) (uint64, error) {
+	bs, myerror := ParseSize (str)
+	if (myerror != nil) { return 0, fmt.Errorf ("invalid block size %q: expected a number of bytes with an optional unit (e.g., 4096, 64k, 1MiB)", str) }
+	return bs, CheckBlockSize (bs)
+}
+
+/**
+ * Check that a block size is within the limits supported by the server
+ * @param[in]	bs	Block size in bytes
+ * @return	Error describing why the block size is invalid, nil otherwise
+ */
+func CheckBlockSize (bs uint64) error {
+	if (bs < MinBlockSize) { return fmt.Errorf ("invalid block size of %d bytes: must be at least %d bytes", bs, MinBlockSize) }
+	if (bs > MaxBlockSize) { return fmt.Errorf ("invalid block size of %d bytes: must be at most %d bytes", bs, MaxBlockSize) }
+	if (bs % BlockSizeAlignment != 0) { return fmt.Errorf ("invalid block size of %d bytes: must be a multiple of %d bytes", bs, BlockSizeAlignment) }
+	return nil
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"fmt"
+	"log")
+
+func TestBlockSize (t *testing.T) {
+	fmt.Print ("Testing block size parsing... ")
+	valid := map[string]uint64 {
+		"4096": 4096,
+		"64k": 64 * 1024,
+		"64KiB": 64 * 1024,
+		"1MiB": 1024 * 1024,
+		"1 MB": 1024 * 1024,
+		"2m": 2 * 1024 * 1024,
+		"1GiB": 1024 * 1024 * 1024,
+		"512B": 512,
+	}
+	for str, expected := range valid {
+		bs, myerror := ParseBlockSize (str)
+		if (myerror != nil || bs != expected) { log.Fatal ("FATAL ERROR: Cannot parse block size ", str, ": ", myerror) }
+	}
+	for _, str := range []string {"", "1", "0", "-1MiB", "1.5MiB", "100", "1000", "2GiB", "MiB", "1TiB", "18446744073709551615k"} {
+		_, myerror := ParseBlockSize (str)
+		if (myerror == nil) { log.Fatal ("FATAL ERROR: Invalid block size accepted: ", str) }
+	}
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing block size limits... ")
+	if (CheckBlockSize (MinBlockSize) != nil || CheckBlockSize (MaxBlockSize) != nil) { log.Fatal ("FATAL ERROR: Limits rejected") }
+	if (CheckBlockSize (MinBlockSize - 1) == nil || CheckBlockSize (MaxBlockSize + BlockSizeAlignment) == nil) { log.Fatal ("FATAL ERROR: Out of range block size accepted") }
+	if (CheckBlockSize (4096 + 1) == nil) { log.Fatal ("FATAL ERROR: Unaligned block size accepted") }
+	if (ServerInit ("/tmp", 1, "127.0.0.1:8901") != nil) { log.Fatal ("FATAL ERROR: Server created with 1-byte blocks") }
+	fmt.Println ("PASS")
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("os"
+	"fmt"
+	"sync"
+	"strings"
+	"container/list")
+
+import err "github.com/gvallee/syserror"
+
+// Default maximum number of block files kept open by a server
+const DefaultBlockCacheSize = 1024
+
+/**
+ * Open block file. While refs is not 0, the handle is in use and cannot be closed;
+ * if the entry is invalidated in the meantime, the last user closes it.
+ */
+type cachedFile struct {
+	key	string
+	namespace	string
+	path	string
+	f	*os.File
+	refs	int
+	dirty	bool		// Data written since the last sync
+	invalid	bool		// No longer in the cache
+	closed	bool
+	elem	*list.Element
+}
+
+/**
+ * Bounded LRU cache of the open block files, keyed by namespace and block id.
+ */
+type blockFileCache struct {
+	lock	sync.Mutex
+	size	int
+	entries	map[string]*cachedFile
+	lru	*list.List	// Most recently used first
+	failed	map[string]bool	// Blocks for which a background sync failed
+}
+
+func newBlockFileCache (size int) *blockFileCache {
+	c := new (blockFileCache)
+	c.size = size
+	c.entries = make (map[string]*cachedFile)
+	c.lru = list.New()
+	c.failed = make (map[string]bool)
+	return c
+}
+
+/**
+ * Sync (if dirty) and close a file that is no longer in the cache nor in use.
+ * Must be called with the lock of the cache held.
+ * @return	System error handle
+ */
+func (c *blockFileCache) closeLocked (cf *cachedFile) err.SysError {
+	if (cf.closed) { return err.NoErr }
+	cf.closed = true
+
+	var syncerr error = nil
+	if (cf.dirty) { syncerr = cf.f.Sync() }
+	closeerr := cf.f.Close()
+	if (syncerr != nil || closeerr != nil) {
+		fmt.Println ("ERROR: Cannot flush/close", cf.path)
+		if (syncerr != nil) { c.failed[cf.key] = true }
+		return err.ErrFatal
+	}
+	cf.dirty = false
+	return err.NoErr
+}
+
+func (c *blockFileCache) removeLocked (cf *cachedFile) {
+	c.lru.Remove (cf.elem)
+	delete (c.entries, cf.key)
+	cf.invalid = true
+}
+
+/**
+ * Evict the least recently used files that are not in use until the cache fits its
+ * size. Files that are in use are skipped, the cache can therefore temporarily
+ * be bigger than its size.
+ */
+func (c *blockFileCache) evictLocked () {
+	e := c.lru.Back()
+	for len (c.entries) > c.size && e != nil {
+		prev := e.Prev()
+		cf := e.Value.(*cachedFile)
+		if (cf.refs == 0) {
+			c.removeLocked (cf)
+			c.closeLocked (cf)
+		}
+		e = prev
+	}
+}
+
+/**
+ * Get the open file of a block, opening it if it is not in the cache.
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	key	Key of the block, see blockKey
+ * @param[in]	path	Path to the block file
+ * @param[in]	flags	Flags used to open the file if needed
+ * @return	Cached file, to be released with release
+ * @return	Error returned by the open system call, if any
+ */
+func (c *blockFileCache) acquire (namespace string, key string, path string, flags int) (*cachedFile, error) {
+	c.lock.Lock()
+	cf, ok := c.entries[key]
+	if (ok) {
+		cf.refs += 1
+		c.lru.MoveToFront (cf.elem)
+		c.lock.Unlock()
+		return cf, nil
+	}
+	c.lock.Unlock()
+
+	// Opening the file can be slow, we do it without holding the lock
+	f, myerror := os.OpenFile (path, flags, 0755)
+	if (myerror != nil) { return nil, myerror }
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cf, ok = c.entries[key]
+	if (ok) {
+		// Someone opened the same block in the meantime
+		f.Close()
+	} else {
+		cf = new (cachedFile)
+		cf.key = key
+		cf.namespace = namespace
+		cf.path = path
+		cf.f = f
+		cf.elem = c.lru.PushFront (cf)
+		c.entries[key] = cf
+	}
+	cf.refs += 1
+	c.lru.MoveToFront (cf.elem)
+	c.evictLocked()
+
+	return cf, nil
+}
+
+/**
+ * Release a file obtained with acquire.
+ * @param[in]	cf	Cached file
+ * @param[in]	dirty	Whether data was written and not synced
+ */
+func (c *blockFileCache) release (cf *cachedFile, dirty bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cf.refs -= 1
+	if (dirty) { cf.dirty = true }
+	if (cf.invalid) {
+		if (cf.refs == 0) { c.closeLocked (cf) }
+		return
+	}
+	c.evictLocked()
+}
+
+/**
+ * Drop a block from the cache, for instance because the block is being deleted.
+ * @param[in]	key	Key of the block
+ */
+func (c *blockFileCache) invalidate (key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete (c.failed, key)
+	cf, ok := c.entries[key]
+	if (!ok) { return }
+	c.removeLocked (cf)
+	if (cf.refs == 0) { c.closeLocked (cf) }
+}
+
+/**
+ * Drop all the blocks of a namespace from the cache.
+ * @param[in]	namespace	Namespace's name
+ */
+func (c *blockFileCache) invalidateNamespace (namespace string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	prefix := namespace + "/"
+	for key, cf := range c.entries {
+		if (!strings.HasPrefix (key, prefix)) { continue }
+		c.removeLocked (cf)
+		if (cf.refs == 0) { c.closeLocked (cf) }
+	}
+	for key := range c.failed {
+		if (strings.HasPrefix (key, prefix)) { delete (c.failed, key) }
+	}
+}
+
+/**
+ * Change the maximum number of open files
+ * @param[in]	size	New size of the cache
+ */
+func (c *blockFileCache) resize (size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.size = size
+	c.evictLocked()
+}
+
+/**
+ * Flush and close all the files, including the ones in use.
+ * @return	Number of files that could not be flushed or closed
+ */
+func (c *blockFileCache) closeAll () int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	failed := 0
+	for _, cf := range c.entries {
+		c.removeLocked (cf)
+		// Users still holding the file will get an error from it
+		if (c.closeLocked (cf) != err.NoErr) { failed += 1 }
+	}
+	return failed
+}
+
+/**
+ * Sync the dirty files that match a filter. The files are synced without holding the
+ * lock of the cache so other blocks can still be accessed in the meantime.
+ * @param[in]	match	Function selecting the files to sync
+ * @return	Number of files that could not be synced
+ */
+func (c *blockFileCache) syncDirty (match func (*cachedFile) bool) int {
+	var todo []*cachedFile
+
+	c.lock.Lock()
+	for _, cf := range c.entries {
+		if (!cf.dirty || !match (cf)) { continue }
+		cf.refs += 1
+		cf.dirty = false
+		todo = append (todo, cf)
+	}
+	c.lock.Unlock()
+
+	failed := 0
+	for _, cf := range todo {
+		syncerr := cf.f.Sync()
+		if (syncerr != nil) {
+			fmt.Println ("ERROR: Cannot sync", cf.path, ":", syncerr.Error())
+			failed += 1
+			c.lock.Lock()
+			c.failed[cf.key] = true
+			c.lock.Unlock()
+		}
+		c.release (cf, false)
+	}
+	return failed
+}
+
+/**
+ * Sync the dirty files of a namespace and collect the failures of the previous syncs
+ * done in the background for the namespace.
+ * @param[in]	namespace	Namespace's name
+ * @return	true if all the data of the namespace reached the disk; false otherwise
+ */
+func (c *blockFileCache) flushNamespace (namespace string) bool {
+	failed := c.syncDirty (func (cf *cachedFile) bool { return cf.namespace == namespace })
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	prefix := namespace + "/"
+	for key := range c.failed {
+		if (!strings.HasPrefix (key, prefix)) { continue }
+		delete (c.failed, key)
+		failed += 1
+	}
+	return failed == 0
+}
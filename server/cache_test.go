@@ -0,0 +1,59 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"fmt"
+	"log"
+	"os"
+	"strconv")
+
+func TestBlockFileCache (t *testing.T) {
+	testPath := "/tmp/ns_test_cache/"
+	myerror := os.RemoveAll (testPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove directory required for testing") }
+	myerror = os.MkdirAll (testPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create directory required for testing") }
+	defer os.RemoveAll (testPath)
+
+	fmt.Print ("Testing cache eviction... ")
+	c := newBlockFileCache (2)
+	var files []*cachedFile
+	for i := 0; i < 3; i++ {
+		path := testPath + "block" + strconv.Itoa (i)
+		cf, myerr := c.acquire ("ns", blockKey ("ns", uint64 (i)), path, os.O_RDWR|os.O_CREATE)
+		if (myerr != nil) { log.Fatal ("FATAL ERROR: Cannot open ", path) }
+		files = append (files, cf)
+	}
+	// All the files are in use, none of them can be evicted
+	if (len (c.entries) != 3) { log.Fatal ("FATAL ERROR: File in use was evicted") }
+	for _, cf := range files {
+		c.release (cf, true)
+	}
+	if (len (c.entries) != 2 || !files[0].closed || files[1].closed || files[2].closed) { log.Fatal ("FATAL ERROR: Least recently used file was not evicted") }
+	if (files[0].dirty) { log.Fatal ("FATAL ERROR: Evicted file was not synced") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing cache hit... ")
+	cf, _ := c.acquire ("ns", blockKey ("ns", 2), testPath + "block2", os.O_RDWR)
+	if (cf != files[2]) { log.Fatal ("FATAL ERROR: Cached file was reopened") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing cache invalidation... ")
+	c.invalidate (blockKey ("ns", 2))
+	if (cf.closed) { log.Fatal ("FATAL ERROR: File in use was closed") }
+	c.release (cf, false)
+	if (!cf.closed || len (c.entries) != 1) { log.Fatal ("FATAL ERROR: Invalidated file was not closed") }
+	c.invalidateNamespace ("ns")
+	if (!files[1].closed || len (c.entries) != 0) { log.Fatal ("FATAL ERROR: Namespace was not invalidated") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing closing the cache... ")
+	cf, _ = c.acquire ("ns", blockKey ("ns", 0), testPath + "block0", os.O_RDWR)
+	if (c.closeAll () != 0 || !cf.closed) { log.Fatal ("FATAL ERROR: Cannot close all files") }
+	c.release (cf, false)
+	fmt.Println ("PASS")
+}
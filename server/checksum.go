@@ -0,0 +1,157 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("fmt"
+	"math/bits"
+	"hash/crc32"
+	"encoding/binary")
+
+import err "github.com/gvallee/syserror"
+
+/**
+ * Checksum algorithm protecting the data of the blocks
+ */
+type Checksum int
+
+const (
+	// No checksum
+	ChecksumNone Checksum = iota
+	// CRC32C (Castagnoli), hardware accelerated on most platforms
+	ChecksumCRC32C
+	// 64-bit xxHash, faster in software and with fewer collisions
+	ChecksumXXHash
+)
+
+// Default size of the chunks of a block that get their own checksum
+const DefaultChecksumChunkSize = 4096
+
+var checksumNames = []string {
+	ChecksumNone:	"none",
+	ChecksumCRC32C:	"crc32c",
+	ChecksumXXHash:	"xxhash",
+}
+
+var crc32cTable = crc32.MakeTable (crc32.Castagnoli)
+
+func (c Checksum) String () string {
+	if (c < 0 || int (c) >= len (checksumNames)) { return "unknown" }
+	return checksumNames[c]
+}
+
+/**
+ * Get a checksum algorithm from its name
+ * @param[in]	name	Name of the algorithm: none, crc32c or xxhash
+ * @return	Checksum algorithm
+ * @return	System error handle
+ */
+func ParseChecksum (name string) (Checksum, err.SysError) {
+	for c, n := range checksumNames {
+		if (n == name) { return Checksum (c), err.NoErr }
+	}
+	return ChecksumNone, err.ErrNotAvailable
+}
+
+/**
+ * Compute the checksum of some data
+ * @param[in]	data	Data
+ * @return	Checksum of the data; CRC32C values use the low 32 bits
+ */
+func (c Checksum) Sum (data []byte) uint64 {
+	switch c {
+	case ChecksumCRC32C:
+		return uint64 (crc32.Checksum (data, crc32cTable))
+	case ChecksumXXHash:
+		return xxhash64 (data)
+	}
+	return 0
+}
+
+/**
+ * Check that a checksum chunk size can be used
+ * @param[in]	size	Size of the chunks in bytes
+ * @return	Error describing why the size is invalid, nil otherwise
+ */
+func CheckChecksumChunkSize (size uint64) error {
+	// Same constraints than the blocks, chunks are usually a divisor of the block size
+	myerror := CheckBlockSize (size)
+	if (myerror != nil) { return fmt.Errorf ("invalid checksum chunk size of %d bytes", size) }
+	return nil
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound (acc uint64, input uint64) uint64 {
+	acc += input * xxPrime2
+	return bits.RotateLeft64 (acc, 31) * xxPrime1
+}
+
+func xxMergeRound (acc uint64, val uint64) uint64 {
+	acc ^= xxRound (0, val)
+	return acc * xxPrime1 + xxPrime4
+}
+
+/**
+ * 64-bit xxHash (XXH64) of some data, with a seed of 0
+ * @param[in]	data	Data
+ * @return	Hash of the data
+ */
+func xxhash64 (data []byte) uint64 {
+	n := uint64 (len (data))
+	var h uint64
+
+	if (len (data) >= 32) {
+		// The initial accumulators wrap around, as in the reference implementation
+		prime1, prime2 := xxPrime1, xxPrime2
+		v1 := prime1 + prime2
+		v2 := prime2
+		v3 := uint64 (0)
+		v4 := -prime1
+		for len (data) >= 32 {
+			v1 = xxRound (v1, binary.LittleEndian.Uint64 (data[0:8]))
+			v2 = xxRound (v2, binary.LittleEndian.Uint64 (data[8:16]))
+			v3 = xxRound (v3, binary.LittleEndian.Uint64 (data[16:24]))
+			v4 = xxRound (v4, binary.LittleEndian.Uint64 (data[24:32]))
+			data = data[32:]
+		}
+		h = bits.RotateLeft64 (v1, 1) + bits.RotateLeft64 (v2, 7) + bits.RotateLeft64 (v3, 12) + bits.RotateLeft64 (v4, 18)
+		h = xxMergeRound (h, v1)
+		h = xxMergeRound (h, v2)
+		h = xxMergeRound (h, v3)
+		h = xxMergeRound (h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += n
+
+	for len (data) >= 8 {
+		h ^= xxRound (0, binary.LittleEndian.Uint64 (data[0:8]))
+		h = bits.RotateLeft64 (h, 27) * xxPrime1 + xxPrime4
+		data = data[8:]
+	}
+	if (len (data) >= 4) {
+		h ^= uint64 (binary.LittleEndian.Uint32 (data[0:4])) * xxPrime1
+		h = bits.RotateLeft64 (h, 23) * xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64 (b) * xxPrime5
+		h = bits.RotateLeft64 (h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
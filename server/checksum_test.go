@@ -0,0 +1,151 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"context"
+	"fmt"
+	"log"
+	"os")
+
+import err "github.com/gvallee/syserror"
+
+func TestChecksumAlgorithms (t *testing.T) {
+	fmt.Print ("Testing checksum algorithms... ")
+	if (ChecksumCRC32C.Sum ([]byte ("123456789")) != 0xe3069283) { log.Fatal ("FATAL ERROR: Invalid CRC32C") }
+	vectors := map[string]uint64 {
+		"":	0xef46db3751d8e999,
+		"abc":	0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition":	0xfbcea83c8a378bf1,
+	}
+	for input, expected := range vectors {
+		if (ChecksumXXHash.Sum ([]byte (input)) != expected) { log.Fatal ("FATAL ERROR: Invalid xxHash of ", input) }
+	}
+	for _, name := range []string {"none", "crc32c", "xxhash"} {
+		algo, myerr := ParseChecksum (name)
+		if (myerr != err.NoErr || algo.String () != name) { log.Fatal ("FATAL ERROR: Cannot parse ", name) }
+	}
+	_, myerr := ParseChecksum ("md5")
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Unknown algorithm accepted") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing checksummed read reply decoding... ")
+	data := []byte {1, 2, 0, 0}
+	payload := putUint64 (nil, 2)
+	payload = putUint64 (payload, ChecksumXXHash.Sum (data))
+	payload = append (payload, data...)
+	valid, got, myerr := ParseChecksumReadReply (payload, ChecksumXXHash)
+	if (valid != 2 || len (got) != 4 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Invalid read reply") }
+	payload[len (payload) - 1] = 1
+	_, _, myerr = ParseChecksumReadReply (payload, ChecksumXXHash)
+	if (myerr != err.ErrFatal) { log.Fatal ("FATAL ERROR: Corrupted read reply accepted") }
+	fmt.Println ("PASS")
+}
+
+func TestChecksumStore (t *testing.T) {
+	fmt.Print ("Testing reads and writes with checksums... ")
+	mem := NewMemoryStore (0)
+	store := NewChecksumStore (mem, ChecksumCRC32C, 512)
+	desc := NamespaceDescriptor {FormatVersion: FormatVersion, BlockSize: 4096}
+	_, myerr := store.CreateNamespace ("ns", desc)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	_, myerr = store.CreateNamespace ("x.sums", desc)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Created a reserved namespace") }
+	names, _ := store.ListNamespaces ()
+	if (len (names) != 1 || names[0] != "ns") { log.Fatal ("FATAL ERROR: Invalid list of namespaces: ", names) }
+
+	data := make ([]byte, 1000)
+	for i := range data { data[i] = byte (i) }
+	_, _, myerr = store.Write ("ns", 1, 700, data, DurabilityPerWrite)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	_, _, myerr = store.Write ("ns", 1, 100, data[:50], DurabilityPerWrite)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	buff := make ([]byte, 2000)
+	rs, myerr := store.Read ("ns", 1, 0, buff)
+	if (rs != 1700 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Invalid read - Read ", rs, " bytes") }
+	if (buff[99] != 0 || buff[149] != 49 || buff[150] != 0 || buff[1000] != 44) { log.Fatal ("FATAL ERROR: Invalid data") }
+	rs, myerr = store.Read ("ns", 1, 1000, buff[:10])
+	if (rs != 10 || myerr != err.NoErr || buff[0] != 44) { log.Fatal ("FATAL ERROR: Invalid partial read") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing truncation with checksums... ")
+	if (store.Truncate ("ns", 1, 800, DurabilityPerWrite) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot truncate block") }
+	if (store.Truncate ("ns", 1, 1500, DurabilityPerWrite) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot extend block") }
+	rs, myerr = store.Read ("ns", 1, 0, buff)
+	if (rs != 1500 || myerr != err.NoErr || buff[799] != 99 || buff[800] != 0) { log.Fatal ("FATAL ERROR: Invalid data after truncation") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing the detection of corrupted data... ")
+	mem.Write ("ns", 1, 1200, []byte {1}, DurabilityNone)
+	rs, myerr = store.Read ("ns", 1, 1100, buff[:10])
+	if (myerr != err.ErrFatal) { log.Fatal ("FATAL ERROR: Corrupted data returned") }
+	_, _, myerr = store.Write ("ns", 1, 1100, data[:10], DurabilityPerWrite)
+	if (myerr != err.ErrFatal) { log.Fatal ("FATAL ERROR: Corrupted chunk got a new checksum") }
+	rs, myerr = store.Read ("ns", 1, 0, buff[:512])
+	if (rs != 512 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot read the valid chunks") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing blocks and namespaces without checksums... ")
+	mem.Write ("ns", 2, 0, data, DurabilityNone)
+	rs, myerr = store.Read ("ns", 2, 0, buff)
+	if (rs != 1000 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot read a block without checksums") }
+	_, _, myerr = store.Write ("ns", 2, 10, data[:10], DurabilityPerWrite)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	mem.Write ("ns", 2, 900, []byte {1}, DurabilityNone)
+	_, myerr = store.Read ("ns", 2, 0, buff)
+	if (myerr != err.ErrFatal) { log.Fatal ("FATAL ERROR: Block without checksums not checksummed once written") }
+
+	// Disabling the checksums only affects the new namespaces
+	store = NewChecksumStore (mem, ChecksumNone, DefaultChecksumChunkSize)
+	_, myerr = store.Read ("ns", 2, 0, buff)
+	if (myerr != err.ErrFatal) { log.Fatal ("FATAL ERROR: Checksums no longer verified") }
+	store.CreateNamespace ("plain", desc)
+	_, _, myerr = store.Write ("plain", 0, 0, data, DurabilityPerWrite)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	_, myerr = mem.GetNamespace (checksumNamespaceName ("plain"))
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Checksums created while disabled") }
+	if (store.RenameNamespace ("ns", "renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot rename namespace") }
+	rs, myerr = store.Read ("renamed", 1, 0, buff[:512])
+	if (rs != 512 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot read renamed namespace") }
+	if (store.DeleteNamespace ("renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	names, _ = mem.ListNamespaces ()
+	if (len (names) != 1 || names[0] != "plain") { log.Fatal ("FATAL ERROR: Checksums left behind: ", names) }
+	fmt.Println ("PASS")
+}
+
+func TestChecksumServer (t *testing.T) {
+	validTestPath := "/tmp/ds_test_checksums/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing a server with checksums... ")
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 8192
+	cfg.URL = "127.0.0.1:8906"
+	cfg.Checksum = ChecksumXXHash
+	cfg.ChecksumChunkSize = 3000
+	if (ServerInitWithConfig (&cfg) != nil) { log.Fatal ("FATAL ERROR: Invalid chunk size accepted") }
+	cfg.ChecksumChunkSize = 1024
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+
+	data := make ([]byte, 5000)
+	for i := range data { data[i] = byte (i % 251) }
+	_, myerr := BlockWrite (myserver, "default", 7, 100, data)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	rs, buff, myerr := BlockRead (myserver, "default", 7, 0, 8192)
+	if (rs != 5100 || myerr != err.NoErr || buff[100] != 0 || buff[5099] != byte (4999 % 251)) { log.Fatal ("FATAL ERROR: Invalid read - Read ", rs, " bytes") }
+	names, _ := NamespaceList (myserver)
+	if (len (names) != 1) { log.Fatal ("FATAL ERROR: Checksums visible as a namespace: ", names) }
+	stats, _ := NamespaceStat (myserver, "default")
+	if (stats.Blocks != 1 || stats.BytesUsed != 5100) { log.Fatal ("FATAL ERROR: Invalid statistics: ", stats) }
+	fmt.Println ("PASS")
+}
@@ -0,0 +1,463 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("fmt"
+	"sync"
+	"strings"
+	"encoding/binary")
+
+import err "github.com/gvallee/syserror"
+
+// Suffix of the namespaces holding the checksums of the blocks of another namespace
+const checksumSuffix = ".sums"
+
+/**
+ * How the blocks of a namespace are checksummed
+ */
+type checksumNamespace struct {
+	algo	Checksum
+	chunk	uint64
+}
+
+/**
+ * Block store decorator checksumming the data of the blocks of the store it wraps. Each
+ * chunk of a block gets its own checksum, verified on every read so that silent
+ * corruption is reported instead of returned. The checksums of the blocks of namespace
+ * "ns" are stored in the wrapped store as the blocks of the companion namespace
+ * "ns.sums", with the same ids, one 8-byte little-endian value per chunk; the algorithm
+ * and chunk size are in the descriptor of the companion namespace so that existing
+ * namespaces keep theirs when the configuration changes, including when checksums are
+ * disabled (ChecksumNone): the namespaces that have checksums keep being verified.
+ * Namespaces names ending with ".sums" are therefore reserved.
+ * Blocks written before checksums were enabled are not verified until they are
+ * written again. The data and the checksums are not updated atomically: a crash
+ * in-between reports the chunks being written as corrupted.
+ */
+type ChecksumStore struct {
+	store	BlockStore
+	algo	Checksum
+	chunk	uint64
+	lock	sync.Mutex
+	namespaces	map[string]*checksumNamespace	// nil if the namespace has no checksums
+}
+
+/**
+ * Create a checksum store
+ * @param[in]	store	Block store actually storing the blocks and the checksums
+ * @param[in]	algo	Checksum algorithm of the new namespaces
+ * @param[in]	chunkSize	Size of the chunks of the blocks of the new namespaces
+ * @return	Pointer to a new ChecksumStore structure
+ */
+func NewChecksumStore (store BlockStore, algo Checksum, chunkSize uint64) *ChecksumStore {
+	cs := new (ChecksumStore)
+	cs.store = store
+	cs.algo = algo
+	cs.chunk = chunkSize
+	cs.namespaces = make (map[string]*checksumNamespace)
+	return cs
+}
+
+/**
+ * Get the block store wrapped by the checksum store
+ * @return	Wrapped block store
+ */
+func (store *ChecksumStore) Unwrap () BlockStore {
+	return store.store
+}
+
+func checksumNamespaceName (namespace string) string {
+	return namespace + checksumSuffix
+}
+
+func reservedNamespace (namespace string) bool {
+	return strings.HasSuffix (namespace, checksumSuffix)
+}
+
+/**
+ * Get how the blocks of a namespace are checksummed
+ * @param[in]	namespace	Namespace's name
+ * @param[in]	create	Enable the checksums of the namespace if needed
+ * @return	Checksums of the namespace; nil if the namespace has none
+ * @return	System error handle
+ */
+func (store *ChecksumStore) getNamespace (namespace string, create bool) (*checksumNamespace, err.SysError) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	create = create && store.algo != ChecksumNone
+	ns, ok := store.namespaces[namespace]
+	if (ok && (ns != nil || !create)) { return ns, err.NoErr }
+
+	companion := checksumNamespaceName (namespace)
+	desc, myerr := store.store.GetNamespace (companion)
+	if (myerr == err.ErrNotAvailable && !create) {
+		store.namespaces[namespace] = nil
+		return nil, err.NoErr
+	}
+	if (myerr == err.ErrNotAvailable) {
+		// New namespace, or created before the checksums were enabled
+		var data NamespaceDescriptor
+		data, myerr = store.store.GetNamespace (namespace)
+		if (myerr != err.NoErr) { return nil, myerr }
+		if (!validStoreName (companion)) {
+			fmt.Println ("Namespace name too long to checksum the blocks:", namespace)
+			return nil, err.ErrNotAvailable
+		}
+		desc.FormatVersion = FormatVersion
+		desc.BlockSize = data.BlockSize
+		desc.Checksum = store.algo.String ()
+		desc.ChecksumChunkSize = store.chunk
+		desc, myerr = store.store.CreateNamespace (companion, desc)
+	}
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	ns = new (checksumNamespace)
+	algo, myerr := ParseChecksum (desc.Checksum)
+	ns.algo = algo
+	ns.chunk = desc.ChecksumChunkSize
+	if (myerr != err.NoErr || algo == ChecksumNone || CheckChecksumChunkSize (ns.chunk) != nil) {
+		fmt.Println ("Invalid checksums for namespace", namespace)
+		return nil, err.ErrFatal
+	}
+	store.namespaces[namespace] = ns
+	return ns, err.NoErr
+}
+
+func (store *ChecksumStore) forgetNamespace (namespace string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete (store.namespaces, namespace)
+}
+
+/**
+ * Load the checksums of some chunks of a block
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	first	First chunk
+ * @param[in]	count	Number of chunks
+ * @return	Checksums of the chunks; nil if the block has no checksums
+ * @return	System error handle; ErrFatal if some checksums are missing
+ */
+func (store *ChecksumStore) loadSums (namespace string, blockid uint64, first uint64, count uint64) ([]uint64, err.SysError) {
+	buff := make ([]byte, count * 8)
+	n, myerr := store.store.Read (checksumNamespaceName (namespace), blockid, first * 8, buff)
+	if (myerr == err.ErrNotAvailable) { return nil, err.NoErr }
+	if (myerr != err.NoErr) { return nil, myerr }
+	if (n != len (buff)) {
+		fmt.Println ("Missing checksums for block", blockid, "of namespace", namespace)
+		return nil, err.ErrFatal
+	}
+
+	sums := make ([]uint64, count)
+	for i := range sums {
+		sums[i] = binary.LittleEndian.Uint64 (buff[i * 8:])
+	}
+	return sums, err.NoErr
+}
+
+func checksumMismatch (namespace string, blockid uint64, offset uint64) err.SysError {
+	fmt.Println ("ERROR: Checksum mismatch in block", blockid, "of namespace", namespace, "at offset", offset)
+	return err.ErrFatal
+}
+
+/**
+ * Compute the checksums of the chunks covering [lo, hi) of a block being updated: the
+ * data of the block up to keep, then the new data at offset, zeros elsewhere. The old
+ * data still needed is verified first, so corrupted data never gets a valid checksum.
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	ns	Checksums of the namespace
+ * @param[in]	blockid	Block id
+ * @param[in]	oldsize	Current size of the block
+ * @param[in]	keep	Size of the current data kept by the update
+ * @param[in]	lo	Start of the range, aligned on a chunk
+ * @param[in]	hi	End of the range, i.e., new size of the block or end of a chunk
+ * @param[in]	offset	Offset of the new data
+ * @param[in]	data	New data; nil for a truncation
+ * @param[in]	verify	Whether the current data has checksums to verify
+ * @return	New checksums of the chunks
+ * @return	System error handle
+ */
+func (store *ChecksumStore) updateSums (namespace string, ns *checksumNamespace, blockid uint64, oldsize uint64, keep uint64, lo uint64, hi uint64, offset uint64, data []byte, verify bool) ([]uint64, err.SysError) {
+	buff := make ([]byte, hi - lo)
+	end := offset + uint64 (len (data))
+	first := lo / ns.chunk
+	var oldsums []uint64
+	if (verify && lo < oldsize) {
+		last := hi
+		if (last > oldsize) { last = oldsize }
+		var myerr err.SysError
+		oldsums, myerr = store.loadSums (namespace, blockid, first, (last - lo + ns.chunk - 1) / ns.chunk)
+		if (myerr != err.NoErr) { return nil, myerr }
+	}
+
+	var sums []uint64
+	for start := lo; start < hi; start += ns.chunk {
+		stop := start + ns.chunk
+		if (stop > hi) { stop = hi }
+		overwritten := data != nil && start >= offset && stop <= end
+		if (!overwritten && start < keep) {
+			// The whole chunk is read, as it was checksummed
+			oldstop := start + ns.chunk
+			if (oldstop > oldsize) { oldstop = oldsize }
+			chunk := make ([]byte, oldstop - start)
+			n, myerr := store.store.Read (namespace, blockid, start, chunk)
+			if (myerr != err.NoErr) { return nil, myerr }
+			if (uint64 (n) != oldstop - start) { return nil, err.ErrFatal }
+			c := (start - lo) / ns.chunk
+			if (oldsums != nil && c < uint64 (len (oldsums)) && ns.algo.Sum (chunk) != oldsums[c]) { return nil, checksumMismatch (namespace, blockid, start) }
+			if (oldstop > keep) { oldstop = keep }
+			copy (buff[start - lo:], chunk[:oldstop - start])
+		}
+	}
+	if (data != nil) { copy (buff[offset - lo:], data) }
+
+	for start := lo; start < hi; start += ns.chunk {
+		stop := start + ns.chunk
+		if (stop > hi) { stop = hi }
+		sums = append (sums, ns.algo.Sum (buff[start - lo:stop - lo]))
+	}
+	return sums, err.NoErr
+}
+
+/**
+ * Save the checksums of some chunks of a block
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	first	First chunk
+ * @param[in]	sums	Checksums of the chunks
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	true if the checksums reached stable storage; false otherwise
+ * @return	System error handle
+ */
+func (store *ChecksumStore) saveSums (namespace string, blockid uint64, first uint64, sums []uint64, mode Durability) (bool, err.SysError) {
+	buff := make ([]byte, 0, len (sums) * 8)
+	for _, sum := range sums {
+		buff = putUint64 (buff, sum)
+	}
+	_, synced, myerr := store.store.Write (checksumNamespaceName (namespace), blockid, first * 8, buff, mode)
+	return synced, myerr
+}
+
+/**
+ * Check whether a block has checksums
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @return	true if the block has checksums; false otherwise
+ * @return	System error handle
+ */
+func (store *ChecksumStore) hasSums (namespace string, blockid uint64) (bool, err.SysError) {
+	_, myerr := store.store.Stat (checksumNamespaceName (namespace), blockid)
+	if (myerr == err.ErrNotAvailable) { return false, err.NoErr }
+	return myerr == err.NoErr, myerr
+}
+
+func (store *ChecksumStore) Open (basedir string) err.SysError {
+	return store.store.Open (basedir)
+}
+
+func (store *ChecksumStore) Close () err.SysError {
+	return store.store.Close ()
+}
+
+func (store *ChecksumStore) Read (namespace string, blockid uint64, offset uint64, buff []byte) (int, err.SysError) {
+	ns, myerr := store.getNamespace (namespace, false)
+	if (myerr != err.NoErr) { return -1, myerr }
+	if (ns == nil) { return store.store.Read (namespace, blockid, offset, buff) }
+
+	size, myerr := store.store.Stat (namespace, blockid)
+	if (myerr != err.NoErr) { return -1, myerr }
+	if (offset >= size || len (buff) == 0) { return 0, err.NoErr }
+	end := offset + uint64 (len (buff))
+	if (end > size) { end = size }
+
+	// Whole chunks are read to be verified
+	lo := offset / ns.chunk * ns.chunk
+	hi := (end + ns.chunk - 1) / ns.chunk * ns.chunk
+	if (hi > size) { hi = size }
+	data := make ([]byte, hi - lo)
+	n, myerr := store.store.Read (namespace, blockid, lo, data)
+	if (myerr != err.NoErr) { return -1, myerr }
+	if (uint64 (n) != hi - lo) { return -1, err.ErrFatal }
+
+	sums, myerr := store.loadSums (namespace, blockid, lo / ns.chunk, (hi - lo + ns.chunk - 1) / ns.chunk)
+	if (myerr != err.NoErr) { return -1, myerr }
+	for i, sum := range sums {
+		start := uint64 (i) * ns.chunk
+		stop := start + ns.chunk
+		if (stop > hi - lo) { stop = hi - lo }
+		if (ns.algo.Sum (data[start:stop]) != sum) { return -1, checksumMismatch (namespace, blockid, lo + start) }
+	}
+	return copy (buff, data[offset - lo:end - lo]), err.NoErr
+}
+
+func (store *ChecksumStore) Write (namespace string, blockid uint64, offset uint64, data []byte, mode Durability) (int, bool, err.SysError) {
+	ns, myerr := store.getNamespace (namespace, true)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	if (ns == nil || len (data) == 0) { return store.store.Write (namespace, blockid, offset, data, mode) }
+
+	oldsize, myerr := store.store.Stat (namespace, blockid)
+	if (myerr == err.ErrNotAvailable) {
+		oldsize = 0
+	} else if (myerr != err.NoErr) {
+		return -1, false, myerr
+	}
+	verify, myerr := store.hasSums (namespace, blockid)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+
+	end := offset + uint64 (len (data))
+	newsize := oldsize
+	if (end > newsize) { newsize = end }
+	// A gap between the current data and the new one is made of zeros
+	lo := offset
+	if (oldsize < lo) { lo = oldsize }
+	// A block without checksums gets all of them
+	if (!verify) { lo = 0 }
+	lo = lo / ns.chunk * ns.chunk
+	hi := (end + ns.chunk - 1) / ns.chunk * ns.chunk
+	if (hi > newsize) { hi = newsize }
+
+	sums, myerr := store.updateSums (namespace, ns, blockid, oldsize, oldsize, lo, hi, offset, data, verify)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	s, synced, myerr := store.store.Write (namespace, blockid, offset, data, mode)
+	if (myerr != err.NoErr) { return s, synced, myerr }
+	sumsSynced, myerr := store.saveSums (namespace, blockid, lo / ns.chunk, sums, mode)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	return s, synced && sumsSynced, err.NoErr
+}
+
+func (store *ChecksumStore) Truncate (namespace string, blockid uint64, size uint64, mode Durability) err.SysError {
+	ns, myerr := store.getNamespace (namespace, false)
+	if (myerr != err.NoErr) { return myerr }
+	if (ns == nil) { return store.store.Truncate (namespace, blockid, size, mode) }
+
+	oldsize, myerr := store.store.Stat (namespace, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	verify, myerr := store.hasSums (namespace, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	// Left without checksums until written
+	if (!verify) { return store.store.Truncate (namespace, blockid, size, mode) }
+
+	keep := oldsize
+	if (size < keep) { keep = size }
+	lo := keep / ns.chunk * ns.chunk
+	sums, myerr := store.updateSums (namespace, ns, blockid, oldsize, keep, lo, size, size, nil, true)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = store.store.Truncate (namespace, blockid, size, mode)
+	if (myerr != err.NoErr) { return myerr }
+
+	myerr = store.store.Truncate (checksumNamespaceName (namespace), blockid, (size + ns.chunk - 1) / ns.chunk * 8, mode)
+	if (myerr != err.NoErr || len (sums) == 0) { return myerr }
+	_, myerr = store.saveSums (namespace, blockid, lo / ns.chunk, sums, mode)
+	return myerr
+}
+
+func (store *ChecksumStore) Delete (namespace string, blockid uint64) err.SysError {
+	myerr := store.store.Delete (namespace, blockid)
+	if (myerr != err.NoErr) { return myerr }
+
+	ns, myerr := store.getNamespace (namespace, false)
+	if (myerr != err.NoErr || ns == nil) { return myerr }
+	myerr = store.store.Delete (checksumNamespaceName (namespace), blockid)
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	return myerr
+}
+
+func (store *ChecksumStore) List (namespace string) ([]uint64, err.SysError) {
+	return store.store.List (namespace)
+}
+
+func (store *ChecksumStore) Stat (namespace string, blockid uint64) (uint64, err.SysError) {
+	return store.store.Stat (namespace, blockid)
+}
+
+/**
+ * Copy a block to another namespace. The data and the checksums are cloned with the
+ * wrapped store when both namespaces are checksummed the same way; the checksums of
+ * the copy are computed again otherwise.
+ * @param[in]	src	Namespace of the block to copy
+ * @param[in]	dst	Namespace of the copy
+ * @param[in]	blockid	Block id, the same in both namespaces
+ * @param[in]	mode	Durability policy of the copy
+ * @return	System error handle; ErrNotAvailable if the block to copy does not exist
+ */
+func (store *ChecksumStore) CloneBlock (src string, dst string, blockid uint64, mode Durability) err.SysError {
+	from, myerr := store.getNamespace (src, false)
+	if (myerr != err.NoErr) { return myerr }
+	to, myerr := store.getNamespace (dst, false)
+	if (myerr != err.NoErr) { return myerr }
+	if (from == nil && to == nil) { return cloneBlock (store.store, src, dst, blockid, mode) }
+	if (from == nil || to == nil || *from != *to) { return copyBlock (store, src, dst, blockid, mode) }
+	return cloneBlockWithCompanion (store.store, src, dst, checksumNamespaceName, blockid, mode)
+}
+
+func (store *ChecksumStore) Flush (namespace string) err.SysError {
+	myerr := store.store.Flush (namespace)
+	ns, nserr := store.getNamespace (namespace, false)
+	if (nserr != err.NoErr || ns == nil) { return myerr }
+	if (store.store.Flush (checksumNamespaceName (namespace)) != err.NoErr) { return err.ErrFatal }
+	return myerr
+}
+
+func (store *ChecksumStore) SyncDirty (match func (namespace string) bool) int {
+	return store.store.SyncDirty (func (namespace string) bool { return match (strings.TrimSuffix (namespace, checksumSuffix)) })
+}
+
+func (store *ChecksumStore) CreateNamespace (namespace string, desc NamespaceDescriptor) (NamespaceDescriptor, err.SysError) {
+	if (reservedNamespace (namespace)) { return desc, err.ErrNotAvailable }
+
+	desc, myerr := store.store.CreateNamespace (namespace, desc)
+	if (myerr != err.NoErr) { return desc, myerr }
+	_, myerr = store.getNamespace (namespace, true)
+	return desc, myerr
+}
+
+func (store *ChecksumStore) GetNamespace (namespace string) (NamespaceDescriptor, err.SysError) {
+	if (reservedNamespace (namespace)) { return NamespaceDescriptor {}, err.ErrNotAvailable }
+	return store.store.GetNamespace (namespace)
+}
+
+func (store *ChecksumStore) ListNamespaces () ([]string, err.SysError) {
+	names, myerr := store.store.ListNamespaces ()
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	var visible []string
+	for _, name := range names {
+		if (!reservedNamespace (name)) { visible = append (visible, name) }
+	}
+	return visible, err.NoErr
+}
+
+func (store *ChecksumStore) DeleteNamespace (namespace string) err.SysError {
+	if (reservedNamespace (namespace)) { return err.ErrNotAvailable }
+
+	store.forgetNamespace (namespace)
+	myerr := store.store.DeleteNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = store.store.DeleteNamespace (checksumNamespaceName (namespace))
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	return myerr
+}
+
+func (store *ChecksumStore) RenameNamespace (oldname string, newname string) err.SysError {
+	if (reservedNamespace (oldname) || reservedNamespace (newname)) { return err.ErrNotAvailable }
+	oldCompanion := checksumNamespaceName (oldname)
+	newCompanion := checksumNamespaceName (newname)
+	if (!validStoreName (newCompanion)) { return err.ErrNotAvailable }
+
+	store.forgetNamespace (oldname)
+	store.forgetNamespace (newname)
+	myerr := store.store.RenameNamespace (oldname, newname)
+	if (myerr != err.NoErr) { return myerr }
+
+	// Left over by a namespace that was not fully deleted
+	_, myerr = store.store.GetNamespace (newCompanion)
+	if (myerr == err.NoErr) { store.store.DeleteNamespace (newCompanion) }
+	_, myerr = store.store.GetNamespace (oldCompanion)
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	return store.store.RenameNamespace (oldCompanion, newCompanion)
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("fmt"
+	"sync")
+
+import err "github.com/gvallee/syserror"
+import "github.com/klauspost/compress/zstd"
+import "github.com/pierrec/lz4"
+import "github.com/golang/snappy"
+
+/**
+ * Compression algorithm of the data of the blocks
+ */
+type Compression int
+
+const (
+	// No compression
+	CompressionNone Compression = iota
+	// Zstandard, best ratio
+	CompressionZstd
+	// LZ4, fastest
+	CompressionLZ4
+	// Snappy
+	CompressionSnappy
+)
+
+// Default size of the chunks of a block compressed independently
+const DefaultCompressionChunkSize = 64 * 1024
+
+var compressionNames = []string {
+	CompressionNone:	"none",
+	CompressionZstd:	"zstd",
+	CompressionLZ4:		"lz4",
+	CompressionSnappy:	"snappy",
+}
+
+// Encoder and decoder of zstd, which support concurrent use and are costly to create
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+
+func (c Compression) String () string {
+	if (c < 0 || int (c) >= len (compressionNames)) { return "unknown" }
+	return compressionNames[c]
+}
+
+/**
+ * Get a compression algorithm from its name
+ * @param[in]	name	Name of the algorithm: none, zstd, lz4 or snappy
+ * @return	Compression algorithm
+ * @return	System error handle
+ */
+func ParseCompression (name string) (Compression, err.SysError) {
+	for c, n := range compressionNames {
+		if (n == name) { return Compression (c), err.NoErr }
+	}
+	return CompressionNone, err.ErrNotAvailable
+}
+
+/**
+ * Check that a compression chunk size can be used
+ * @param[in]	size	Size of the chunks in bytes
+ * @return	Error describing why the size is invalid, nil otherwise
+ */
+func CheckCompressionChunkSize (size uint64) error {
+	myerror := CheckBlockSize (size)
+	if (myerror != nil) { return fmt.Errorf ("invalid compression chunk size of %d bytes", size) }
+	return nil
+}
+
+func initZstd () {
+	zstdEncoder, _ = zstd.NewWriter (nil)
+	zstdDecoder, _ = zstd.NewReader (nil)
+}
+
+/**
+ * Compress some data
+ * @param[in]	data	Data
+ * @return	Compressed data; nil if the data does not compress
+ */
+func (c Compression) compress (data []byte) []byte {
+	var out []byte
+	switch c {
+	case CompressionZstd:
+		zstdOnce.Do (initZstd)
+		if (zstdEncoder == nil) { return nil }
+		out = zstdEncoder.EncodeAll (data, nil)
+	case CompressionLZ4:
+		out = make ([]byte, lz4.CompressBlockBound (len (data)))
+		n, myerror := lz4.CompressBlock (data, out, nil)
+		if (myerror != nil || n == 0) { return nil } // Incompressible
+		out = out[:n]
+	case CompressionSnappy:
+		out = snappy.Encode (nil, data)
+	}
+	if (len (out) >= len (data)) { return nil }
+	return out
+}
+
+/**
+ * Decompress some data
+ * @param[in]	data	Compressed data
+ * @param[in]	max	Maximum size of the decompressed data
+ * @return	Decompressed data
+ * @return	System error handle; ErrFatal if the data is corrupted
+ */
+func (c Compression) decompress (data []byte, max uint64) ([]byte, err.SysError) {
+	var out []byte
+	var myerror error
+	switch c {
+	case CompressionNone:
+		out = data
+	case CompressionZstd:
+		zstdOnce.Do (initZstd)
+		if (zstdDecoder == nil) { return nil, err.ErrFatal }
+		out, myerror = zstdDecoder.DecodeAll (data, nil)
+	case CompressionLZ4:
+		out = make ([]byte, max)
+		var n int
+		n, myerror = lz4.UncompressBlock (data, out)
+		out = out[:n]
+	case CompressionSnappy:
+		out, myerror = snappy.Decode (nil, data)
+	default:
+		return nil, err.ErrFatal
+	}
+	if (myerror != nil || uint64 (len (out)) > max) { return nil, err.ErrFatal }
+	return out, err.NoErr
+}
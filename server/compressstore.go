@@ -0,0 +1,663 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("fmt"
+	"sync"
+	"strings"
+	"encoding/binary")
+
+import err "github.com/gvallee/syserror"
+
+// Suffix of the namespaces holding the chunk indexes of the blocks of another namespace
+const compressionSuffix = ".cmap"
+
+// Size of the header (logical size and chunk size) and of the entries of a chunk index
+const (
+	chunkIndexHeaderSize = 16
+	chunkIndexEntrySize = 24
+)
+
+/**
+ * How the blocks of a namespace are compressed
+ */
+type compressedNamespace struct {
+	algo		Compression
+	chunk		uint64
+	blocksize	uint64
+}
+
+/**
+ * Where a chunk of a block is stored
+ */
+type chunkEntry struct {
+	offset		uint64		// Offset of the stored chunk in the block
+	length		uint64		// Size of the stored chunk; 0 for a chunk of zeros
+	capacity	uint64		// Space reserved for the chunk, rewritten in place if it fits
+	codec		Compression	// How the chunk is compressed, CompressionNone if stored as is
+}
+
+/**
+ * Chunk index of a block, i.e., where each chunk of the block is stored
+ */
+type chunkIndex struct {
+	size	uint64		// Logical size of the block
+	chunk	uint64		// Size of the chunks
+	chunks	[]chunkEntry
+	stored	uint64		// Size of the index as stored
+}
+
+/**
+ * New content of a chunk, as stored
+ */
+type chunkUpdate struct {
+	chunk	uint64
+	codec	Compression
+	data	[]byte
+}
+
+/**
+ * Block store decorator compressing the data of the blocks of the store it wraps. The
+ * namespaces are compressed or not depending on their descriptor (see NamespaceInit),
+ * i.e., for their whole life. Each chunk of a block is compressed independently so that
+ * random reads and writes only decompress and compress the chunks they touch; chunks
+ * that do not compress are stored as is and chunks of zeros are not stored at all. The
+ * stored chunks of block "id" of namespace "ns" are packed in block "id" of the wrapped
+ * store; the chunk index of the block is block "id" of the companion namespace
+ * "ns.cmap": logical size and chunk size followed, for each chunk, by its offset, size
+ * and reserved space in the packed block and its codec (little-endian, 8 bytes each
+ * except the size and codec, 4 bytes each). A chunk whose new version does not fit in
+ * its reserved space is moved to the end of the packed block; the block is compacted
+ * when it would outgrow the block size or when the space lost to moved chunks exceeds
+ * the data. Namespaces names ending with ".cmap" are reserved. The data and the index
+ * are not updated atomically: a crash in-between can corrupt the chunks being written.
+ */
+type CompressionStore struct {
+	store	BlockStore
+	lock	sync.Mutex
+	namespaces	map[string]*compressedNamespace	// nil if the namespace is not compressed
+}
+
+/**
+ * Create a compression store
+ * @param[in]	store	Block store actually storing the blocks and the chunk indexes
+ * @return	Pointer to a new CompressionStore structure
+ */
+func NewCompressionStore (store BlockStore) *CompressionStore {
+	cs := new (CompressionStore)
+	cs.store = store
+	cs.namespaces = make (map[string]*compressedNamespace)
+	return cs
+}
+
+/**
+ * Get the block store wrapped by the compression store
+ * @return	Wrapped block store
+ */
+func (store *CompressionStore) Unwrap () BlockStore {
+	return store.store
+}
+
+func compressionNamespaceName (namespace string) string {
+	return namespace + compressionSuffix
+}
+
+/**
+ * Get the compression of a namespace from its descriptor
+ * @param[in]	desc	Descriptor of the namespace
+ * @return	Compression algorithm
+ * @return	System error handle; ErrFatal if the compression is invalid
+ */
+func namespaceCompression (desc NamespaceDescriptor) (Compression, err.SysError) {
+	if (desc.Compression == "") { return CompressionNone, err.NoErr }
+	algo, myerr := ParseCompression (desc.Compression)
+	if (myerr != err.NoErr || (algo != CompressionNone && CheckCompressionChunkSize (desc.CompressionChunkSize) != nil)) { return CompressionNone, err.ErrFatal }
+	return algo, err.NoErr
+}
+
+/**
+ * Size of the blocks of the companion namespace of a compressed namespace, big enough
+ * for the chunk index of a full block
+ * @param[in]	blocksize	Block size of the compressed namespace
+ * @param[in]	chunk	Chunk size of the compressed namespace
+ * @return	Block size of the companion namespace
+ */
+func chunkIndexBlockSize (blocksize uint64, chunk uint64) uint64 {
+	size := chunkIndexHeaderSize + (blocksize + chunk - 1) / chunk * chunkIndexEntrySize
+	return (size + BlockSizeAlignment - 1) / BlockSizeAlignment * BlockSizeAlignment
+}
+
+/**
+ * Get how the blocks of a namespace are compressed
+ * @param[in]	namespace	Namespace's name
+ * @return	Compression of the namespace; nil if the namespace is not compressed
+ * @return	System error handle
+ */
+func (store *CompressionStore) getNamespace (namespace string) (*compressedNamespace, err.SysError) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ns, ok := store.namespaces[namespace]
+	if (ok) { return ns, err.NoErr }
+
+	desc, myerr := store.store.GetNamespace (namespace)
+	if (myerr == err.ErrNotAvailable) { return nil, err.NoErr } // Unknown or created before descriptors existed
+	if (myerr != err.NoErr) { return nil, myerr }
+	algo, myerr := namespaceCompression (desc)
+	if (myerr != err.NoErr) {
+		fmt.Println ("Invalid compression for namespace", namespace)
+		return nil, myerr
+	}
+	if (algo != CompressionNone) {
+		ns = new (compressedNamespace)
+		ns.algo = algo
+		ns.chunk = desc.CompressionChunkSize
+		ns.blocksize = desc.BlockSize
+
+		// The companion may be missing after a crash while the namespace was created
+		companion := compressionNamespaceName (namespace)
+		var index NamespaceDescriptor
+		index.FormatVersion = FormatVersion
+		index.BlockSize = chunkIndexBlockSize (ns.blocksize, ns.chunk)
+		_, myerr = store.store.CreateNamespace (companion, index)
+		if (myerr != err.NoErr) { return nil, myerr }
+	}
+	store.namespaces[namespace] = ns
+	return ns, err.NoErr
+}
+
+func (store *CompressionStore) forgetNamespace (namespace string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete (store.namespaces, namespace)
+}
+
+/**
+ * Load the chunk index of a block
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	ns	Compression of the namespace
+ * @param[in]	blockid	Block id
+ * @return	Chunk index of the block
+ * @return	System error handle; ErrNotAvailable if the block does not exist
+ */
+func (store *CompressionStore) loadIndex (namespace string, ns *compressedNamespace, blockid uint64) (*chunkIndex, err.SysError) {
+	buff := make ([]byte, chunkIndexBlockSize (ns.blocksize, ns.chunk))
+	n, myerr := store.store.Read (compressionNamespaceName (namespace), blockid, 0, buff)
+	if (myerr == err.ErrNotAvailable) {
+		_, myerr = store.store.Stat (namespace, blockid)
+		if (myerr == err.NoErr) {
+			fmt.Println ("Missing chunk index for block", blockid, "of namespace", namespace)
+			return nil, err.ErrFatal
+		}
+		return nil, myerr
+	}
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	index := new (chunkIndex)
+	index.stored = uint64 (n)
+	buff = buff[:n]
+	if (n < chunkIndexHeaderSize) { return nil, invalidChunkIndex (namespace, blockid) }
+	index.size = binary.LittleEndian.Uint64 (buff[0:])
+	index.chunk = binary.LittleEndian.Uint64 (buff[8:])
+	if (index.chunk == 0 || index.size > ns.blocksize) { return nil, invalidChunkIndex (namespace, blockid) }
+	count := (index.size + index.chunk - 1) / index.chunk
+	if (uint64 (n) != chunkIndexHeaderSize + count * chunkIndexEntrySize) { return nil, invalidChunkIndex (namespace, blockid) }
+
+	index.chunks = make ([]chunkEntry, count)
+	for i := range index.chunks {
+		entry := buff[chunkIndexHeaderSize + i * chunkIndexEntrySize:]
+		index.chunks[i].offset = binary.LittleEndian.Uint64 (entry[0:])
+		index.chunks[i].length = uint64 (binary.LittleEndian.Uint32 (entry[8:]))
+		index.chunks[i].capacity = uint64 (binary.LittleEndian.Uint32 (entry[12:]))
+		index.chunks[i].codec = Compression (binary.LittleEndian.Uint32 (entry[16:]))
+		if (index.chunks[i].length > index.chunks[i].capacity) { return nil, invalidChunkIndex (namespace, blockid) }
+	}
+	return index, err.NoErr
+}
+
+func invalidChunkIndex (namespace string, blockid uint64) err.SysError {
+	fmt.Println ("ERROR: Invalid chunk index for block", blockid, "of namespace", namespace)
+	return err.ErrFatal
+}
+
+/**
+ * Save the chunk index of a block
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	index	Chunk index of the block
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	true if the index reached stable storage; false otherwise
+ * @return	System error handle
+ */
+func (store *CompressionStore) saveIndex (namespace string, blockid uint64, index *chunkIndex, mode Durability) (bool, err.SysError) {
+	buff := putUint64 (nil, index.size)
+	buff = putUint64 (buff, index.chunk)
+	for _, c := range index.chunks {
+		var entry [chunkIndexEntrySize]byte
+		binary.LittleEndian.PutUint64 (entry[0:], c.offset)
+		binary.LittleEndian.PutUint32 (entry[8:], uint32 (c.length))
+		binary.LittleEndian.PutUint32 (entry[12:], uint32 (c.capacity))
+		binary.LittleEndian.PutUint32 (entry[16:], uint32 (c.codec))
+		buff = append (buff, entry[:]...)
+	}
+
+	companion := compressionNamespaceName (namespace)
+	_, synced, myerr := store.store.Write (companion, blockid, 0, buff, mode)
+	if (myerr != err.NoErr) { return false, myerr }
+	if (index.stored > uint64 (len (buff))) {
+		myerr = store.store.Truncate (companion, blockid, uint64 (len (buff)), mode)
+		if (myerr != err.NoErr) { return false, myerr }
+	}
+	index.stored = uint64 (len (buff))
+	return synced, err.NoErr
+}
+
+/**
+ * Read and decompress a chunk of a block
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	index	Chunk index of the block
+ * @param[in]	i	Chunk
+ * @return	Data of the chunk, possibly shorter than the chunk (the rest is zeros)
+ * @return	System error handle
+ */
+func (store *CompressionStore) readChunk (namespace string, blockid uint64, index *chunkIndex, i uint64) ([]byte, err.SysError) {
+	entry := index.chunks[i]
+	if (entry.length == 0) { return nil, err.NoErr }
+
+	stored := make ([]byte, entry.length)
+	n, myerr := store.store.Read (namespace, blockid, entry.offset, stored)
+	if (myerr != err.NoErr) { return nil, myerr }
+	if (uint64 (n) != entry.length) { return nil, invalidChunkIndex (namespace, blockid) }
+	data, myerr := entry.codec.decompress (stored, index.chunk)
+	if (myerr != err.NoErr) {
+		fmt.Println ("ERROR: Cannot decompress chunk", i, "of block", blockid, "of namespace", namespace)
+		return nil, myerr
+	}
+	return data, err.NoErr
+}
+
+/**
+ * Compress the new content of a chunk
+ * @param[in]	ns	Compression of the namespace
+ * @param[in]	i	Chunk
+ * @param[in]	data	Content of the chunk
+ * @return	Chunk as stored
+ */
+func encodeChunk (ns *compressedNamespace, i uint64, data []byte) chunkUpdate {
+	zeros := true
+	for _, b := range data {
+		if (b != 0) { zeros = false; break }
+	}
+	if (zeros) { return chunkUpdate {i, CompressionNone, nil} }
+
+	compressed := ns.algo.compress (data)
+	if (compressed == nil) { return chunkUpdate {i, CompressionNone, data} }
+	return chunkUpdate {i, ns.algo, compressed}
+}
+
+/**
+ * Store the new content of some chunks of a block, then its index
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	ns	Compression of the namespace
+ * @param[in]	blockid	Block id
+ * @param[in]	index	Chunk index of the block, already resized
+ * @param[in]	updates	New content of the chunks
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	true if the data reached stable storage; false otherwise
+ * @return	System error handle
+ */
+func (store *CompressionStore) storeChunks (namespace string, ns *compressedNamespace, blockid uint64, index *chunkIndex, updates []chunkUpdate, mode Durability) (bool, err.SysError) {
+	var end uint64 = 0
+	for _, c := range index.chunks {
+		if (c.offset + c.capacity > end) { end = c.offset + c.capacity }
+	}
+
+	// Chunks that do not fit in their space anymore go to the end
+	for _, u := range updates {
+		c := &index.chunks[u.chunk]
+		c.length = uint64 (len (u.data))
+		c.codec = u.codec
+		if (c.length > c.capacity) {
+			c.offset = end
+			c.capacity = c.length
+			end += c.length
+		}
+	}
+	var reserved, live uint64 = 0, 0
+	for _, c := range index.chunks {
+		reserved += c.capacity
+		live += c.length
+	}
+	if (end > ns.blocksize || (end - reserved > live && end - reserved >= ns.chunk)) {
+		return store.compact (namespace, ns, blockid, index, updates, mode)
+	}
+
+	synced := true
+	for _, u := range updates {
+		if (len (u.data) == 0) { continue }
+		_, s, myerr := store.store.Write (namespace, blockid, index.chunks[u.chunk].offset, u.data, mode)
+		if (myerr != err.NoErr) { return false, myerr }
+		synced = synced && s
+	}
+	s, myerr := store.saveIndex (namespace, blockid, index, mode)
+	return synced && s, myerr
+}
+
+/**
+ * Rewrite a block with its chunks packed, including the new content of some of them,
+ * then its index
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	ns	Compression of the namespace
+ * @param[in]	blockid	Block id
+ * @param[in]	index	Chunk index of the block, the updated chunks having their new size
+ * @param[in]	updates	New content of the chunks
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	true if the data reached stable storage; false otherwise
+ * @return	System error handle
+ */
+func (store *CompressionStore) compact (namespace string, ns *compressedNamespace, blockid uint64, index *chunkIndex, updates []chunkUpdate, mode Durability) (bool, err.SysError) {
+	updated := make (map[uint64][]byte)
+	for _, u := range updates {
+		updated[u.chunk] = u.data
+	}
+
+	var packed []byte
+	for i := range index.chunks {
+		c := &index.chunks[i]
+		data, ok := updated[uint64 (i)]
+		if (!ok && c.length > 0) {
+			data = make ([]byte, c.length)
+			n, myerr := store.store.Read (namespace, blockid, c.offset, data)
+			if (myerr != err.NoErr) { return false, myerr }
+			if (uint64 (n) != c.length) { return false, invalidChunkIndex (namespace, blockid) }
+		}
+		c.offset = uint64 (len (packed))
+		c.capacity = c.length
+		packed = append (packed, data...)
+	}
+
+	_, synced, myerr := store.store.Write (namespace, blockid, 0, packed, mode)
+	if (myerr != err.NoErr) { return false, myerr }
+	myerr = store.store.Truncate (namespace, blockid, uint64 (len (packed)), mode)
+	if (myerr != err.NoErr) { return false, myerr }
+	s, myerr := store.saveIndex (namespace, blockid, index, mode)
+	return synced && s, myerr
+}
+
+func (store *CompressionStore) Open (basedir string) err.SysError {
+	return store.store.Open (basedir)
+}
+
+func (store *CompressionStore) Close () err.SysError {
+	return store.store.Close ()
+}
+
+func (store *CompressionStore) Read (namespace string, blockid uint64, offset uint64, buff []byte) (int, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return -1, myerr }
+	if (ns == nil) { return store.store.Read (namespace, blockid, offset, buff) }
+
+	index, myerr := store.loadIndex (namespace, ns, blockid)
+	if (myerr != err.NoErr) { return -1, myerr }
+	if (offset >= index.size || len (buff) == 0) { return 0, err.NoErr }
+	end := offset + uint64 (len (buff))
+	if (end > index.size) { end = index.size }
+
+	for i := offset / index.chunk; i * index.chunk < end; i++ {
+		data, myerr := store.readChunk (namespace, blockid, index, i)
+		if (myerr != err.NoErr) { return -1, myerr }
+		start := i * index.chunk
+		lo, hi := start, start + index.chunk
+		if (lo < offset) { lo = offset }
+		if (hi > end) { hi = end }
+		part := buff[lo - offset:hi - offset]
+		n := 0
+		if (lo - start < uint64 (len (data))) { n = copy (part, data[lo - start:]) }
+		for k := n; k < len (part); k++ { part[k] = 0 }
+	}
+	return int (end - offset), err.NoErr
+}
+
+func (store *CompressionStore) Write (namespace string, blockid uint64, offset uint64, data []byte, mode Durability) (int, bool, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	if (ns == nil) { return store.store.Write (namespace, blockid, offset, data, mode) }
+
+	index, myerr := store.loadIndex (namespace, ns, blockid)
+	if (myerr == err.ErrNotAvailable) {
+		// The packed block must exist even if all the chunks are zeros
+		_, _, myerr = store.store.Write (namespace, blockid, 0, []byte {}, mode)
+		if (myerr != err.NoErr) { return -1, false, myerr }
+		index = &chunkIndex {size: 0, chunk: ns.chunk}
+	} else if (myerr != err.NoErr) {
+		return -1, false, myerr
+	}
+
+	end := offset + uint64 (len (data))
+	size := index.size
+	if (end > size) { size = end }
+	oldcount := uint64 (len (index.chunks))
+	for uint64 (len (index.chunks)) * index.chunk < size {
+		index.chunks = append (index.chunks, chunkEntry {})
+	}
+
+	var updates []chunkUpdate
+	for i := offset / index.chunk; i * index.chunk < end; i++ {
+		start := i * index.chunk
+		stop := start + index.chunk
+		if (stop > size) { stop = size }
+		var content []byte
+		if (offset <= start && end >= stop) {
+			content = data[start - offset:stop - offset]
+		} else {
+			content = make ([]byte, stop - start)
+			if (i < oldcount) {
+				old, myerr := store.readChunk (namespace, blockid, index, i)
+				if (myerr != err.NoErr) { return -1, false, myerr }
+				copy (content, old)
+			}
+			lo := start
+			if (lo < offset) { lo = offset }
+			hi := stop
+			if (hi > end) { hi = end }
+			copy (content[lo - start:], data[lo - offset:hi - offset])
+		}
+		updates = append (updates, encodeChunk (ns, i, content))
+	}
+	index.size = size
+
+	synced, myerr := store.storeChunks (namespace, ns, blockid, index, updates, mode)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	return len (data), synced, err.NoErr
+}
+
+func (store *CompressionStore) Truncate (namespace string, blockid uint64, size uint64, mode Durability) err.SysError {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	if (ns == nil) { return store.store.Truncate (namespace, blockid, size, mode) }
+
+	index, myerr := store.loadIndex (namespace, ns, blockid)
+	if (myerr != err.NoErr) { return myerr }
+
+	var updates []chunkUpdate
+	count := (size + index.chunk - 1) / index.chunk
+	if (size < index.size) {
+		// The data past the new size must not come back if the block grows again
+		last := size / index.chunk
+		if (size % index.chunk != 0) {
+			data, myerr := store.readChunk (namespace, blockid, index, last)
+			if (myerr != err.NoErr) { return myerr }
+			if (uint64 (len (data)) > size - last * index.chunk) {
+				updates = append (updates, encodeChunk (ns, last, data[:size - last * index.chunk]))
+			}
+		}
+		index.chunks = index.chunks[:count]
+	}
+	for uint64 (len (index.chunks)) < count {
+		index.chunks = append (index.chunks, chunkEntry {})
+	}
+	index.size = size
+
+	_, myerr = store.storeChunks (namespace, ns, blockid, index, updates, mode)
+	if (myerr != err.NoErr) { return myerr }
+
+	// Release the space of the chunks dropped at the end of the block
+	var end uint64 = 0
+	for _, c := range index.chunks {
+		if (c.offset + c.capacity > end) { end = c.offset + c.capacity }
+	}
+	physical, myerr := store.store.Stat (namespace, blockid)
+	if (myerr != err.NoErr || physical <= end) { return myerr }
+	return store.store.Truncate (namespace, blockid, end, mode)
+}
+
+func (store *CompressionStore) Delete (namespace string, blockid uint64) err.SysError {
+	myerr := store.store.Delete (namespace, blockid)
+	if (myerr != err.NoErr) { return myerr }
+
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr || ns == nil) { return myerr }
+	myerr = store.store.Delete (compressionNamespaceName (namespace), blockid)
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	return myerr
+}
+
+func (store *CompressionStore) List (namespace string) ([]uint64, err.SysError) {
+	return store.store.List (namespace)
+}
+
+func (store *CompressionStore) Stat (namespace string, blockid uint64) (uint64, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return 0, myerr }
+	if (ns == nil) { return store.store.Stat (namespace, blockid) }
+
+	index, myerr := store.loadIndex (namespace, ns, blockid)
+	if (myerr != err.NoErr) { return 0, myerr }
+	return index.size, err.NoErr
+}
+
+/**
+ * Get the amount of storage used by a block: its packed chunks and its chunk index
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @return	Amount of storage used by the block
+ * @return	System error handle
+ */
+func (store *CompressionStore) PhysicalSize (namespace string, blockid uint64) (uint64, err.SysError) {
+	size, myerr := store.store.Stat (namespace, blockid)
+	if (myerr != err.NoErr) { return 0, myerr }
+	size, myerr = physicalSize (store.store, namespace, blockid, size)
+	if (myerr != err.NoErr) { return 0, myerr }
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr || ns == nil) { return size, myerr }
+
+	companion := compressionNamespaceName (namespace)
+	indexSize, myerr := store.store.Stat (companion, blockid)
+	if (myerr == err.ErrNotAvailable) { return size, err.NoErr }
+	if (myerr != err.NoErr) { return 0, myerr }
+	indexSize, myerr = physicalSize (store.store, companion, blockid, indexSize)
+	return size + indexSize, myerr
+}
+
+/**
+ * Copy a block to another namespace. The stored chunks and the chunk index are cloned
+ * with the wrapped store when both namespaces are compressed the same way; the block
+ * is decompressed and compressed again otherwise.
+ * @param[in]	src	Namespace of the block to copy
+ * @param[in]	dst	Namespace of the copy
+ * @param[in]	blockid	Block id, the same in both namespaces
+ * @param[in]	mode	Durability policy of the copy
+ * @return	System error handle; ErrNotAvailable if the block to copy does not exist
+ */
+func (store *CompressionStore) CloneBlock (src string, dst string, blockid uint64, mode Durability) err.SysError {
+	from, myerr := store.getNamespace (src)
+	if (myerr != err.NoErr) { return myerr }
+	to, myerr := store.getNamespace (dst)
+	if (myerr != err.NoErr) { return myerr }
+	if (from == nil && to == nil) { return cloneBlock (store.store, src, dst, blockid, mode) }
+	if (from == nil || to == nil || *from != *to) { return copyBlock (store, src, dst, blockid, mode) }
+	return cloneBlockWithCompanion (store.store, src, dst, compressionNamespaceName, blockid, mode)
+}
+
+func (store *CompressionStore) Flush (namespace string) err.SysError {
+	myerr := store.store.Flush (namespace)
+	ns, nserr := store.getNamespace (namespace)
+	if (nserr != err.NoErr || ns == nil) { return myerr }
+	if (store.store.Flush (compressionNamespaceName (namespace)) != err.NoErr) { return err.ErrFatal }
+	return myerr
+}
+
+func (store *CompressionStore) SyncDirty (match func (namespace string) bool) int {
+	return store.store.SyncDirty (func (namespace string) bool { return match (strings.TrimSuffix (namespace, compressionSuffix)) })
+}
+
+func (store *CompressionStore) CreateNamespace (namespace string, desc NamespaceDescriptor) (NamespaceDescriptor, err.SysError) {
+	if (strings.HasSuffix (namespace, compressionSuffix)) { return desc, err.ErrNotAvailable }
+	algo, myerr := namespaceCompression (desc)
+	if (myerr != err.NoErr) { return desc, err.ErrNotAvailable }
+	if (algo != CompressionNone && !validStoreName (compressionNamespaceName (namespace))) {
+		fmt.Println ("Namespace name too long to compress the blocks:", namespace)
+		return desc, err.ErrNotAvailable
+	}
+
+	desc, myerr = store.store.CreateNamespace (namespace, desc)
+	if (myerr != err.NoErr) { return desc, myerr }
+	_, myerr = store.getNamespace (namespace)
+	return desc, myerr
+}
+
+func (store *CompressionStore) GetNamespace (namespace string) (NamespaceDescriptor, err.SysError) {
+	if (strings.HasSuffix (namespace, compressionSuffix)) { return NamespaceDescriptor {}, err.ErrNotAvailable }
+	return store.store.GetNamespace (namespace)
+}
+
+func (store *CompressionStore) ListNamespaces () ([]string, err.SysError) {
+	names, myerr := store.store.ListNamespaces ()
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	var visible []string
+	for _, name := range names {
+		if (!strings.HasSuffix (name, compressionSuffix)) { visible = append (visible, name) }
+	}
+	return visible, err.NoErr
+}
+
+func (store *CompressionStore) DeleteNamespace (namespace string) err.SysError {
+	if (strings.HasSuffix (namespace, compressionSuffix)) { return err.ErrNotAvailable }
+
+	store.forgetNamespace (namespace)
+	myerr := store.store.DeleteNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = store.store.DeleteNamespace (compressionNamespaceName (namespace))
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	return myerr
+}
+
+func (store *CompressionStore) RenameNamespace (oldname string, newname string) err.SysError {
+	if (strings.HasSuffix (oldname, compressionSuffix) || strings.HasSuffix (newname, compressionSuffix)) { return err.ErrNotAvailable }
+	oldCompanion := compressionNamespaceName (oldname)
+	newCompanion := compressionNamespaceName (newname)
+	if (!validStoreName (newCompanion)) { return err.ErrNotAvailable }
+
+	store.forgetNamespace (oldname)
+	store.forgetNamespace (newname)
+	myerr := store.store.RenameNamespace (oldname, newname)
+	if (myerr != err.NoErr) { return myerr }
+
+	// Left over by a namespace that was not fully deleted
+	_, myerr = store.store.GetNamespace (newCompanion)
+	if (myerr == err.NoErr) { store.store.DeleteNamespace (newCompanion) }
+	_, myerr = store.store.GetNamespace (oldCompanion)
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	myerr = store.store.RenameNamespace (oldCompanion, newCompanion)
+	if (myerr != err.NoErr) {
+		// The blocks are unreadable without their index
+		store.store.RenameNamespace (newname, oldname)
+	}
+	return myerr
+}
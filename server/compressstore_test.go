@@ -0,0 +1,163 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os")
+
+import err "github.com/gvallee/syserror"
+
+func TestCompressionStore (t *testing.T) {
+	fmt.Print ("Testing compressed namespaces... ")
+	mem := NewMemoryStore (0)
+	store := NewCompressionStore (mem)
+	desc := NamespaceDescriptor {FormatVersion: FormatVersion, BlockSize: 8192}
+	_, myerr := store.CreateNamespace ("plain", desc)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	desc.Compression = "bzip2"
+	_, myerr = store.CreateNamespace ("invalid", desc)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Invalid compression accepted") }
+	for _, name := range []string {"zstd", "lz4", "snappy"} {
+		desc.Compression = name
+		desc.CompressionChunkSize = 1024
+		_, myerr = store.CreateNamespace (name, desc)
+		if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	}
+	_, myerr = store.CreateNamespace ("x.cmap", desc)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Created a reserved namespace") }
+	names, _ := store.ListNamespaces ()
+	if (len (names) != 4) { log.Fatal ("FATAL ERROR: Invalid list of namespaces: ", names) }
+
+	text := bytes.Repeat ([]byte ("checkpoint data "), 512)
+	_, _, myerr = store.Write ("zstd", 1, 100, text[:5000], DurabilityPerWrite)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	size, _ := store.Stat ("zstd", 1)
+	physical, _ := store.PhysicalSize ("zstd", 1)
+	if (size != 5100 || physical >= 2500) { log.Fatal ("FATAL ERROR: Block not compressed: ", size, " ", physical) }
+	physical, _ = store.PhysicalSize ("plain", 1)
+	if (physical != 0) { log.Fatal ("FATAL ERROR: Invalid physical size") }
+	buff := make ([]byte, 6000)
+	rs, myerr := store.Read ("zstd", 1, 0, buff)
+	if (rs != 5100 || myerr != err.NoErr || buff[99] != 0 || !bytes.Equal (buff[100:5100], text[:5000])) { log.Fatal ("FATAL ERROR: Invalid data") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing random accesses to compressed blocks... ")
+	random := rand.New (rand.NewSource (42))
+	for _, name := range []string {"zstd", "lz4", "snappy"} {
+		var model []byte
+		for op := 0; op < 300; op++ {
+			offset := uint64 (random.Intn (8192))
+			length := random.Intn (3000)
+			if (offset + uint64 (length) > 8192) { length = int (8192 - offset) }
+			data := make ([]byte, length)
+			switch random.Intn (4) {
+			case 0:
+				random.Read (data)
+			case 1:
+				copy (data, text[offset % 16:])
+			case 2:
+				// Zeros
+			case 3:
+				myerr = store.Truncate (name, 7, offset, DurabilityNone)
+				if (myerr != err.NoErr && (model != nil || myerr != err.ErrNotAvailable)) { log.Fatal ("FATAL ERROR: Cannot truncate block") }
+				if (model == nil) { continue }
+				if (offset < uint64 (len (model))) {
+					model = model[:offset]
+				} else {
+					model = append (model, make ([]byte, offset - uint64 (len (model)))...)
+				}
+				data = nil
+			}
+			if (data != nil) {
+				_, _, myerr = store.Write (name, 7, offset, data, DurabilityNone)
+				if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+				if (model == nil) { model = []byte {} }
+				if (offset + uint64 (length) > uint64 (len (model))) { model = append (model, make ([]byte, offset + uint64 (length) - uint64 (len (model)))...) }
+				copy (model[offset:], data)
+			}
+
+			buff = make ([]byte, 8192)
+			for i := range buff { buff[i] = 0xff }
+			rs, myerr = store.Read (name, 7, 0, buff)
+			if (myerr != err.NoErr || rs != len (model) || !bytes.Equal (buff[:rs], model)) { log.Fatal ("FATAL ERROR: Invalid data in namespace ", name, " after operation ", op) }
+			stored, _ := mem.Stat (name, 7)
+			if (stored > 8192) { log.Fatal ("FATAL ERROR: Packed block bigger than the block size") }
+			rs, myerr = store.Read (name, 7, offset, buff[:100])
+			if (myerr != err.NoErr || (offset < uint64 (len (model)) && !bytes.Equal (buff[:rs], model[offset:offset + uint64 (rs)]))) { log.Fatal ("FATAL ERROR: Invalid partial read") }
+		}
+	}
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing deleting and renaming compressed namespaces... ")
+	if (store.Delete ("zstd", 1) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete block") }
+	_, myerr = mem.Stat (compressionNamespaceName ("zstd"), 1)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Chunk index left behind") }
+	if (store.RenameNamespace ("lz4", "renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot rename namespace") }
+	_, myerr = store.Read ("renamed", 7, 0, buff)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot read renamed namespace") }
+	if (store.DeleteNamespace ("renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	_, myerr = mem.GetNamespace (compressionNamespaceName ("renamed"))
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Chunk indexes left behind") }
+	fmt.Println ("PASS")
+}
+
+func TestCompressionServer (t *testing.T) {
+	validTestPath := "/tmp/ds_test_compression/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing a server with compression... ")
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 65536
+	cfg.URL = "127.0.0.1:8909"
+	cfg.Checksum = ChecksumCRC32C
+	cfg.Compression = CompressionLZ4
+	cfg.CompressionChunkSize = 16384
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+
+	text := bytes.Repeat ([]byte ("checkpoint data "), 4096)
+	_, myerr := BlockWrite (myserver, "default", 3, 0, text[:40000])
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	stats, _ := NamespaceStat (myserver, "default")
+	if (stats.BytesUsed != 40000 || stats.PhysicalBytes == 0 || stats.PhysicalBytes >= 20000) { log.Fatal ("FATAL ERROR: Invalid statistics: ", stats) }
+	if (NamespaceInitWithCompression ("snap", myserver, 0, CompressionSnappy) == nil) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	if (NamespaceInitWithCompression ("snap", myserver, 0, CompressionZstd) != nil) { log.Fatal ("FATAL ERROR: Compression of a namespace changed") }
+	if (NamespaceInit ("snap", myserver, 0) == nil) { log.Fatal ("FATAL ERROR: Cannot get namespace") }
+	if (NamespaceInitWithCompression ("raw", myserver, 0, CompressionNone) == nil) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	BlockWrite (myserver, "raw", 0, 0, text[:1000])
+	stats, _ = NamespaceStat (myserver, "raw")
+	if (stats.PhysicalBytes != 1000) { log.Fatal ("FATAL ERROR: Invalid statistics: ", stats) }
+	names, _ := NamespaceList (myserver)
+	if (len (names) != 3) { log.Fatal ("FATAL ERROR: Chunk indexes visible as namespaces: ", names) }
+	if (myserver.Stop (context.Background ()) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot stop server") }
+
+	// Namespaces keep their compression when the configuration changes
+	cfg.Compression = CompressionNone
+	myserver = ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+	rs, buff, myerr := BlockRead (myserver, "default", 3, 0, 65536)
+	if (rs != 40000 || myerr != err.NoErr || !bytes.Equal (buff[:rs], text[:40000])) { log.Fatal ("FATAL ERROR: Invalid data after restart") }
+	_, myerr = BlockWrite (myserver, "default", 3, 50000, text[:1000])
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	stats, _ = NamespaceStat (myserver, "default")
+	if (stats.BytesUsed != 51000 || stats.PhysicalBytes >= 25000) { log.Fatal ("FATAL ERROR: Invalid statistics: ", stats) }
+	waitScrub (myserver, 0)
+	if (ScrubStart (myserver) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start scrubbing") }
+	report := waitScrub (myserver, 1)
+	if (report.Blocks != 2 || report.Errors != 0) { log.Fatal ("FATAL ERROR: Invalid scrub report: ", report) }
+	fmt.Println ("PASS")
+}
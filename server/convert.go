@@ -0,0 +1,162 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("os"
+	"fmt"
+	"io/ioutil"
+	"path/filepath")
+
+import err "github.com/gvallee/syserror"
+
+/**
+ * Convert the namespaces of a basedir from the file layout (one file per block) to the
+ * extent layout, see ExtentStore. This must be done offline, i.e., while no server uses
+ * the basedir. The descriptor of a namespace is switched to the extent layout only once
+ * all its blocks are copied, so a conversion interrupted by a crash can simply be run
+ * again; the block files are removed last.
+ * @param[in]	basedir	Basedir to convert
+ * @param[in]	namespace	Namespace to convert; empty to convert all the namespaces
+ * @return	System error handle
+ */
+func ConvertToExtents (basedir string, namespace string) err.SysError {
+	names := []string {namespace}
+	if (namespace == "") {
+		var myerr err.SysError
+		names, myerr = listNamespaceDirs (basedir)
+		if (myerr != err.NoErr) { return myerr }
+	}
+
+	for _, name := range names {
+		myerr := convertNamespace (basedir, name)
+		if (myerr != err.NoErr) {
+			fmt.Println ("Cannot convert namespace", name)
+			return myerr
+		}
+	}
+	return err.NoErr
+}
+
+/**
+ * Remove the files of a namespace matching a filter
+ * @param[in]	path	Path to the namespace's directory
+ * @param[in]	match	Function selecting the files to remove
+ * @return	System error handle
+ */
+func removeNamespaceFiles (path string, match func (filename string) bool) err.SysError {
+	entries, myerror := ioutil.ReadDir (path)
+	if (myerror != nil) { return err.ErrFatal }
+	for _, entry := range entries {
+		if (!match (entry.Name ())) { continue }
+		myerror = os.Remove (filepath.Join (path, entry.Name ()))
+		if (myerror != nil) {
+			fmt.Println ("Cannot remove", entry.Name (), ":", myerror.Error())
+			return err.ErrFatal
+		}
+	}
+	return err.NoErr
+}
+
+/**
+ * Remove the block files of a namespace and its shards, whatever the variant of the file
+ * layout
+ * @param[in]	path	Path to the namespace's directory
+ * @return	System error handle
+ */
+func removeBlockFiles (path string) err.SysError {
+	files, myerr := listBlockFiles (path)
+	if (myerr != err.NoErr) { return myerr }
+	for _, file := range files {
+		myerror := os.Remove (file)
+		if (myerror != nil) {
+			fmt.Println ("Cannot remove", file, ":", myerror.Error())
+			return err.ErrFatal
+		}
+	}
+	shards, _ := filepath.Glob (filepath.Join (path, "??", "??"))
+	for _, shard := range shards {
+		if (isShardDir (filepath.Base (shard)) && isShardDir (filepath.Base (filepath.Dir (shard)))) { os.Remove (shard) }
+	}
+	shards, _ = filepath.Glob (filepath.Join (path, "??"))
+	for _, shard := range shards {
+		if (isShardDir (filepath.Base (shard))) { os.Remove (shard) }
+	}
+	return err.NoErr
+}
+
+func isExtentFile (filename string) bool {
+	_, ok := parseContainerName (filename)
+	return ok || filename == extentIndexName || filename == extentIndexName + ".tmp"
+}
+
+func convertNamespace (basedir string, name string) err.SysError {
+	path, myerr := namespacePath (basedir, name)
+	if (myerr != err.NoErr) { return myerr }
+
+	desc, myerr := readNamespaceDescriptor (path)
+	if (myerr == err.ErrNotAvailable) {
+		// Namespaces created before descriptors existed use the block size of the basedir
+		var sb superblock
+		myerr = readJSONFile (filepath.Join (basedir, superblockName), &sb)
+		if (myerr != err.NoErr) {
+			fmt.Println ("Cannot get the block size of namespace", name)
+			return myerr
+		}
+		desc = NamespaceDescriptor {FormatVersion: FormatVersion, BlockSize: sb.BlockSize}
+		if (!validNamespaceDescriptor (desc)) { return err.ErrFatal }
+	} else if (myerr != err.NoErr) {
+		return myerr
+	}
+
+	if (namespaceLayout (desc) == LayoutExtent) {
+		// A previous conversion may have stopped before removing the block files
+		return removeBlockFiles (path)
+	}
+
+	// Start over from the block files if a previous conversion did not complete
+	myerr = removeNamespaceFiles (path, isExtentFile)
+	if (myerr != err.NoErr) { return myerr }
+
+	desc.Layout = LayoutExtent
+	desc.LayoutVersion = 0
+	desc.MigratingFrom = 0
+	ns, myerr := loadExtentNamespace (path, desc)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = copyBlockFiles (ns)
+	if (myerr == err.NoErr) { myerr = ns.sync () }
+	if (ns.close () != err.NoErr && myerr == err.NoErr) { myerr = err.ErrFatal }
+	if (myerr != err.NoErr) { return myerr }
+
+	myerr = writeJSONFile (filepath.Join (path, namespaceDescriptorName), desc)
+	if (myerr != err.NoErr) { return myerr }
+	return removeBlockFiles (path)
+}
+
+/**
+ * Copy the block files of a namespace to its extents
+ * @param[in]	ns	Namespace, loaded with the extent layout
+ * @return	System error handle
+ */
+func copyBlockFiles (ns *extentNamespace) err.SysError {
+	files, myerr := listBlockFiles (ns.path)
+	if (myerr != err.NoErr) { return myerr }
+
+	for blockid, file := range files {
+		data, myerror := ioutil.ReadFile (file)
+		if (myerror != nil) {
+			fmt.Println ("Cannot read block file", file, ":", myerror.Error())
+			return err.ErrFatal
+		}
+		if (uint64 (len (data)) > ns.desc.BlockSize) {
+			fmt.Println ("Block file", file, "is bigger than the block size of", ns.desc.BlockSize, "bytes")
+			return err.ErrFatal
+		}
+		if (data == nil) { data = []byte {} }
+		_, myerr := ns.update (blockid, 0, data, true)
+		if (myerr != err.NoErr) { return myerr }
+	}
+	return err.NoErr
+}
@@ -0,0 +1,690 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("fmt"
+	"sync"
+	"strings"
+	"strconv"
+	"crypto/sha256"
+	"encoding/binary")
+
+import err "github.com/gvallee/syserror"
+
+// Suffix of the namespaces holding the references of the blocks of another namespace
+const dedupRefSuffix = ".dref"
+
+// Suffix of the namespaces holding the unique blocks, one per block size
+const dedupPoolSuffix = ".dpool"
+
+// Size of a reference: hash, value (block of the pool or number of references) and size
+const dedupEntrySize = sha256.Size + 16
+
+/**
+ * How the blocks of a namespace are deduplicated
+ */
+type dedupNamespace struct {
+	pool	string		// Namespace of the unique blocks
+}
+
+/**
+ * Reference to a unique block, or number of references to it
+ */
+type dedupEntry struct {
+	hash	[sha256.Size]byte
+	value	uint64
+	size	uint64
+}
+
+/**
+ * Statistics of the deduplication of the blocks
+ */
+type DedupStats struct {
+	UniqueBlocks	uint64		// Blocks actually stored
+	References	uint64		// Blocks of the namespaces referencing them
+	StoredBytes	uint64		// Size of the unique blocks
+	LogicalBytes	uint64		// Size of the blocks of the namespaces
+}
+
+/**
+ * Get the deduplication ratio
+ * @return	Amount of data of the namespaces per byte stored; 1 without deduplication
+ */
+func (stats DedupStats) Ratio () float64 {
+	if (stats.StoredBytes == 0) { return 1 }
+	return float64 (stats.LogicalBytes) / float64 (stats.StoredBytes)
+}
+
+/**
+ * Block store decorator storing each unique block once, across namespaces. The
+ * namespaces are deduplicated or not depending on their descriptor (see
+ * NamespaceInit), i.e., for their whole life. The content of the blocks is addressed by
+ * its SHA-256: the unique blocks of the namespaces with a block size of "bs" are the
+ * blocks of namespace "bs.dpool" of the wrapped store, with the first 8 bytes of their
+ * hash as id (the next free id upon collision). Block "id" of namespace "ns" is a
+ * reference stored as block "id" of the companion namespace "ns.dref": hash, id of the
+ * unique block and size. The number of references to each unique block is block "id"
+ * of "bs.dpool.dref": hash, number of references and size. Unique blocks are deleted
+ * as soon as their last reference is dropped, and the numbers of references are
+ * checked when the store is opened so that a crash at worst delays the deletion of a
+ * block. Writes replace the whole block: deduplication suits namespaces written by
+ * whole blocks. Encrypted namespaces do not deduplicate. Namespaces names ending with
+ * ".dref" or ".dpool" are reserved.
+ */
+type DedupStore struct {
+	store	BlockStore
+	lock	sync.Mutex
+	namespaces	map[string]*dedupNamespace	// nil if the namespace is not deduplicated
+	poolLock	sync.Mutex	// Numbers of references of the unique blocks
+}
+
+/**
+ * Create a deduplication store
+ * @param[in]	store	Block store actually storing the unique blocks and the references
+ * @return	Pointer to a new DedupStore structure
+ */
+func NewDedupStore (store BlockStore) *DedupStore {
+	ds := new (DedupStore)
+	ds.store = store
+	ds.namespaces = make (map[string]*dedupNamespace)
+	return ds
+}
+
+/**
+ * Get the block store wrapped by the deduplication store
+ * @return	Wrapped block store
+ */
+func (store *DedupStore) Unwrap () BlockStore {
+	return store.store
+}
+
+/**
+ * Find the deduplication store in a stack of decorators
+ * @param[in]	store	Block store, possibly decorated
+ * @return	Deduplication store; nil if the stack has none
+ */
+func dedupStore (store BlockStore) *DedupStore {
+	for {
+		ds, ok := store.(*DedupStore)
+		if (ok) { return ds }
+		decorator, ok := store.(interface { Unwrap () BlockStore })
+		if (!ok) { return nil }
+		store = decorator.Unwrap ()
+	}
+}
+
+func dedupNamespaceName (namespace string) string {
+	return namespace + dedupRefSuffix
+}
+
+func dedupPoolName (blocksize uint64) string {
+	return strconv.FormatUint (blocksize, 10) + dedupPoolSuffix
+}
+
+func dedupReserved (namespace string) bool {
+	return strings.HasSuffix (namespace, dedupRefSuffix) || strings.HasSuffix (namespace, dedupPoolSuffix)
+}
+
+/**
+ * Create the namespaces of a pool of unique blocks if needed
+ * @param[in]	blocksize	Size of the blocks of the pool
+ * @return	Name of the pool
+ * @return	System error handle
+ */
+func (store *DedupStore) createPool (blocksize uint64) (string, err.SysError) {
+	pool := dedupPoolName (blocksize)
+	var desc NamespaceDescriptor
+	desc.FormatVersion = FormatVersion
+	desc.BlockSize = blocksize
+	_, myerr := store.store.CreateNamespace (pool, desc)
+	if (myerr != err.NoErr) { return pool, myerr }
+	desc.BlockSize = BlockSizeAlignment
+	_, myerr = store.store.CreateNamespace (dedupNamespaceName (pool), desc)
+	return pool, myerr
+}
+
+/**
+ * Get how the blocks of a namespace are deduplicated
+ * @param[in]	namespace	Namespace's name
+ * @return	Deduplication of the namespace; nil if the namespace is not deduplicated
+ * @return	System error handle
+ */
+func (store *DedupStore) getNamespace (namespace string) (*dedupNamespace, err.SysError) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ns, ok := store.namespaces[namespace]
+	if (ok) { return ns, err.NoErr }
+
+	desc, myerr := store.store.GetNamespace (namespace)
+	if (myerr == err.ErrNotAvailable) { return nil, err.NoErr } // Unknown or created before descriptors existed
+	if (myerr != err.NoErr) { return nil, myerr }
+	if (desc.Dedup) {
+		// The companions may be missing after a crash while the namespace was created
+		ns = new (dedupNamespace)
+		ns.pool, myerr = store.createPool (desc.BlockSize)
+		if (myerr != err.NoErr) { return nil, myerr }
+		var refs NamespaceDescriptor
+		refs.FormatVersion = FormatVersion
+		refs.BlockSize = BlockSizeAlignment
+		_, myerr = store.store.CreateNamespace (dedupNamespaceName (namespace), refs)
+		if (myerr != err.NoErr) { return nil, myerr }
+	}
+	store.namespaces[namespace] = ns
+	return ns, err.NoErr
+}
+
+func (store *DedupStore) forgetNamespace (namespace string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete (store.namespaces, namespace)
+}
+
+/**
+ * Load a reference, or the number of references to a unique block
+ * @param[in]	namespace	Namespace of the reference
+ * @param[in]	blockid	Block id
+ * @return	Reference
+ * @return	System error handle; ErrNotAvailable if the reference does not exist
+ */
+func (store *DedupStore) loadEntry (namespace string, blockid uint64) (dedupEntry, err.SysError) {
+	var entry dedupEntry
+	buff := make ([]byte, dedupEntrySize)
+	n, myerr := store.store.Read (namespace, blockid, 0, buff)
+	if (myerr != err.NoErr) { return entry, myerr }
+	if (n != dedupEntrySize) {
+		fmt.Println ("ERROR: Invalid reference", blockid, "in namespace", namespace)
+		return entry, err.ErrFatal
+	}
+	copy (entry.hash[:], buff)
+	entry.value = binary.LittleEndian.Uint64 (buff[sha256.Size:])
+	entry.size = binary.LittleEndian.Uint64 (buff[sha256.Size + 8:])
+	return entry, err.NoErr
+}
+
+func (store *DedupStore) saveEntry (namespace string, blockid uint64, entry dedupEntry, mode Durability) (bool, err.SysError) {
+	buff := append ([]byte {}, entry.hash[:]...)
+	buff = putUint64 (buff, entry.value)
+	buff = putUint64 (buff, entry.size)
+	_, synced, myerr := store.store.Write (namespace, blockid, 0, buff, mode)
+	return synced, myerr
+}
+
+/**
+ * Get a unique block with a given content, stored if it is new
+ * @param[in]	pool	Namespace of the unique blocks
+ * @param[in]	hash	Hash of the content
+ * @param[in]	data	Content
+ * @param[in]	mode	Durability policy of the namespace referencing the block
+ * @return	Id of the unique block
+ * @return	true if the block reached stable storage; false otherwise
+ * @return	System error handle
+ */
+func (store *DedupStore) acquire (pool string, hash [sha256.Size]byte, data []byte, mode Durability) (uint64, bool, err.SysError) {
+	store.poolLock.Lock()
+	defer store.poolLock.Unlock()
+
+	counts := dedupNamespaceName (pool)
+	id := binary.LittleEndian.Uint64 (hash[:])
+	for {
+		entry, myerr := store.loadEntry (counts, id)
+		if (myerr == err.ErrNotAvailable) { break }
+		if (myerr != err.NoErr) { return 0, false, myerr }
+		if (entry.hash == hash && entry.size == uint64 (len (data))) {
+			entry.value += 1
+			synced, myerr := store.saveEntry (counts, id, entry, mode)
+			return id, synced, myerr
+		}
+		id += 1
+	}
+
+	// Left over by a crash before its number of references was saved
+	store.store.Delete (pool, id)
+	_, synced, myerr := store.store.Write (pool, id, 0, data, mode)
+	if (myerr != err.NoErr) { return 0, false, myerr }
+	countSynced, myerr := store.saveEntry (counts, id, dedupEntry {hash, 1, uint64 (len (data))}, mode)
+	return id, synced && countSynced, myerr
+}
+
+/**
+ * Drop a reference to a unique block, deleted with its last reference
+ * @param[in]	pool	Namespace of the unique blocks
+ * @param[in]	id	Id of the unique block
+ * @param[in]	mode	Durability policy of the namespace referencing the block
+ * @return	System error handle
+ */
+func (store *DedupStore) release (pool string, id uint64, mode Durability) err.SysError {
+	store.poolLock.Lock()
+	defer store.poolLock.Unlock()
+
+	counts := dedupNamespaceName (pool)
+	entry, myerr := store.loadEntry (counts, id)
+	if (myerr != err.NoErr) { return myerr }
+	if (entry.value > 1) {
+		entry.value -= 1
+		_, myerr = store.saveEntry (counts, id, entry, mode)
+		return myerr
+	}
+	// Without its number of references, a block is not reused even if a crash leaves it
+	myerr = store.store.Delete (counts, id)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = store.store.Delete (pool, id)
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	return myerr
+}
+
+/**
+ * Add a reference to an existing unique block
+ * @param[in]	pool	Namespace of the unique blocks
+ * @param[in]	id	Id of the unique block
+ * @param[in]	mode	Durability policy of the namespace referencing the block
+ * @return	System error handle
+ */
+func (store *DedupStore) reference (pool string, id uint64, mode Durability) err.SysError {
+	store.poolLock.Lock()
+	defer store.poolLock.Unlock()
+
+	counts := dedupNamespaceName (pool)
+	entry, myerr := store.loadEntry (counts, id)
+	if (myerr != err.NoErr) { return myerr }
+	entry.value += 1
+	_, myerr = store.saveEntry (counts, id, entry, mode)
+	return myerr
+}
+
+/**
+ * Replace the content of a block of a deduplicated namespace
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	ns	Deduplication of the namespace
+ * @param[in]	blockid	Block id
+ * @param[in]	old	Current reference of the block
+ * @param[in]	exists	Whether the block exists
+ * @param[in]	data	New content of the block
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	true if the block reached stable storage; false otherwise
+ * @return	System error handle
+ */
+func (store *DedupStore) replace (namespace string, ns *dedupNamespace, blockid uint64, old dedupEntry, exists bool, data []byte, mode Durability) (bool, err.SysError) {
+	hash := sha256.Sum256 (data)
+	if (exists && hash == old.hash && old.size == uint64 (len (data))) { return true, err.NoErr }
+
+	// Referenced before being released, a crash can only delay the deletion of a block
+	id, synced, myerr := store.acquire (ns.pool, hash, data, mode)
+	if (myerr != err.NoErr) { return false, myerr }
+	refSynced, myerr := store.saveEntry (dedupNamespaceName (namespace), blockid, dedupEntry {hash, id, uint64 (len (data))}, mode)
+	if (myerr != err.NoErr) {
+		store.release (ns.pool, id, mode)
+		return false, myerr
+	}
+	if (exists) {
+		myerr = store.release (ns.pool, old.value, mode)
+		if (myerr != err.NoErr) { fmt.Println ("WARNING: Cannot release unique block", old.value, "of", ns.pool) }
+	}
+	return synced && refSynced, err.NoErr
+}
+
+/**
+ * Read the whole content of a block of a deduplicated namespace
+ * @param[in]	ns	Deduplication of the namespace
+ * @param[in]	ref	Reference of the block
+ * @param[in]	size	Size of the buffer to return, at least the size of the block
+ * @return	Content of the block followed by zeros
+ * @return	System error handle
+ */
+func (store *DedupStore) readBlock (ns *dedupNamespace, ref dedupEntry, size uint64) ([]byte, err.SysError) {
+	data := make ([]byte, size)
+	n, myerr := store.store.Read (ns.pool, ref.value, 0, data[:ref.size])
+	if (myerr != err.NoErr) { return nil, myerr }
+	if (uint64 (n) != ref.size) {
+		fmt.Println ("ERROR: Unique block", ref.value, "of", ns.pool, "truncated")
+		return nil, err.ErrFatal
+	}
+	return data, err.NoErr
+}
+
+/**
+ * Check the numbers of references of the unique blocks against the references of the
+ * namespaces, e.g., after a crash, and delete the blocks that are not referenced
+ * @return	System error handle
+ */
+func (store *DedupStore) check () err.SysError {
+	names, myerr := store.store.ListNamespaces ()
+	if (myerr != err.NoErr) { return myerr }
+
+	refs := make (map[string]map[uint64]uint64)	// By pool then unique block
+	var pools []string
+	for _, name := range names {
+		if (strings.HasSuffix (name, dedupPoolSuffix)) { pools = append (pools, name) }
+		if (dedupReserved (name)) { continue }
+		ns, myerr := store.getNamespace (name)
+		if (myerr != err.NoErr) { return myerr }
+		if (ns == nil) { continue }
+		if (refs[ns.pool] == nil) { refs[ns.pool] = make (map[uint64]uint64) }
+		blocks, myerr := store.store.List (dedupNamespaceName (name))
+		if (myerr != err.NoErr) { return myerr }
+		for _, blockid := range blocks {
+			ref, myerr := store.loadEntry (dedupNamespaceName (name), blockid)
+			if (myerr != err.NoErr) { return myerr }
+			refs[ns.pool][ref.value] += 1
+		}
+	}
+
+	store.poolLock.Lock()
+	defer store.poolLock.Unlock()
+	var fixed uint64 = 0
+	for _, pool := range pools {
+		counts := dedupNamespaceName (pool)
+		ids, myerr := store.store.List (counts)
+		if (myerr != err.NoErr) { return myerr }
+		for _, id := range ids {
+			entry, myerr := store.loadEntry (counts, id)
+			if (myerr != err.NoErr) { return myerr }
+			n := refs[pool][id]
+			if (n == entry.value) { continue }
+			fixed += 1
+			if (n == 0) {
+				myerr = store.store.Delete (counts, id)
+				if (myerr == err.NoErr) { myerr = store.store.Delete (pool, id) }
+			} else {
+				entry.value = n
+				_, myerr = store.saveEntry (counts, id, entry, DurabilityPerWrite)
+			}
+			if (myerr != err.NoErr && myerr != err.ErrNotAvailable) { return myerr }
+		}
+	}
+	if (fixed != 0) { fmt.Println ("Deduplication: fixed the references of", fixed, "unique block(s)") }
+	return err.NoErr
+}
+
+/**
+ * Get the statistics of the deduplication of all the namespaces
+ * @return	Statistics
+ * @return	System error handle
+ */
+func (store *DedupStore) Stats () (DedupStats, err.SysError) {
+	var stats DedupStats
+	names, myerr := store.store.ListNamespaces ()
+	if (myerr != err.NoErr) { return stats, myerr }
+
+	store.poolLock.Lock()
+	defer store.poolLock.Unlock()
+	for _, name := range names {
+		if (!strings.HasSuffix (name, dedupPoolSuffix)) { continue }
+		counts := dedupNamespaceName (name)
+		ids, myerr := store.store.List (counts)
+		if (myerr != err.NoErr) { return stats, myerr }
+		for _, id := range ids {
+			entry, myerr := store.loadEntry (counts, id)
+			if (myerr != err.NoErr) { return stats, myerr }
+			stats.UniqueBlocks += 1
+			stats.References += entry.value
+			stats.StoredBytes += entry.size
+			stats.LogicalBytes += entry.value * entry.size
+		}
+	}
+	return stats, err.NoErr
+}
+
+func (store *DedupStore) Open (basedir string) err.SysError {
+	myerr := store.store.Open (basedir)
+	if (myerr != err.NoErr) { return myerr }
+	return store.check ()
+}
+
+func (store *DedupStore) Close () err.SysError {
+	return store.store.Close ()
+}
+
+func (store *DedupStore) Read (namespace string, blockid uint64, offset uint64, buff []byte) (int, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return -1, myerr }
+	if (ns == nil) { return store.store.Read (namespace, blockid, offset, buff) }
+
+	ref, myerr := store.loadEntry (dedupNamespaceName (namespace), blockid)
+	if (myerr != err.NoErr) { return -1, myerr }
+	if (offset >= ref.size) { return 0, err.NoErr }
+	if (uint64 (len (buff)) > ref.size - offset) { buff = buff[:ref.size - offset] }
+	return store.store.Read (ns.pool, ref.value, offset, buff)
+}
+
+func (store *DedupStore) Write (namespace string, blockid uint64, offset uint64, data []byte, mode Durability) (int, bool, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	if (ns == nil) { return store.store.Write (namespace, blockid, offset, data, mode) }
+
+	ref, myerr := store.loadEntry (dedupNamespaceName (namespace), blockid)
+	exists := (myerr == err.NoErr)
+	if (myerr != err.NoErr && myerr != err.ErrNotAvailable) { return -1, false, myerr }
+	size := offset + uint64 (len (data))
+	if (size < ref.size) { size = ref.size }
+	content := make ([]byte, size)
+	if (exists) {
+		content, myerr = store.readBlock (ns, ref, size)
+		if (myerr != err.NoErr) { return -1, false, myerr }
+	}
+	copy (content[offset:], data)
+
+	synced, myerr := store.replace (namespace, ns, blockid, ref, exists, content, mode)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	return len (data), synced, err.NoErr
+}
+
+func (store *DedupStore) Truncate (namespace string, blockid uint64, size uint64, mode Durability) err.SysError {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	if (ns == nil) { return store.store.Truncate (namespace, blockid, size, mode) }
+
+	ref, myerr := store.loadEntry (dedupNamespaceName (namespace), blockid)
+	if (myerr != err.NoErr) { return myerr }
+	content, myerr := store.readBlock (ns, ref, ref.size)
+	if (myerr != err.NoErr) { return myerr }
+	if (size <= ref.size) {
+		content = content[:size]
+	} else {
+		content = append (content, make ([]byte, size - ref.size)...)
+	}
+	_, myerr = store.replace (namespace, ns, blockid, ref, true, content, mode)
+	return myerr
+}
+
+func (store *DedupStore) Delete (namespace string, blockid uint64) err.SysError {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	if (ns == nil) { return store.store.Delete (namespace, blockid) }
+
+	companion := dedupNamespaceName (namespace)
+	ref, myerr := store.loadEntry (companion, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = store.store.Delete (companion, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	return store.release (ns.pool, ref.value, DurabilityNone)
+}
+
+func (store *DedupStore) List (namespace string) ([]uint64, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return nil, myerr }
+	if (ns == nil) { return store.store.List (namespace) }
+	return store.store.List (dedupNamespaceName (namespace))
+}
+
+func (store *DedupStore) Stat (namespace string, blockid uint64) (uint64, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return 0, myerr }
+	if (ns == nil) { return store.store.Stat (namespace, blockid) }
+
+	ref, myerr := store.loadEntry (dedupNamespaceName (namespace), blockid)
+	if (myerr != err.NoErr) { return 0, myerr }
+	return ref.size, err.NoErr
+}
+
+/**
+ * Get the amount of storage used by a block: its share of the unique block it
+ * references, i.e., the size of the unique block divided by its number of references
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @return	Amount of storage used by the block
+ * @return	System error handle
+ */
+func (store *DedupStore) PhysicalSize (namespace string, blockid uint64) (uint64, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return 0, myerr }
+	if (ns == nil) { return store.store.Stat (namespace, blockid) }
+
+	ref, myerr := store.loadEntry (dedupNamespaceName (namespace), blockid)
+	if (myerr != err.NoErr) { return 0, myerr }
+	store.poolLock.Lock()
+	defer store.poolLock.Unlock()
+	count, myerr := store.loadEntry (dedupNamespaceName (ns.pool), ref.value)
+	if (myerr != err.NoErr || count.value == 0) { return ref.size, myerr }
+	return ref.size / count.value, err.NoErr
+}
+
+/**
+ * Copy a block to another namespace. When both namespaces are deduplicated in the same
+ * pool, the copy is only a new reference to the unique block.
+ * @param[in]	src	Namespace of the block to copy
+ * @param[in]	dst	Namespace of the copy
+ * @param[in]	blockid	Block id, the same in both namespaces
+ * @param[in]	mode	Durability policy of the copy
+ * @return	System error handle; ErrNotAvailable if the block to copy does not exist
+ */
+func (store *DedupStore) CloneBlock (src string, dst string, blockid uint64, mode Durability) err.SysError {
+	from, myerr := store.getNamespace (src)
+	if (myerr != err.NoErr) { return myerr }
+	to, myerr := store.getNamespace (dst)
+	if (myerr != err.NoErr) { return myerr }
+	if (from == nil && to == nil) { return cloneBlock (store.store, src, dst, blockid, mode) }
+	if (from == nil || to == nil || *from != *to) { return copyBlock (store, src, dst, blockid, mode) }
+
+	ref, myerr := store.loadEntry (dedupNamespaceName (src), blockid)
+	if (myerr == err.ErrNotAvailable) {
+		myerr = store.Delete (dst, blockid)
+		if (myerr == err.NoErr || myerr == err.ErrNotAvailable) { return err.ErrNotAvailable }
+		return myerr
+	}
+	if (myerr != err.NoErr) { return myerr }
+	companion := dedupNamespaceName (dst)
+	old, olderr := store.loadEntry (companion, blockid)
+	if (olderr != err.NoErr && olderr != err.ErrNotAvailable) { return olderr }
+	if (olderr == err.NoErr && old.value == ref.value) { return err.NoErr }
+
+	// Referenced before being released, as in replace
+	myerr = store.reference (to.pool, ref.value, mode)
+	if (myerr != err.NoErr) { return myerr }
+	_, myerr = store.saveEntry (companion, blockid, ref, mode)
+	if (myerr != err.NoErr) {
+		store.release (to.pool, ref.value, mode)
+		return myerr
+	}
+	if (olderr == err.NoErr) {
+		myerr = store.release (to.pool, old.value, mode)
+		if (myerr != err.NoErr) { fmt.Println ("WARNING: Cannot release unique block", old.value, "of", to.pool) }
+	}
+	return err.NoErr
+}
+
+func (store *DedupStore) Flush (namespace string) err.SysError {
+	myerr := store.store.Flush (namespace)
+	ns, nserr := store.getNamespace (namespace)
+	if (nserr != err.NoErr || ns == nil) { return myerr }
+	for _, n := range []string {dedupNamespaceName (namespace), ns.pool, dedupNamespaceName (ns.pool)} {
+		if (store.store.Flush (n) != err.NoErr) { myerr = err.ErrFatal }
+	}
+	return myerr
+}
+
+func (store *DedupStore) SyncDirty (match func (namespace string) bool) int {
+	return store.store.SyncDirty (func (namespace string) bool { return match (strings.TrimSuffix (namespace, dedupRefSuffix)) })
+}
+
+func (store *DedupStore) CreateNamespace (namespace string, desc NamespaceDescriptor) (NamespaceDescriptor, err.SysError) {
+	if (dedupReserved (namespace)) { return desc, err.ErrNotAvailable }
+	if (desc.Dedup && !validStoreName (dedupNamespaceName (namespace))) {
+		fmt.Println ("Namespace name too long to deduplicate the blocks:", namespace)
+		return desc, err.ErrNotAvailable
+	}
+
+	desc, myerr := store.store.CreateNamespace (namespace, desc)
+	if (myerr != err.NoErr) { return desc, myerr }
+	_, myerr = store.getNamespace (namespace)
+	return desc, myerr
+}
+
+func (store *DedupStore) GetNamespace (namespace string) (NamespaceDescriptor, err.SysError) {
+	if (dedupReserved (namespace)) { return NamespaceDescriptor {}, err.ErrNotAvailable }
+	return store.store.GetNamespace (namespace)
+}
+
+func (store *DedupStore) ListNamespaces () ([]string, err.SysError) {
+	names, myerr := store.store.ListNamespaces ()
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	var visible []string
+	for _, name := range names {
+		if (!dedupReserved (name)) { visible = append (visible, name) }
+	}
+	return visible, err.NoErr
+}
+
+func (store *DedupStore) DeleteNamespace (namespace string) err.SysError {
+	if (dedupReserved (namespace)) { return err.ErrNotAvailable }
+
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	if (ns != nil) {
+		// The unique blocks only referenced by the namespace go away with it
+		blocks, myerr := store.store.List (dedupNamespaceName (namespace))
+		if (myerr != err.NoErr) { return myerr }
+		for _, blockid := range blocks {
+			myerr = store.Delete (namespace, blockid)
+			if (myerr != err.NoErr) { return myerr }
+		}
+	}
+	store.forgetNamespace (namespace)
+	myerr = store.store.DeleteNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = store.store.DeleteNamespace (dedupNamespaceName (namespace))
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	return myerr
+}
+
+func (store *DedupStore) RenameNamespace (oldname string, newname string) err.SysError {
+	if (dedupReserved (oldname) || dedupReserved (newname)) { return err.ErrNotAvailable }
+	oldCompanion := dedupNamespaceName (oldname)
+	newCompanion := dedupNamespaceName (newname)
+	if (!validStoreName (newCompanion)) { return err.ErrNotAvailable }
+
+	store.forgetNamespace (oldname)
+	store.forgetNamespace (newname)
+	myerr := store.store.RenameNamespace (oldname, newname)
+	if (myerr != err.NoErr) { return myerr }
+
+	// Left over by a namespace that was not fully deleted
+	_, myerr = store.store.GetNamespace (newCompanion)
+	if (myerr == err.NoErr) { store.store.DeleteNamespace (newCompanion) }
+	_, myerr = store.store.GetNamespace (oldCompanion)
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	myerr = store.store.RenameNamespace (oldCompanion, newCompanion)
+	if (myerr != err.NoErr) {
+		// The blocks are unreadable without their references
+		store.store.RenameNamespace (newname, oldname)
+	}
+	return myerr
+}
+
+/**
+ * Get the statistics of the deduplication of the blocks of a server
+ * @param[in]	dataserver	Structure representing the server
+ * @return	Statistics of the deduplication
+ * @return	System error handle; ErrNotAvailable if the store does not deduplicate
+ */
+func GetDedupStats (dataserver *Server) (DedupStats, err.SysError) {
+	if (dataserver == nil) { return DedupStats {}, err.ErrNotAvailable }
+	store := dedupStore (dataserver.store)
+	if (store == nil) { return DedupStats {}, err.ErrNotAvailable }
+	return store.Stats ()
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os")
+
+import err "github.com/gvallee/syserror"
+
+func checkDedupStats (store *DedupStore, unique uint64, references uint64) DedupStats {
+	stats, myerr := store.Stats ()
+	if (myerr != err.NoErr || stats.UniqueBlocks != unique || stats.References != references) { log.Fatal ("FATAL ERROR: Invalid deduplication statistics: ", stats) }
+	return stats
+}
+
+func TestDedupStore (t *testing.T) {
+	fmt.Print ("Testing deduplicated namespaces... ")
+	mem := NewMemoryStore (0)
+	store := NewDedupStore (mem)
+	desc := NamespaceDescriptor {FormatVersion: FormatVersion, BlockSize: 4096, Dedup: true}
+	for _, name := range []string {"job1", "job2"} {
+		_, myerr := store.CreateNamespace (name, desc)
+		if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	}
+	_, myerr := store.CreateNamespace ("plain", NamespaceDescriptor {FormatVersion: FormatVersion, BlockSize: 4096})
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	for _, name := range []string {"x.dref", "4096.dpool"} {
+		_, myerr = store.CreateNamespace (name, desc)
+		if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Created a reserved namespace") }
+	}
+	names, _ := store.ListNamespaces ()
+	if (len (names) != 3) { log.Fatal ("FATAL ERROR: Invalid list of namespaces: ", names) }
+
+	restart := bytes.Repeat ([]byte ("restart "), 512)
+	zeros := make ([]byte, 4096)
+	for _, name := range []string {"job1", "job2"} {
+		for id := uint64 (0); id < 4; id++ {
+			_, _, myerr = store.Write (name, id, 0, restart, DurabilityNone)
+			if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+		}
+		store.Write (name, 10, 0, zeros, DurabilityNone)
+	}
+	stats := checkDedupStats (store, 2, 10)
+	if (stats.StoredBytes != 8192 || stats.LogicalBytes != 40960 || stats.Ratio () != 5) { log.Fatal ("FATAL ERROR: Invalid deduplication statistics: ", stats) }
+	blocks, _ := store.List ("job1")
+	size, _ := store.Stat ("job1", 2)
+	physical, _ := store.PhysicalSize ("job1", 2)
+	if (len (blocks) != 5 || size != 4096 || physical != 4096 / 8) { log.Fatal ("FATAL ERROR: Invalid blocks: ", blocks, " ", size, " ", physical) }
+	buff := make ([]byte, 4096)
+	rs, myerr := store.Read ("job2", 3, 8, buff)
+	if (rs != 4088 || myerr != err.NoErr || !bytes.Equal (buff[:rs], restart[8:])) { log.Fatal ("FATAL ERROR: Invalid data") }
+	decoded, myerr := ParseDedupStats (putUint64 (putUint64 (putUint64 (putUint64 (nil, 1), 2), 3), 4))
+	if (myerr != err.NoErr || decoded != (DedupStats {1, 2, 3, 4})) { log.Fatal ("FATAL ERROR: Invalid deduplication reply") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing updating deduplicated blocks... ")
+	_, _, myerr = store.Write ("job1", 0, 100, []byte ("changed"), DurabilityNone)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	checkDedupStats (store, 3, 10)
+	rs, _ = store.Read ("job2", 0, 0, buff)
+	if (rs != 4096 || !bytes.Equal (buff, restart)) { log.Fatal ("FATAL ERROR: Shared block modified") }
+	rs, _ = store.Read ("job1", 0, 0, buff)
+	if (rs != 4096 || string (buff[100:107]) != "changed") { log.Fatal ("FATAL ERROR: Block not modified") }
+	// Going back to a known content shares the block again and drops the modified one
+	store.Write ("job1", 0, 100, restart[100:107], DurabilityNone)
+	checkDedupStats (store, 2, 10)
+	if (store.Truncate ("job1", 1, 100, DurabilityNone) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot truncate block") }
+	size, _ = store.Stat ("job1", 1)
+	if (size != 100) { log.Fatal ("FATAL ERROR: Invalid size after truncation") }
+	_, _, myerr = store.Write ("job1", 20, 1000, []byte ("x"), DurabilityNone)
+	rs, _ = store.Read ("job1", 20, 0, buff)
+	if (myerr != err.NoErr || rs != 1001 || buff[999] != 0 || buff[1000] != 'x') { log.Fatal ("FATAL ERROR: Invalid sparse block") }
+	checkDedupStats (store, 4, 11)
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing collecting unreferenced blocks... ")
+	if (store.Delete ("job1", 20) != err.NoErr || store.Delete ("job1", 1) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete block") }
+	checkDedupStats (store, 2, 9)
+	if (store.RenameNamespace ("job2", "renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot rename namespace") }
+	rs, myerr = store.Read ("renamed", 10, 0, buff)
+	if (rs != 4096 || myerr != err.NoErr || !bytes.Equal (buff, zeros)) { log.Fatal ("FATAL ERROR: Cannot read renamed namespace") }
+	if (store.DeleteNamespace ("renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	checkDedupStats (store, 2, 4)
+	if (store.DeleteNamespace ("job1") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	checkDedupStats (store, 0, 0)
+	blocks, _ = mem.List (dedupPoolName (4096))
+	if (len (blocks) != 0) { log.Fatal ("FATAL ERROR: Unique blocks left behind") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing repairing the references of unique blocks... ")
+	store.CreateNamespace ("job3", desc)
+	store.Write ("job3", 0, 0, restart, DurabilityNone)
+	store.Write ("job3", 1, 0, restart, DurabilityNone)
+	// As left by crashes: a reference lost, and a unique block never referenced
+	mem.Delete (dedupNamespaceName ("job3"), 1)
+	store.acquire (dedupPoolName (4096), [32]byte {1}, zeros, DurabilityNone)
+	checkDedupStats (store, 2, 3)
+	if (NewDedupStore (mem).Open ("") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot open store") }
+	checkDedupStats (store, 1, 1)
+	rs, myerr = store.Read ("job3", 0, 0, buff)
+	if (rs != 4096 || myerr != err.NoErr || !bytes.Equal (buff, restart)) { log.Fatal ("FATAL ERROR: Invalid data after repair") }
+	fmt.Println ("PASS")
+}
+
+func TestDedupServer (t *testing.T) {
+	validTestPath := "/tmp/ds_test_dedup/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing a server with deduplication... ")
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 8192
+	cfg.URL = "127.0.0.1:8911"
+	cfg.Checksum = ChecksumCRC32C
+	cfg.Dedup = true
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+
+	data := make ([]byte, 8192)
+	for i := range data { data[i] = byte (i * 7) }
+	for _, name := range []string {"job1", "job2"} {
+		if (NamespaceInit (name, myserver, 0) == nil) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+		for id := uint64 (0); id < 4; id++ {
+			_, myerr := BlockWrite (myserver, name, id, 0, data)
+			if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+		}
+	}
+	stats, _ := NamespaceStat (myserver, "job1")
+	if (stats.Blocks != 4 || stats.BytesUsed != 32768 || stats.PhysicalBytes != 4 * 8192 / 8) { log.Fatal ("FATAL ERROR: Invalid statistics: ", stats) }
+	dedup, myerr := GetDedupStats (myserver)
+	if (myerr != err.NoErr || dedup.UniqueBlocks != 1 || dedup.Ratio () != 8) { log.Fatal ("FATAL ERROR: Invalid deduplication statistics: ", dedup) }
+	names, _ := NamespaceList (myserver)
+	if (len (names) != 3) { log.Fatal ("FATAL ERROR: References visible as namespaces: ", names) }
+	if (NamespaceDelete (myserver, "job2") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	if (myserver.Stop (context.Background ()) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot stop server") }
+
+	// Namespaces keep being deduplicated when the configuration changes
+	cfg.Dedup = false
+	myserver = ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+	rs, buff, myerr := BlockRead (myserver, "job1", 3, 0, 8192)
+	if (rs != 8192 || myerr != err.NoErr || !bytes.Equal (buff[:rs], data)) { log.Fatal ("FATAL ERROR: Invalid data after restart") }
+	BlockWrite (myserver, "job1", 5, 0, data)
+	dedup, _ = GetDedupStats (myserver)
+	if (dedup.UniqueBlocks != 1 || dedup.References != 5) { log.Fatal ("FATAL ERROR: Invalid deduplication statistics: ", dedup) }
+	waitScrub (myserver, 0)
+	if (ScrubStart (myserver) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start scrubbing") }
+	report := waitScrub (myserver, 1)
+	if (report.Blocks != 5 || report.Errors != 0) { log.Fatal ("FATAL ERROR: Invalid scrub report: ", report) }
+	fmt.Println ("PASS")
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("fmt"
+	"time")
+
+import err "github.com/gvallee/syserror"
+
+/**
+ * Durability policy, i.e., when the data written to a block is synced to disk.
+ */
+type Durability int
+
+const (
+	// Sync after every write before acknowledging it (default)
+	DurabilityPerWrite Durability = iota
+	// Never sync, for scratch data
+	DurabilityNone
+	// Group commit: the dirty blocks are synced in the background at a regular interval
+	DurabilityPeriodic
+	// Sync only upon explicit flush and when the block file is closed
+	DurabilityOnFlush
+)
+
+// Default interval between two group commits of the periodic durability policy
+const DefaultSyncInterval = 100 * time.Millisecond
+
+var durabilityNames = []string {
+	DurabilityPerWrite:	"write",
+	DurabilityNone:		"none",
+	DurabilityPeriodic:	"periodic",
+	DurabilityOnFlush:	"flush",
+}
+
+func (d Durability) String () string {
+	if (d < 0 || int (d) >= len (durabilityNames)) { return "unknown" }
+	return durabilityNames[d]
+}
+
+/**
+ * Get a durability policy from its name
+ * @param[in]	name	Name of the policy: none, write, periodic or flush
+ * @return	Durability policy
+ * @return	System error handle
+ */
+func ParseDurability (name string) (Durability, err.SysError) {
+	for d, n := range durabilityNames {
+		if (n == name) { return Durability (d), err.NoErr }
+	}
+	return DurabilityPerWrite, err.ErrNotAvailable
+}
+
+/**
+ * Set the durability policy of a namespace, overriding the one of the server. Unless
+ * the new policy is DurabilityNone, the data already written to the namespace is then
+ * flushed.
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	namespace	Namespace's name
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	System error handle; ErrNotAvailable if the namespace does not exist or the
+ *		policy is unknown; the error of the flush otherwise
+ */
+func SetNamespaceDurability (dataserver *Server, namespace string, mode Durability) err.SysError {
+	if (dataserver == nil || mode.String () == "unknown") { return err.ErrNotAvailable }
+	if (checkNamespace (dataserver, namespace, false) != StatusOK) { return err.ErrNotAvailable }
+
+	// The namespace cannot be deleted, which drops its policy, in the meantime
+	unlockns, myerr := useNamespace (dataserver, namespace, false)
+	if (myerr != err.NoErr) { return myerr }
+	dataserver.durabilityLock.Lock()
+	dataserver.nsDurability[namespace] = mode
+	dataserver.durabilityLock.Unlock()
+	unlockns()
+
+	// Data that was written under a weaker policy must not remain unsynced
+	if (mode == DurabilityNone) { return err.NoErr }
+	return NamespaceFlush (dataserver, namespace)
+}
+
+/**
+ * Get the durability policy of a namespace
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	namespace	Namespace's name
+ * @return	Durability policy of the namespace
+ */
+func GetNamespaceDurability (dataserver *Server, namespace string) Durability {
+	dataserver.durabilityLock.Lock()
+	defer dataserver.durabilityLock.Unlock()
+
+	mode, ok := dataserver.nsDurability[namespace]
+	if (!ok) { return dataserver.durability }
+	return mode
+}
+
+/**
+ * Sync all the data written to a namespace.
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	namespace	Namespace's name
+ * @return	System error handle; ErrFatal if some data, including data synced in the
+ *		background since the previous flush, could not reach the disk
+ */
+func NamespaceFlush (dataserver *Server, namespace string) err.SysError {
+	if (dataserver == nil) { return err.ErrNotAvailable }
+
+	unlockns, myerr := useNamespace (dataserver, namespace, false)
+	if (myerr != err.NoErr) { return myerr }
+	defer unlockns()
+	return dataserver.store.Flush (namespace)
+}
+
+/**
+ * Group commit of the blocks of the namespaces using the periodic durability policy,
+ * until the server stops.
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	interval	Time between two commits
+ */
+func runPeriodicSync (dataserver *Server, interval time.Duration) {
+	defer dataserver.background.Done()
+	ticker := time.NewTicker (interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dataserver.stopping:
+			return
+		case <-ticker.C:
+			failed := dataserver.store.SyncDirty (func (namespace string) bool {
+				return GetNamespaceDurability (dataserver, namespace) == DurabilityPeriodic
+			})
+			if (failed != 0) { fmt.Println ("ERROR:", failed, "block(s) could not be synced") }
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"context"
+	"fmt"
+	"log"
+	"os")
+
+import err "github.com/gvallee/syserror"
+
+func TestDurability (t *testing.T) {
+	validTestPath := "/tmp/ns_test_durability/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing durability policy names... ")
+	for _, name := range []string {"none", "write", "periodic", "flush"} {
+		mode, myerr := ParseDurability (name)
+		if (myerr != err.NoErr || mode.String () != name) { log.Fatal ("FATAL ERROR: Cannot parse ", name) }
+	}
+	_, myerr := ParseDurability ("sometimes")
+	if (myerr == err.NoErr) { log.Fatal ("FATAL ERROR: Invalid policy accepted") }
+	fmt.Println ("PASS")
+
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 1024 * 1024
+	cfg.URL = "127.0.0.1:8892"
+	cfg.BlockCacheSize = 4
+	cfg.Durability = DurabilityOnFlush
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing writes with the server's policy... ")
+	data := make ([]byte, 4096)
+	ws, synced, myerr := blockWrite (myserver, "default", 0, 0, data)
+	if (ws != 4096 || synced || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Write was synced despite the flush policy") }
+	if (NamespaceFlush (myserver, "default") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot flush namespace") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing writes with a namespace's policy... ")
+	if (SetNamespaceDurability (myserver, "default", DurabilityPerWrite) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot set durability policy") }
+	ws, synced, myerr = blockWrite (myserver, "default", 0, 0, data)
+	if (ws != 4096 || !synced || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Write was not synced") }
+	if (GetNamespaceDurability (myserver, "other") != DurabilityOnFlush) { log.Fatal ("FATAL ERROR: Policy of the server was not used") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing invalid namespace policies... ")
+	for _, name := range []string {"other", "default.sums", "default.cmap", "../default", ""} {
+		if (SetNamespaceDurability (myserver, name, DurabilityPerWrite) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Policy set for namespace ", name) }
+	}
+	if (SetNamespaceDurability (myserver, "default", Durability (42)) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Unknown policy accepted") }
+	if (GetNamespaceDurability (myserver, "default") != DurabilityPerWrite || GetNamespaceDurability (myserver, "other") != DurabilityOnFlush) { log.Fatal ("FATAL ERROR: Policies changed by invalid requests") }
+	fmt.Println ("PASS")
+}
@@ -0,0 +1,673 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("fmt"
+	"sync"
+	"strings"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary")
+
+import err "github.com/gvallee/syserror"
+
+// Suffix of the namespaces holding the nonces and tags of the blocks of another namespace
+const encryptionSuffix = ".enc"
+
+// Only encryption algorithm, recorded in the descriptors of the encrypted namespaces
+const EncryptionAESGCM = "aes-gcm"
+
+// Size of the chunks of a block encrypted independently
+const DefaultEncryptionChunkSize = 4096
+
+// Size of the metadata of an encrypted chunk: key id, size, nonce and tag
+const (
+	encryptionNonceSize = 12
+	encryptionTagSize = 16
+	encryptionEntrySize = 8 + encryptionNonceSize + encryptionTagSize
+)
+
+/**
+ * How the blocks of a namespace are encrypted
+ */
+type encryptedNamespace struct {
+	chunk		uint64
+	blocksize	uint64
+}
+
+/**
+ * Metadata of an encrypted chunk
+ */
+type encryptionEntry struct {
+	key	uint32		// Id of the key of the chunk; 0 for a chunk of zeros never written
+	length	uint64		// Size of the encrypted data, the rest of the chunk is zeros
+	nonce	[encryptionNonceSize]byte
+	tag	[encryptionTagSize]byte
+}
+
+/**
+ * Block store decorator encrypting the data of the blocks of the store it wraps with
+ * AES-GCM. The namespaces are encrypted or not depending on their descriptor (see
+ * NamespaceInit), i.e., for their whole life. Each chunk of a block is encrypted
+ * independently, with a random nonce and the block id and chunk number as additional
+ * data, so that random reads and writes only decrypt and encrypt the chunks they touch
+ * and chunks cannot be swapped unnoticed. The encrypted data keeps the offsets of the
+ * plain data in block "id" of namespace "ns" of the wrapped store; the metadata of the
+ * chunks is block "id" of the companion namespace "ns.enc": for each chunk, the key
+ * id and size of the encrypted data (little-endian, 4 bytes each), the nonce and the
+ * tag. Keys come from a KeyProvider; data encrypted with a key the provider does not
+ * know, or with another key under the same id, cannot be read (ErrFatal). Namespaces
+ * names ending with ".enc" are reserved. The data and the metadata are not updated
+ * atomically: a crash in-between makes the chunks being written unreadable.
+ */
+type EncryptionStore struct {
+	store	BlockStore
+	keys	KeyProvider
+	lock	sync.Mutex
+	namespaces	map[string]*encryptedNamespace	// nil if the namespace is not encrypted
+	ciphers	map[string]cipher.AEAD	// By key
+}
+
+/**
+ * Create an encryption store
+ * @param[in]	store	Block store actually storing the blocks and the metadata
+ * @param[in]	keys	Source of the keys; nil if no namespace can be encrypted
+ * @return	Pointer to a new EncryptionStore structure
+ */
+func NewEncryptionStore (store BlockStore, keys KeyProvider) *EncryptionStore {
+	es := new (EncryptionStore)
+	es.store = store
+	es.keys = keys
+	es.namespaces = make (map[string]*encryptedNamespace)
+	es.ciphers = make (map[string]cipher.AEAD)
+	return es
+}
+
+/**
+ * Get the block store wrapped by the encryption store
+ * @return	Wrapped block store
+ */
+func (store *EncryptionStore) Unwrap () BlockStore {
+	return store.store
+}
+
+/**
+ * Find the encryption store in a stack of decorators
+ * @param[in]	store	Block store, possibly decorated
+ * @return	Encryption store; nil if the stack has none
+ */
+func encryptionStore (store BlockStore) *EncryptionStore {
+	for {
+		es, ok := store.(*EncryptionStore)
+		if (ok) { return es }
+		decorator, ok := store.(interface { Unwrap () BlockStore })
+		if (!ok) { return nil }
+		store = decorator.Unwrap ()
+	}
+}
+
+func encryptionNamespaceName (namespace string) string {
+	return namespace + encryptionSuffix
+}
+
+/**
+ * Check the encryption settings of a namespace descriptor
+ * @param[in]	desc	Descriptor of the namespace
+ * @return	true if the namespace is encrypted; false otherwise
+ * @return	System error handle; ErrFatal if the settings are invalid
+ */
+func namespaceEncrypted (desc NamespaceDescriptor) (bool, err.SysError) {
+	if (desc.Encryption == "") { return false, err.NoErr }
+	if (desc.Encryption != EncryptionAESGCM || CheckBlockSize (desc.EncryptionChunkSize) != nil) { return false, err.ErrFatal }
+	return true, err.NoErr
+}
+
+/**
+ * Size of the blocks of the companion namespace of an encrypted namespace, big enough
+ * for the metadata of a full block
+ * @param[in]	blocksize	Block size of the encrypted namespace
+ * @param[in]	chunk	Chunk size of the encrypted namespace
+ * @return	Block size of the companion namespace
+ */
+func encryptionBlockSize (blocksize uint64, chunk uint64) uint64 {
+	size := (blocksize + chunk - 1) / chunk * encryptionEntrySize
+	return (size + BlockSizeAlignment - 1) / BlockSizeAlignment * BlockSizeAlignment
+}
+
+/**
+ * Get how the blocks of a namespace are encrypted
+ * @param[in]	namespace	Namespace's name
+ * @return	Encryption of the namespace; nil if the namespace is not encrypted
+ * @return	System error handle
+ */
+func (store *EncryptionStore) getNamespace (namespace string) (*encryptedNamespace, err.SysError) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ns, ok := store.namespaces[namespace]
+	if (ok) { return ns, err.NoErr }
+
+	desc, myerr := store.store.GetNamespace (namespace)
+	if (myerr == err.ErrNotAvailable) { return nil, err.NoErr } // Unknown or created before descriptors existed
+	if (myerr != err.NoErr) { return nil, myerr }
+	encrypted, myerr := namespaceEncrypted (desc)
+	if (myerr != err.NoErr) {
+		fmt.Println ("Invalid encryption for namespace", namespace)
+		return nil, myerr
+	}
+	if (encrypted) {
+		if (store.keys == nil) {
+			fmt.Println ("No key provider for encrypted namespace", namespace)
+			return nil, err.ErrNotAvailable
+		}
+		ns = new (encryptedNamespace)
+		ns.chunk = desc.EncryptionChunkSize
+		ns.blocksize = desc.BlockSize
+
+		// The companion may be missing after a crash while the namespace was created
+		var meta NamespaceDescriptor
+		meta.FormatVersion = FormatVersion
+		meta.BlockSize = encryptionBlockSize (ns.blocksize, ns.chunk)
+		_, myerr = store.store.CreateNamespace (encryptionNamespaceName (namespace), meta)
+		if (myerr != err.NoErr) { return nil, myerr }
+	}
+	store.namespaces[namespace] = ns
+	return ns, err.NoErr
+}
+
+func (store *EncryptionStore) forgetNamespace (namespace string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete (store.namespaces, namespace)
+}
+
+/**
+ * Get the cipher of a key
+ * @param[in]	id	Key id
+ * @return	AES-GCM cipher
+ * @return	System error handle; ErrFatal if the key is not available
+ */
+func (store *EncryptionStore) getCipher (id uint32) (cipher.AEAD, err.SysError) {
+	key, myerr := store.keys.Key (id)
+	if (myerr != err.NoErr) {
+		fmt.Println ("ERROR: Key", id, "not available")
+		return nil, err.ErrFatal
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	aead, ok := store.ciphers[string (key)]
+	if (ok) { return aead, err.NoErr }
+	block, myerror := aes.NewCipher (key)
+	if (myerror != nil) { return nil, err.ErrFatal }
+	aead, myerror = cipher.NewGCM (block)
+	if (myerror != nil) { return nil, err.ErrFatal }
+	store.ciphers[string (key)] = aead
+	return aead, err.NoErr
+}
+
+func invalidEncryptionMetadata (namespace string, blockid uint64) err.SysError {
+	fmt.Println ("ERROR: Invalid encryption metadata for block", blockid, "of namespace", namespace)
+	return err.ErrFatal
+}
+
+/**
+ * Load the metadata of the chunks of a block
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	ns	Encryption of the namespace
+ * @param[in]	blockid	Block id
+ * @param[in]	size	Size of the block
+ * @return	Metadata of each chunk of the block
+ * @return	System error handle
+ */
+func (store *EncryptionStore) loadMetadata (namespace string, ns *encryptedNamespace, blockid uint64, size uint64) ([]encryptionEntry, err.SysError) {
+	count := (size + ns.chunk - 1) / ns.chunk
+	if (count == 0) { return nil, err.NoErr }
+	buff := make ([]byte, count * encryptionEntrySize)
+	n, myerr := store.store.Read (encryptionNamespaceName (namespace), blockid, 0, buff)
+	if (myerr == err.ErrNotAvailable) {
+		fmt.Println ("Missing encryption metadata for block", blockid, "of namespace", namespace)
+		return nil, err.ErrFatal
+	}
+	if (myerr != err.NoErr) { return nil, myerr }
+	if (uint64 (n) != count * encryptionEntrySize) { return nil, invalidEncryptionMetadata (namespace, blockid) }
+
+	entries := make ([]encryptionEntry, count)
+	for i := range entries {
+		raw := buff[i * encryptionEntrySize:]
+		entries[i].key = binary.LittleEndian.Uint32 (raw[0:])
+		entries[i].length = uint64 (binary.LittleEndian.Uint32 (raw[4:]))
+		copy (entries[i].nonce[:], raw[8:])
+		copy (entries[i].tag[:], raw[8 + encryptionNonceSize:])
+		if (entries[i].length > ns.chunk) { return nil, invalidEncryptionMetadata (namespace, blockid) }
+	}
+	return entries, err.NoErr
+}
+
+/**
+ * Save the metadata of consecutive chunks of a block
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	first	First chunk
+ * @param[in]	entries	Metadata of the chunks
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	true if the metadata reached stable storage; false otherwise
+ * @return	System error handle
+ */
+func (store *EncryptionStore) saveMetadata (namespace string, blockid uint64, first uint64, entries []encryptionEntry, mode Durability) (bool, err.SysError) {
+	buff := make ([]byte, len (entries) * encryptionEntrySize)
+	for i, e := range entries {
+		raw := buff[i * encryptionEntrySize:]
+		binary.LittleEndian.PutUint32 (raw[0:], e.key)
+		binary.LittleEndian.PutUint32 (raw[4:], uint32 (e.length))
+		copy (raw[8:], e.nonce[:])
+		copy (raw[8 + encryptionNonceSize:], e.tag[:])
+	}
+	_, synced, myerr := store.store.Write (encryptionNamespaceName (namespace), blockid, first * encryptionEntrySize, buff, mode)
+	return synced, myerr
+}
+
+func chunkAdditionalData (blockid uint64, i uint64) []byte {
+	return putUint64 (putUint64 (nil, blockid), i)
+}
+
+/**
+ * Encrypt a chunk
+ * @param[in]	blockid	Block id
+ * @param[in]	i	Chunk
+ * @param[in]	key	Id of the key
+ * @param[in]	data	Content of the chunk
+ * @return	Metadata of the chunk
+ * @return	Encrypted data, of the size of the content
+ * @return	System error handle
+ */
+func (store *EncryptionStore) sealChunk (blockid uint64, i uint64, key uint32, data []byte) (encryptionEntry, []byte, err.SysError) {
+	entry := encryptionEntry {key: key, length: uint64 (len (data))}
+	aead, myerr := store.getCipher (key)
+	if (myerr != err.NoErr) { return entry, nil, myerr }
+	_, myerror := rand.Read (entry.nonce[:])
+	if (myerror != nil) { return entry, nil, err.ErrFatal }
+
+	sealed := aead.Seal (nil, entry.nonce[:], data, chunkAdditionalData (blockid, i))
+	copy (entry.tag[:], sealed[len (data):])
+	return entry, sealed[:len (data)], err.NoErr
+}
+
+/**
+ * Decrypt a chunk
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	i	Chunk
+ * @param[in]	entry	Metadata of the chunk
+ * @param[in]	data	Encrypted data of the chunk, at least the size of the metadata
+ * @return	Content of the chunk, possibly shorter than the chunk (the rest is zeros)
+ * @return	System error handle; ErrFatal if the key is wrong or the data corrupted
+ */
+func (store *EncryptionStore) openChunk (namespace string, blockid uint64, i uint64, entry encryptionEntry, data []byte) ([]byte, err.SysError) {
+	if (entry.key == 0) { return nil, err.NoErr }
+	if (uint64 (len (data)) < entry.length) { return nil, invalidEncryptionMetadata (namespace, blockid) }
+	aead, myerr := store.getCipher (entry.key)
+	if (myerr != err.NoErr) {
+		fmt.Println ("ERROR: Cannot decrypt block", blockid, "of namespace", namespace)
+		return nil, myerr
+	}
+
+	sealed := make ([]byte, 0, entry.length + encryptionTagSize)
+	sealed = append (sealed, data[:entry.length]...)
+	sealed = append (sealed, entry.tag[:]...)
+	plain, myerror := aead.Open (sealed[:0], entry.nonce[:], sealed, chunkAdditionalData (blockid, i))
+	if (myerror != nil) {
+		fmt.Println ("ERROR: Cannot decrypt chunk", i, "of block", blockid, "of namespace", namespace, ": wrong key or corrupted data")
+		return nil, err.ErrFatal
+	}
+	return plain, err.NoErr
+}
+
+/**
+ * Read and decrypt consecutive chunks of a block
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	ns	Encryption of the namespace
+ * @param[in]	entries	Metadata of the chunks of the block
+ * @param[in]	first	First chunk
+ * @param[in]	last	Last chunk
+ * @param[in]	size	Size of the block
+ * @return	Content of each chunk
+ * @return	System error handle
+ */
+func (store *EncryptionStore) readChunks (namespace string, blockid uint64, ns *encryptedNamespace, entries []encryptionEntry, first uint64, last uint64, size uint64) ([][]byte, err.SysError) {
+	start := first * ns.chunk
+	stop := (last + 1) * ns.chunk
+	if (stop > size) { stop = size }
+	data := make ([]byte, stop - start)
+	n, myerr := store.store.Read (namespace, blockid, start, data)
+	if (myerr != err.NoErr) { return nil, myerr }
+	data = data[:n]
+
+	chunks := make ([][]byte, last - first + 1)
+	for i := first; i <= last; i++ {
+		var raw []byte
+		if ((i - first) * ns.chunk < uint64 (len (data))) { raw = data[(i - first) * ns.chunk:] }
+		chunks[i - first], myerr = store.openChunk (namespace, blockid, i, entries[i], raw)
+		if (myerr != err.NoErr) { return nil, myerr }
+	}
+	return chunks, err.NoErr
+}
+
+func (store *EncryptionStore) Open (basedir string) err.SysError {
+	return store.store.Open (basedir)
+}
+
+func (store *EncryptionStore) Close () err.SysError {
+	return store.store.Close ()
+}
+
+func (store *EncryptionStore) Read (namespace string, blockid uint64, offset uint64, buff []byte) (int, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return -1, myerr }
+	if (ns == nil) { return store.store.Read (namespace, blockid, offset, buff) }
+
+	size, myerr := store.store.Stat (namespace, blockid)
+	if (myerr != err.NoErr) { return -1, myerr }
+	if (offset >= size || len (buff) == 0) { return 0, err.NoErr }
+	end := offset + uint64 (len (buff))
+	if (end > size) { end = size }
+	entries, myerr := store.loadMetadata (namespace, ns, blockid, size)
+	if (myerr != err.NoErr) { return -1, myerr }
+
+	first := offset / ns.chunk
+	chunks, myerr := store.readChunks (namespace, blockid, ns, entries, first, (end - 1) / ns.chunk, size)
+	if (myerr != err.NoErr) { return -1, myerr }
+	for k, data := range chunks {
+		start := (first + uint64 (k)) * ns.chunk
+		lo, hi := start, start + ns.chunk
+		if (lo < offset) { lo = offset }
+		if (hi > end) { hi = end }
+		part := buff[lo - offset:hi - offset]
+		n := 0
+		if (lo - start < uint64 (len (data))) { n = copy (part, data[lo - start:]) }
+		for j := n; j < len (part); j++ { part[j] = 0 }
+	}
+	return int (end - offset), err.NoErr
+}
+
+func (store *EncryptionStore) Write (namespace string, blockid uint64, offset uint64, data []byte, mode Durability) (int, bool, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	if (ns == nil || len (data) == 0) { return store.store.Write (namespace, blockid, offset, data, mode) }
+
+	size, myerr := store.store.Stat (namespace, blockid)
+	if (myerr == err.ErrNotAvailable) {
+		size = 0
+	} else if (myerr != err.NoErr) {
+		return -1, false, myerr
+	}
+	entries, myerr := store.loadMetadata (namespace, ns, blockid, size)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	key, myerr := store.keys.CurrentKey (namespace)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+
+	end := offset + uint64 (len (data))
+	newsize := size
+	if (end > newsize) { newsize = end }
+	first := offset / ns.chunk
+	last := (end - 1) / ns.chunk
+
+	var sealed []byte
+	updates := make ([]encryptionEntry, 0, last - first + 1)
+	for i := first; i <= last; i++ {
+		start := i * ns.chunk
+		stop := start + ns.chunk
+		if (stop > newsize) { stop = newsize }
+		var content []byte
+		if (offset <= start && end >= stop) {
+			content = data[start - offset:stop - offset]
+		} else {
+			// Only the chunks partially overwritten need their current content
+			content = make ([]byte, stop - start)
+			if (i < uint64 (len (entries))) {
+				old, myerr := store.readChunks (namespace, blockid, ns, entries, i, i, size)
+				if (myerr != err.NoErr) { return -1, false, myerr }
+				copy (content, old[0])
+			}
+			lo := start
+			if (lo < offset) { lo = offset }
+			hi := stop
+			if (hi > end) { hi = end }
+			copy (content[lo - start:], data[lo - offset:hi - offset])
+		}
+		entry, encrypted, myerr := store.sealChunk (blockid, i, key, content)
+		if (myerr != err.NoErr) { return -1, false, myerr }
+		updates = append (updates, entry)
+		sealed = append (sealed, encrypted...)
+	}
+
+	_, synced, myerr := store.store.Write (namespace, blockid, first * ns.chunk, sealed, mode)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	metaSynced, myerr := store.saveMetadata (namespace, blockid, first, updates, mode)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	return len (data), synced && metaSynced, err.NoErr
+}
+
+func (store *EncryptionStore) Truncate (namespace string, blockid uint64, size uint64, mode Durability) err.SysError {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	if (ns == nil) { return store.store.Truncate (namespace, blockid, size, mode) }
+
+	oldsize, myerr := store.store.Stat (namespace, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	if (size < oldsize && size % ns.chunk != 0) {
+		// The data past the new size must not come back if the block grows again
+		entries, myerr := store.loadMetadata (namespace, ns, blockid, oldsize)
+		if (myerr != err.NoErr) { return myerr }
+		last := size / ns.chunk
+		length := size - last * ns.chunk
+		if (entries[last].length > length) {
+			chunks, myerr := store.readChunks (namespace, blockid, ns, entries, last, last, oldsize)
+			if (myerr != err.NoErr) { return myerr }
+			entry, sealed, myerr := store.sealChunk (blockid, last, entries[last].key, chunks[0][:length])
+			if (myerr != err.NoErr) { return myerr }
+			_, _, myerr = store.store.Write (namespace, blockid, last * ns.chunk, sealed, mode)
+			if (myerr != err.NoErr) { return myerr }
+			_, myerr = store.saveMetadata (namespace, blockid, last, []encryptionEntry {entry}, mode)
+			if (myerr != err.NoErr) { return myerr }
+		}
+	}
+
+	myerr = store.store.Truncate (namespace, blockid, size, mode)
+	if (myerr != err.NoErr) { return myerr }
+	// The chunks added by growing the block are zeros never written
+	count := (size + ns.chunk - 1) / ns.chunk
+	companion := encryptionNamespaceName (namespace)
+	myerr = store.store.Truncate (companion, blockid, count * encryptionEntrySize, mode)
+	if (myerr == err.ErrNotAvailable) {
+		_, _, myerr = store.store.Write (companion, blockid, 0, make ([]byte, count * encryptionEntrySize), mode)
+	}
+	return myerr
+}
+
+/**
+ * Re-encrypt the chunks of a block that are not encrypted with the current key of its
+ * namespace
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	Number of chunks re-encrypted
+ * @return	System error handle; ErrNotAvailable if the block does not exist
+ */
+func (store *EncryptionStore) rotateBlock (namespace string, blockid uint64, mode Durability) (uint64, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr || ns == nil) { return 0, myerr }
+	size, myerr := store.store.Stat (namespace, blockid)
+	if (myerr != err.NoErr) { return 0, myerr }
+	entries, myerr := store.loadMetadata (namespace, ns, blockid, size)
+	if (myerr != err.NoErr) { return 0, myerr }
+	key, myerr := store.keys.CurrentKey (namespace)
+	if (myerr != err.NoErr) { return 0, myerr }
+
+	var rotated uint64 = 0
+	for i, entry := range entries {
+		if (entry.key == 0 || entry.key == key) { continue }
+		chunks, myerr := store.readChunks (namespace, blockid, ns, entries, uint64 (i), uint64 (i), size)
+		if (myerr != err.NoErr) { return rotated, myerr }
+		update, sealed, myerr := store.sealChunk (blockid, uint64 (i), key, chunks[0])
+		if (myerr != err.NoErr) { return rotated, myerr }
+		_, _, myerr = store.store.Write (namespace, blockid, uint64 (i) * ns.chunk, sealed, mode)
+		if (myerr != err.NoErr) { return rotated, myerr }
+		_, myerr = store.saveMetadata (namespace, blockid, uint64 (i), []encryptionEntry {update}, mode)
+		if (myerr != err.NoErr) { return rotated, myerr }
+		rotated += 1
+	}
+	return rotated, err.NoErr
+}
+
+func (store *EncryptionStore) Delete (namespace string, blockid uint64) err.SysError {
+	myerr := store.store.Delete (namespace, blockid)
+	if (myerr != err.NoErr) { return myerr }
+
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr || ns == nil) { return myerr }
+	myerr = store.store.Delete (encryptionNamespaceName (namespace), blockid)
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	return myerr
+}
+
+func (store *EncryptionStore) List (namespace string) ([]uint64, err.SysError) {
+	return store.store.List (namespace)
+}
+
+func (store *EncryptionStore) Stat (namespace string, blockid uint64) (uint64, err.SysError) {
+	return store.store.Stat (namespace, blockid)
+}
+
+/**
+ * Get the amount of storage used by a block: its encrypted data and its metadata
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @return	Amount of storage used by the block
+ * @return	System error handle
+ */
+func (store *EncryptionStore) PhysicalSize (namespace string, blockid uint64) (uint64, err.SysError) {
+	size, myerr := store.store.Stat (namespace, blockid)
+	if (myerr != err.NoErr) { return 0, myerr }
+	size, myerr = physicalSize (store.store, namespace, blockid, size)
+	if (myerr != err.NoErr) { return 0, myerr }
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr || ns == nil) { return size, myerr }
+
+	companion := encryptionNamespaceName (namespace)
+	metaSize, myerr := store.store.Stat (companion, blockid)
+	if (myerr == err.ErrNotAvailable) { return size, err.NoErr }
+	if (myerr != err.NoErr) { return 0, myerr }
+	metaSize, myerr = physicalSize (store.store, companion, blockid, metaSize)
+	return size + metaSize, myerr
+}
+
+/**
+ * Copy a block to another namespace. The encrypted data and its metadata are cloned
+ * with the wrapped store when both namespaces are encrypted the same way, the
+ * additional data of the chunks not depending on the namespace; the block is decrypted
+ * and encrypted again otherwise.
+ * @param[in]	src	Namespace of the block to copy
+ * @param[in]	dst	Namespace of the copy
+ * @param[in]	blockid	Block id, the same in both namespaces
+ * @param[in]	mode	Durability policy of the copy
+ * @return	System error handle; ErrNotAvailable if the block to copy does not exist
+ */
+func (store *EncryptionStore) CloneBlock (src string, dst string, blockid uint64, mode Durability) err.SysError {
+	from, myerr := store.getNamespace (src)
+	if (myerr != err.NoErr) { return myerr }
+	to, myerr := store.getNamespace (dst)
+	if (myerr != err.NoErr) { return myerr }
+	if (from == nil && to == nil) { return cloneBlock (store.store, src, dst, blockid, mode) }
+	if (from == nil || to == nil || *from != *to) { return copyBlock (store, src, dst, blockid, mode) }
+	return cloneBlockWithCompanion (store.store, src, dst, encryptionNamespaceName, blockid, mode)
+}
+
+func (store *EncryptionStore) Flush (namespace string) err.SysError {
+	myerr := store.store.Flush (namespace)
+	ns, nserr := store.getNamespace (namespace)
+	if (nserr != err.NoErr || ns == nil) { return myerr }
+	if (store.store.Flush (encryptionNamespaceName (namespace)) != err.NoErr) { return err.ErrFatal }
+	return myerr
+}
+
+func (store *EncryptionStore) SyncDirty (match func (namespace string) bool) int {
+	return store.store.SyncDirty (func (namespace string) bool { return match (strings.TrimSuffix (namespace, encryptionSuffix)) })
+}
+
+func (store *EncryptionStore) CreateNamespace (namespace string, desc NamespaceDescriptor) (NamespaceDescriptor, err.SysError) {
+	if (strings.HasSuffix (namespace, encryptionSuffix)) { return desc, err.ErrNotAvailable }
+	encrypted, myerr := namespaceEncrypted (desc)
+	if (myerr != err.NoErr) { return desc, err.ErrNotAvailable }
+	if (encrypted && store.keys == nil) {
+		fmt.Println ("No key provider to encrypt namespace", namespace)
+		return desc, err.ErrNotAvailable
+	}
+	if (encrypted && !validStoreName (encryptionNamespaceName (namespace))) {
+		fmt.Println ("Namespace name too long to encrypt the blocks:", namespace)
+		return desc, err.ErrNotAvailable
+	}
+
+	desc, myerr = store.store.CreateNamespace (namespace, desc)
+	if (myerr != err.NoErr) { return desc, myerr }
+	_, myerr = store.getNamespace (namespace)
+	return desc, myerr
+}
+
+func (store *EncryptionStore) GetNamespace (namespace string) (NamespaceDescriptor, err.SysError) {
+	if (strings.HasSuffix (namespace, encryptionSuffix)) { return NamespaceDescriptor {}, err.ErrNotAvailable }
+	return store.store.GetNamespace (namespace)
+}
+
+func (store *EncryptionStore) ListNamespaces () ([]string, err.SysError) {
+	names, myerr := store.store.ListNamespaces ()
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	var visible []string
+	for _, name := range names {
+		if (!strings.HasSuffix (name, encryptionSuffix)) { visible = append (visible, name) }
+	}
+	return visible, err.NoErr
+}
+
+func (store *EncryptionStore) DeleteNamespace (namespace string) err.SysError {
+	if (strings.HasSuffix (namespace, encryptionSuffix)) { return err.ErrNotAvailable }
+
+	store.forgetNamespace (namespace)
+	myerr := store.store.DeleteNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = store.store.DeleteNamespace (encryptionNamespaceName (namespace))
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	return myerr
+}
+
+func (store *EncryptionStore) RenameNamespace (oldname string, newname string) err.SysError {
+	if (strings.HasSuffix (oldname, encryptionSuffix) || strings.HasSuffix (newname, encryptionSuffix)) { return err.ErrNotAvailable }
+	oldCompanion := encryptionNamespaceName (oldname)
+	newCompanion := encryptionNamespaceName (newname)
+	if (!validStoreName (newCompanion)) { return err.ErrNotAvailable }
+
+	store.forgetNamespace (oldname)
+	store.forgetNamespace (newname)
+	myerr := store.store.RenameNamespace (oldname, newname)
+	if (myerr != err.NoErr) { return myerr }
+
+	// Left over by a namespace that was not fully deleted
+	_, myerr = store.store.GetNamespace (newCompanion)
+	if (myerr == err.NoErr) { store.store.DeleteNamespace (newCompanion) }
+	_, myerr = store.store.GetNamespace (oldCompanion)
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	myerr = store.store.RenameNamespace (oldCompanion, newCompanion)
+	if (myerr != err.NoErr) {
+		// The blocks are unreadable without their metadata
+		store.store.RenameNamespace (newname, oldname)
+	}
+	return myerr
+}
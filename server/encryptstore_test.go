@@ -0,0 +1,263 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"time")
+
+import err "github.com/gvallee/syserror"
+
+const testKey1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+const testKey2 = "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"
+
+func writeKeyFile (path string, content string) {
+	myerror := os.WriteFile (path, []byte (content), 0600)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot write keyfile") }
+}
+
+func waitRotation (myserver *Server, name string) KeyRotation {
+	for i := 0; i < 500; i++ {
+		rotation, myerr := KeyRotationStatus (myserver, name)
+		if (myerr == err.NoErr && !rotation.Running) { return rotation }
+		time.Sleep (10 * time.Millisecond)
+	}
+	log.Fatal ("FATAL ERROR: Key rotation did not complete")
+	return KeyRotation {}
+}
+
+func TestKeyFile (t *testing.T) {
+	validTestPath := "/tmp/ds_test_keyfile/"
+	os.RemoveAll (validTestPath)
+	myerror := os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create directory") }
+	defer os.RemoveAll (validTestPath)
+	path := validTestPath + "keys"
+
+	fmt.Print ("Testing keyfiles... ")
+	writeKeyFile (path, "# Keys\n1 " + testKey1 + "\n\n2 " + testKey2 + "\n")
+	kf, myerror := LoadKeyFile (path)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot load keyfile: ", myerror) }
+	current, _ := kf.CurrentKey ("default")
+	key, myerr := kf.Key (1)
+	if (current != 2 || myerr != err.NoErr || len (key) != 32 || key[1] != 1) { log.Fatal ("FATAL ERROR: Invalid keys") }
+	_, myerr = kf.Key (3)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Unknown key returned") }
+
+	for _, invalid := range []string {"", "0 " + testKey1, "1 0011", "1 " + testKey1 + "\n1 " + testKey2, "x " + testKey1, "1"} {
+		writeKeyFile (path, invalid)
+		if (kf.Reload () == nil) { log.Fatal ("FATAL ERROR: Invalid keyfile accepted: ", invalid) }
+	}
+	current, _ = kf.CurrentKey ("default")
+	if (current != 2) { log.Fatal ("FATAL ERROR: Keys lost by an invalid keyfile") }
+	fmt.Println ("PASS")
+}
+
+func TestEncryptionStore (t *testing.T) {
+	validTestPath := "/tmp/ds_test_encryptstore/"
+	os.RemoveAll (validTestPath)
+	myerror := os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create directory") }
+	defer os.RemoveAll (validTestPath)
+	path := validTestPath + "keys"
+	writeKeyFile (path, "1 " + testKey1 + "\n")
+	kf, _ := LoadKeyFile (path)
+
+	fmt.Print ("Testing encrypted namespaces... ")
+	mem := NewMemoryStore (0)
+	store := NewEncryptionStore (mem, kf)
+	desc := NamespaceDescriptor {FormatVersion: FormatVersion, BlockSize: 8192}
+	_, myerr := store.CreateNamespace ("plain", desc)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	desc.Encryption = EncryptionAESGCM
+	desc.EncryptionChunkSize = 1024
+	_, myerr = store.CreateNamespace ("secret", desc)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	_, myerr = NewEncryptionStore (mem, nil).CreateNamespace ("nokeys", desc)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Encrypted namespace created without keys") }
+	_, myerr = store.CreateNamespace ("x.enc", NamespaceDescriptor {FormatVersion: FormatVersion, BlockSize: 8192})
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Created a reserved namespace") }
+	names, _ := store.ListNamespaces ()
+	if (len (names) != 2) { log.Fatal ("FATAL ERROR: Invalid list of namespaces: ", names) }
+
+	text := bytes.Repeat ([]byte ("checkpoint data "), 512)
+	_, _, myerr = store.Write ("secret", 1, 100, text[:3000], DurabilityPerWrite)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	stored := make ([]byte, 4096)
+	n, _ := mem.Read ("secret", 1, 0, stored)
+	if (n != 3100 || bytes.Contains (stored[:n], []byte ("checkpoint"))) { log.Fatal ("FATAL ERROR: Block stored in plain text") }
+	physical, _ := store.PhysicalSize ("secret", 1)
+	if (physical != 3100 + 4 * encryptionEntrySize) { log.Fatal ("FATAL ERROR: Invalid physical size: ", physical) }
+	buff := make ([]byte, 4096)
+	rs, myerr := store.Read ("secret", 1, 0, buff)
+	if (rs != 3100 || myerr != err.NoErr || buff[99] != 0 || !bytes.Equal (buff[100:3100], text[:3000])) { log.Fatal ("FATAL ERROR: Invalid data") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing random accesses to encrypted blocks... ")
+	random := rand.New (rand.NewSource (42))
+	var model []byte
+	for op := 0; op < 300; op++ {
+		offset := uint64 (random.Intn (8192))
+		length := random.Intn (3000)
+		if (offset + uint64 (length) > 8192) { length = int (8192 - offset) }
+		data := make ([]byte, length)
+		random.Read (data)
+		if (random.Intn (4) == 0) {
+			myerr = store.Truncate ("secret", 7, offset, DurabilityNone)
+			if (myerr != err.NoErr && (model != nil || myerr != err.ErrNotAvailable)) { log.Fatal ("FATAL ERROR: Cannot truncate block") }
+			if (model == nil) { continue }
+			if (offset < uint64 (len (model))) {
+				model = model[:offset]
+			} else {
+				model = append (model, make ([]byte, offset - uint64 (len (model)))...)
+			}
+		} else {
+			_, _, myerr = store.Write ("secret", 7, offset, data, DurabilityNone)
+			if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+			if (model == nil) { model = []byte {} }
+			if (offset + uint64 (length) > uint64 (len (model))) { model = append (model, make ([]byte, offset + uint64 (length) - uint64 (len (model)))...) }
+			copy (model[offset:], data)
+		}
+
+		buff = make ([]byte, 8192)
+		rs, myerr = store.Read ("secret", 7, 0, buff)
+		if (myerr != err.NoErr || rs != len (model) || !bytes.Equal (buff[:rs], model)) { log.Fatal ("FATAL ERROR: Invalid data after operation ", op) }
+		rs, myerr = store.Read ("secret", 7, offset, buff[:100])
+		if (myerr != err.NoErr || (offset < uint64 (len (model)) && !bytes.Equal (buff[:rs], model[offset:offset + uint64 (rs)]))) { log.Fatal ("FATAL ERROR: Invalid partial read") }
+	}
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing tampering with encrypted blocks... ")
+	_, _, myerr = store.Write ("secret", 2, 0, text[:2048], DurabilityNone)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	mem.Write ("secret", 2, 1500, []byte {'x'}, DurabilityNone)
+	_, myerr = store.Read ("secret", 2, 0, buff[:100])
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot read intact chunk") }
+	_, myerr = store.Read ("secret", 2, 1024, buff[:100])
+	if (myerr != err.ErrFatal) { log.Fatal ("FATAL ERROR: Tampered chunk returned") }
+	// Chunks cannot be moved to another block
+	mem.Read ("secret", 1, 0, stored[:1024])
+	mem.Write ("secret", 2, 0, stored[:1024], DurabilityNone)
+	meta := make ([]byte, encryptionEntrySize)
+	mem.Read (encryptionNamespaceName ("secret"), 1, 0, meta)
+	mem.Write (encryptionNamespaceName ("secret"), 2, 0, meta, DurabilityNone)
+	_, myerr = store.Read ("secret", 2, 0, buff[:100])
+	if (myerr != err.ErrFatal) { log.Fatal ("FATAL ERROR: Moved chunk returned") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing reading encrypted blocks with the wrong key... ")
+	writeKeyFile (path, "1 " + testKey2 + "\n")
+	wrong, _ := LoadKeyFile (path)
+	_, myerr = NewEncryptionStore (mem, wrong).Read ("secret", 1, 0, buff)
+	if (myerr != err.ErrFatal) { log.Fatal ("FATAL ERROR: Block decrypted with the wrong key") }
+	writeKeyFile (path, "2 " + testKey2 + "\n")
+	missing, _ := LoadKeyFile (path)
+	_, myerr = NewEncryptionStore (mem, missing).Read ("secret", 1, 0, buff)
+	if (myerr != err.ErrFatal) { log.Fatal ("FATAL ERROR: Block decrypted without its key") }
+	_, myerr = NewEncryptionStore (mem, nil).Read ("secret", 1, 0, buff)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Block read without keys") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing re-encrypting blocks with a new key... ")
+	writeKeyFile (path, "1 " + testKey1 + "\n2 " + testKey2 + "\n")
+	kf.Reload ()
+	rotated, myerr := store.rotateBlock ("secret", 1, DurabilityNone)
+	if (rotated != 4 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot re-encrypt block: ", rotated) }
+	rotated, _ = store.rotateBlock ("secret", 1, DurabilityNone)
+	if (rotated != 0) { log.Fatal ("FATAL ERROR: Block re-encrypted twice") }
+	rs, myerr = NewEncryptionStore (mem, missing).Read ("secret", 1, 0, buff)
+	if (rs != 3100 || myerr != err.NoErr || !bytes.Equal (buff[100:3100], text[:3000])) { log.Fatal ("FATAL ERROR: Invalid data after re-encryption") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing deleting and renaming encrypted namespaces... ")
+	if (store.Delete ("secret", 2) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete block") }
+	_, myerr = mem.Stat (encryptionNamespaceName ("secret"), 2)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Encryption metadata left behind") }
+	if (store.RenameNamespace ("secret", "renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot rename namespace") }
+	rs, myerr = store.Read ("renamed", 1, 0, buff)
+	if (rs != 3100 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot read renamed namespace") }
+	if (store.DeleteNamespace ("renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	_, myerr = mem.GetNamespace (encryptionNamespaceName ("renamed"))
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Encryption metadata left behind") }
+	fmt.Println ("PASS")
+}
+
+func TestEncryptionServer (t *testing.T) {
+	validTestPath := "/tmp/ds_test_encryption/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+	path := "/tmp/ds_test_encryption.keys"
+	defer os.Remove (path)
+	writeKeyFile (path, "1 " + testKey1 + "\n")
+	kf, _ := LoadKeyFile (path)
+
+	fmt.Print ("Testing a server with encryption... ")
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 65536
+	cfg.URL = "127.0.0.1:8910"
+	cfg.Checksum = ChecksumCRC32C
+	cfg.Compression = CompressionLZ4
+	cfg.Encrypt = true
+	if (ServerInitWithConfig (&cfg) != nil) { log.Fatal ("FATAL ERROR: Encrypting server created without keys") }
+	cfg.Keys = kf
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+
+	text := bytes.Repeat ([]byte ("checkpoint data "), 4096)
+	_, myerr := BlockWrite (myserver, "default", 3, 0, text[:40000])
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	stats, _ := NamespaceStat (myserver, "default")
+	if (stats.BytesUsed != 40000 || stats.PhysicalBytes >= 20000) { log.Fatal ("FATAL ERROR: Block not compressed before encryption: ", stats) }
+	if (NamespaceInitWithEncryption ("clear", myserver, 0, false) == nil) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	if (NamespaceInitWithEncryption ("clear", myserver, 0, true) != nil) { log.Fatal ("FATAL ERROR: Encryption of a namespace changed") }
+	BlockWrite (myserver, "clear", 0, 0, text[:1000])
+	if (NamespaceRotateKey (myserver, "clear") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Re-encrypted a namespace not encrypted") }
+	names, _ := NamespaceList (myserver)
+	if (len (names) != 2) { log.Fatal ("FATAL ERROR: Encryption metadata visible as namespaces: ", names) }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing key rotation... ")
+	for id := uint64 (10); id < 20; id++ { BlockWrite (myserver, "default", id, 0, text[id:id + 5000]) }
+	writeKeyFile (path, "1 " + testKey1 + "\n2 " + testKey2 + "\n")
+	if (NamespaceRotateKey (myserver, "default") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start key rotation") }
+	rotation := waitRotation (myserver, "default")
+	if (rotation.Blocks != 11 || rotation.Chunks == 0 || rotation.Errors != 0) { log.Fatal ("FATAL ERROR: Invalid key rotation: ", rotation) }
+	if (myserver.Stop (context.Background ()) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot stop server") }
+
+	// The old key is not needed anymore
+	writeKeyFile (path, "2 " + testKey2 + "\n")
+	cfg.Keys, _ = LoadKeyFile (path)
+	cfg.Encrypt = false
+	myserver = ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	rs, buff, myerr := BlockRead (myserver, "default", 3, 0, 65536)
+	if (rs != 40000 || myerr != err.NoErr || !bytes.Equal (buff[:rs], text[:40000])) { log.Fatal ("FATAL ERROR: Invalid data after key rotation") }
+	rs, buff, myerr = BlockRead (myserver, "default", 15, 0, 65536)
+	if (rs != 5000 || myerr != err.NoErr || !bytes.Equal (buff[:rs], text[15:5015])) { log.Fatal ("FATAL ERROR: Invalid data after key rotation") }
+	if (myserver.Stop (context.Background ()) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot stop server") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing a server with the wrong keys... ")
+	writeKeyFile (path, "2 " + testKey1 + "\n")
+	cfg.Keys, _ = LoadKeyFile (path)
+	myserver = ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+	_, _, myerr = BlockRead (myserver, "default", 3, 0, 65536)
+	if (myerr == err.NoErr) { log.Fatal ("FATAL ERROR: Block read with the wrong key") }
+	rs, buff, myerr = BlockRead (myserver, "clear", 0, 0, 65536)
+	if (rs != 1000 || myerr != err.NoErr || !bytes.Equal (buff[:rs], text[:1000])) { log.Fatal ("FATAL ERROR: Namespace not encrypted unreadable") }
+	fmt.Println ("PASS")
+}
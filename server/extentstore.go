@@ -0,0 +1,766 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("os"
+	"io"
+	"fmt"
+	"sort"
+	"sync"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"encoding/binary"
+	"path/filepath")
+
+import err "github.com/gvallee/syserror"
+
+// Maximum size of a container file of the extent layout
+const ExtentContainerSize = 1024 * 1024 * 1024
+
+// Number of free slots from which the containers of a namespace are compacted
+const extentCompactThreshold = 1024
+
+// Names of the files of a namespace with the extent layout
+const (
+	extentIndexName = "extents.index"
+	extentContainerPrefix = "extents."
+)
+
+// Size of a record of the index: block id, slot + 1 (0 for a deleted block) and size
+const extentRecordSize = 24
+
+/**
+ * Location of a block: its slot in the containers and the size of its data
+ */
+type extent struct {
+	slot	uint64
+	size	uint64
+}
+
+/**
+ * Namespace with the extent layout. Each block is stored in a slot of the size of a
+ * block; the slots are packed in container files. The index of the blocks is an
+ * append-only log of records, rewritten when the namespace is compacted.
+ * Invariant: the bytes of a slot past the size of its block may hold stale data and
+ * are zeroed before the block grows over them.
+ */
+type extentNamespace struct {
+	// Block operations share it, the compaction moves blocks around and takes it exclusively
+	io	sync.RWMutex
+
+	lock	sync.Mutex	// Protects the fields below
+	path	string
+	desc	NamespaceDescriptor
+	slotsPerContainer	uint64
+	index	map[uint64]*extent
+	free	[]uint64	// Free slots below next, sorted
+	next	uint64		// First slot never used
+	containers	map[uint64]*os.File
+	log	*os.File
+	records	uint64		// Number of records in the log
+	dirty	bool		// Data or records not synced yet
+	failed	bool		// A background sync failed since the last flush
+}
+
+/**
+ * Block store packing the blocks of each namespace in a few large container files
+ * instead of one file per block, for namespaces with many small blocks. Namespaces are
+ * directories of the basedir, as with the file store, and are loaded upon first use.
+ */
+type ExtentStore struct {
+	basedir		string
+	lock		sync.Mutex
+	namespaces	map[string]*extentNamespace
+}
+
+/**
+ * Create an extent store
+ * @return	Pointer to a new ExtentStore structure
+ */
+func NewExtentStore () *ExtentStore {
+	store := new (ExtentStore)
+	store.namespaces = make (map[string]*extentNamespace)
+	return store
+}
+
+func (store *ExtentStore) Open (basedir string) err.SysError {
+	_, myerror := os.Stat (basedir)
+	if (myerror != nil) { return err.ErrNotAvailable }
+
+	store.basedir = basedir
+	return err.NoErr
+}
+
+func (store *ExtentStore) Close () err.SysError {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	status := err.NoErr
+	for name, ns := range store.namespaces {
+		if (ns.close () != err.NoErr) { status = err.ErrFatal }
+		delete (store.namespaces, name)
+	}
+	return status
+}
+
+func putRecord (buff []byte, blockid uint64, slot uint64, size uint64) {
+	binary.LittleEndian.PutUint64 (buff[0:8], blockid)
+	binary.LittleEndian.PutUint64 (buff[8:16], slot)
+	binary.LittleEndian.PutUint64 (buff[16:24], size)
+}
+
+/**
+ * Load a namespace with the extent layout, replaying its index.
+ * @param[in]	path	Path to the namespace's directory
+ * @param[in]	desc	Descriptor of the namespace
+ * @return	Namespace
+ * @return	System error handle
+ */
+func loadExtentNamespace (path string, desc NamespaceDescriptor) (*extentNamespace, err.SysError) {
+	ns := new (extentNamespace)
+	ns.path = path
+	ns.desc = desc
+	ns.slotsPerContainer = ExtentContainerSize / desc.BlockSize
+	if (ns.slotsPerContainer == 0) { ns.slotsPerContainer = 1 }
+	ns.index = make (map[uint64]*extent)
+	ns.containers = make (map[uint64]*os.File)
+
+	indexPath := filepath.Join (path, extentIndexName)
+	content, myerror := ioutil.ReadFile (indexPath)
+	if (myerror != nil && !os.IsNotExist (myerror)) {
+		fmt.Println ("Cannot read index of", path, ":", myerror.Error())
+		return nil, err.ErrFatal
+	}
+
+	// A record cut short by a crash is ignored, the write it describes never completed
+	used := make (map[uint64]uint64)
+	for len (content) >= extentRecordSize {
+		blockid := binary.LittleEndian.Uint64 (content[0:8])
+		slot := binary.LittleEndian.Uint64 (content[8:16])
+		size := binary.LittleEndian.Uint64 (content[16:24])
+		content = content[extentRecordSize:]
+		ns.records += 1
+
+		old, ok := ns.index[blockid]
+		if (ok) {
+			delete (used, old.slot)
+			delete (ns.index, blockid)
+		}
+		if (slot == 0) { continue }
+		if (size > desc.BlockSize) {
+			fmt.Println ("Invalid index for", path, ": block", blockid, "is too big")
+			return nil, err.ErrFatal
+		}
+		other, taken := used[slot - 1]
+		if (taken && other != blockid) {
+			fmt.Println ("Invalid index for", path, ": blocks", blockid, "and", other, "share a slot")
+			return nil, err.ErrFatal
+		}
+		used[slot - 1] = blockid
+		ns.index[blockid] = &extent {slot - 1, size}
+		if (slot > ns.next) { ns.next = slot }
+	}
+	for slot := uint64 (0); slot < ns.next; slot++ {
+		_, ok := used[slot]
+		if (!ok) { ns.free = append (ns.free, slot) }
+	}
+
+	ns.log, myerror = os.OpenFile (indexPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if (myerror != nil) {
+		fmt.Println ("Cannot open index of", path, ":", myerror.Error())
+		return nil, err.ErrFatal
+	}
+	if (len (content) != 0) {
+		// Drop the partial record so the next ones are aligned
+		myerror = ns.log.Truncate (int64 (ns.records * extentRecordSize))
+		if (myerror != nil) { ns.log.Close(); return nil, err.ErrFatal }
+	}
+	return ns, err.NoErr
+}
+
+/**
+ * Get a namespace, loading it if needed
+ * @param[in]	name	Namespace's name
+ * @return	Namespace
+ * @return	System error handle
+ */
+func (store *ExtentStore) getNamespace (name string) (*extentNamespace, err.SysError) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ns, ok := store.namespaces[name]
+	if (ok) { return ns, err.NoErr }
+
+	path, myerr := namespacePath (store.basedir, name)
+	if (myerr != err.NoErr) { return nil, myerr }
+	desc, myerr := readNamespaceDescriptor (path)
+	if (myerr != err.NoErr) { return nil, myerr }
+	if (namespaceLayout (desc) != LayoutExtent) { return nil, wrongLayout (name, desc) }
+
+	ns, myerr = loadExtentNamespace (path, desc)
+	if (myerr != err.NoErr) { return nil, myerr }
+	store.namespaces[name] = ns
+	return ns, err.NoErr
+}
+
+/**
+ * Forget a loaded namespace, e.g., before it is deleted or renamed
+ * @param[in]	name	Namespace's name
+ * @return	System error handle
+ */
+func (store *ExtentStore) unloadNamespace (name string) err.SysError {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ns, ok := store.namespaces[name]
+	if (!ok) { return err.NoErr }
+	delete (store.namespaces, name)
+	return ns.close ()
+}
+
+/**
+ * Get the container file and offset of a slot, opening the container if needed
+ * @param[in]	slot	Slot
+ * @return	Container file
+ * @return	Offset of the slot in the container
+ * @return	System error handle
+ */
+func (ns *extentNamespace) container (slot uint64) (*os.File, int64, err.SysError) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	c := slot / ns.slotsPerContainer
+	offset := int64 ((slot % ns.slotsPerContainer) * ns.desc.BlockSize)
+	f, ok := ns.containers[c]
+	if (ok) { return f, offset, err.NoErr }
+
+	path := filepath.Join (ns.path, extentContainerPrefix + strconv.FormatUint (c, 10))
+	f, myerror := os.OpenFile (path, os.O_RDWR|os.O_CREATE, 0600)
+	if (myerror != nil) {
+		fmt.Println ("Cannot open container", path, ":", myerror.Error())
+		return nil, 0, err.ErrFatal
+	}
+	ns.containers[c] = f
+	return f, offset, err.NoErr
+}
+
+/**
+ * Allocate the lowest free slot. Must be called with the lock of the namespace held.
+ */
+func (ns *extentNamespace) allocLocked () uint64 {
+	if (len (ns.free) > 0) {
+		slot := ns.free[0]
+		ns.free = ns.free[1:]
+		return slot
+	}
+	ns.next += 1
+	return ns.next - 1
+}
+
+/**
+ * Give a slot back. Must be called with the lock of the namespace held.
+ */
+func (ns *extentNamespace) releaseLocked (slot uint64) {
+	i := sort.Search (len (ns.free), func (i int) bool { return ns.free[i] >= slot })
+	ns.free = append (ns.free, 0)
+	copy (ns.free[i + 1:], ns.free[i:])
+	ns.free[i] = slot
+}
+
+/**
+ * Append a record to the index. Must be called with the lock of the namespace held.
+ * @param[in]	blockid	Block id
+ * @param[in]	ext	New location of the block; nil if the block is deleted
+ * @return	System error handle
+ */
+func (ns *extentNamespace) appendRecordLocked (blockid uint64, ext *extent) err.SysError {
+	record := make ([]byte, extentRecordSize)
+	if (ext == nil) {
+		putRecord (record, blockid, 0, 0)
+	} else {
+		putRecord (record, blockid, ext.slot + 1, ext.size)
+	}
+	_, myerror := ns.log.Write (record)
+	if (myerror != nil) {
+		fmt.Println ("Cannot update index of", ns.path, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	ns.records += 1
+	return err.NoErr
+}
+
+/**
+ * Sync the containers and the index of the namespace
+ * @return	System error handle
+ */
+func (ns *extentNamespace) sync () err.SysError {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	ns.dirty = false
+	status := err.NoErr
+	for _, f := range ns.containers {
+		if (f.Sync () != nil) { status = err.ErrFatal }
+	}
+	if (ns.log.Sync () != nil) { status = err.ErrFatal }
+	if (status != err.NoErr) { fmt.Println ("ERROR: Cannot sync namespace", ns.path) }
+	return status
+}
+
+/**
+ * Sync and close the files of the namespace
+ * @return	System error handle
+ */
+func (ns *extentNamespace) close () err.SysError {
+	status := err.NoErr
+	if (ns.dirty && ns.sync () != err.NoErr) { status = err.ErrFatal }
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	for c, f := range ns.containers {
+		if (f.Close () != nil) { status = err.ErrFatal }
+		delete (ns.containers, c)
+	}
+	if (ns.log.Close () != nil) { status = err.ErrFatal }
+	return status
+}
+
+/**
+ * Sync what must be synced after an update, depending on the durability policy
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	true if the update reached stable storage; false otherwise
+ * @return	System error handle
+ */
+func (ns *extentNamespace) commit (mode Durability) (bool, err.SysError) {
+	if (mode == DurabilityNone) { return false, err.NoErr }
+	if (mode != DurabilityPerWrite) {
+		ns.lock.Lock()
+		ns.dirty = true
+		ns.lock.Unlock()
+		return false, err.NoErr
+	}
+	myerr := ns.sync ()
+	return myerr == err.NoErr, myerr
+}
+
+func writeZeros (f *os.File, offset int64, size uint64) error {
+	zeros := make ([]byte, 64 * 1024)
+	for size > 0 {
+		n := uint64 (len (zeros))
+		if (n > size) { n = size }
+		_, myerror := f.WriteAt (zeros[:n], offset)
+		if (myerror != nil) { return myerror }
+		offset += int64 (n)
+		size -= n
+	}
+	return nil
+}
+
+func (ns *extentNamespace) read (blockid uint64, offset uint64, buff []byte) (int, err.SysError) {
+	ns.lock.Lock()
+	ext, ok := ns.index[blockid]
+	var cur extent
+	if (ok) { cur = *ext }
+	ns.lock.Unlock()
+	if (!ok) { return -1, err.ErrNotAvailable }
+
+	if (offset >= cur.size) { return 0, err.NoErr }
+	valid := cur.size - offset
+	if (valid > uint64 (len (buff))) { valid = uint64 (len (buff)) }
+
+	f, base, myerr := ns.container (cur.slot)
+	if (myerr != err.NoErr) { return -1, myerr }
+	_, myerror := f.ReadAt (buff[:valid], base + int64 (offset))
+	if (myerror != nil && myerror != io.EOF) {
+		fmt.Println ("ERROR: Cannot read block", blockid, ":", myerror.Error())
+		return -1, err.ErrFatal
+	}
+	return int (valid), err.NoErr
+}
+
+/**
+ * Change the data or size of a block, creating it if needed.
+ * @param[in]	blockid	Block id
+ * @param[in]	offset	Offset of the data to write
+ * @param[in]	data	Data to write; nil to truncate the block to offset
+ * @param[in]	create	Whether the block can be created
+ * @return	Amount of data written
+ * @return	System error handle
+ */
+func (ns *extentNamespace) update (blockid uint64, offset uint64, data []byte, create bool) (int, err.SysError) {
+	ns.lock.Lock()
+	ext, exists := ns.index[blockid]
+	var cur extent
+	if (exists) {
+		cur = *ext
+	} else if (create) {
+		cur.slot = ns.allocLocked ()
+	} else {
+		ns.lock.Unlock()
+		return -1, err.ErrNotAvailable
+	}
+	ns.lock.Unlock()
+
+	newsize := offset + uint64 (len (data))
+	if (data != nil && newsize < cur.size) { newsize = cur.size }
+
+	f, base, myerr := ns.container (cur.slot)
+	var myerror error = nil
+	if (myerr == err.NoErr) {
+		// The slot may hold stale data past the current end of the block
+		if (offset > cur.size) { myerror = writeZeros (f, base + int64 (cur.size), offset - cur.size) }
+		if (myerror == nil && data != nil) { _, myerror = f.WriteAt (data, base + int64 (offset)) }
+		if (myerror != nil) { myerr = err.ErrFatal }
+	}
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if (myerr != err.NoErr) {
+		if (myerror != nil) { fmt.Println ("Cannot write block", blockid, ":", myerror.Error()) }
+		if (!exists) { ns.releaseLocked (cur.slot) }
+		return -1, myerr
+	}
+	if (!exists || newsize != cur.size) {
+		newext := &extent {cur.slot, newsize}
+		myerr = ns.appendRecordLocked (blockid, newext)
+		if (myerr != err.NoErr) {
+			if (!exists) { ns.releaseLocked (cur.slot) }
+			return -1, myerr
+		}
+		ns.index[blockid] = newext
+	}
+	return len (data), err.NoErr
+}
+
+func (ns *extentNamespace) remove (blockid uint64) err.SysError {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	ext, ok := ns.index[blockid]
+	if (!ok) { return err.ErrNotAvailable }
+	myerr := ns.appendRecordLocked (blockid, nil)
+	if (myerr != err.NoErr) { return myerr }
+	delete (ns.index, blockid)
+	ns.releaseLocked (ext.slot)
+	return err.NoErr
+}
+
+/**
+ * Rewrite the index with only the live blocks. Must be called with both locks of the
+ * namespace held.
+ * @return	System error handle
+ */
+func (ns *extentNamespace) checkpointLocked () err.SysError {
+	indexPath := filepath.Join (ns.path, extentIndexName)
+	tmp := indexPath + ".tmp"
+	content := make ([]byte, 0, len (ns.index) * extentRecordSize)
+	record := make ([]byte, extentRecordSize)
+	for blockid, ext := range ns.index {
+		putRecord (record, blockid, ext.slot + 1, ext.size)
+		content = append (content, record...)
+	}
+
+	f, myerror := os.OpenFile (tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if (myerror == nil) {
+		_, myerror = f.Write (content)
+		if (myerror == nil) { myerror = f.Sync() }
+		closeerr := f.Close()
+		if (myerror == nil) { myerror = closeerr }
+	}
+	if (myerror == nil) { myerror = os.Rename (tmp, indexPath) }
+	if (myerror != nil) {
+		fmt.Println ("Cannot rewrite index of", ns.path, ":", myerror.Error())
+		os.Remove (tmp)
+		return err.ErrFatal
+	}
+
+	// The old log is gone, further records go to the new one
+	ns.log.Close()
+	ns.log, myerror = os.OpenFile (indexPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if (myerror != nil) { return err.ErrFatal }
+	ns.records = uint64 (len (ns.index))
+	return err.NoErr
+}
+
+/**
+ * Move the blocks stored past the number of blocks to the free slots below, so the
+ * slots are contiguous, then release the space of the unused slots and rewrite the
+ * index. The block operations on the namespace wait until the compaction is done.
+ * @return	System error handle
+ */
+func (ns *extentNamespace) compact () err.SysError {
+	ns.io.Lock()
+	defer ns.io.Unlock()
+
+	live := uint64 (len (ns.index))
+	buff := make ([]byte, ns.desc.BlockSize)
+	for blockid, ext := range ns.index {
+		if (ext.slot < live) { continue }
+
+		// There are as many free slots below live as blocks above it
+		ns.lock.Lock()
+		slot := ns.allocLocked ()
+		ns.lock.Unlock()
+
+		src, srcoff, myerr := ns.container (ext.slot)
+		if (myerr != err.NoErr) { return myerr }
+		dst, dstoff, myerr := ns.container (slot)
+		if (myerr != err.NoErr) { return myerr }
+		_, myerror := src.ReadAt (buff[:ext.size], srcoff)
+		if (myerror == io.EOF) { myerror = nil }
+		if (myerror == nil) { _, myerror = dst.WriteAt (buff[:ext.size], dstoff) }
+		if (myerror != nil) {
+			fmt.Println ("Cannot move block", blockid, ":", myerror.Error())
+			return err.ErrFatal
+		}
+		ns.lock.Lock()
+		ns.releaseLocked (ext.slot)
+		ext.slot = slot
+		ns.lock.Unlock()
+	}
+
+	// The moved blocks must be on disk before the index points to them
+	if (ns.sync () != err.NoErr) { return err.ErrFatal }
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	myerr := ns.checkpointLocked ()
+	if (myerr != err.NoErr) { return myerr }
+
+	// Release the space of the slots past the blocks
+	ns.free = nil
+	ns.next = live
+	lastContainer := live / ns.slotsPerContainer
+	entries, myerror := ioutil.ReadDir (ns.path)
+	if (myerror != nil) { return err.ErrFatal }
+	for _, entry := range entries {
+		c, ok := parseContainerName (entry.Name ())
+		if (!ok || c < lastContainer) { continue }
+		path := filepath.Join (ns.path, entry.Name ())
+		if (c == lastContainer && live % ns.slotsPerContainer != 0) {
+			myerror = os.Truncate (path, int64 ((live % ns.slotsPerContainer) * ns.desc.BlockSize))
+		} else {
+			f, open := ns.containers[c]
+			if (open) { f.Close(); delete (ns.containers, c) }
+			myerror = os.Remove (path)
+		}
+		if (myerror != nil) { fmt.Println ("Cannot shrink container", path, ":", myerror.Error()) }
+	}
+	return err.NoErr
+}
+
+/**
+ * Get the container number from the name of a container file
+ * @param[in]	filename	Name of the file
+ * @return	Container number
+ * @return	true if the file is a container; false otherwise
+ */
+func parseContainerName (filename string) (uint64, bool) {
+	if (!strings.HasPrefix (filename, extentContainerPrefix)) { return 0, false }
+	c, myerror := strconv.ParseUint (strings.TrimPrefix (filename, extentContainerPrefix), 10, 64)
+	if (myerror != nil) { return 0, false }
+	return c, true
+}
+
+/**
+ * Compact a namespace if enough slots are free, see Compact
+ */
+func (ns *extentNamespace) maybeCompact () {
+	ns.lock.Lock()
+	wasted := uint64 (len (ns.free)) >= extentCompactThreshold && len (ns.free) > len (ns.index)
+	ns.lock.Unlock()
+	if (wasted) { ns.compact () }
+}
+
+/**
+ * Compact a namespace: the blocks are packed at the beginning of the containers, the
+ * space of the free slots is released and the index is rewritten. This happens
+ * automatically when many blocks were deleted.
+ * @param[in]	namespace	Namespace's name
+ * @return	System error handle
+ */
+func (store *ExtentStore) Compact (namespace string) err.SysError {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	return ns.compact ()
+}
+
+func (store *ExtentStore) Read (namespace string, blockid uint64, offset uint64, buff []byte) (int, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return -1, myerr }
+	ns.io.RLock()
+	defer ns.io.RUnlock()
+
+	return ns.read (blockid, offset, buff)
+}
+
+func (store *ExtentStore) Write (namespace string, blockid uint64, offset uint64, data []byte, mode Durability) (int, bool, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	ns.io.RLock()
+	defer ns.io.RUnlock()
+
+	if (data == nil) { data = []byte {} }
+	s, myerr := ns.update (blockid, offset, data, true)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	synced, myerr := ns.commit (mode)
+	return s, synced, myerr
+}
+
+func (store *ExtentStore) Truncate (namespace string, blockid uint64, size uint64, mode Durability) err.SysError {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	ns.io.RLock()
+	defer ns.io.RUnlock()
+
+	_, myerr = ns.update (blockid, size, nil, false)
+	if (myerr != err.NoErr) { return myerr }
+	_, myerr = ns.commit (mode)
+	return myerr
+}
+
+func (store *ExtentStore) Delete (namespace string, blockid uint64) err.SysError {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+
+	ns.io.RLock()
+	myerr = ns.remove (blockid)
+	ns.io.RUnlock()
+	if (myerr == err.NoErr) { ns.maybeCompact () }
+	return myerr
+}
+
+func (store *ExtentStore) List (namespace string) ([]uint64, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	var blocks []uint64
+	for blockid := range ns.index {
+		blocks = append (blocks, blockid)
+	}
+	return blocks, err.NoErr
+}
+
+func (store *ExtentStore) Stat (namespace string, blockid uint64) (uint64, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return 0, myerr }
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	ext, ok := ns.index[blockid]
+	if (!ok) { return 0, err.ErrNotAvailable }
+	return ext.size, err.NoErr
+}
+
+func (store *ExtentStore) Flush (namespace string) err.SysError {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+
+	myerr = ns.sync ()
+	ns.lock.Lock()
+	if (ns.failed) { myerr = err.ErrFatal }
+	ns.failed = false
+	ns.lock.Unlock()
+	return myerr
+}
+
+func (store *ExtentStore) SyncDirty (match func (namespace string) bool) int {
+	store.lock.Lock()
+	var todo []*extentNamespace
+	for name, ns := range store.namespaces {
+		ns.lock.Lock()
+		dirty := ns.dirty
+		ns.lock.Unlock()
+		if (dirty && match (name)) { todo = append (todo, ns) }
+	}
+	store.lock.Unlock()
+
+	failed := 0
+	for _, ns := range todo {
+		if (ns.sync () == err.NoErr) { continue }
+		failed += 1
+		ns.lock.Lock()
+		ns.failed = true
+		ns.lock.Unlock()
+	}
+	return failed
+}
+
+func (store *ExtentStore) CreateNamespace (namespace string, desc NamespaceDescriptor) (NamespaceDescriptor, err.SysError) {
+	path, myerr := namespacePath (store.basedir, namespace)
+	if (myerr != err.NoErr) { return desc, myerr }
+
+	myerror := os.MkdirAll (path, 0700)
+	if (myerror != nil) {
+		fmt.Println ("Cannot create namespace", namespace, ":", myerror.Error())
+		return desc, err.ErrFatal
+	}
+
+	existing, myerr := readNamespaceDescriptor (path)
+	if (myerr == err.NoErr && namespaceLayout (existing) != LayoutExtent) { return existing, wrongLayout (namespace, existing) }
+	if (myerr != err.ErrNotAvailable) { return existing, myerr }
+
+	// The blocks of a namespace created before descriptors existed are in files
+	entries, myerror := ioutil.ReadDir (path)
+	if (myerror != nil) { return desc, err.ErrFatal }
+	for _, entry := range entries {
+		_, isblock := parseBlockFilename (entry.Name ())
+		if (isblock) {
+			desc.Layout = LayoutFile
+			return desc, wrongLayout (namespace, desc)
+		}
+	}
+
+	desc.Layout = LayoutExtent
+	myerr = writeJSONFile (filepath.Join (path, namespaceDescriptorName), desc)
+	return desc, myerr
+}
+
+func (store *ExtentStore) GetNamespace (namespace string) (NamespaceDescriptor, err.SysError) {
+	ns, myerr := store.getNamespace (namespace)
+	if (myerr != err.NoErr) { return NamespaceDescriptor {}, myerr }
+	return ns.desc, err.NoErr
+}
+
+func (store *ExtentStore) ListNamespaces () ([]string, err.SysError) {
+	return listNamespaceDirs (store.basedir)
+}
+
+func (store *ExtentStore) DeleteNamespace (namespace string) err.SysError {
+	path, myerr := namespacePath (store.basedir, namespace)
+	if (myerr != err.NoErr) { return myerr }
+
+	store.unloadNamespace (namespace)
+	myerror := os.RemoveAll (path)
+	if (myerror != nil) {
+		fmt.Println ("Cannot delete namespace", namespace, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	return err.NoErr
+}
+
+func (store *ExtentStore) RenameNamespace (oldname string, newname string) err.SysError {
+	oldPath, myerr := namespacePath (store.basedir, oldname)
+	if (myerr != err.NoErr) { return myerr }
+	newPath, myerr := namespacePath (store.basedir, newname)
+	if (myerr != err.NoErr) { return myerr }
+
+	_, myerror := os.Stat (newPath)
+	if (myerror == nil) { return err.ErrNotAvailable }
+
+	// The namespace is loaded again from its new path when used
+	myerr = store.unloadNamespace (oldname)
+	if (myerr != err.NoErr) { return myerr }
+	myerror = os.Rename (oldPath, newPath)
+	if (myerror != nil) {
+		fmt.Println ("Cannot rename namespace", oldname, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	return err.NoErr
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath")
+
+import err "github.com/gvallee/syserror"
+
+func TestExtentStore (t *testing.T) {
+	validTestPath := "/tmp/ds_test_extentstore/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing reads and writes with the extent store... ")
+	store := NewExtentStore ()
+	if (store.Open (validTestPath) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot open the store") }
+	desc := NamespaceDescriptor {FormatVersion: FormatVersion, BlockSize: 4096}
+	_, myerr := store.CreateNamespace ("ns", desc)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	got, myerr := store.GetNamespace ("ns")
+	if (myerr != err.NoErr || got.Layout != LayoutExtent || got.BlockSize != 4096) { log.Fatal ("FATAL ERROR: Invalid descriptor: ", got) }
+
+	data := make ([]byte, 100)
+	for i := range data { data[i] = 0xff }
+	for blockid := uint64 (0); blockid < 8; blockid++ {
+		ws, _, myerr := store.Write ("ns", blockid, blockid, data, DurabilityPerWrite)
+		if (ws != 100 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	}
+	buff := make ([]byte, 4096)
+	rs, myerr := store.Read ("ns", 5, 0, buff)
+	if (rs != 105 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Invalid read - Read ", rs, " bytes") }
+	if (buff[4] != 0 || buff[5] != 0xff || buff[104] != 0xff) { log.Fatal ("FATAL ERROR: Invalid data") }
+	rs, myerr = store.Read ("ns", 5, 200, buff)
+	if (rs != 0 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Read past the end of a block") }
+	_, myerr = store.Read ("ns", 8, 0, buff)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Read a missing block") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing truncation and slot reuse with the extent store... ")
+	if (store.Truncate ("ns", 2, 10, DurabilityPerWrite) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot truncate block") }
+	if (store.Truncate ("ns", 2, 50, DurabilityPerWrite) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot extend block") }
+	rs, _ = store.Read ("ns", 2, 0, buff)
+	if (rs != 50 || buff[9] != 0xff || buff[10] != 0) { log.Fatal ("FATAL ERROR: Truncated data is still there") }
+	if (store.Delete ("ns", 3) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete block") }
+	if (store.Delete ("ns", 3) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Deleted a missing block") }
+	// The new block takes the slot of the deleted one, without its data
+	_, _, myerr = store.Write ("ns", 100, 50, data[:10], DurabilityPerWrite)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	rs, _ = store.Read ("ns", 100, 0, buff)
+	if (rs != 60 || buff[10] != 0 || buff[50] != 0xff) { log.Fatal ("FATAL ERROR: Data of a deleted block is visible") }
+	ns, _ := store.getNamespace ("ns")
+	if (ns.next != 8) { log.Fatal ("FATAL ERROR: Slot not reused, ", ns.next, " slots used") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing compaction with the extent store... ")
+	for _, blockid := range []uint64 {0, 1, 2, 4, 5} {
+		if (store.Delete ("ns", blockid) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete block") }
+	}
+	if (store.Compact ("ns") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot compact namespace") }
+	info, myerror := os.Stat (filepath.Join (validTestPath, "ns", "extents.0"))
+	if (myerror != nil || info.Size () > 3 * 4096) { log.Fatal ("FATAL ERROR: Container not shrunk") }
+	blocks, _ := store.List ("ns")
+	if (len (blocks) != 3) { log.Fatal ("FATAL ERROR: Invalid list of blocks: ", blocks) }
+	rs, _ = store.Read ("ns", 7, 0, buff)
+	if (rs != 107 || buff[6] != 0 || buff[7] != 0xff) { log.Fatal ("FATAL ERROR: Block lost by the compaction") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing the persistence of the extent store... ")
+	_, _, myerr = store.Write ("ns", 6, 200, data[:1], DurabilityPerWrite)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	if (store.Close () != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot close the store") }
+	store = NewExtentStore ()
+	if (store.Open (validTestPath) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot open the store") }
+	defer store.Close ()
+	for blockid, expected := range map[uint64]int {6: 201, 7: 107, 100: 60} {
+		size, myerr := store.Stat ("ns", blockid)
+		if (myerr != err.NoErr || size != uint64 (expected)) { log.Fatal ("FATAL ERROR: Invalid size of block ", blockid, ": ", size) }
+	}
+	rs, _ = store.Read ("ns", 100, 0, buff)
+	if (rs != 60 || buff[49] != 0 || buff[50] != 0xff) { log.Fatal ("FATAL ERROR: Invalid data after reopening") }
+	if (store.RenameNamespace ("ns", "renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot rename namespace") }
+	size, myerr := store.Stat ("renamed", 7)
+	if (myerr != err.NoErr || size != 107) { log.Fatal ("FATAL ERROR: Cannot read renamed namespace") }
+	if (store.DeleteNamespace ("renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	_, myerr = store.GetNamespace ("renamed")
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Deleted namespace still there") }
+	fmt.Println ("PASS")
+}
+
+func TestConvertToExtents (t *testing.T) {
+	validTestPath := "/tmp/ds_test_convert/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing the conversion of a basedir to the extent layout... ")
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 4096
+	cfg.URL = "127.0.0.1:8904"
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	data := make ([]byte, 100)
+	for i := range data { data[i] = byte (i) }
+	for blockid := uint64 (0); blockid < 4; blockid++ {
+		_, myerr := BlockWrite (myserver, "default", blockid, blockid * 10, data)
+		if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	}
+	myserver.Stop (context.Background ())
+
+	// A server with the extent store cannot use the file layout
+	cfg.Store = NewExtentStore ()
+	if (ServerInitWithConfig (&cfg) != nil) { log.Fatal ("FATAL ERROR: Extent store used the file layout") }
+
+	if (ConvertToExtents (validTestPath, "") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot convert basedir") }
+	_, myerror = os.Stat (filepath.Join (validTestPath, "default", "block0"))
+	if (!os.IsNotExist (myerror)) { log.Fatal ("FATAL ERROR: Block files not removed") }
+	// Converting again has nothing to do
+	if (ConvertToExtents (validTestPath, "default") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot convert basedir twice") }
+
+	cfg.Store = NewExtentStore ()
+	myserver = ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server with the extent store") }
+	defer myserver.Stop (context.Background ())
+	for blockid := uint64 (0); blockid < 4; blockid++ {
+		rs, buff, myerr := BlockRead (myserver, "default", blockid, 0, 4096)
+		if (myerr != err.NoErr || rs != int (blockid * 10 + 100)) { log.Fatal ("FATAL ERROR: Invalid read - Read ", rs, " bytes") }
+		if (buff[blockid * 10 + 42] != 42) { log.Fatal ("FATAL ERROR: Invalid data in block ", blockid) }
+	}
+	fmt.Println ("PASS")
+}
@@ -0,0 +1,707 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("os"
+	"io"
+	"fmt"
+	"sync"
+	"strings"
+	"strconv"
+	"hash/fnv"
+	"io/ioutil"
+	"encoding/binary"
+	"path/filepath")
+
+import err "github.com/gvallee/syserror"
+
+// Name of the file describing a namespace, in the namespace's directory
+const namespaceDescriptorName = ".namespace"
+
+/**
+ * Default block store: each namespace is a directory of the basedir and each block a
+ * file under that directory, either directly in it (FileLayoutFlat) or in a subdirectory
+ * chosen by hash of the block id (FileLayoutSharded, used for new namespaces). The
+ * block files are kept open in a bounded cache.
+ */
+type FileStore struct {
+	basedir	string
+	cache	*blockFileCache
+	lock	sync.Mutex
+	descs	map[string]NamespaceDescriptor	// Descriptors of the namespaces used so far
+}
+
+/**
+ * Create a file store
+ * @param[in]	cacheSize	Maximum number of block files kept open
+ * @return	Pointer to a new FileStore structure
+ */
+func NewFileStore (cacheSize int) *FileStore {
+	store := new (FileStore)
+	store.cache = newBlockFileCache (cacheSize)
+	store.descs = make (map[string]NamespaceDescriptor)
+	return store
+}
+
+func (store *FileStore) Open (basedir string) err.SysError {
+	_, myerror := os.Stat (basedir)
+	if (myerror != nil) { return err.ErrNotAvailable }
+
+	store.basedir = basedir
+	return err.NoErr
+}
+
+func (store *FileStore) Close () err.SysError {
+	if (store.cache.closeAll () != 0) { return err.ErrFatal }
+	return err.NoErr
+}
+
+/**
+ * Change the maximum number of block files kept open.
+ * @param[in]	size	Maximum number of open block files; 0 to disable caching
+ * @return	System error handle
+ */
+func (store *FileStore) SetCacheSize (size int) err.SysError {
+	if (size < 0) { return err.ErrNotAvailable }
+
+	store.cache.resize (size)
+	return err.NoErr
+}
+
+/**
+ * Get the path to the directory of a namespace. This is the only place where a path is
+ * built from a namespace's name: the name is validated and the path is guaranteed to
+ * be a direct child of the basedir.
+ * @param[in]	basedir	Basedir of the server
+ * @param[in]	name	Namespace's name
+ * @return	Path to the namespace's directory
+ * @return	System error handle; ErrNotAvailable if the name is invalid
+ */
+func namespacePath (basedir string, name string) (string, err.SysError) {
+	if (!validStoreName (name)) {
+		fmt.Println ("Invalid namespace name:", strconv.Quote (name))
+		return "", err.ErrNotAvailable
+	}
+
+	namespacePath := filepath.Join (basedir, name)
+	if (filepath.Dir (namespacePath) != filepath.Clean (basedir)) { return "", err.ErrNotAvailable }
+	return namespacePath, err.NoErr
+}
+
+/**
+ * List the namespaces' directories of a basedir
+ * @param[in]	basedir	Basedir of the server
+ * @return	Names of the namespaces
+ * @return	System error handle
+ */
+func listNamespaceDirs (basedir string) ([]string, err.SysError) {
+	entries, myerror := ioutil.ReadDir (basedir)
+	if (myerror != nil) {
+		fmt.Println ("Cannot read basedir:", myerror.Error())
+		return nil, err.ErrFatal
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if (!entry.IsDir () || !validStoreName (entry.Name ())) { continue }
+		names = append (names, entry.Name ())
+	}
+	return names, err.NoErr
+}
+
+func (store *FileStore) namespacePath (name string) (string, err.SysError) {
+	return namespacePath (store.basedir, name)
+}
+
+/**
+ * Get the variant of the file layout of a namespace
+ * @param[in]	desc	Descriptor of the namespace
+ * @return	FileLayoutFlat or FileLayoutSharded
+ */
+func fileLayoutVersion (desc NamespaceDescriptor) int {
+	if (desc.LayoutVersion == 0) { return FileLayoutFlat }
+	return desc.LayoutVersion
+}
+
+/**
+ * Check that the file store can handle the variant of the file layout of a namespace
+ * @param[in]	desc	Descriptor of the namespace
+ * @return	true if the variant is known; false otherwise
+ */
+func validFileLayout (desc NamespaceDescriptor) bool {
+	version := fileLayoutVersion (desc)
+	if (version != FileLayoutFlat && version != FileLayoutSharded) { return false }
+	return desc.MigratingFrom == 0 || (version == FileLayoutSharded && desc.MigratingFrom == FileLayoutFlat)
+}
+
+/**
+ * Get the subdirectory of a block with the sharded layout: two levels named after the
+ * first two bytes of a hash of the block id, so consecutive blocks are spread evenly.
+ * @param[in]	blockid	Block id
+ * @return	Path to the subdirectory, relative to the namespace's directory
+ */
+func shardDir (blockid uint64) string {
+	b := make ([]byte, 8)
+	binary.LittleEndian.PutUint64 (b, blockid)
+	h := fnv.New32a ()
+	h.Write (b)
+	sum := h.Sum32 ()
+	return filepath.Join (fmt.Sprintf ("%02x", sum >> 24), fmt.Sprintf ("%02x", (sum >> 16) & 0xff))
+}
+
+/**
+ * Check whether the name of a directory is the one of a shard, see shardDir
+ * @param[in]	name	Name of the directory
+ * @return	true if the directory is a shard; false otherwise
+ */
+func isShardDir (name string) bool {
+	if (len (name) != 2) { return false }
+	_, myerror := strconv.ParseUint (name, 16, 8)
+	return myerror == nil && strings.ToLower (name) == name
+}
+
+func blockFilename (blockid uint64) string {
+	return "block" + strconv.FormatUint (blockid, 10)
+}
+
+/**
+ * Get the path to a block file
+ * @param[in]	namespacePath	Path to the namespace's directory
+ * @param[in]	version	Variant of the file layout
+ * @param[in]	blockid	Block id
+ * @return	Path to the block file
+ */
+func fileLayoutPath (namespacePath string, version int, blockid uint64) string {
+	if (version == FileLayoutSharded) { return filepath.Join (namespacePath, shardDir (blockid), blockFilename (blockid)) }
+	return filepath.Join (namespacePath, blockFilename (blockid))
+}
+
+/**
+ * Find the block files of a namespace, with any variant of the file layout. The flat
+ * files are listed first so that a file moved to its shard in the meantime is found
+ * anyway.
+ * @param[in]	namespacePath	Path to the namespace's directory
+ * @return	Paths to the block files, by block id
+ * @return	System error handle
+ */
+func listBlockFiles (namespacePath string) (map[uint64]string, err.SysError) {
+	entries, myerror := ioutil.ReadDir (namespacePath)
+	if (myerror != nil) {
+		if (os.IsNotExist (myerror)) { return nil, err.ErrNotAvailable }
+		fmt.Println ("Cannot read namespace:", myerror.Error())
+		return nil, err.ErrFatal
+	}
+
+	blocks := make (map[uint64]string)
+	var shards []string
+	for _, entry := range entries {
+		if (entry.IsDir () && isShardDir (entry.Name ())) {
+			shards = append (shards, entry.Name ())
+			continue
+		}
+		blockid, isblock := parseBlockFilename (entry.Name ())
+		if (!isblock || !entry.Mode ().IsRegular ()) { continue }
+		blocks[blockid] = filepath.Join (namespacePath, entry.Name ())
+	}
+
+	for _, shard := range shards {
+		subdirs, myerror := ioutil.ReadDir (filepath.Join (namespacePath, shard))
+		if (myerror != nil) { return nil, err.ErrFatal }
+		for _, subdir := range subdirs {
+			if (!subdir.IsDir () || !isShardDir (subdir.Name ())) { continue }
+			dir := filepath.Join (namespacePath, shard, subdir.Name ())
+			files, myerror := ioutil.ReadDir (dir)
+			if (myerror != nil) { return nil, err.ErrFatal }
+			for _, file := range files {
+				blockid, isblock := parseBlockFilename (file.Name ())
+				if (!isblock || !file.Mode ().IsRegular ()) { continue }
+				blocks[blockid] = filepath.Join (dir, file.Name ())
+			}
+		}
+	}
+	return blocks, err.NoErr
+}
+
+/**
+ * Get the descriptor of a namespace, read from disk upon first use
+ * @param[in]	namespace	Namespace's name
+ * @return	Descriptor of the namespace
+ * @return	System error handle
+ */
+func (store *FileStore) descriptor (namespace string) (NamespaceDescriptor, err.SysError) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	desc, ok := store.descs[namespace]
+	if (ok) { return desc, err.NoErr }
+
+	namespacePath, myerr := store.namespacePath (namespace)
+	if (myerr != err.NoErr) { return desc, myerr }
+	desc, myerr = readNamespaceDescriptor (namespacePath)
+	if (myerr != err.NoErr) { return desc, myerr }
+	if (namespaceLayout (desc) != LayoutFile) { return desc, wrongLayout (namespace, desc) }
+	if (!validFileLayout (desc)) {
+		fmt.Println ("Unknown variant", desc.LayoutVersion, "of the file layout for namespace", namespace)
+		return desc, err.ErrFatal
+	}
+	store.descs[namespace] = desc
+	return desc, err.NoErr
+}
+
+/**
+ * Replace the descriptor of a namespace, on disk and in memory
+ * @param[in]	namespace	Namespace's name
+ * @param[in]	desc	New descriptor of the namespace
+ * @return	System error handle
+ */
+func (store *FileStore) saveDescriptor (namespace string, desc NamespaceDescriptor) err.SysError {
+	namespacePath, myerr := store.namespacePath (namespace)
+	if (myerr != err.NoErr) { return myerr }
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	// The descriptor is replaced atomically
+	myerr = writeJSONFile (filepath.Join (namespacePath, namespaceDescriptorName), desc)
+	if (myerr != err.NoErr) {
+		delete (store.descs, namespace)
+		return myerr
+	}
+	store.descs[namespace] = desc
+	return err.NoErr
+}
+
+func (store *FileStore) forgetDescriptor (namespace string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete (store.descs, namespace)
+}
+
+/**
+ * Get the path to the file where the block is saved.
+ * @param[in]   namespace       Namespace of the block
+ * @param[in]   blockid         Block id
+ * @return      Path to the block file
+ * @return      Descriptor of the namespace
+ * @return      System error handle
+ */
+func (store *FileStore) blockPath (namespace string, blockid uint64) (string, NamespaceDescriptor, err.SysError) {
+	desc, myerr := store.descriptor (namespace)
+	if (myerr != err.NoErr) { return "", desc, myerr }
+	namespacePath, myerr := store.namespacePath (namespace)
+	if (myerr != err.NoErr) { return "", desc, myerr }
+
+	return fileLayoutPath (namespacePath, fileLayoutVersion (desc), blockid), desc, err.NoErr
+}
+
+/**
+ * Move a block file to its place in the new variant of the layout of a namespace being
+ * migrated. The caller must have exclusive access to the block.
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	desc	Descriptor of the namespace
+ * @param[in]	blockid	Block id
+ * @return	System error handle; NoErr if there was nothing to move
+ */
+func (store *FileStore) migrateBlockFile (namespace string, desc NamespaceDescriptor, blockid uint64) err.SysError {
+	if (desc.MigratingFrom == 0) { return err.NoErr }
+	namespacePath, myerr := store.namespacePath (namespace)
+	if (myerr != err.NoErr) { return myerr }
+
+	from := fileLayoutPath (namespacePath, desc.MigratingFrom, blockid)
+	to := fileLayoutPath (namespacePath, fileLayoutVersion (desc), blockid)
+	myerror := os.Rename (from, to)
+	if (os.IsNotExist (myerror)) {
+		_, staterr := os.Lstat (from)
+		if (os.IsNotExist (staterr)) { return err.NoErr }
+		myerror = os.MkdirAll (filepath.Dir (to), 0700)
+		if (myerror == nil) { myerror = os.Rename (from, to) }
+	}
+	if (myerror != nil) {
+		fmt.Println ("Cannot move block", blockid, "of namespace", namespace, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	return err.NoErr
+}
+
+/**
+ * Get the block id from the name of a block file
+ * @param[in]	filename	Name of the file
+ * @return	Block id
+ * @return	true if the file is a block file; false otherwise
+ */
+func parseBlockFilename (filename string) (uint64, bool) {
+	if (!strings.HasPrefix (filename, "block")) { return 0, false }
+	blockid, myerror := strconv.ParseUint (strings.TrimPrefix (filename, "block"), 10, 64)
+	if (myerror != nil) { return 0, false }
+	return blockid, true
+}
+
+/**
+ * Get the file where the block is saved. The underlying file will be correctly
+ * opened/created, or taken from the cache of open files.
+ * @param[in]   namespace       Namespace of the block
+ * @param[in]   blockid         Block id
+ * @param[in]   create          Create the block file if it does not exist
+ * @return      Cached file handle, to be released with the release method of the cache
+ * @return      System error handle; ErrNotAvailable if the block does not exist
+ */
+func (store *FileStore) openBlockFile (namespace string, blockid uint64, create bool) (*cachedFile, err.SysError) {
+	block_file, desc, myerr := store.blockPath (namespace, blockid)
+	if (myerr != err.NoErr) { return nil, myerr }
+	myerr = store.migrateBlockFile (namespace, desc, blockid)
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	flags := os.O_RDWR
+	if (create) { flags |= os.O_CREATE }
+	cf, myerror := store.cache.acquire (namespace, blockKey (namespace, blockid), block_file, flags)
+	if (os.IsNotExist (myerror) && create && fileLayoutVersion (desc) == FileLayoutSharded) {
+		// First block of the shard
+		myerror = os.MkdirAll (filepath.Dir (block_file), 0700)
+		if (myerror == nil) { cf, myerror = store.cache.acquire (namespace, blockKey (namespace, blockid), block_file, flags) }
+	}
+	if (myerror != nil) {
+		if (os.IsNotExist (myerror)) { return nil, err.ErrNotAvailable }
+		fmt.Println (myerror.Error())
+		return nil, err.ErrFatal
+	}
+	return cf, err.NoErr
+}
+
+func (store *FileStore) Read (namespace string, blockid uint64, offset uint64, buff []byte) (int, err.SysError) {
+	// Reading must not create the block
+	cf, myerr := store.openBlockFile (namespace, blockid, false)
+	if (myerr != err.NoErr) {
+		fmt.Println ("Cannot open block", blockid, ":", myerr.Error())
+		return -1, myerr
+	}
+	defer store.cache.release (cf, false)
+
+	s, myreaderr := cf.f.ReadAt (buff, int64 (offset)) // Unfortunately Read return an INT
+	if (myreaderr != nil && myreaderr != io.EOF) {
+		fmt.Println ("ERRROR: Cannot read from file")
+		return -1, err.ErrFatal
+	}
+	return s, err.NoErr
+}
+
+func (store *FileStore) Write (namespace string, blockid uint64, offset uint64, data []byte, mode Durability) (int, bool, err.SysError) {
+	cf, myerr := store.openBlockFile (namespace, blockid, true)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+
+	s, mywriteerr := cf.f.WriteAt (data, int64 (offset)) // Unfortunately, Write return an INT
+	if (mywriteerr != nil) {
+		fmt.Println (mywriteerr.Error())
+		store.cache.release (cf, s > 0 && mode != DurabilityNone)
+		return -1, false, err.ErrFatal
+	}
+	if (mode != DurabilityPerWrite) {
+		// The data is synced later, if at all
+		store.cache.release (cf, mode != DurabilityNone)
+		return s, false, err.NoErr
+	}
+	mysyncerr := cf.f.Sync()
+	store.cache.release (cf, mysyncerr != nil)
+	if (mysyncerr != nil) {
+		fmt.Println ("Cannot sync block", blockid, ":", mysyncerr.Error())
+		return s, false, err.ErrFatal
+	}
+	return s, true, err.NoErr
+}
+
+/**
+ * Truncate a block file with ftruncate, which releases the space past the new size.
+ * Hole punching is not used: the protocol has no request deleting a range inside a
+ * block, a block only shrinks from its end.
+ */
+func (store *FileStore) Truncate (namespace string, blockid uint64, size uint64, mode Durability) err.SysError {
+	cf, myerr := store.openBlockFile (namespace, blockid, false)
+	if (myerr != err.NoErr) { return myerr }
+
+	myerror := cf.f.Truncate (int64 (size))
+	if (myerror == nil && mode == DurabilityPerWrite) { myerror = cf.f.Sync() }
+	store.cache.release (cf, mode != DurabilityNone && mode != DurabilityPerWrite)
+	if (myerror != nil) {
+		fmt.Println ("Cannot truncate block", blockid, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	return err.NoErr
+}
+
+/**
+ * Delete a block by unlinking its file. A whole block is always removed, hole punching
+ * is not used (see Truncate). The caller has exclusive access to the block, no reader
+ * is left with the unlinked file.
+ */
+func (store *FileStore) Delete (namespace string, blockid uint64) err.SysError {
+	block_file, desc, myerr := store.blockPath (namespace, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = store.migrateBlockFile (namespace, desc, blockid)
+	if (myerr != err.NoErr) { return myerr }
+
+	// Nobody else is using the block, the cached file can safely go away
+	store.cache.invalidate (blockKey (namespace, blockid))
+	myerror := os.Remove (block_file)
+	if (myerror != nil) {
+		if (os.IsNotExist (myerror)) { return err.ErrNotAvailable }
+		fmt.Println ("Cannot delete block", blockid, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	return err.NoErr
+}
+
+/**
+ * Copy a block to another namespace, sharing the data of the block file on disk when
+ * the file system supports it (reflink, e.g., XFS or Btrfs) and copying it otherwise.
+ * The copy is written next to the destination block file, then renamed over it. The
+ * caller must have exclusive access to both blocks.
+ * @param[in]	src	Namespace of the block to copy
+ * @param[in]	dst	Namespace of the copy
+ * @param[in]	blockid	Block id, the same in both namespaces
+ * @param[in]	mode	Durability policy of the copy
+ * @return	System error handle; ErrNotAvailable if the block to copy does not exist
+ */
+func (store *FileStore) CloneBlock (src string, dst string, blockid uint64, mode Durability) err.SysError {
+	from, desc, myerr := store.blockPath (src, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = store.migrateBlockFile (src, desc, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	to, desc, myerr := store.blockPath (dst, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	myerr = store.migrateBlockFile (dst, desc, blockid)
+	if (myerr != err.NoErr) { return myerr }
+
+	in, myerror := os.Open (from)
+	if (os.IsNotExist (myerror)) {
+		myerr = store.Delete (dst, blockid)
+		if (myerr == err.NoErr || myerr == err.ErrNotAvailable) { return err.ErrNotAvailable }
+		return myerr
+	}
+	if (myerror != nil) {
+		fmt.Println ("Cannot open block", blockid, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	defer in.Close ()
+
+	tmp := to + ".clone"
+	myerror = os.MkdirAll (filepath.Dir (to), 0700)
+	var out *os.File
+	if (myerror == nil) { out, myerror = os.OpenFile (tmp, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0600) }
+	if (myerror != nil) {
+		fmt.Println ("Cannot create copy of block", blockid, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	if (reflink (out, in) != nil) {
+		_, myerror = io.Copy (out, in)
+	}
+	if (myerror == nil && mode != DurabilityNone) { myerror = out.Sync () }
+	closeerr := out.Close ()
+	if (myerror == nil) { myerror = closeerr }
+	if (myerror == nil) {
+		// The cached file of the old block must not be used anymore
+		store.cache.invalidate (blockKey (dst, blockid))
+		myerror = os.Rename (tmp, to)
+	}
+	if (myerror != nil) {
+		os.Remove (tmp)
+		fmt.Println ("Cannot copy block", blockid, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	return err.NoErr
+}
+
+func (store *FileStore) List (namespace string) ([]uint64, err.SysError) {
+	namespacePath, myerr := store.namespacePath (namespace)
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	files, myerr := listBlockFiles (namespacePath)
+	if (myerr != err.NoErr) { return nil, myerr }
+	var blocks []uint64
+	for blockid := range files {
+		blocks = append (blocks, blockid)
+	}
+	return blocks, err.NoErr
+}
+
+func (store *FileStore) Stat (namespace string, blockid uint64) (uint64, err.SysError) {
+	block_file, desc, myerr := store.blockPath (namespace, blockid)
+	if (myerr != err.NoErr) { return 0, myerr }
+
+	info, myerror := os.Stat (block_file)
+	if (os.IsNotExist (myerror) && desc.MigratingFrom != 0) {
+		// Not moved yet; the caller does not lock the block, the file is left in place
+		namespacePath, _ := store.namespacePath (namespace)
+		info, myerror = os.Stat (fileLayoutPath (namespacePath, desc.MigratingFrom, blockid))
+	}
+	if (myerror != nil) {
+		if (os.IsNotExist (myerror)) { return 0, err.ErrNotAvailable }
+		return 0, err.ErrFatal
+	}
+	return uint64 (info.Size ()), err.NoErr
+}
+
+func (store *FileStore) Flush (namespace string) err.SysError {
+	if (!store.cache.flushNamespace (namespace)) { return err.ErrFatal }
+	return err.NoErr
+}
+
+func (store *FileStore) SyncDirty (match func (namespace string) bool) int {
+	return store.cache.syncDirty (func (cf *cachedFile) bool { return match (cf.namespace) })
+}
+
+/**
+ * Read the descriptor of a namespace
+ * @param[in]	namespacePath	Path to the namespace's directory
+ * @return	Descriptor of the namespace
+ * @return	System error handle; ErrNotAvailable if the namespace has no descriptor,
+ *		ErrFatal if the descriptor is invalid
+ */
+func readNamespaceDescriptor (namespacePath string) (NamespaceDescriptor, err.SysError) {
+	var desc NamespaceDescriptor
+
+	myerr := readJSONFile (filepath.Join (namespacePath, namespaceDescriptorName), &desc)
+	if (myerr != err.NoErr) { return desc, myerr }
+	if (!validNamespaceDescriptor (desc)) {
+		fmt.Println ("Invalid descriptor for namespace", namespacePath)
+		return desc, err.ErrFatal
+	}
+	return desc, err.NoErr
+}
+
+/**
+ * Report a namespace stored with a layout the store does not handle
+ * @param[in]	namespace	Namespace's name
+ * @param[in]	desc	Descriptor of the namespace
+ * @return	System error handle
+ */
+func wrongLayout (namespace string, desc NamespaceDescriptor) err.SysError {
+	fmt.Println ("Namespace", namespace, "uses the", namespaceLayout (desc), "layout, which the block store does not handle")
+	return err.ErrFatal
+}
+
+func (store *FileStore) CreateNamespace (namespace string, desc NamespaceDescriptor) (NamespaceDescriptor, err.SysError) {
+	namespacePath, myerr := store.namespacePath (namespace)
+	if (myerr != err.NoErr) { return desc, myerr }
+
+	// The blocks of a namespace created before descriptors existed are all in its directory
+	_, myerror := os.Stat (namespacePath)
+	legacy := myerror == nil
+	myerror = os.MkdirAll (namespacePath, 0700)
+	if (myerror != nil) {
+		fmt.Println ("Cannot create namespace", namespace, ":", myerror.Error())
+		return desc, err.ErrFatal
+	}
+
+	existing, myerr := store.descriptor (namespace)
+	if (myerr != err.ErrNotAvailable) { return existing, myerr }
+
+	desc.Layout = LayoutFile
+	desc.LayoutVersion = FileLayoutSharded
+	if (legacy) { desc.LayoutVersion = FileLayoutFlat }
+	desc.MigratingFrom = 0
+	return desc, store.saveDescriptor (namespace, desc)
+}
+
+func (store *FileStore) GetNamespace (namespace string) (NamespaceDescriptor, err.SysError) {
+	return store.descriptor (namespace)
+}
+
+/**
+ * Start migrating a namespace with the flat layout to the sharded layout. From then on,
+ * each block file is moved to its shard upon first access, see migrateBlock. The
+ * caller must have exclusive access to the namespace.
+ * @param[in]	namespace	Namespace's name
+ * @return	true if the namespace has blocks to move; false if it already uses the
+ *		sharded layout
+ * @return	System error handle
+ */
+func (store *FileStore) startMigration (namespace string) (bool, err.SysError) {
+	desc, myerr := store.descriptor (namespace)
+	if (myerr != err.NoErr) { return false, myerr }
+	if (desc.MigratingFrom != 0) { return true, err.NoErr } // Interrupted migration
+	if (fileLayoutVersion (desc) == FileLayoutSharded) { return false, err.NoErr }
+
+	desc.MigratingFrom = fileLayoutVersion (desc)
+	desc.LayoutVersion = FileLayoutSharded
+	return true, store.saveDescriptor (namespace, desc)
+}
+
+/**
+ * Move a block of a namespace being migrated to its shard. The caller must have
+ * exclusive access to the block.
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @return	System error handle
+ */
+func (store *FileStore) migrateBlock (namespace string, blockid uint64) err.SysError {
+	desc, myerr := store.descriptor (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	return store.migrateBlockFile (namespace, desc, blockid)
+}
+
+/**
+ * Complete the migration of a namespace once all its blocks were moved. The caller must
+ * have exclusive access to the namespace.
+ * @param[in]	namespace	Namespace's name
+ * @return	System error handle
+ */
+func (store *FileStore) finishMigration (namespace string) err.SysError {
+	desc, myerr := store.descriptor (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	if (desc.MigratingFrom == 0) { return err.NoErr }
+	namespacePath, myerr := store.namespacePath (namespace)
+	if (myerr != err.NoErr) { return myerr }
+
+	// Nothing may be left behind once the flat layout is forgotten
+	files, myerr := listBlockFiles (namespacePath)
+	if (myerr != err.NoErr) { return myerr }
+	for blockid, path := range files {
+		if (filepath.Dir (path) != namespacePath) { continue }
+		myerr = store.migrateBlockFile (namespace, desc, blockid)
+		if (myerr != err.NoErr) { return myerr }
+	}
+
+	desc.MigratingFrom = 0
+	return store.saveDescriptor (namespace, desc)
+}
+
+func (store *FileStore) ListNamespaces () ([]string, err.SysError) {
+	return listNamespaceDirs (store.basedir)
+}
+
+func (store *FileStore) DeleteNamespace (namespace string) err.SysError {
+	namespacePath, myerr := store.namespacePath (namespace)
+	if (myerr != err.NoErr) { return myerr }
+
+	store.cache.invalidateNamespace (namespace)
+	store.forgetDescriptor (namespace)
+	myerror := os.RemoveAll (namespacePath)
+	if (myerror != nil) {
+		fmt.Println ("Cannot delete namespace", namespace, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	return err.NoErr
+}
+
+func (store *FileStore) RenameNamespace (oldname string, newname string) err.SysError {
+	oldPath, myerr := store.namespacePath (oldname)
+	if (myerr != err.NoErr) { return myerr }
+	newPath, myerr := store.namespacePath (newname)
+	if (myerr != err.NoErr) { return myerr }
+
+	_, myerror := os.Stat (newPath)
+	if (myerror == nil) { return err.ErrNotAvailable }
+
+	store.cache.invalidateNamespace (oldname)
+	store.forgetDescriptor (oldname)
+	store.forgetDescriptor (newname)
+	myerror = os.Rename (oldPath, newPath)
+	if (myerror != nil) {
+		fmt.Println ("Cannot rename namespace", oldname, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	return err.NoErr
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("fmt"
+	"os"
+	"sort"
+	"sync"
+	"strings"
+	"strconv"
+	"encoding/hex")
+
+import err "github.com/gvallee/syserror"
+
+/**
+ * Source of the keys encrypting the blocks, see EncryptionStore. Keys are identified by
+ * a number, recorded with each encrypted chunk so that the data stays readable while
+ * the key of a namespace changes.
+ */
+type KeyProvider interface {
+	/**
+	 * Get a key
+	 * @param[in]	id	Key id
+	 * @return	AES key (16, 24 or 32 bytes)
+	 * @return	System error handle; ErrNotAvailable if the key is unknown
+	 */
+	Key (id uint32) ([]byte, err.SysError)
+
+	/**
+	 * Get the key encrypting the new data of a namespace
+	 * @param[in]	namespace	Namespace's name
+	 * @return	Key id, never 0
+	 * @return	System error handle
+	 */
+	CurrentKey (namespace string) (uint32, err.SysError)
+}
+
+/**
+ * Key provider reading the keys from a local file. Each line of the file is a key id
+ * (a positive number) followed by the key in hexadecimal; empty lines and lines
+ * starting with '#' are ignored. The key with the highest id encrypts the new data of
+ * all the namespaces: to rotate keys, append a new key to the file, then ask the server
+ * to re-encrypt the namespaces (see NamespaceRotateKey), which reloads the file. Old
+ * keys can be removed from the file once no block uses them anymore.
+ */
+type KeyFile struct {
+	path	string
+	lock	sync.RWMutex
+	keys	map[uint32][]byte
+	current	uint32
+}
+
+/**
+ * Load a keyfile
+ * @param[in]	path	Path to the keyfile
+ * @return	Pointer to a new KeyFile structure
+ * @return	Error describing why the file cannot be used, nil otherwise
+ */
+func LoadKeyFile (path string) (*KeyFile, error) {
+	kf := new (KeyFile)
+	kf.path = path
+	myerror := kf.Reload ()
+	if (myerror != nil) { return nil, myerror }
+	return kf, nil
+}
+
+/**
+ * Read the keyfile again, e.g., after a key was added. The keys loaded previously are
+ * kept if the file is invalid.
+ * @return	Error describing why the file cannot be used, nil otherwise
+ */
+func (kf *KeyFile) Reload () error {
+	info, myerror := os.Stat (kf.path)
+	if (myerror != nil) { return myerror }
+	if (info.Mode ().Perm () & 0077 != 0) {
+		fmt.Println ("WARNING: Keyfile", kf.path, "is accessible by other users")
+	}
+	content, myerror := os.ReadFile (kf.path)
+	if (myerror != nil) { return myerror }
+
+	keys := make (map[uint32][]byte)
+	var current uint32 = 0
+	for n, line := range strings.Split (string (content), "\n") {
+		line = strings.TrimSpace (line)
+		if (line == "" || strings.HasPrefix (line, "#")) { continue }
+		fields := strings.Fields (line)
+		if (len (fields) != 2) { return fmt.Errorf ("%s:%d: expected a key id and a key", kf.path, n + 1) }
+		id, myerror := strconv.ParseUint (fields[0], 10, 32)
+		if (myerror != nil || id == 0) { return fmt.Errorf ("%s:%d: invalid key id %q", kf.path, n + 1, fields[0]) }
+		key, myerror := hex.DecodeString (fields[1])
+		if (myerror != nil || (len (key) != 16 && len (key) != 24 && len (key) != 32)) {
+			return fmt.Errorf ("%s:%d: keys must be 16, 24 or 32 bytes in hexadecimal", kf.path, n + 1)
+		}
+		_, ok := keys[uint32 (id)]
+		if (ok) { return fmt.Errorf ("%s:%d: duplicate key id %d", kf.path, n + 1, id) }
+		keys[uint32 (id)] = key
+		if (uint32 (id) > current) { current = uint32 (id) }
+	}
+	if (current == 0) { return fmt.Errorf ("%s: no key", kf.path) }
+
+	kf.lock.Lock()
+	defer kf.lock.Unlock()
+	kf.keys = keys
+	kf.current = current
+	return nil
+}
+
+func (kf *KeyFile) Key (id uint32) ([]byte, err.SysError) {
+	kf.lock.RLock()
+	defer kf.lock.RUnlock()
+
+	key, ok := kf.keys[id]
+	if (!ok) { return nil, err.ErrNotAvailable }
+	return key, err.NoErr
+}
+
+func (kf *KeyFile) CurrentKey (namespace string) (uint32, err.SysError) {
+	kf.lock.RLock()
+	defer kf.lock.RUnlock()
+
+	return kf.current, err.NoErr
+}
+
+/**
+ * Progress of the re-encryption of a namespace with its current key
+ */
+type KeyRotation struct {
+	Running	bool
+	Blocks	uint64		// Blocks processed
+	Chunks	uint64		// Chunks re-encrypted
+	Errors	uint64		// Blocks that could not be re-encrypted
+}
+
+/**
+ * Re-encrypt in the background the blocks of a namespace that are not encrypted with
+ * the current key of the namespace, e.g., after a new key was added to the keyfile.
+ * The key provider is reloaded first if it supports it (see KeyFile). Clients can keep
+ * using the namespace: each block is locked only while it is re-encrypted, and new
+ * writes use the new key. See KeyRotationStatus for the progress.
+ * @param[in]	dataserver	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @return	System error handle; ErrNotAvailable if the namespace is not encrypted or
+ *		is already being re-encrypted
+ */
+func NamespaceRotateKey (dataserver *Server, name string) err.SysError {
+	if (dataserver == nil) { return err.ErrNotAvailable }
+	es := encryptionStore (dataserver.store)
+	if (es == nil || es.keys == nil) { return err.ErrNotAvailable }
+
+	unlockns, myerr := useNamespace (dataserver, name, false)
+	if (myerr != err.NoErr) { return myerr }
+	ns, myerr := es.getNamespace (name)
+	unlockns()
+	if (myerr != err.NoErr) { return myerr }
+	if (ns == nil) { return err.ErrNotAvailable }
+
+	reloader, ok := es.keys.(interface { Reload () error })
+	if (ok) {
+		myerror := reloader.Reload ()
+		if (myerror != nil) {
+			fmt.Println ("Cannot reload the keys:", myerror.Error())
+			return err.ErrFatal
+		}
+	}
+
+	dataserver.rotationsLock.Lock()
+	defer dataserver.rotationsLock.Unlock()
+	if (isStopping (dataserver)) { return err.ErrNotAvailable }
+	rotation, ok := dataserver.rotations[name]
+	if (ok && rotation.Running) { return err.ErrNotAvailable }
+	rotation = &KeyRotation {Running: true}
+	dataserver.rotations[name] = rotation
+	dataserver.background.Add (1)
+	go rotateNamespace (dataserver, es, name, rotation)
+	return err.NoErr
+}
+
+/**
+ * Get the progress of the last re-encryption of a namespace
+ * @param[in]	dataserver	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @return	Progress of the re-encryption
+ * @return	System error handle; ErrNotAvailable if the namespace was not re-encrypted
+ */
+func KeyRotationStatus (dataserver *Server, name string) (KeyRotation, err.SysError) {
+	if (dataserver == nil) { return KeyRotation {}, err.ErrNotAvailable }
+	dataserver.rotationsLock.Lock()
+	defer dataserver.rotationsLock.Unlock()
+
+	rotation, ok := dataserver.rotations[name]
+	if (!ok) { return KeyRotation {}, err.ErrNotAvailable }
+	return *rotation, err.NoErr
+}
+
+func rotateNamespace (dataserver *Server, es *EncryptionStore, name string, rotation *KeyRotation) {
+	defer dataserver.background.Done()
+	fmt.Println ("Re-encrypting namespace", name)
+
+	unlockns, myerr := useNamespace (dataserver, name, false)
+	var blocks []uint64
+	if (myerr == err.NoErr) {
+		blocks, myerr = dataserver.store.List (name)
+		unlockns()
+	}
+	sort.Slice (blocks, func (i, j int) bool { return blocks[i] < blocks[j] })
+	for _, blockid := range blocks {
+		if (myerr != err.NoErr || isStopping (dataserver)) { break }
+		chunks, blockerr := rotateBlock (dataserver, es, name, blockid)
+		if (blockerr == err.ErrNotAvailable && !namespaceKnown (dataserver, name)) { break } // Deleted or renamed
+
+		dataserver.rotationsLock.Lock()
+		rotation.Blocks += 1
+		rotation.Chunks += chunks
+		if (blockerr != err.NoErr && blockerr != err.ErrNotAvailable) {
+			fmt.Println ("Cannot re-encrypt block", blockid, "of namespace", name)
+			rotation.Errors += 1
+		}
+		dataserver.rotationsLock.Unlock()
+	}
+
+	dataserver.rotationsLock.Lock()
+	defer dataserver.rotationsLock.Unlock()
+	if (myerr != err.NoErr) { rotation.Errors += 1 }
+	rotation.Running = false
+	fmt.Println ("Namespace", name, "re-encrypted:", rotation.Chunks, "chunk(s) of", rotation.Blocks, "block(s),", rotation.Errors, "error(s)")
+}
+
+func rotateBlock (dataserver *Server, es *EncryptionStore, name string, blockid uint64) (uint64, err.SysError) {
+	unlockns, myerr := useNamespace (dataserver, name, false)
+	if (myerr != err.NoErr) { return 0, myerr }
+	defer unlockns()
+	unlock := dataserver.blocks.lockBlock (name, blockid)
+	defer unlock()
+
+	return es.rotateBlock (name, blockid, GetNamespaceDurability (dataserver, name))
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("sync"
+	"strconv")
+
+/**
+ * Lock protecting a single block. Writers take the lock exclusively, readers share it.
+ * refs counts the goroutines currently holding or waiting for the lock so that the
+ * entry can be dropped from the table once nobody needs it anymore.
+ */
+type blockLock struct {
+	lock	sync.RWMutex
+	refs	int
+}
+
+/**
+ * Table of the locks of the blocks (or namespaces) currently being accessed. Entries
+ * are created on demand and removed when the last user releases them, so the table
+ * only grows with the number of concurrent operations, not with the number of blocks.
+ */
+type blockLockTable struct {
+	lock	sync.Mutex
+	locks	map[string]*blockLock
+}
+
+func newBlockLockTable () *blockLockTable {
+	t := new (blockLockTable)
+	t.locks = make (map[string]*blockLock)
+	return t
+}
+
+func blockKey (namespace string, blockid uint64) string {
+	return namespace + "/" + strconv.FormatUint (blockid, 10)
+}
+
+func (t *blockLockTable) ref (key string) *blockLock {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	l, ok := t.locks[key]
+	if (!ok) {
+		l = new (blockLock)
+		t.locks[key] = l
+	}
+	l.refs += 1
+	return l
+}
+
+func (t *blockLockTable) unref (key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	l := t.locks[key]
+	l.refs -= 1
+	if (l.refs == 0) { delete (t.locks, key) }
+}
+
+/**
+ * Lock an entry of the table exclusively
+ * @param[in]	key	Key of the entry
+ * @return	Function to call to release the lock
+ */
+func (t *blockLockTable) lockKey (key string) func() {
+	l := t.ref (key)
+	l.lock.Lock()
+	return func() {
+		l.lock.Unlock()
+		t.unref (key)
+	}
+}
+
+/**
+ * Lock an entry of the table in shared mode
+ * @param[in]	key	Key of the entry
+ * @return	Function to call to release the lock
+ */
+func (t *blockLockTable) rlockKey (key string) func() {
+	l := t.ref (key)
+	l.lock.RLock()
+	return func() {
+		l.lock.RUnlock()
+		t.unref (key)
+	}
+}
+
+/**
+ * Lock a block for writing
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid		Block id
+ * @return	Function to call to release the lock
+ */
+func (t *blockLockTable) lockBlock (namespace string, blockid uint64) func() {
+	return t.lockKey (blockKey (namespace, blockid))
+}
+
+/**
+ * Lock a block for reading
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid		Block id
+ * @return	Function to call to release the lock
+ */
+func (t *blockLockTable) rlockBlock (namespace string, blockid uint64) func() {
+	return t.rlockKey (blockKey (namespace, blockid))
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("fmt"
+	"sync")
+
+import err "github.com/gvallee/syserror"
+
+type memNamespace struct {
+	desc	NamespaceDescriptor
+	blocks	map[uint64][]byte
+}
+
+/**
+ * Volatile block store keeping all the blocks in memory, e.g., for tests or as a burst
+ * buffer. Nothing survives the server: the store does not need a basedir and the data
+ * is reported as never synced. The memory used by the blocks can be bounded, writes
+ * that would go past the capacity fail with ErrDataOverflow.
+ */
+type MemoryStore struct {
+	lock		sync.RWMutex
+	capacity	uint64		// 0 if unlimited
+	used		uint64
+	namespaces	map[string]*memNamespace
+}
+
+/**
+ * Create a memory store
+ * @param[in]	capacity	Maximum amount of block data in bytes; 0 for no limit
+ * @return	Pointer to a new MemoryStore structure
+ */
+func NewMemoryStore (capacity uint64) *MemoryStore {
+	store := new (MemoryStore)
+	store.capacity = capacity
+	store.namespaces = make (map[string]*memNamespace)
+	return store
+}
+
+/**
+ * Get the amount of memory used by the blocks
+ * @return	Size of the blocks' data in bytes
+ * @return	Capacity of the store in bytes; 0 if unlimited
+ */
+func (store *MemoryStore) Usage () (uint64, uint64) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.used, store.capacity
+}
+
+func (store *MemoryStore) Open (basedir string) err.SysError {
+	return err.NoErr
+}
+
+func (store *MemoryStore) Close () err.SysError {
+	return err.NoErr
+}
+
+/**
+ * Get a block, must be called with the lock of the store held.
+ * @return	Data of the block
+ * @return	System error handle; ErrNotAvailable if the block does not exist
+ */
+func (store *MemoryStore) getBlockLocked (namespace string, blockid uint64) ([]byte, err.SysError) {
+	ns, ok := store.namespaces[namespace]
+	if (!ok) { return nil, err.ErrNotAvailable }
+	data, ok := ns.blocks[blockid]
+	if (!ok) { return nil, err.ErrNotAvailable }
+	return data, err.NoErr
+}
+
+/**
+ * Change the size of a block, must be called with the lock of the store held for writing.
+ * @param[in]	ns	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	size	New size of the block
+ * @return	System error handle; ErrDataOverflow if the store is full
+ */
+func (store *MemoryStore) resizeLocked (ns *memNamespace, blockid uint64, size uint64) err.SysError {
+	data := ns.blocks[blockid]
+	oldsize := uint64 (len (data))
+	if (size > oldsize && store.capacity != 0 && store.used + size - oldsize > store.capacity) {
+		fmt.Println ("Memory store full:", store.used, "of", store.capacity, "bytes used")
+		return err.ErrDataOverflow
+	}
+
+	if (size <= uint64 (cap (data))) {
+		// Growing within the capacity of the slice must expose zeros, not old data
+		newdata := data[:size]
+		for i := oldsize; i < size; i++ { newdata[i] = 0 }
+		data = newdata
+	} else {
+		newdata := make ([]byte, size)
+		copy (newdata, data)
+		data = newdata
+	}
+	ns.blocks[blockid] = data
+	store.used = store.used + size - oldsize
+	return err.NoErr
+}
+
+func (store *MemoryStore) Read (namespace string, blockid uint64, offset uint64, buff []byte) (int, err.SysError) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	data, myerr := store.getBlockLocked (namespace, blockid)
+	if (myerr != err.NoErr) { return -1, myerr }
+	if (offset >= uint64 (len (data))) { return 0, err.NoErr }
+	return copy (buff, data[offset:]), err.NoErr
+}
+
+func (store *MemoryStore) Write (namespace string, blockid uint64, offset uint64, data []byte, mode Durability) (int, bool, err.SysError) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ns, ok := store.namespaces[namespace]
+	if (!ok) { return -1, false, err.ErrNotAvailable }
+
+	block, exists := ns.blocks[blockid]
+	end := offset + uint64 (len (data))
+	if (!exists || end > uint64 (len (block))) {
+		myerr := store.resizeLocked (ns, blockid, end)
+		if (myerr != err.NoErr) { return -1, false, myerr }
+		block = ns.blocks[blockid]
+	}
+	return copy (block[offset:], data), false, err.NoErr
+}
+
+func (store *MemoryStore) Truncate (namespace string, blockid uint64, size uint64, mode Durability) err.SysError {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	_, myerr := store.getBlockLocked (namespace, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	return store.resizeLocked (store.namespaces[namespace], blockid, size)
+}
+
+func (store *MemoryStore) Delete (namespace string, blockid uint64) err.SysError {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	data, myerr := store.getBlockLocked (namespace, blockid)
+	if (myerr != err.NoErr) { return myerr }
+	store.used -= uint64 (len (data))
+	delete (store.namespaces[namespace].blocks, blockid)
+	return err.NoErr
+}
+
+func (store *MemoryStore) List (namespace string) ([]uint64, err.SysError) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	ns, ok := store.namespaces[namespace]
+	if (!ok) { return nil, err.ErrNotAvailable }
+	var blocks []uint64
+	for blockid := range ns.blocks {
+		blocks = append (blocks, blockid)
+	}
+	return blocks, err.NoErr
+}
+
+func (store *MemoryStore) Stat (namespace string, blockid uint64) (uint64, err.SysError) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	data, myerr := store.getBlockLocked (namespace, blockid)
+	if (myerr != err.NoErr) { return 0, myerr }
+	return uint64 (len (data)), err.NoErr
+}
+
+func (store *MemoryStore) Flush (namespace string) err.SysError {
+	// Nothing can be made more durable than it is
+	return err.NoErr
+}
+
+func (store *MemoryStore) SyncDirty (match func (namespace string) bool) int {
+	return 0
+}
+
+func (store *MemoryStore) CreateNamespace (namespace string, desc NamespaceDescriptor) (NamespaceDescriptor, err.SysError) {
+	if (!validStoreName (namespace)) { return desc, err.ErrNotAvailable }
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ns, ok := store.namespaces[namespace]
+	if (ok) { return ns.desc, err.NoErr }
+	ns = new (memNamespace)
+	ns.desc = desc
+	ns.blocks = make (map[uint64][]byte)
+	store.namespaces[namespace] = ns
+	return desc, err.NoErr
+}
+
+func (store *MemoryStore) GetNamespace (namespace string) (NamespaceDescriptor, err.SysError) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	ns, ok := store.namespaces[namespace]
+	if (!ok) { return NamespaceDescriptor {}, err.ErrNotAvailable }
+	return ns.desc, err.NoErr
+}
+
+func (store *MemoryStore) ListNamespaces () ([]string, err.SysError) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	var names []string
+	for name := range store.namespaces {
+		names = append (names, name)
+	}
+	return names, err.NoErr
+}
+
+func (store *MemoryStore) DeleteNamespace (namespace string) err.SysError {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ns, ok := store.namespaces[namespace]
+	if (!ok) { return err.ErrNotAvailable }
+	for _, data := range ns.blocks {
+		store.used -= uint64 (len (data))
+	}
+	delete (store.namespaces, namespace)
+	return err.NoErr
+}
+
+func (store *MemoryStore) RenameNamespace (oldname string, newname string) err.SysError {
+	if (!validStoreName (newname)) { return err.ErrNotAvailable }
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ns, ok := store.namespaces[oldname]
+	if (!ok) { return err.ErrNotAvailable }
+	_, exists := store.namespaces[newname]
+	if (exists) { return err.ErrNotAvailable }
+	delete (store.namespaces, oldname)
+	store.namespaces[newname] = ns
+	return err.NoErr
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"context"
+	"fmt"
+	"log")
+
+import err "github.com/gvallee/syserror"
+
+func TestMemoryStore (t *testing.T) {
+	fmt.Print ("Testing a server without basedir... ")
+	store := NewMemoryStore (16 * 1024)
+	var cfg ServerConfig
+	cfg.BlockSize = 8192
+	cfg.URL = "127.0.0.1:8903"
+	cfg.Store = store
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing reads and writes in memory... ")
+	data := make ([]byte, 100)
+	for i := range data { data[i] = 0xff }
+	ws, myerr := BlockWrite (myserver, "default", 3, 10, data)
+	if (ws != 100 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	rs, buff, myerr := BlockRead (myserver, "default", 3, 0, 4096)
+	if (rs != 110 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Invalid read - Read ", rs, " bytes") }
+	for i := range buff {
+		if ((i >= 10 && i < 110 && buff[i] != 0xff) || ((i < 10 || i >= 110) && buff[i] != 0)) { log.Fatal ("FATAL ERROR: Invalid data at ", i) }
+	}
+	_, _, myerr = BlockRead (myserver, "default", 4, 0, 10)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Read a missing block") }
+	_, myerr = BlockWrite (myserver, "default", 3, 8100, data)
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Wrote past the end of a block") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing truncation and deletion in memory... ")
+	if (BlockTruncate (myserver, "default", 3, 20) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot truncate block") }
+	if (BlockTruncate (myserver, "default", 3, 50) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot extend block") }
+	rs, buff, _ = BlockRead (myserver, "default", 3, 0, 100)
+	if (rs != 50 || buff[15] != 0xff || buff[30] != 0) { log.Fatal ("FATAL ERROR: Truncated data is still there") }
+	if (BlockDelete (myserver, "default", 3) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete block") }
+	if (BlockDelete (myserver, "default", 3) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Deleted a missing block") }
+	used, _ := store.Usage ()
+	if (used != 0) { log.Fatal ("FATAL ERROR: Memory of deleted block still accounted: ", used) }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing the capacity of the memory store... ")
+	_, myerr = BlockWrite (myserver, "default", 0, 0, make ([]byte, 8192))
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	if (NamespaceInit ("other", myserver, 0) == nil) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	_, myerr = BlockWrite (myserver, "other", 0, 0, make ([]byte, 8192))
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	_, myerr = BlockWrite (myserver, "other", 1, 0, make ([]byte, 1))
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Wrote past the capacity of the store") }
+	stats, myerr := NamespaceStat (myserver, "other")
+	if (myerr != err.NoErr || stats.Blocks != 1 || stats.BytesUsed != 8192) { log.Fatal ("FATAL ERROR: Invalid namespace statistics: ", stats) }
+	if (NamespaceDelete (myserver, "other") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	_, myerr = BlockWrite (myserver, "default", 1, 0, make ([]byte, 8192))
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Memory of deleted namespace was not released") }
+	fmt.Println ("PASS")
+}
@@ -0,0 +1,432 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("net"
+	"fmt"
+	"sort"
+	"strconv")
+
+import err "github.com/gvallee/syserror"
+import comm "github.com/gvallee/fscomm"
+
+// Namespace that always exists and cannot be deleted nor renamed
+const DefaultNamespace = "default"
+
+// Maximum length of a namespace's name
+const MaxNamespaceNameLen = 128
+
+// Maximum length of the name of a namespace of a block store. The stores derive their
+// own namespaces from the clients' ones (e.g., "ns.s.snapmap.cmap.enc.sums" for a
+// snapshot), the suffixes must fit on top of MaxNamespaceNameLen and the result must
+// remain a valid file name (255 characters on most file systems).
+const maxStoreNameLen = MaxNamespaceNameLen + 120
+
+/**
+ * Usage statistics of a namespace
+ */
+type NamespaceStats struct {
+	Blocks		uint64	// Number of blocks
+	BytesUsed	uint64	// Sum of the size of the blocks
+	PhysicalBytes	uint64	// Storage actually used by the blocks, e.g., once compressed
+	BlockSize	uint64	// Size of the blocks of the namespace
+}
+
+/**
+ * Check whether a namespace's name is valid. Names come from clients and end up in
+ * paths, they are therefore restricted to letters, digits, '.', '_' and '-', must
+ * start with a letter or a digit (which excludes "." and "..") and cannot be longer
+ * than MaxNamespaceNameLen.
+ * @param[in]	name	Namespace's name
+ * @return	true if the name is valid; false otherwise
+ */
+func ValidNamespaceName (name string) bool {
+	return len (name) <= MaxNamespaceNameLen && validStoreName (name)
+}
+
+/**
+ * Check whether the name of a namespace of a block store is valid: same characters
+ * than ValidNamespaceName, up to maxStoreNameLen characters. The names coming from
+ * clients are checked with ValidNamespaceName, so that the stores can add suffixes.
+ * @param[in]	name	Namespace's name
+ * @return	true if the name is valid; false otherwise
+ */
+func validStoreName (name string) bool {
+	if (len (name) == 0 || len (name) > maxStoreNameLen) { return false }
+
+	for i, c := range name {
+		alnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if (alnum) { continue }
+		if (i == 0 || (c != '.' && c != '_' && c != '-')) { return false }
+	}
+	return true
+}
+
+/**
+ * Check whether a namespace is known to the server
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @return	true if the namespace exists; false otherwise
+ */
+func namespaceKnown (dataserver *Server, name string) bool {
+	dataserver.registryLock.Lock()
+	defer dataserver.registryLock.Unlock()
+
+	_, ok := dataserver.registry[name]
+	return ok
+}
+
+/**
+ * Get access to a namespace for a block operation. The namespace cannot be deleted or
+ * renamed until the returned function is called.
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @param[in]	create	Create the namespace if it does not exist and the server's
+ *			policy allows it
+ * @return	Function to call when done with the namespace
+ * @return	System error handle; ErrNotAvailable if the namespace does not exist
+ */
+func useNamespace (dataserver *Server, name string, create bool) (func(), err.SysError) {
+	if (create && dataserver.autoCreate && !namespaceKnown (dataserver, name)) {
+		NamespaceInit (name, dataserver, 0)
+	}
+
+	unlockns := dataserver.namespaces.rlockKey (name)
+	if (!namespaceKnown (dataserver, name)) {
+		unlockns()
+		fmt.Println ("Unknown namespace:", strconv.Quote (name))
+		return nil, err.ErrNotAvailable
+	}
+	return unlockns, err.NoErr
+}
+
+/**
+ * Get the size of the blocks of a namespace
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @return	Block size of the namespace
+ * @return	System error handle; ErrNotAvailable if the namespace does not exist
+ */
+func GetNamespaceBlocksize (dataserver *Server, name string) (uint64, err.SysError) {
+	if (dataserver == nil) { return 0, err.ErrNotAvailable }
+
+	dataserver.registryLock.Lock()
+	defer dataserver.registryLock.Unlock()
+
+	ns, ok := dataserver.registry[name]
+	if (!ok) { return 0, err.ErrNotAvailable }
+	return ns.block_size, err.NoErr
+}
+
+/**
+ * Load the namespaces of the block store into the registry of the server
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	blocksize	Block size of the namespaces created before descriptors existed
+ * @param[in]	force	Skip the namespaces with an invalid descriptor instead of failing
+ * @return	System error handle
+ */
+func loadNamespaces (dataserver *Server, blocksize uint64, force bool) err.SysError {
+	names, myerr := dataserver.store.ListNamespaces ()
+	if (myerr != err.NoErr) { return myerr }
+
+	dataserver.registryLock.Lock()
+	defer dataserver.registryLock.Unlock()
+
+	for _, name := range names {
+		// Namespaces created before descriptors existed use the block size of the basedir
+		desc, myerr := dataserver.store.GetNamespace (name)
+		if (myerr == err.ErrNotAvailable) {
+			desc.FormatVersion = FormatVersion
+			desc.BlockSize = blocksize
+			desc, myerr = dataserver.store.CreateNamespace (name, desc)
+		}
+		if (myerr != err.NoErr && force) {
+			fmt.Println ("WARNING: ignoring namespace", name)
+			continue
+		}
+		if (myerr != err.NoErr) { return myerr }
+		ns := new (Namespace)
+		ns.block_size = desc.BlockSize
+		dataserver.registry[name] = ns
+	}
+	return err.NoErr
+}
+
+/**
+ * List the namespaces of the server
+ * @param[in]	ds	Structure representing the server
+ * @return	Sorted list of the namespaces' names
+ * @return	System error handle
+ */
+func NamespaceList (dataserver *Server) ([]string, err.SysError) {
+	if (dataserver == nil) { return nil, err.ErrNotAvailable }
+
+	dataserver.registryLock.Lock()
+	var names []string
+	for name := range dataserver.registry {
+		names = append (names, name)
+	}
+	dataserver.registryLock.Unlock()
+
+	sort.Strings (names)
+	return names, err.NoErr
+}
+
+/**
+ * Get the usage statistics of a namespace
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @return	Statistics of the namespace
+ * @return	System error handle; ErrNotAvailable if the namespace does not exist
+ */
+func NamespaceStat (dataserver *Server, name string) (NamespaceStats, err.SysError) {
+	var stats NamespaceStats
+
+	unlockns, myerr := useNamespace (dataserver, name, false)
+	if (myerr != err.NoErr) { return stats, myerr }
+	defer unlockns()
+
+	blocks, myerr := dataserver.store.List (name)
+	if (myerr != err.NoErr) { return stats, myerr }
+
+	stats.BlockSize, myerr = GetNamespaceBlocksize (dataserver, name)
+	if (myerr != err.NoErr) { return stats, myerr }
+	for _, blockid := range blocks {
+		size, myerr := dataserver.store.Stat (name, blockid)
+		if (myerr == err.ErrNotAvailable) { continue } // Deleted in the meantime
+		if (myerr != err.NoErr) { return stats, myerr }
+		physical, myerr := physicalSize (dataserver.store, name, blockid, size)
+		if (myerr == err.ErrNotAvailable) { continue }
+		if (myerr != err.NoErr) { return stats, myerr }
+		stats.Blocks += 1
+		stats.BytesUsed += size
+		stats.PhysicalBytes += physical
+	}
+	return stats, err.NoErr
+}
+
+/**
+ * Delete a namespace and all its blocks. The operations in progress on the namespace
+ * complete before the namespace is deleted.
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @return	System error handle; ErrNotAvailable if the namespace does not exist
+ */
+func NamespaceDelete (dataserver *Server, name string) err.SysError {
+	if (name == DefaultNamespace || !ValidNamespaceName (name)) { return err.ErrNotAvailable }
+
+	unlockns := dataserver.namespaces.lockKey (name)
+	defer unlockns()
+
+	if (!namespaceKnown (dataserver, name)) { return err.ErrNotAvailable }
+
+	// The namespace is unusable from now on, even if its blocks cannot all be removed
+	dataserver.registryLock.Lock()
+	delete (dataserver.registry, name)
+	dataserver.registryLock.Unlock()
+
+	myerr := dataserver.store.DeleteNamespace (name)
+	if (myerr != err.NoErr) { return myerr }
+
+	dataserver.durabilityLock.Lock()
+	delete (dataserver.nsDurability, name)
+	dataserver.durabilityLock.Unlock()
+
+	return err.NoErr
+}
+
+/**
+ * Rename a namespace. The operations in progress on the namespace complete before the
+ * namespace is renamed.
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	oldname	Current name of the namespace
+ * @param[in]	newname	New name of the namespace, which must not exist yet
+ * @return	System error handle; ErrNotAvailable if the namespace does not exist or
+ *		if the new name is already used
+ */
+func NamespaceRename (dataserver *Server, oldname string, newname string) err.SysError {
+	if (oldname == DefaultNamespace || newname == DefaultNamespace || oldname == newname) { return err.ErrNotAvailable }
+	if (!ValidNamespaceName (oldname) || !ValidNamespaceName (newname)) {
+		fmt.Println ("Invalid namespace name:", strconv.Quote (newname))
+		return err.ErrNotAvailable
+	}
+
+	// Always lock the namespaces in the same order to avoid deadlocks
+	first, second := oldname, newname
+	if (second < first) { first, second = second, first }
+	unlock1 := dataserver.namespaces.lockKey (first)
+	defer unlock1()
+	unlock2 := dataserver.namespaces.lockKey (second)
+	defer unlock2()
+
+	if (!namespaceKnown (dataserver, oldname) || namespaceKnown (dataserver, newname)) { return err.ErrNotAvailable }
+
+	myerr := dataserver.store.RenameNamespace (oldname, newname)
+	if (myerr != err.NoErr) { return myerr }
+
+	dataserver.registryLock.Lock()
+	ns := dataserver.registry[oldname]
+	delete (dataserver.registry, oldname)
+	dataserver.registry[newname] = ns
+	dataserver.registryLock.Unlock()
+
+	dataserver.durabilityLock.Lock()
+	mode, ok := dataserver.nsDurability[oldname]
+	if (ok) {
+		delete (dataserver.nsDurability, oldname)
+		dataserver.nsDurability[newname] = mode
+	}
+	dataserver.durabilityLock.Unlock()
+
+	return err.NoErr
+}
+
+/**
+ * Migrate a namespace of the file store from the flat layout (all the block files in
+ * the namespace's directory) to the sharded layout, while the namespace is in use.
+ * Blocks are moved one at a time under their lock; a block accessed before being
+ * reached is moved upon that access. An interrupted migration, e.g., by a restart,
+ * resumes when called again. Namespaces already sharded are left untouched.
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @return	System error handle; ErrNotAvailable if the namespace does not exist or
+ *		the block store is not a file store
+ */
+func NamespaceMigrate (dataserver *Server, name string) err.SysError {
+	if (dataserver == nil) { return err.ErrNotAvailable }
+	store, ok := baseStore (dataserver.store).(*FileStore)
+	if (!ok) { return err.ErrNotAvailable }
+
+	// Switching layouts requires the namespace to be idle. The checksums, chunk indexes,
+	// encryption metadata and references of the blocks, if any, are in files too and move
+	// with them; the unique blocks of deduplicated namespaces are shared and stay.
+	unlockns := dataserver.namespaces.lockKey (name)
+	if (!namespaceKnown (dataserver, name)) {
+		unlockns()
+		return err.ErrNotAvailable
+	}
+	var names []string
+	compressed := compressionNamespaceName (name)
+	encrypted := encryptionNamespaceName (name)
+	for _, n := range []string {name, checksumNamespaceName (name), compressed, checksumNamespaceName (compressed), encrypted, checksumNamespaceName (encrypted), dedupNamespaceName (name)} {
+		todo, myerr := store.startMigration (n)
+		if (myerr == err.ErrNotAvailable && n != name) { continue }
+		if (myerr != err.NoErr) { unlockns(); return myerr }
+		if (todo) { names = append (names, n) }
+	}
+	unlockns()
+	if (len (names) == 0) { return err.NoErr }
+	fmt.Println ("Migrating namespace", name, "to the sharded layout")
+
+	unlockns, myerr := useNamespace (dataserver, name, false)
+	if (myerr != err.NoErr) { return myerr }
+	for _, n := range names {
+		var blocks []uint64
+		blocks, myerr = store.List (n)
+		for _, blockid := range blocks {
+			if (myerr != err.NoErr) { break }
+			unlock := dataserver.blocks.lockBlock (name, blockid)
+			myerr = store.migrateBlock (n, blockid)
+			unlock()
+		}
+		if (myerr != err.NoErr) { break }
+	}
+	unlockns()
+	if (myerr != err.NoErr) { return myerr }
+
+	unlockns = dataserver.namespaces.lockKey (name)
+	defer unlockns()
+	if (!namespaceKnown (dataserver, name)) { return err.ErrNotAvailable }
+	for _, n := range names {
+		myerr = store.finishMigration (n)
+		if (myerr != err.NoErr) { return myerr }
+	}
+	fmt.Println ("Namespace", name, "migrated to the sharded layout")
+	return err.NoErr
+}
+
+/**
+ * Receive and handle a namespace management request. The message header has already
+ * been received.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	conn	Connection to the client
+ * @param[in]	msghdr	Header of the message
+ * @return	System error handle
+ */
+func handleNamespaceReq (server *Server, conn net.Conn, msghdr string) err.SysError {
+	if (msghdr == NSLISTREQ) {
+		names, myerr := NamespaceList (server)
+		if (myerr != err.NoErr) { return sendErrorReply (conn, myerr) }
+		return sendNamespaceList (conn, names)
+	}
+
+	name, recverr := recvString (conn, maxRequestNameLen)
+	if (recverr == err.ErrDataOverflow) { return refuseOverflow (conn, msghdr != NSSTATREQ) }
+	if (recverr != err.NoErr) { return recverr }
+	var blocksize uint64 = 0
+	var algo Compression = server.compression
+	if (msghdr == NSINITREQ || msghdr == NSINITCREQ) {
+		var syserr err.SysError
+		blocksize, syserr = comm.RecvUint64 (conn)
+		if (syserr != err.NoErr) { return err.ErrFatal }
+	}
+	if (msghdr == NSINITCREQ) {
+		code, syserr := comm.RecvUint64 (conn)
+		if (syserr != err.NoErr) { return err.ErrFatal }
+		algo = Compression (code)
+	}
+	newname := ""
+	if (msghdr == NSRENAMEREQ) {
+		newname, recverr = recvString (conn, maxRequestNameLen)
+		if (recverr == err.ErrDataOverflow) { return refuseOverflow (conn, true) }
+		if (recverr != err.NoErr) { return recverr }
+		if (!ValidNamespaceName (newname)) { return sendWriteAckStatus (conn, StatusInvalidNamespace, 0, false) }
+	}
+
+	var status uint64 = StatusOK
+	if (msghdr != NSINITREQ && msghdr != NSINITCREQ) { status = checkNamespace (server, name, false) }
+	if (status != StatusOK) {
+		if (msghdr == NSSTATREQ) { return sendStatusReply (conn, status) }
+		return sendWriteAckStatus (conn, status, 0, false)
+	}
+
+	var myerr err.SysError
+	switch msghdr {
+	case NSINITREQ, NSINITCREQ:
+		if (!ValidNamespaceName (name)) { return sendWriteAckStatus (conn, StatusInvalidNamespace, 0, false) }
+		if (algo.String () == "unknown") { return sendWriteAck (conn, err.ErrNotAvailable, 0, false) }
+		myerr = err.NoErr
+		if (msghdr == NSINITREQ && NamespaceInit (name, server, blocksize) == nil) { myerr = err.ErrFatal }
+		if (msghdr == NSINITCREQ && NamespaceInitWithCompression (name, server, blocksize, algo) == nil) { myerr = err.ErrFatal }
+	case NSSTATREQ:
+		stats, staterr := NamespaceStat (server, name)
+		if (staterr != err.NoErr) { return sendErrorReply (conn, staterr) }
+		return sendNamespaceStat (conn, stats)
+	case NSDELETEREQ:
+		myerr = NamespaceDelete (server, name)
+	case NSRENAMEREQ:
+		myerr = NamespaceRename (server, name, newname)
+	case NSMIGRATEREQ:
+		myerr = NamespaceMigrate (server, name)
+	case NSROTATEREQ:
+		myerr = NamespaceRotateKey (server, name)
+	}
+	return sendWriteAck (conn, myerr, 0, false)
+}
+
+/**
+ * Check whether a client can use a namespace
+ * @param[in]	server	Structure representing the server
+ * @param[in]	name	Namespace's name, as received from the client
+ * @param[in]	create	Whether the namespace can be created, depending on the server's policy
+ * @return	StatusOK if the namespace can be used; the status to report otherwise
+ */
+func checkNamespace (server *Server, name string, create bool) uint64 {
+	if (!ValidNamespaceName (name)) { return StatusInvalidNamespace }
+	if (namespaceKnown (server, name)) { return StatusOK }
+	if (create && server.autoCreate) { return StatusOK }
+	return StatusUnknownNamespace
+}
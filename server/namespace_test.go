@@ -0,0 +1,233 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings")
+
+import err "github.com/gvallee/syserror"
+
+func TestNamespaceManagement (t *testing.T) {
+	validTestPath := "/tmp/ns_test_mgmt/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	myserver := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8895")
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing namespace listing... ")
+	if (NamespaceInit ("tenant1", myserver, 0) == nil) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	names, myerr := NamespaceList (myserver)
+	if (myerr != err.NoErr || len (names) != 2 || names[0] != "default" || names[1] != "tenant1") { log.Fatal ("FATAL ERROR: Invalid list of namespaces: ", names) }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing namespace statistics... ")
+	data := make ([]byte, 4096)
+	BlockWrite (myserver, "tenant1", 0, 0, data)
+	BlockWrite (myserver, "tenant1", 7, 0, data[:100])
+	stats, myerr := NamespaceStat (myserver, "tenant1")
+	if (myerr != err.NoErr || stats.Blocks != 2 || stats.BytesUsed != 4196) { log.Fatal ("FATAL ERROR: Invalid namespace statistics: ", stats) }
+	_, myerr = NamespaceStat (myserver, "tenant2")
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Got statistics of a missing namespace") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing namespace renaming... ")
+	if (NamespaceRename (myserver, "tenant1", "default") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Renamed to an existing namespace") }
+	if (NamespaceRename (myserver, "tenant1", "tenant2") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot rename namespace") }
+	rs, _, myerr := BlockRead (myserver, "tenant2", 7, 0, 4096)
+	if (rs != 100 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot read renamed namespace") }
+	_, _, myerr = BlockRead (myserver, "tenant1", 7, 0, 4096)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Old namespace still readable") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing namespace deletion... ")
+	if (NamespaceDelete (myserver, "default") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Deleted the default namespace") }
+	if (NamespaceDelete (myserver, "tenant2") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	if (NamespaceDelete (myserver, "tenant2") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Deleted a missing namespace") }
+	names, _ = NamespaceList (myserver)
+	if (len (names) != 1) { log.Fatal ("FATAL ERROR: Namespace still listed") }
+	fmt.Println ("PASS")
+}
+
+func TestNamespaceValidation (t *testing.T) {
+	validTestPath := "/tmp/ns_test_validation/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing namespace names... ")
+	for _, name := range []string {"default", "ns_1", "Tenant-2.ckpt", "0"} {
+		if (!ValidNamespaceName (name)) { log.Fatal ("FATAL ERROR: Valid name rejected: ", name) }
+	}
+	long := make ([]byte, MaxNamespaceNameLen + 1)
+	for i := range long { long[i] = 'a' }
+	for _, name := range []string {"", ".", "..", "../../etc", "a/b", ".hidden", "-x", "a b", "ns\x00", string (long)} {
+		if (ValidNamespaceName (name)) { log.Fatal ("FATAL ERROR: Invalid name accepted: ", name) }
+	}
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing path traversal... ")
+	myserver := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8896")
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+
+	if (NamespaceInit ("../escape", myserver, 0) != nil) { log.Fatal ("FATAL ERROR: Created a namespace outside of the basedir") }
+	_, myerr := BlockWrite (myserver, "../../tmp", 0, 0, make ([]byte, 10))
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Wrote a block outside of the basedir") }
+	_, _, myerr = BlockRead (myserver, "..", 0, 0, 10)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Read a block outside of the basedir") }
+	if (NamespaceRename (myserver, "default", "../x") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Renamed a namespace outside of the basedir") }
+	fmt.Println ("PASS")
+}
+
+func TestNamespaceRegistry (t *testing.T) {
+	validTestPath := "/tmp/ns_test_registry/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath + "existing", 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	myserver := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8897")
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing namespaces loaded from the basedir... ")
+	_, myerr := BlockWrite (myserver, "existing", 0, 0, make ([]byte, 10))
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write to a namespace created by a previous server") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing unknown namespaces... ")
+	myerror = os.MkdirAll (validTestPath + "sneaky", 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create directory") }
+	_, myerr = BlockWrite (myserver, "sneaky", 0, 0, make ([]byte, 10))
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Wrote to a namespace that was never initialized") }
+	_, myerr = BlockWrite (myserver, "unknown", 0, 0, make ([]byte, 10))
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Wrote to an unknown namespace") }
+	_, myerror = os.Stat (validTestPath + "unknown")
+	if (!os.IsNotExist (myerror)) { log.Fatal ("FATAL ERROR: Unknown namespace was created") }
+	if (checkNamespace (myserver, "unknown", false) != StatusUnknownNamespace) { log.Fatal ("FATAL ERROR: Invalid status for an unknown namespace") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing namespace auto-creation... ")
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 1024 * 1024
+	cfg.URL = "127.0.0.1:8898"
+	cfg.AutoCreateNamespaces = true
+	autoserver := ServerInitWithConfig (&cfg)
+	if (autoserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer autoserver.Stop (context.Background ())
+	_, _, myerr = BlockRead (autoserver, "auto", 0, 0, 10)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Read created a namespace") }
+	_, myerr = BlockWrite (autoserver, "auto", 0, 0, make ([]byte, 10))
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Namespace was not created upon write") }
+	if (checkNamespace (autoserver, "other", true) != StatusOK) { log.Fatal ("FATAL ERROR: Invalid status with auto-creation") }
+	fmt.Println ("PASS")
+}
+
+func TestNamespaceBlocksize (t *testing.T) {
+	validTestPath := "/tmp/ns_test_blocksize/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	myserver := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8899")
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+
+	fmt.Print ("Testing namespace block size... ")
+	if (NamespaceInit ("small", myserver, 4096) == nil) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	if (NamespaceInit ("small", myserver, 8192) != nil) { log.Fatal ("FATAL ERROR: Changed the block size of a namespace") }
+	if (NamespaceInit ("small", myserver, 0) == nil) { log.Fatal ("FATAL ERROR: Cannot initialize an existing namespace") }
+	bs, myerr := GetNamespaceBlocksize (myserver, "small")
+	if (myerr != err.NoErr || bs != 4096) { log.Fatal ("FATAL ERROR: Invalid namespace block size: ", bs) }
+	_, myerr = BlockWrite (myserver, "small", 0, 4000, make ([]byte, 200))
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Wrote past the end of a block") }
+	_, myerr = BlockWrite (myserver, "default", 0, 4000, make ([]byte, 200))
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write to the default namespace") }
+	_, _, myerr = BlockRead (myserver, "small", 0, 0, 8192)
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Read past the end of a block") }
+	// Offsets and sizes whose sum wraps around
+	_, _, myerr = BlockRead (myserver, "small", 0, 1, math.MaxUint64)
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Read a huge amount of data") }
+	_, _, myerr = BlockRead (myserver, "small", 0, math.MaxUint64, 2)
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Read at a huge offset") }
+	_, myerr = BlockWrite (myserver, "small", 0, math.MaxUint64, make ([]byte, 1))
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Wrote at a huge offset") }
+	_, myerr = BlockWrite (myserver, "small", 0, math.MaxUint64 - 10, make ([]byte, 20))
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Wrote at a wrapping offset") }
+	if (BlockTruncate (myserver, "small", 0, math.MaxUint64) != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Truncated to a huge size") }
+	stats, myerr := NamespaceStat (myserver, "default")
+	if (myerr != err.NoErr || stats.BlockSize != 1024 * 1024) { log.Fatal ("FATAL ERROR: Invalid block size in statistics") }
+	myserver.Stop (context.Background ())
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing persistence of the namespace block size... ")
+	myserver = ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8899")
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot restart data server") }
+	defer myserver.Stop (context.Background ())
+	bs, _ = GetNamespaceBlocksize (myserver, "small")
+	if (bs != 4096) { log.Fatal ("FATAL ERROR: Block size of the namespace was not persisted") }
+	fmt.Println ("PASS")
+}
+
+func TestLongestNamespaceNames (t *testing.T) {
+	validTestPath := "/tmp/ns_test_longest/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+	path := "/tmp/ns_test_longest.keys"
+	defer os.Remove (path)
+	writeKeyFile (path, "1 " + testKey1 + "\n")
+	kf, _ := LoadKeyFile (path)
+
+	fmt.Print ("Testing namespaces with the longest names... ")
+	// Every store adds its companion namespaces
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 8192
+	cfg.URL = "127.0.0.1:8913"
+	cfg.Checksum = ChecksumCRC32C
+	cfg.Compression = CompressionLZ4
+	cfg.Encrypt = true
+	cfg.Keys = kf
+	cfg.Dedup = true
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+
+	name := strings.Repeat ("a", MaxNamespaceNameLen)
+	newname := strings.Repeat ("b", MaxNamespaceNameLen)
+	if (NamespaceInit (name, myserver, 0) == nil) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	_, myerr := BlockWrite (myserver, name, 0, 0, []byte ("longest"))
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	if (NamespaceRename (myserver, name, newname) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot rename namespace") }
+	if (NamespaceInit (name + "a", myserver, 0) != nil) { log.Fatal ("FATAL ERROR: Created a namespace with a name too long") }
+	if (myserver.Stop (context.Background ()) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot stop server") }
+
+	myserver = ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+	names, _ := NamespaceList (myserver)
+	if (len (names) != 2) { log.Fatal ("FATAL ERROR: Invalid namespaces after restart: ", names) }
+	rs, buff, myerr := BlockRead (myserver, newname, 0, 0, 7)
+	if (rs != 7 || myerr != err.NoErr || string (buff) != "longest") { log.Fatal ("FATAL ERROR: Invalid data after restart") }
+	fmt.Println ("PASS")
+}
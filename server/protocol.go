@@ -0,0 +1,457 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("net"
+	"encoding/binary")
+
+import err "github.com/gvallee/syserror"
+import comm "github.com/gvallee/fscomm"
+
+/*
+ * Messages the data server handles on top of the ones defined by fscomm. Headers have the
+ * same length than the fscomm ones (e.g., DATAMSG, READREQ). The fields of the requests
+ * are sent the same way than the ones of DATAMSG; the payload of the replies is sent
+ * with comm.SendMsg. Integers in the payloads are little-endian uint64.
+ *
+ * Names (namespaces, snapshots, "ns@s") cannot be longer than the one of a snapshot of
+ * a namespace and the data of a write cannot be larger than the namespace's blocks. A
+ * request with a longer field is refused with StatusDataOverflow, in a WRITEACK or an
+ * ERRREPLY as for its other errors (an ERRREPLY for DATAMSG), and the connection is
+ * closed: the rest of the request is not received.
+ */
+const (
+	// Reply to a request that failed: status code followed by the error message
+	ERRREPLY = "ERREPLY"
+
+	// Reply to a DATAACKMSG: status code, number of bytes written and whether the data
+	// was synced to disk (1) or not (0)
+	WRITEACK = "WRITACK"
+
+	// Write request with the fields of DATAMSG, for clients that want to know the
+	// outcome of the write: the server replies with a WRITEACK. A plain DATAMSG is
+	// not answered, so that clients can send several of them without waiting.
+	DATAACKMSG = "DATAACK"
+
+	// Request to sync all the data of a namespace: namespace length and namespace,
+	// as for DATAMSG. The server replies with a WRITEACK reporting 0 bytes, the
+	// synced flag tells whether all the data reached the disk.
+	FLUSHREQ = "FLUSHRQ"
+
+	// Read request returning how much of the data was actually written to the block:
+	// same fields than READREQ. The server replies with a RDXREPLY carrying the
+	// amount of valid data followed by the data (always of the requested size, the
+	// parts never written being zeros), or with an ERRREPLY.
+	READXREQ = "READXRQ"
+	RDXREPLY = "RDXREPL"
+
+	// Variants of DATAMSG and READXREQ carrying checksums, for clients verifying the
+	// data end to end. DATACKMSG has the fields of DATAMSG followed by a checksum
+	// algorithm (see Checksum) and the checksum of the data; the server verifies the
+	// data before writing it and replies with a WRITEACK, StatusChecksumMismatch
+	// if the data got corrupted on the way. READCKREQ has the fields of READREQ
+	// followed by a checksum algorithm; the server replies with a RDCKREPLY carrying
+	// the amount of valid data, the checksum of the data and the data itself (as for
+	// RDXREPLY), or with an ERRREPLY.
+	DATACKMSG = "DATACKM"
+	READCKREQ = "READCKR"
+	RDCKREPLY = "RDCKREP"
+
+	// Request to delete a block: namespace length, namespace and block id. The
+	// server replies with a WRITEACK reporting 0 bytes.
+	DELETEREQ = "DELETRQ"
+
+	// Request to truncate a block: namespace length, namespace, block id and new
+	// size. The server replies with a WRITEACK reporting 0 bytes.
+	TRUNCATEREQ = "TRUNCRQ"
+
+	// Namespace management. Names are sent as a length followed by the name, as
+	// for DATAMSG. NSINITREQ (one name and a block size, 0 for the server's one),
+	// NSINITCREQ (as NSINITREQ followed by a compression algorithm, see Compression),
+	// NSDELETEREQ (one name), NSRENAMEREQ (old and new names), NSMIGRATEREQ (one
+	// name, see NamespaceMigrate) and NSROTATEREQ (one name, see NamespaceRotateKey)
+	// are acknowledged with a WRITEACK reporting 0 bytes. NSLISTREQ (no field) is answered with a
+	// NSLISTREPLY: number of namespaces followed by the length and name of each of
+	// them. NSSTATREQ (one name) is answered with a NSSTATREPLY: number of blocks,
+	// bytes used, block size and bytes actually stored of the namespace. Errors are
+	// reported with an ERRREPLY.
+	NSINITREQ = "NSINITR"
+	NSINITCREQ = "NSINITC"
+	NSLISTREQ = "NSLISTR"
+	NSSTATREQ = "NSSTATR"
+	NSDELETEREQ = "NSDELER"
+	NSRENAMEREQ = "NSRENAR"
+	NSMIGRATEREQ = "NSMIGRR"
+	NSROTATEREQ = "NSROTAR"
+	NSLISTREPLY = "NSLISTP"
+	NSSTATREPLY = "NSSTATP"
+
+	// Scrubber administration: action (see ScrubActionStatus). Starting and cancelling
+	// a scrub are acknowledged with a WRITEACK reporting 0 bytes. The status is
+	// answered with a SCRUBREPLY: running and paused flags, number of passes, start
+	// and end times (Unix nanoseconds, 0 if unset), namespaces, blocks and bytes
+	// verified, number of problems found and number of problems detailed, followed
+	// for each of them by the namespace's length and name, the block id and the
+	// problem's length and description. Errors are reported with an ERRREPLY.
+	SCRUBREQ = "SCRUBRQ"
+	SCRUBREPLY = "SCRUBRP"
+
+	// Statistics of the deduplication (no field), answered with a DEDUPREPLY: unique
+	// blocks, references to them, bytes stored and bytes referenced, see DedupStats.
+	// Errors are reported with an ERRREPLY.
+	DEDUPREQ = "DEDUPRQ"
+	DEDUPREPLY = "DEDUPRP"
+
+	// Snapshot management: action (see SnapshotActionCreate), namespace's length and
+	// name, then, except to list the snapshots, snapshot's length and name. Listing is
+	// answered with a NSLISTREPLY carrying the names of the snapshots; the other
+	// actions are acknowledged with a WRITEACK reporting 0 bytes. The blocks of
+	// snapshot "s" of namespace "ns" are read with the read requests (READREQ,
+	// READXREQ, READCKREQ) on namespace "ns@s". Errors are reported with an ERRREPLY.
+	SNAPREQ = "SNAPREQ"
+)
+
+/*
+ * Status codes carried by replies. The first ones map one-to-one to the syserror codes
+ * so that clients get the same error than the one the server got; the other ones give
+ * more details about errors detected by the server before performing a request.
+ */
+const (
+	StatusOK uint64 = iota
+	StatusFatal
+	StatusNotAvailable
+	StatusDataOverflow
+	// The namespace's name is invalid (see ValidNamespaceName)
+	StatusInvalidNamespace
+	// The namespace was never initialized
+	StatusUnknownNamespace
+	// The data does not match the checksum sent along with it
+	StatusChecksumMismatch
+)
+
+var statusErrors = []err.SysError {
+	StatusOK:		err.NoErr,
+	StatusFatal:		err.ErrFatal,
+	StatusNotAvailable:	err.ErrNotAvailable,
+	StatusDataOverflow:	err.ErrDataOverflow,
+	StatusInvalidNamespace:	err.ErrNotAvailable,
+	StatusUnknownNamespace:	err.ErrNotAvailable,
+	StatusChecksumMismatch:	err.ErrFatal,
+}
+
+var statusMessages = map[uint64]string {
+	StatusInvalidNamespace:	"Invalid namespace name",
+	StatusUnknownNamespace:	"Unknown namespace",
+	StatusChecksumMismatch:	"Checksum mismatch",
+}
+
+/**
+ * Convert a system error into the status code sent over the wire
+ * @param[in]	syserr	System error handle
+ * @return	Status code
+ */
+func ErrorToStatus (syserr err.SysError) uint64 {
+	for code, e := range statusErrors {
+		if (e == syserr) { return uint64 (code) }
+	}
+	return StatusFatal
+}
+
+/**
+ * Convert a status code received over the wire into a system error
+ * @param[in]	code	Status code
+ * @return	System error handle
+ */
+func StatusToError (code uint64) err.SysError {
+	if (code >= uint64 (len (statusErrors))) { return err.ErrFatal }
+	return statusErrors[code]
+}
+
+func putUint64 (buff []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64 (b[:], v)
+	return append (buff, b[:]...)
+}
+
+func getUint64 (buff []byte) (uint64, []byte, err.SysError) {
+	if (len (buff) < 8) { return 0, buff, err.ErrFatal }
+	return binary.LittleEndian.Uint64 (buff), buff[8:], err.NoErr
+}
+
+/**
+ * Send an error reply to a client
+ * @param[in]	conn	Connection to the client
+ * @param[in]	syserr	Error to report
+ * @return	System error handle
+ */
+func sendErrorReply (conn net.Conn, syserr err.SysError) err.SysError {
+	payload := putUint64 (nil, ErrorToStatus (syserr))
+	payload = append (payload, []byte (syserr.Error())...)
+	return comm.SendMsg (conn, ERRREPLY, payload)
+}
+
+/**
+ * Send an error reply for a status code that has no syserror equivalent
+ * @param[in]	conn	Connection to the client
+ * @param[in]	code	Status code to report
+ * @return	System error handle
+ */
+func sendStatusReply (conn net.Conn, code uint64) err.SysError {
+	msg, ok := statusMessages[code]
+	if (!ok) { return sendErrorReply (conn, StatusToError (code)) }
+
+	payload := putUint64 (nil, code)
+	payload = append (payload, []byte (msg)...)
+	return comm.SendMsg (conn, ERRREPLY, payload)
+}
+
+/**
+ * Decode the payload of an error reply
+ * @param[in]	payload	Payload of the ERRREPLY message
+ * @return	Error reported by the server
+ * @return	Error message of the server
+ */
+func ParseErrorReply (payload []byte) (err.SysError, string) {
+	_, syserr, msg := ParseErrorReplyStatus (payload)
+	return syserr, msg
+}
+
+/**
+ * Decode the payload of an error reply, including the status code
+ * @param[in]	payload	Payload of the ERRREPLY message
+ * @return	Status code reported by the server
+ * @return	Error reported by the server
+ * @return	Error message of the server
+ */
+func ParseErrorReplyStatus (payload []byte) (uint64, err.SysError, string) {
+	code, msg, myerr := getUint64 (payload)
+	if (myerr != err.NoErr) { return StatusFatal, err.ErrFatal, "" }
+	return code, StatusToError (code), string (msg)
+}
+
+/**
+ * Send a write acknowledgement to a client
+ * @param[in]	conn	Connection to the client
+ * @param[in]	syserr	Outcome of the write
+ * @param[in]	written	Number of bytes written
+ * @param[in]	synced	Whether the data was synced to disk
+ * @return	System error handle
+ */
+func sendWriteAck (conn net.Conn, syserr err.SysError, written uint64, synced bool) err.SysError {
+	return sendWriteAckStatus (conn, ErrorToStatus (syserr), written, synced)
+}
+
+func sendWriteAckStatus (conn net.Conn, code uint64, written uint64, synced bool) err.SysError {
+	var flag uint64 = 0
+	if (synced) { flag = 1 }
+
+	payload := putUint64 (nil, code)
+	payload = putUint64 (payload, written)
+	payload = putUint64 (payload, flag)
+	return comm.SendMsg (conn, WRITEACK, payload)
+}
+
+/**
+ * Decode the payload of a write acknowledgement
+ * @param[in]	payload	Payload of the WRITEACK message
+ * @return	Number of bytes written
+ * @return	true if the data was synced to disk; false otherwise
+ * @return	Outcome of the write on the server
+ */
+func ParseWriteAck (payload []byte) (uint64, bool, err.SysError) {
+	code, payload, myerr := getUint64 (payload)
+	if (myerr != err.NoErr) { return 0, false, myerr }
+	written, payload, myerr := getUint64 (payload)
+	if (myerr != err.NoErr) { return 0, false, myerr }
+	flag, _, myerr := getUint64 (payload)
+	if (myerr != err.NoErr) { return 0, false, myerr }
+
+	return written, flag == 1, StatusToError (code)
+}
+
+/**
+ * Send the reply to a READXREQ
+ * @param[in]	conn	Connection to the client
+ * @param[in]	valid	Amount of valid data in the buffer
+ * @param[in]	data	Data read from the block
+ * @return	System error handle
+ */
+func sendReadReply (conn net.Conn, valid uint64, data []byte) err.SysError {
+	payload := putUint64 (nil, valid)
+	payload = append (payload, data...)
+	return comm.SendMsg (conn, RDXREPLY, payload)
+}
+
+/**
+ * Decode the payload of the reply to a READXREQ
+ * @param[in]	payload	Payload of the RDXREPLY message
+ * @return	Amount of valid data, in bytes
+ * @return	Data read from the block
+ * @return	System error handle
+ */
+func ParseReadReply (payload []byte) (uint64, []byte, err.SysError) {
+	valid, data, myerr := getUint64 (payload)
+	if (myerr != err.NoErr) { return 0, nil, myerr }
+	if (valid > uint64 (len (data))) { return 0, nil, err.ErrFatal }
+	return valid, data, err.NoErr
+}
+
+/**
+ * Send the reply to a READCKREQ
+ * @param[in]	conn	Connection to the client
+ * @param[in]	algo	Checksum algorithm requested by the client
+ * @param[in]	valid	Amount of valid data in the buffer
+ * @param[in]	data	Data read from the block
+ * @return	System error handle
+ */
+func sendChecksumReadReply (conn net.Conn, algo Checksum, valid uint64, data []byte) err.SysError {
+	payload := putUint64 (nil, valid)
+	payload = putUint64 (payload, algo.Sum (data))
+	payload = append (payload, data...)
+	return comm.SendMsg (conn, RDCKREPLY, payload)
+}
+
+/**
+ * Decode the payload of the reply to a READCKREQ and verify the data
+ * @param[in]	payload	Payload of the RDCKREPLY message
+ * @param[in]	algo	Checksum algorithm of the request
+ * @return	Amount of valid data, in bytes
+ * @return	Data read from the block
+ * @return	System error handle; ErrFatal if the data does not match its checksum
+ */
+func ParseChecksumReadReply (payload []byte, algo Checksum) (uint64, []byte, err.SysError) {
+	valid, payload, myerr := getUint64 (payload)
+	if (myerr != err.NoErr) { return 0, nil, myerr }
+	sum, data, myerr := getUint64 (payload)
+	if (myerr != err.NoErr) { return 0, nil, myerr }
+	if (valid > uint64 (len (data)) || algo.Sum (data) != sum) { return 0, nil, err.ErrFatal }
+	return valid, data, err.NoErr
+}
+
+// Maximum length of the names sent in requests, the longest being the ones of the
+// snapshots, e.g., "ns@s"
+const maxRequestNameLen uint64 = MaxNamespaceNameLen + uint64 (len (SnapshotSeparator)) + MaxSnapshotNameLen
+
+/**
+ * Receive a string sent as a length followed by the string itself. The length comes
+ * from the client, it is checked before anything is allocated for the string.
+ * @param[in]	conn	Connection to the client
+ * @param[in]	maxlen	Maximum length of the string
+ * @return	String
+ * @return	System error handle; ErrDataOverflow if the string is too long, in which
+ *		case it is not received (see refuseOverflow)
+ */
+func recvString (conn net.Conn, maxlen uint64) (string, err.SysError) {
+	strlen, syserr := comm.RecvUint64 (conn)
+	if (syserr != err.NoErr) { return "", err.ErrFatal }
+	if (strlen > maxlen) { return "", err.ErrDataOverflow }
+	str, strerr := comm.RecvNamespace (conn, strlen)
+	if (strerr != err.NoErr) { return "", err.ErrFatal }
+	return str, err.NoErr
+}
+
+/**
+ * Refuse a request with a field too large to be received. What follows the field
+ * cannot be skipped, the connection must then be closed.
+ * @param[in]	conn	Connection to the client
+ * @param[in]	ack	Whether the request is answered with a WRITEACK; with an ERRREPLY otherwise
+ * @return	ErrDataOverflow
+ */
+func refuseOverflow (conn net.Conn, ack bool) err.SysError {
+	if (ack) {
+		sendWriteAckStatus (conn, StatusDataOverflow, 0, false)
+	} else {
+		sendStatusReply (conn, StatusDataOverflow)
+	}
+	return err.ErrDataOverflow
+}
+
+func sendNamespaceList (conn net.Conn, names []string) err.SysError {
+	payload := putUint64 (nil, uint64 (len (names)))
+	for _, name := range names {
+		payload = putUint64 (payload, uint64 (len (name)))
+		payload = append (payload, []byte (name)...)
+	}
+	return comm.SendMsg (conn, NSLISTREPLY, payload)
+}
+
+/**
+ * Decode the payload of a NSLISTREPLY
+ * @param[in]	payload	Payload of the message
+ * @return	Names of the namespaces
+ * @return	System error handle
+ */
+func ParseNamespaceList (payload []byte) ([]string, err.SysError) {
+	count, payload, myerr := getUint64 (payload)
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	var names []string
+	for i := uint64 (0); i < count; i++ {
+		var namelen uint64
+		namelen, payload, myerr = getUint64 (payload)
+		if (myerr != err.NoErr || namelen > uint64 (len (payload))) { return nil, err.ErrFatal }
+		names = append (names, string (payload[:namelen]))
+		payload = payload[namelen:]
+	}
+	return names, err.NoErr
+}
+
+func sendNamespaceStat (conn net.Conn, stats NamespaceStats) err.SysError {
+	payload := putUint64 (nil, stats.Blocks)
+	payload = putUint64 (payload, stats.BytesUsed)
+	payload = putUint64 (payload, stats.BlockSize)
+	payload = putUint64 (payload, stats.PhysicalBytes)
+	return comm.SendMsg (conn, NSSTATREPLY, payload)
+}
+
+func sendDedupStats (conn net.Conn, stats DedupStats) err.SysError {
+	payload := putUint64 (nil, stats.UniqueBlocks)
+	payload = putUint64 (payload, stats.References)
+	payload = putUint64 (payload, stats.StoredBytes)
+	payload = putUint64 (payload, stats.LogicalBytes)
+	return comm.SendMsg (conn, DEDUPREPLY, payload)
+}
+
+/**
+ * Decode the payload of a DEDUPREPLY
+ * @param[in]	payload	Payload of the message
+ * @return	Statistics of the deduplication
+ * @return	System error handle
+ */
+func ParseDedupStats (payload []byte) (DedupStats, err.SysError) {
+	var stats DedupStats
+	var myerr err.SysError
+
+	for _, field := range []*uint64 {&stats.UniqueBlocks, &stats.References, &stats.StoredBytes, &stats.LogicalBytes} {
+		*field, payload, myerr = getUint64 (payload)
+		if (myerr != err.NoErr) { return stats, myerr }
+	}
+	return stats, err.NoErr
+}
+
+/**
+ * Decode the payload of a NSSTATREPLY
+ * @param[in]	payload	Payload of the message
+ * @return	Statistics of the namespace
+ * @return	System error handle
+ */
+func ParseNamespaceStat (payload []byte) (NamespaceStats, err.SysError) {
+	var stats NamespaceStats
+	var myerr err.SysError
+
+	stats.Blocks, payload, myerr = getUint64 (payload)
+	if (myerr != err.NoErr) { return stats, myerr }
+	stats.BytesUsed, payload, myerr = getUint64 (payload)
+	if (myerr != err.NoErr) { return stats, myerr }
+	stats.BlockSize, payload, myerr = getUint64 (payload)
+	if (myerr != err.NoErr) { return stats, myerr }
+	// Servers without compression do not send the physical size
+	stats.PhysicalBytes = stats.BytesUsed
+	if (len (payload) == 0) { return stats, err.NoErr }
+	stats.PhysicalBytes, payload, myerr = getUint64 (payload)
+	if (myerr != err.NoErr) { return stats, myerr }
+	return stats, err.NoErr
+}
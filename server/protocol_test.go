@@ -0,0 +1,415 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time")
+
+import err "github.com/gvallee/syserror"
+import comm "github.com/gvallee/fscomm"
+
+func TestStatusCodes (t *testing.T) {
+	fmt.Print ("Testing status code conversions... ")
+	errs := []err.SysError {err.NoErr, err.ErrFatal, err.ErrNotAvailable, err.ErrDataOverflow}
+	for _, e := range errs {
+		if (StatusToError (ErrorToStatus (e)) != e) { log.Fatal ("FATAL ERROR: Cannot convert ", e.Error()) }
+	}
+	if (StatusToError (1000) != err.ErrFatal) { log.Fatal ("FATAL ERROR: Unknown status code is not fatal") }
+	if (StatusToError (StatusInvalidNamespace) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Invalid conversion of server status code") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing error reply decoding... ")
+	payload := putUint64 (nil, ErrorToStatus (err.ErrDataOverflow))
+	payload = append (payload, []byte (err.ErrDataOverflow.Error())...)
+	e, msg := ParseErrorReply (payload)
+	if (e != err.ErrDataOverflow || msg != err.ErrDataOverflow.Error()) { log.Fatal ("FATAL ERROR: Invalid error reply") }
+	e, _ = ParseErrorReply ([]byte {1, 2})
+	if (e != err.ErrFatal) { log.Fatal ("FATAL ERROR: Truncated error reply accepted") }
+	code, e, _ := ParseErrorReplyStatus (putUint64 (nil, StatusInvalidNamespace))
+	if (code != StatusInvalidNamespace || e != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Invalid status in error reply") }
+	fmt.Println ("PASS")
+}
+
+func TestWriteAck (t *testing.T) {
+	fmt.Print ("Testing write acknowledgement decoding... ")
+	payload := putUint64 (nil, StatusOK)
+	payload = putUint64 (payload, 4096)
+	payload = putUint64 (payload, 1)
+	written, synced, e := ParseWriteAck (payload)
+	if (written != 4096 || !synced || e != err.NoErr) { log.Fatal ("FATAL ERROR: Invalid write ack") }
+
+	payload = putUint64 (nil, ErrorToStatus (err.ErrDataOverflow))
+	payload = putUint64 (payload, 0)
+	payload = putUint64 (payload, 0)
+	written, synced, e = ParseWriteAck (payload)
+	if (written != 0 || synced || e != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Invalid write ack for a failed write") }
+
+	_, _, e = ParseWriteAck (payload[:12])
+	if (e != err.ErrFatal) { log.Fatal ("FATAL ERROR: Truncated write ack accepted") }
+	fmt.Println ("PASS")
+}
+
+func TestReadReply (t *testing.T) {
+	fmt.Print ("Testing extended read reply decoding... ")
+	payload := putUint64 (nil, 2)
+	payload = append (payload, 1, 2, 0, 0)
+	valid, data, e := ParseReadReply (payload)
+	if (valid != 2 || len (data) != 4 || e != err.NoErr) { log.Fatal ("FATAL ERROR: Invalid read reply") }
+
+	payload = putUint64 (nil, 8)
+	_, _, e = ParseReadReply (append (payload, 1, 2))
+	if (e != err.ErrFatal) { log.Fatal ("FATAL ERROR: Inconsistent read reply accepted") }
+	fmt.Println ("PASS")
+}
+
+func TestNamespaceReplies (t *testing.T) {
+	fmt.Print ("Testing namespace replies decoding... ")
+	payload := putUint64 (nil, 2)
+	payload = putUint64 (payload, 7)
+	payload = append (payload, []byte ("default")...)
+	payload = putUint64 (payload, 2)
+	payload = append (payload, []byte ("ns")...)
+	names, e := ParseNamespaceList (payload)
+	if (e != err.NoErr || len (names) != 2 || names[0] != "default" || names[1] != "ns") { log.Fatal ("FATAL ERROR: Invalid namespace list") }
+	_, e = ParseNamespaceList (payload[:20])
+	if (e != err.ErrFatal) { log.Fatal ("FATAL ERROR: Truncated namespace list accepted") }
+
+	payload = putUint64 (nil, 3)
+	payload = putUint64 (payload, 4096)
+	payload = putUint64 (payload, 512)
+	stats, e := ParseNamespaceStat (payload)
+	if (e != err.NoErr || stats.Blocks != 3 || stats.BytesUsed != 4096 || stats.BlockSize != 512) { log.Fatal ("FATAL ERROR: Invalid namespace statistics") }
+	if (stats.PhysicalBytes != 4096) { log.Fatal ("FATAL ERROR: Invalid physical size without compression") }
+	stats, e = ParseNamespaceStat (putUint64 (payload, 1024))
+	if (e != err.NoErr || stats.PhysicalBytes != 1024) { log.Fatal ("FATAL ERROR: Invalid physical size") }
+	_, e = ParseNamespaceStat (payload[:16])
+	if (e != err.ErrFatal) { log.Fatal ("FATAL ERROR: Truncated namespace statistics accepted") }
+	fmt.Println ("PASS")
+}
+
+/**
+ * Create and start a server in an empty basedir, for the tests going through the
+ * protocol. The caller stops the server and removes the basedir.
+ */
+func startWireServer (cfg *ServerConfig) *Server {
+	myerror := os.RemoveAll (cfg.Basedir)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (cfg.Basedir, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+
+	myserver := ServerInitWithConfig (cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	if (myserver.Start () != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start the data server") }
+	return myserver
+}
+
+func dialServer (url string) net.Conn {
+	conn, _, myerr := comm.Connect2Server (url)
+	if (conn == nil || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot connect to the server") }
+	return conn
+}
+
+// Send the header of a request, then its fields: strings as a length followed by the
+// string, byte slices as a size followed by the data, integers as is
+func sendRequest (conn net.Conn, msghdr string, fields ...interface{}) {
+	if (comm.SendMsg (conn, msghdr, nil) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot send request") }
+	for _, field := range fields {
+		var raw []byte
+		switch v := field.(type) {
+		case uint64:
+			comm.SendUint64 (conn, v)
+		case string:
+			comm.SendUint64 (conn, uint64 (len (v)))
+			raw = []byte (v)
+		case []byte:
+			comm.SendUint64 (conn, uint64 (len (v)))
+			raw = v
+		}
+		if (len (raw) != 0) {
+			_, myerror := conn.Write (raw)
+			if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot send request") }
+		}
+	}
+}
+
+func recvReply (conn net.Conn) (string, []byte) {
+	conn.SetReadDeadline (time.Now ().Add (10 * time.Second))
+	msghdr, myerr := comm.GetHeader (conn)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: No reply received") }
+	size, myerr := comm.RecvUint64 (conn)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Truncated reply") }
+	payload, myerr := comm.DoRecvData (conn, size)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Truncated reply") }
+	return msghdr, payload
+}
+
+func recvWriteAck (conn net.Conn) (uint64, err.SysError) {
+	msghdr, payload := recvReply (conn)
+	if (msghdr != WRITEACK) { log.Fatal ("FATAL ERROR: Write acknowledgement expected, got ", msghdr) }
+	written, _, myerr := ParseWriteAck (payload)
+	return written, myerr
+}
+
+func recvErrorReply (conn net.Conn) err.SysError {
+	msghdr, payload := recvReply (conn)
+	if (msghdr != ERRREPLY) { log.Fatal ("FATAL ERROR: Error reply expected, got ", msghdr) }
+	myerr, _ := ParseErrorReply (payload)
+	return myerr
+}
+
+func writeBlockWire (conn net.Conn, namespace string, blockid uint64, offset uint64, data []byte) (uint64, err.SysError) {
+	sendRequest (conn, DATAACKMSG, namespace, blockid, offset, data)
+	return recvWriteAck (conn)
+}
+
+func readBlockWire (conn net.Conn, namespace string, blockid uint64, offset uint64, size uint64) (uint64, []byte, err.SysError) {
+	sendRequest (conn, READXREQ, namespace, blockid, offset, size)
+	msghdr, payload := recvReply (conn)
+	if (msghdr == ERRREPLY) {
+		myerr, _ := ParseErrorReply (payload)
+		return 0, nil, myerr
+	}
+	if (msghdr != RDXREPLY) { log.Fatal ("FATAL ERROR: Read reply expected, got ", msghdr) }
+	return ParseReadReply (payload)
+}
+
+// The server must have closed the connection, not just be silent
+func checkConnClosed (conn net.Conn) {
+	conn.SetReadDeadline (time.Now ().Add (10 * time.Second))
+	_, myerror := conn.Read (make ([]byte, 1))
+	if (myerror != io.EOF) { log.Fatal ("FATAL ERROR: Connection not closed by the server: ", myerror) }
+}
+
+func TestOversizedRequests (t *testing.T) {
+	var cfg ServerConfig
+	cfg.Basedir = "/tmp/ds_test_oversized/"
+	cfg.BlockSize = 4096
+	cfg.URL = "127.0.0.1:8914"
+	myserver := startWireServer (&cfg)
+	defer os.RemoveAll (cfg.Basedir)
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing requests with oversized lengths... ")
+	conn := dialServer (cfg.URL)
+	sendRequest (conn, DATAACKMSG, uint64 (1 << 62))
+	_, myerr := recvWriteAck (conn)
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Oversized namespace accepted") }
+	checkConnClosed (conn)
+	conn.Close()
+
+	conn = dialServer (cfg.URL)
+	sendRequest (conn, comm.DATAMSG, "default", uint64 (0), uint64 (0), uint64 (1 << 62))
+	if (recvErrorReply (conn) != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Oversized data accepted") }
+	checkConnClosed (conn)
+	conn.Close()
+
+	conn = dialServer (cfg.URL)
+	sendRequest (conn, DATAACKMSG, "default", uint64 (0), uint64 (0), uint64 (cfg.BlockSize + 1))
+	_, myerr = recvWriteAck (conn)
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Data larger than a block accepted") }
+	checkConnClosed (conn)
+	conn.Close()
+
+	conn = dialServer (cfg.URL)
+	sendRequest (conn, comm.READREQ, uint64 (1 << 62))
+	if (recvErrorReply (conn) != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Oversized namespace accepted") }
+	checkConnClosed (conn)
+	conn.Close()
+
+	conn = dialServer (cfg.URL)
+	sendRequest (conn, NSSTATREQ, uint64 (maxRequestNameLen + 1))
+	if (recvErrorReply (conn) != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Oversized namespace accepted") }
+	checkConnClosed (conn)
+	conn.Close()
+
+	conn = dialServer (cfg.URL)
+	sendRequest (conn, SNAPREQ, SnapshotActionCreate, "default", uint64 (1 << 62))
+	_, myerr = recvWriteAck (conn)
+	if (myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Oversized snapshot accepted") }
+	checkConnClosed (conn)
+	conn.Close()
+
+	// Other clients are still served
+	conn = dialServer (cfg.URL)
+	defer conn.Close()
+	sendRequest (conn, DATAACKMSG, "default", uint64 (0), uint64 (0), []byte ("hello"))
+	written, myerr := recvWriteAck (conn)
+	if (written != 5 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write after oversized requests") }
+	fmt.Println ("PASS")
+}
+
+func TestReadErrorReplies (t *testing.T) {
+	var cfg ServerConfig
+	cfg.Basedir = "/tmp/ds_test_read_errors/"
+	cfg.BlockSize = 4096
+	cfg.URL = "127.0.0.1:8916"
+	myserver := startWireServer (&cfg)
+	defer os.RemoveAll (cfg.Basedir)
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing error replies to failed reads... ")
+	conn := dialServer (cfg.URL)
+	defer conn.Close()
+	sendRequest (conn, comm.READREQ, "default", uint64 (99), uint64 (0), uint64 (10))
+	if (recvErrorReply (conn) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Invalid reply for a missing block") }
+	sendRequest (conn, comm.READREQ, "unknown", uint64 (0), uint64 (0), uint64 (10))
+	msghdr, payload := recvReply (conn)
+	code, _, _ := ParseErrorReplyStatus (payload)
+	if (msghdr != ERRREPLY || code != StatusUnknownNamespace) { log.Fatal ("FATAL ERROR: Invalid reply for an unknown namespace") }
+	sendRequest (conn, comm.READREQ, "default", uint64 (0), uint64 (4000), uint64 (200))
+	if (recvErrorReply (conn) != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Invalid reply for a read past the block") }
+
+	// The connection is still usable after the errors
+	writeBlockWire (conn, "default", 0, 0, []byte ("data"))
+	sendRequest (conn, comm.READREQ, "default", uint64 (0), uint64 (0), uint64 (4))
+	msghdr, payload = recvReply (conn)
+	if (msghdr != comm.RDREPLY || string (payload) != "data") { log.Fatal ("FATAL ERROR: Invalid read after errors") }
+	fmt.Println ("PASS")
+}
+
+func TestWriteAcknowledgements (t *testing.T) {
+	var cfg ServerConfig
+	cfg.Basedir = "/tmp/ds_test_write_acks/"
+	cfg.BlockSize = 4096
+	cfg.URL = "127.0.0.1:8917"
+	myserver := startWireServer (&cfg)
+	defer os.RemoveAll (cfg.Basedir)
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing write acknowledgements... ")
+	conn := dialServer (cfg.URL)
+	defer conn.Close()
+	// DATAMSG is not answered: the first reply is the one of the DATAACKMSG
+	for id := uint64 (0); id < 3; id++ {
+		sendRequest (conn, comm.DATAMSG, "default", id, uint64 (0), []byte ("pipelined"))
+	}
+	written, myerr := writeBlockWire (conn, "default", 3, 10, []byte ("acknowledged"))
+	if (written != 12 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Invalid write acknowledgement: ", written) }
+	for id := uint64 (0); id < 3; id++ {
+		valid, data, myerr := readBlockWire (conn, "default", id, 0, 9)
+		if (valid != 9 || myerr != err.NoErr || string (data) != "pipelined") { log.Fatal ("FATAL ERROR: Unacknowledged write lost") }
+	}
+	written, myerr = writeBlockWire (conn, "default", 3, 4000, make ([]byte, 200))
+	if (written != 0 || myerr != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Invalid acknowledgement of a failed write") }
+	fmt.Println ("PASS")
+}
+
+func TestNamespaceRequests (t *testing.T) {
+	var cfg ServerConfig
+	cfg.Basedir = "/tmp/ds_test_ns_requests/"
+	cfg.BlockSize = 8192
+	cfg.URL = "127.0.0.1:8918"
+	myserver := startWireServer (&cfg)
+	defer os.RemoveAll (cfg.Basedir)
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing namespace requests... ")
+	conn := dialServer (cfg.URL)
+	defer conn.Close()
+	sendRequest (conn, NSINITREQ, "jobs", uint64 (4096))
+	_, myerr := recvWriteAck (conn)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	writeBlockWire (conn, "jobs", 0, 0, make ([]byte, 1000))
+	writeBlockWire (conn, "jobs", 1, 0, make ([]byte, 24))
+
+	sendRequest (conn, NSSTATREQ, "jobs")
+	msghdr, payload := recvReply (conn)
+	stats, myerr := ParseNamespaceStat (payload)
+	if (msghdr != NSSTATREPLY || myerr != err.NoErr || stats.Blocks != 2 || stats.BytesUsed != 1024 || stats.BlockSize != 4096) { log.Fatal ("FATAL ERROR: Invalid namespace statistics: ", stats) }
+	sendRequest (conn, NSLISTREQ)
+	msghdr, payload = recvReply (conn)
+	names, myerr := ParseNamespaceList (payload)
+	if (msghdr != NSLISTREPLY || myerr != err.NoErr || len (names) != 2) { log.Fatal ("FATAL ERROR: Invalid namespace list: ", names) }
+
+	sendRequest (conn, NSDELETEREQ, "jobs")
+	_, myerr = recvWriteAck (conn)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	sendRequest (conn, NSSTATREQ, "jobs")
+	msghdr, payload = recvReply (conn)
+	code, _, _ := ParseErrorReplyStatus (payload)
+	if (msghdr != ERRREPLY || code != StatusUnknownNamespace) { log.Fatal ("FATAL ERROR: Deleted namespace still known") }
+	sendRequest (conn, NSDELETEREQ, "default")
+	_, myerr = recvWriteAck (conn)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Deleted the default namespace") }
+	fmt.Println ("PASS")
+}
+
+func TestChecksumRequests (t *testing.T) {
+	var cfg ServerConfig
+	cfg.Basedir = "/tmp/ds_test_checksum_requests/"
+	cfg.BlockSize = 4096
+	cfg.URL = "127.0.0.1:8919"
+	cfg.Checksum = ChecksumCRC32C
+	myserver := startWireServer (&cfg)
+	defer os.RemoveAll (cfg.Basedir)
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing writes and reads with checksums... ")
+	conn := dialServer (cfg.URL)
+	defer conn.Close()
+	data := []byte ("end to end")
+	sendRequest (conn, DATACKMSG, "default", uint64 (0), uint64 (0), data, uint64 (ChecksumCRC32C), ChecksumCRC32C.Sum (data) + 1)
+	msghdr, payload := recvReply (conn)
+	code, _, _ := getUint64 (payload)
+	if (msghdr != WRITEACK || code != StatusChecksumMismatch) { log.Fatal ("FATAL ERROR: Corrupted data accepted") }
+	_, _, myerr := readBlockWire (conn, "default", 0, 0, 10)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Corrupted data written") }
+
+	sendRequest (conn, DATACKMSG, "default", uint64 (0), uint64 (0), data, uint64 (ChecksumCRC32C), ChecksumCRC32C.Sum (data))
+	written, myerr := recvWriteAck (conn)
+	if (written != uint64 (len (data)) || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write data with its checksum") }
+
+	sendRequest (conn, READCKREQ, "default", uint64 (0), uint64 (0), uint64 (16), uint64 (ChecksumCRC32C))
+	msghdr, payload = recvReply (conn)
+	if (msghdr != RDCKREPLY) { log.Fatal ("FATAL ERROR: Checksum read reply expected, got ", msghdr) }
+	expected := append (append ([]byte {}, data...), make ([]byte, 6)...)
+	_, rest, _ := getUint64 (payload)
+	sum, _, _ := getUint64 (rest)
+	if (sum != ChecksumCRC32C.Sum (expected)) { log.Fatal ("FATAL ERROR: Invalid checksum in the reply") }
+	valid, buff, myerr := ParseChecksumReadReply (payload, ChecksumCRC32C)
+	if (valid != uint64 (len (data)) || myerr != err.NoErr || !bytes.Equal (buff, expected)) { log.Fatal ("FATAL ERROR: Invalid data in the reply") }
+	sendRequest (conn, READCKREQ, "default", uint64 (0), uint64 (0), uint64 (16), uint64 (ChecksumNone))
+	if (recvErrorReply (conn) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Read without a checksum algorithm accepted") }
+	fmt.Println ("PASS")
+}
+
+func TestSnapshotRequests (t *testing.T) {
+	var cfg ServerConfig
+	cfg.Basedir = "/tmp/ds_test_snapshot_requests/"
+	cfg.BlockSize = 4096
+	cfg.URL = "127.0.0.1:8920"
+	myserver := startWireServer (&cfg)
+	defer os.RemoveAll (cfg.Basedir)
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing reading snapshots over the protocol... ")
+	conn := dialServer (cfg.URL)
+	defer conn.Close()
+	writeBlockWire (conn, "default", 0, 0, []byte ("before"))
+	sendRequest (conn, SNAPREQ, SnapshotActionCreate, "default", "s1")
+	_, myerr := recvWriteAck (conn)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create snapshot") }
+	writeBlockWire (conn, "default", 0, 0, []byte ("after!"))
+
+	sendRequest (conn, comm.READREQ, "default@s1", uint64 (0), uint64 (0), uint64 (6))
+	msghdr, payload := recvReply (conn)
+	if (msghdr != comm.RDREPLY || string (payload) != "before") { log.Fatal ("FATAL ERROR: Invalid snapshot data: ", string (payload)) }
+	sendRequest (conn, comm.READREQ, "default", uint64 (0), uint64 (0), uint64 (6))
+	msghdr, payload = recvReply (conn)
+	if (msghdr != comm.RDREPLY || string (payload) != "after!") { log.Fatal ("FATAL ERROR: Invalid namespace data: ", string (payload)) }
+	sendRequest (conn, comm.READREQ, "default@unknown", uint64 (0), uint64 (0), uint64 (6))
+	if (recvErrorReply (conn) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Read an unknown snapshot") }
+	_, myerr = writeBlockWire (conn, "default@s1", 0, 0, []byte ("x"))
+	if (myerr == err.NoErr) { log.Fatal ("FATAL ERROR: Wrote to a snapshot") }
+	fmt.Println ("PASS")
+}
@@ -0,0 +1,27 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+//go:build linux
+
+package server
+
+import ("os"
+	"syscall")
+
+// FICLONE ioctl, sharing all the data of a file with another one
+const ficlone = 0x40049409
+
+/**
+ * Make a file share the data of another file, without copying it, if the file system
+ * supports it
+ * @param[in]	dst	File getting the data, replaced entirely
+ * @param[in]	src	File to share the data of
+ * @return	Error if the data could not be shared, nil otherwise
+ */
+func reflink (dst *os.File, src *os.File) error {
+	_, _, errno := syscall.Syscall (syscall.SYS_IOCTL, dst.Fd (), ficlone, src.Fd ())
+	if (errno != 0) { return errno }
+	return nil
+}
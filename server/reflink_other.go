@@ -0,0 +1,21 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+//go:build !linux
+
+package server
+
+import ("os"
+	"errors")
+
+/**
+ * Make a file share the data of another file, not supported on this platform
+ * @param[in]	dst	File getting the data
+ * @param[in]	src	File to share the data of
+ * @return	Error, always
+ */
+func reflink (dst *os.File, src *os.File) error {
+	return errors.New ("reflinks not supported")
+}
@@ -0,0 +1,510 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("net"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"path/filepath")
+
+import err "github.com/gvallee/syserror"
+import comm "github.com/gvallee/fscomm"
+
+// Name of the file keeping the report of the last scrub, in the basedir
+const scrubReportName = ".scrub"
+
+// Default maximum amount of data verified per second by the scrubber
+const DefaultScrubRate = 16 * 1024 * 1024
+
+// Default client load, in block operations per second, above which scrubbing pauses
+const DefaultScrubMaxLoad = 1000
+
+// Maximum number of problems detailed in a scrub report; the other ones are only counted
+const MaxScrubFindings = 1024
+
+// Period over which the client load is measured
+const scrubLoadWindow = 100 * time.Millisecond
+
+// Actions of a SCRUBREQ
+const (
+	// Get the report of the scrub in progress or of the last one
+	ScrubActionStatus uint64 = iota
+	// Start a scrub now
+	ScrubActionStart
+	// Stop the scrub in progress
+	ScrubActionCancel
+)
+
+/**
+ * Problem found by the scrubber on a block
+ */
+type ScrubFinding struct {
+	Namespace	string	`json:"namespace"`	// e.g., "ns@s" for snapshot "s" of namespace "ns"
+	BlockID		uint64	`json:"block_id"`
+	Problem		string	`json:"problem"`
+}
+
+/**
+ * Progress and results of a scrub, i.e., a pass over all the blocks of the server
+ */
+type ScrubReport struct {
+	Running		bool		`json:"-"`
+	Paused		bool		`json:"-"`	// Waiting for the client load to drop
+	Passes		uint64		`json:"passes"`	// Number of scrubs completed or cancelled
+	Started		time.Time	`json:"started"`
+	Finished	time.Time	`json:"finished"`	// Zero while running
+	Namespaces	uint64		`json:"namespaces"`	// Namespaces scrubbed so far
+	Blocks		uint64		`json:"blocks"`	// Blocks verified so far
+	Bytes		uint64		`json:"bytes"`	// Data verified so far
+	Errors		uint64		`json:"errors"`	// Number of problems found
+	Findings	[]ScrubFinding	`json:"findings"`	// First MaxScrubFindings problems
+}
+
+/**
+ * State of the scrubber of a server
+ */
+type scrubber struct {
+	interval	time.Duration	// Time between two scrubs; 0 to scrub only upon request
+	rate		uint64
+	maxLoad		uint64
+	trigger		chan struct{}	// Start a scrub now
+
+	lock		sync.Mutex
+	report		ScrubReport
+	cancel		bool
+}
+
+/**
+ * Measure of the client load, in block operations per second
+ */
+type scrubLoad struct {
+	ops	uint64
+	sampled	time.Time
+	load	float64
+}
+
+func newScrubber (interval time.Duration, rate uint64, maxLoad uint64) *scrubber {
+	s := new (scrubber)
+	s.interval = interval
+	s.rate = rate
+	if (s.rate == 0) { s.rate = DefaultScrubRate }
+	s.maxLoad = maxLoad
+	if (s.maxLoad == 0) { s.maxLoad = DefaultScrubMaxLoad }
+	s.trigger = make (chan struct{}, 1)
+	return s
+}
+
+/**
+ * Count a client operation on a block, for the scrubber to back off under load
+ * @param[in]	ds	Structure representing the server
+ */
+func countClientOp (dataserver *Server) {
+	atomic.AddUint64 (&dataserver.ioOps, 1)
+}
+
+/**
+ * Wait for some time, unless the server stops
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	d	Time to wait
+ * @return	false if the server is stopping; true otherwise
+ */
+func scrubSleep (dataserver *Server, d time.Duration) bool {
+	if (d <= 0) { return !isStopping (dataserver) }
+	timer := time.NewTimer (d)
+	defer timer.Stop()
+	select {
+	case <-dataserver.stopping:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+/**
+ * Wait until the scrubber can verify the next block: the client load must be low enough.
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	load	Client load measured so far
+ * @return	false if the scrub must stop (server stopping or scrub cancelled); true otherwise
+ */
+func scrubWait (dataserver *Server, load *scrubLoad) bool {
+	s := dataserver.scrub
+	for {
+		s.lock.Lock()
+		cancelled := s.cancel
+		s.lock.Unlock()
+		if (cancelled || isStopping (dataserver)) { return false }
+
+		now := time.Now ()
+		ops := atomic.LoadUint64 (&dataserver.ioOps)
+		elapsed := now.Sub (load.sampled)
+		if (elapsed >= scrubLoadWindow) {
+			load.load = float64 (ops - load.ops) / elapsed.Seconds ()
+			load.ops = ops
+			load.sampled = now
+		}
+
+		paused := (load.load > float64 (s.maxLoad))
+		s.lock.Lock()
+		if (paused && !s.report.Paused) { fmt.Println ("Client load is high, scrubbing paused") }
+		s.report.Paused = paused
+		s.lock.Unlock()
+		if (!paused) { return true }
+		if (!scrubSleep (dataserver, scrubLoadWindow)) { return false }
+	}
+}
+
+/**
+ * Verify a block: its size must fit in the namespace's blocks and all its data must be
+ * readable, which includes matching its checksums if it has some (see ChecksumStore).
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	namespace	Namespace of the block, or snapshot, e.g., "ns@s"
+ * @param[in]	blockid	Block id
+ * @param[in]	buff	Buffer of the size of the namespace's blocks
+ * @return	Amount of data verified
+ * @return	Description of the problem found; empty if the block is fine or no longer exists
+ */
+func scrubBlock (dataserver *Server, namespace string, blockid uint64, buff []byte) (uint64, string) {
+	// As for BlockRead, a snapshot shares the locks of its namespace
+	name, _ := splitSnapshotName (namespace)
+	unlockns, myerr := useNamespace (dataserver, name, false)
+	if (myerr != err.NoErr) { return 0, "" }
+	defer unlockns()
+	unlock := dataserver.blocks.rlockBlock (name, blockid)
+	defer unlock()
+
+	size, myerr := dataserver.store.Stat (namespace, blockid)
+	if (myerr == err.ErrNotAvailable) { return 0, "" } // Deleted in the meantime
+	if (myerr != err.NoErr) { return 0, "cannot get the size of the block" }
+	if (size > uint64 (len (buff))) { return 0, fmt.Sprintf ("size of %d bytes exceeds the block size of %d bytes", size, len (buff)) }
+
+	rs, myerr := dataserver.store.Read (namespace, blockid, 0, buff)
+	if (myerr == err.ErrNotAvailable) { return 0, "" }
+	if (myerr != err.NoErr) { return size, "data unreadable or not matching its checksums" }
+	if (uint64 (rs) != size) { return size, fmt.Sprintf ("%d bytes readable out of %d", rs, size) }
+	return size, ""
+}
+
+/**
+ * Scrub all the blocks of a namespace, or the blocks of a snapshot that are not shared
+ * with its namespace, the other ones being scrubbed with the namespace
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	namespace	Namespace's name, or snapshot's, e.g., "ns@s"
+ * @param[in]	load	Client load measured so far
+ * @return	false if the scrub must stop; true otherwise
+ */
+func scrubNamespace (dataserver *Server, namespace string, load *scrubLoad) bool {
+	s := dataserver.scrub
+
+	name, snapshot := splitSnapshotName (namespace)
+	unlockns, myerr := useNamespace (dataserver, name, false)
+	if (myerr != err.NoErr) { return true } // Deleted in the meantime
+	var blocks []uint64
+	if (snapshot == "") {
+		blocks, myerr = dataserver.store.List (namespace)
+	} else {
+		blocks, myerr = snapshotStore (dataserver.store).copies (name, snapshot)
+		if (myerr == err.ErrNotAvailable) { unlockns(); return true }
+	}
+	blocksize, _ := GetNamespaceBlocksize (dataserver, name)
+	unlockns()
+	if (myerr != err.NoErr) {
+		recordScrubFinding (s, ScrubFinding {namespace, 0, "cannot list the blocks of the namespace"})
+		return true
+	}
+
+	sort.Slice (blocks, func (i, j int) bool { return blocks[i] < blocks[j] })
+	buff := make ([]byte, blocksize)
+	for _, blockid := range blocks {
+		if (!scrubWait (dataserver, load)) { return false }
+		size, problem := scrubBlock (dataserver, namespace, blockid, buff)
+		if (problem != "") {
+			fmt.Println ("Scrub: block", blockid, "of namespace", namespace, ":", problem)
+			recordScrubFinding (s, ScrubFinding {namespace, blockid, problem})
+		}
+
+		s.lock.Lock()
+		s.report.Blocks += 1
+		s.report.Bytes += size
+		s.lock.Unlock()
+
+		// Rate limit, the time spent reading the block is not deducted
+		if (!scrubSleep (dataserver, time.Duration (float64 (size) / float64 (s.rate) * float64 (time.Second)))) { return false }
+	}
+
+	if (snapshot == "") {
+		s.lock.Lock()
+		s.report.Namespaces += 1
+		s.lock.Unlock()
+	}
+	return true
+}
+
+/**
+ * Scrub the blocks only the snapshots of a namespace still have (see scrubNamespace)
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	namespace	Namespace's name
+ * @param[in]	load	Client load measured so far
+ * @return	false if the scrub must stop; true otherwise
+ */
+func scrubSnapshots (dataserver *Server, namespace string, load *scrubLoad) bool {
+	snapshots, _ := SnapshotList (dataserver, namespace)
+	for _, snapshot := range snapshots {
+		if (!scrubNamespace (dataserver, namespace + SnapshotSeparator + snapshot, load)) { return false }
+	}
+	return true
+}
+
+func recordScrubFinding (s *scrubber, finding ScrubFinding) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.report.Errors += 1
+	if (len (s.report.Findings) < MaxScrubFindings) { s.report.Findings = append (s.report.Findings, finding) }
+}
+
+/**
+ * Scrub all the blocks of the server, then record the report in the basedir
+ * @param[in]	ds	Structure representing the server
+ */
+func scrubPass (dataserver *Server) {
+	s := dataserver.scrub
+	s.lock.Lock()
+	s.report = ScrubReport {Running: true, Passes: s.report.Passes, Started: time.Now ().UTC ()}
+	s.cancel = false
+	s.lock.Unlock()
+	fmt.Println ("Scrubbing all the blocks...")
+
+	load := scrubLoad {atomic.LoadUint64 (&dataserver.ioOps), time.Now (), 0}
+	names, _ := NamespaceList (dataserver)
+	for _, name := range names {
+		if (!scrubNamespace (dataserver, name, &load)) { break }
+		if (!scrubSnapshots (dataserver, name, &load)) { break }
+	}
+
+	s.lock.Lock()
+	s.report.Running = false
+	s.report.Paused = false
+	s.report.Passes += 1
+	s.report.Finished = time.Now ().UTC ()
+	report := s.report
+	s.lock.Unlock()
+	fmt.Println ("Scrub done:", report.Blocks, "block(s) verified,", report.Errors, "problem(s) found")
+
+	if (dataserver.basedir != "") { writeJSONFile (filepath.Join (dataserver.basedir, scrubReportName), report) }
+}
+
+/**
+ * Scrub the blocks of the server upon request and at regular intervals, until the
+ * server stops.
+ * @param[in]	ds	Structure representing the server
+ */
+func runScrubber (dataserver *Server) {
+	defer dataserver.background.Done()
+	s := dataserver.scrub
+
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if (s.interval > 0) {
+			timer = time.NewTimer (s.interval)
+			timeout = timer.C
+		}
+		stopping := false
+		select {
+		case <-dataserver.stopping:
+			stopping = true
+		case <-s.trigger:
+		case <-timeout:
+		}
+		if (timer != nil) { timer.Stop() }
+		if (stopping) { return }
+		scrubPass (dataserver)
+	}
+}
+
+/**
+ * Load the report of the last scrub of a basedir, if any
+ * @param[in]	ds	Structure representing the server
+ * @return	System error handle
+ */
+func loadScrubReport (dataserver *Server) err.SysError {
+	if (dataserver.basedir == "") { return err.NoErr }
+	var report ScrubReport
+	myerr := readJSONFile (filepath.Join (dataserver.basedir, scrubReportName), &report)
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	if (myerr != err.NoErr) { return myerr }
+	dataserver.scrub.report = report
+	return err.NoErr
+}
+
+/**
+ * Start scrubbing all the blocks of the server in the background. The scrub is rate
+ * limited and pauses while the client load is high.
+ * @param[in]	ds	Structure representing the server
+ * @return	System error handle; ErrNotAvailable if a scrub is already in progress
+ */
+func ScrubStart (dataserver *Server) err.SysError {
+	if (dataserver == nil) { return err.ErrNotAvailable }
+	s := dataserver.scrub
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if (s.report.Running) { return err.ErrNotAvailable }
+	select {
+	case s.trigger <- struct{}{}:
+		return err.NoErr
+	default:
+		return err.ErrNotAvailable
+	}
+}
+
+/**
+ * Stop the scrub in progress. The partial report is kept.
+ * @param[in]	ds	Structure representing the server
+ * @return	System error handle; ErrNotAvailable if no scrub is in progress
+ */
+func ScrubCancel (dataserver *Server) err.SysError {
+	if (dataserver == nil) { return err.ErrNotAvailable }
+	s := dataserver.scrub
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if (!s.report.Running) { return err.ErrNotAvailable }
+	s.cancel = true
+	return err.NoErr
+}
+
+/**
+ * Get the report of the scrub in progress or, if none, of the last scrub, including the
+ * ones of previous instances of the server
+ * @param[in]	ds	Structure representing the server
+ * @return	Scrub report
+ * @return	System error handle
+ */
+func ScrubStatus (dataserver *Server) (ScrubReport, err.SysError) {
+	if (dataserver == nil) { return ScrubReport {}, err.ErrNotAvailable }
+	s := dataserver.scrub
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	report := s.report
+	report.Findings = append ([]ScrubFinding (nil), s.report.Findings...)
+	return report, err.NoErr
+}
+
+func putTime (buff []byte, t time.Time) []byte {
+	if (t.IsZero ()) { return putUint64 (buff, 0) }
+	return putUint64 (buff, uint64 (t.UnixNano ()))
+}
+
+func getTime (buff []byte) (time.Time, []byte, err.SysError) {
+	v, buff, myerr := getUint64 (buff)
+	if (myerr != err.NoErr || v == 0) { return time.Time {}, buff, myerr }
+	return time.Unix (0, int64 (v)).UTC (), buff, err.NoErr
+}
+
+func putBool (buff []byte, b bool) []byte {
+	if (b) { return putUint64 (buff, 1) }
+	return putUint64 (buff, 0)
+}
+
+func scrubReportPayload (report ScrubReport) []byte {
+	payload := putBool (nil, report.Running)
+	payload = putBool (payload, report.Paused)
+	payload = putUint64 (payload, report.Passes)
+	payload = putTime (payload, report.Started)
+	payload = putTime (payload, report.Finished)
+	payload = putUint64 (payload, report.Namespaces)
+	payload = putUint64 (payload, report.Blocks)
+	payload = putUint64 (payload, report.Bytes)
+	payload = putUint64 (payload, report.Errors)
+	payload = putUint64 (payload, uint64 (len (report.Findings)))
+	for _, finding := range report.Findings {
+		payload = putUint64 (payload, uint64 (len (finding.Namespace)))
+		payload = append (payload, []byte (finding.Namespace)...)
+		payload = putUint64 (payload, finding.BlockID)
+		payload = putUint64 (payload, uint64 (len (finding.Problem)))
+		payload = append (payload, []byte (finding.Problem)...)
+	}
+	return payload
+}
+
+func sendScrubReport (conn net.Conn, report ScrubReport) err.SysError {
+	return comm.SendMsg (conn, SCRUBREPLY, scrubReportPayload (report))
+}
+
+func getString (buff []byte) (string, []byte, err.SysError) {
+	strlen, buff, myerr := getUint64 (buff)
+	if (myerr != err.NoErr || strlen > uint64 (len (buff))) { return "", buff, err.ErrFatal }
+	return string (buff[:strlen]), buff[strlen:], err.NoErr
+}
+
+/**
+ * Decode the payload of a SCRUBREPLY
+ * @param[in]	payload	Payload of the message
+ * @return	Scrub report
+ * @return	System error handle
+ */
+func ParseScrubReport (payload []byte) (ScrubReport, err.SysError) {
+	var report ScrubReport
+	var running, paused, count uint64
+	var myerr err.SysError
+
+	fields := []*uint64 {&running, &paused, &report.Passes}
+	for _, field := range fields {
+		*field, payload, myerr = getUint64 (payload)
+		if (myerr != err.NoErr) { return report, myerr }
+	}
+	report.Running = (running == 1)
+	report.Paused = (paused == 1)
+	report.Started, payload, myerr = getTime (payload)
+	if (myerr != err.NoErr) { return report, myerr }
+	report.Finished, payload, myerr = getTime (payload)
+	if (myerr != err.NoErr) { return report, myerr }
+	fields = []*uint64 {&report.Namespaces, &report.Blocks, &report.Bytes, &report.Errors, &count}
+	for _, field := range fields {
+		*field, payload, myerr = getUint64 (payload)
+		if (myerr != err.NoErr) { return report, myerr }
+	}
+
+	for i := uint64 (0); i < count; i++ {
+		var finding ScrubFinding
+		finding.Namespace, payload, myerr = getString (payload)
+		if (myerr != err.NoErr) { return report, myerr }
+		finding.BlockID, payload, myerr = getUint64 (payload)
+		if (myerr != err.NoErr) { return report, myerr }
+		finding.Problem, payload, myerr = getString (payload)
+		if (myerr != err.NoErr) { return report, myerr }
+		report.Findings = append (report.Findings, finding)
+	}
+	return report, err.NoErr
+}
+
+/**
+ * Receive and handle a SCRUBREQ. The message header has already been received.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	conn	Connection to the client
+ * @return	System error handle
+ */
+func handleScrubReq (server *Server, conn net.Conn) err.SysError {
+	action, syserr := comm.RecvUint64 (conn)
+	if (syserr != err.NoErr) { return err.ErrFatal }
+
+	switch action {
+	case ScrubActionStatus:
+		report, myerr := ScrubStatus (server)
+		if (myerr != err.NoErr) { return sendErrorReply (conn, myerr) }
+		return sendScrubReport (conn, report)
+	case ScrubActionStart:
+		return sendWriteAck (conn, ScrubStart (server), 0, false)
+	case ScrubActionCancel:
+		return sendWriteAck (conn, ScrubCancel (server), 0, false)
+	}
+	return sendErrorReply (conn, err.ErrNotAvailable)
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time")
+
+import err "github.com/gvallee/syserror"
+
+func waitScrub (myserver *Server, passes uint64) ScrubReport {
+	for i := 0; i < 500; i++ {
+		report, _ := ScrubStatus (myserver)
+		if (report.Passes >= passes && !report.Running) { return report }
+		time.Sleep (10 * time.Millisecond)
+	}
+	log.Fatal ("FATAL ERROR: Scrub did not complete")
+	return ScrubReport {}
+}
+
+func TestScrub (t *testing.T) {
+	validTestPath := "/tmp/ds_test_scrub/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing scrubbing blocks... ")
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 4096
+	cfg.URL = "127.0.0.1:8907"
+	cfg.Checksum = ChecksumCRC32C
+	cfg.ChecksumChunkSize = 1024
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+
+	report, _ := ScrubStatus (myserver)
+	if (report.Passes != 0 || report.Running) { log.Fatal ("FATAL ERROR: Invalid initial scrub report") }
+	if (ScrubCancel (myserver) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Cancelled a scrub not running") }
+
+	data := make ([]byte, 4096)
+	for i := range data { data[i] = byte (i) }
+	for id := uint64 (0); id < 4; id++ {
+		_, myerr := BlockWrite (myserver, "default", id, 0, data[:1000 * (id + 1)])
+		if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	}
+	if (ScrubStart (myserver) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start scrubbing") }
+	report = waitScrub (myserver, 1)
+	if (report.Namespaces != 1 || report.Blocks != 4 || report.Bytes != 10000 || report.Errors != 0) { log.Fatal ("FATAL ERROR: Invalid scrub report: ", report) }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing the detection of corrupted blocks... ")
+	base := baseStore (myserver.store)
+	base.Write ("default", 2, 2500, []byte {0}, DurabilityPerWrite)
+	base.Truncate ("default", 3, 3000, DurabilityPerWrite)
+	if (ScrubStart (myserver) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start scrubbing") }
+	report = waitScrub (myserver, 2)
+	if (report.Blocks != 4 || report.Errors != 2 || len (report.Findings) != 2) { log.Fatal ("FATAL ERROR: Invalid scrub report: ", report) }
+	if (report.Findings[0].BlockID != 2 || report.Findings[1].BlockID != 3 || report.Findings[0].Namespace != "default") { log.Fatal ("FATAL ERROR: Invalid findings: ", report.Findings) }
+	if (myserver.Stop (context.Background ()) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot stop server") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing the report of the last scrub... ")
+	cfg.URL = "127.0.0.1:8908"
+	cfg.ScrubRate = 64 * 1024
+	cfg.ScrubMaxLoad = 1
+	myserver = ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+	report, _ = ScrubStatus (myserver)
+	if (report.Passes != 2 || report.Errors != 2 || report.Findings[1].Problem != "data unreadable or not matching its checksums") { log.Fatal ("FATAL ERROR: Report of the last scrub lost: ", report) }
+	payload := scrubReportPayload (report)
+	decoded, myerr := ParseScrubReport (payload)
+	if (myerr != err.NoErr || decoded.Passes != 2 || !decoded.Started.Equal (report.Started) || len (decoded.Findings) != 2 || decoded.Findings[1] != report.Findings[1]) { log.Fatal ("FATAL ERROR: Invalid scrub reply") }
+	_, myerr = ParseScrubReport (payload[:len (payload) - 1])
+	if (myerr != err.ErrFatal) { log.Fatal ("FATAL ERROR: Truncated scrub reply accepted") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing pausing the scrubber under load... ")
+	BlockDelete (myserver, "default", 2)
+	BlockDelete (myserver, "default", 3)
+	for id := uint64 (10); id < 20; id++ { BlockWrite (myserver, "default", id, 0, data) }
+	loaded := make (chan struct{})
+	go func () {
+		for i := 0; i < 60; i++ {
+			BlockRead (myserver, "default", 0, 0, 10)
+			time.Sleep (10 * time.Millisecond)
+		}
+		close (loaded)
+	}()
+	if (ScrubStart (myserver) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start scrubbing") }
+	paused := false
+	for !paused {
+		select {
+		case <-loaded:
+			log.Fatal ("FATAL ERROR: Scrubbing not paused")
+		default:
+		}
+		report, _ = ScrubStatus (myserver)
+		paused = report.Paused
+		time.Sleep (10 * time.Millisecond)
+	}
+	if (ScrubStart (myserver) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Started a second scrub") }
+	<-loaded
+	report = waitScrub (myserver, 3)
+	if (report.Blocks != 12 || report.Errors != 0 || report.Paused) { log.Fatal ("FATAL ERROR: Invalid scrub report: ", report) }
+	fmt.Println ("PASS")
+}
@@ -6,8 +6,11 @@
 package server
 
 import ("os"
-	"log"
+	"net"
 	"strconv"
+	"sync"
+	"context"
+	"time"
 	"fmt")
 
 import err "github.com/gvallee/syserror"
@@ -16,147 +19,711 @@ import comm "github.com/gvallee/fscomm"
 type Server struct {
 	basedir         string
 	block_size      uint64
+	url		string
+	uuid		string		// Identifies the basedir, see superblock
 	info		*comm.ServerInfo
+	blocks		*blockLockTable
+	namespaces	*blockLockTable	// Block operations share the lock of their namespace
+
+	// Namespaces known to the server
+	registryLock	sync.Mutex
+	registry	map[string]*Namespace
+	autoCreate	bool		// Create unknown namespaces upon write
+
+	// Connections currently handled by the server; the value tells whether a request
+	// is being processed on the connection
+	connsLock	sync.Mutex
+	conns		map[net.Conn]bool
+	handlers	sync.WaitGroup
+	background	sync.WaitGroup	// Background tasks using the store, e.g., the scrubber
+
+	// Where the blocks are actually stored
+	store		BlockStore
+	compression	Compression	// Compression of the new namespaces
+	compressionChunk	uint64
+	encrypt		bool		// Encrypt the new namespaces
+	dedup		bool		// Deduplicate the blocks of the new namespaces
+
+	// Background re-encryption of the namespaces, see NamespaceRotateKey
+	rotationsLock	sync.Mutex
+	rotations	map[string]*KeyRotation
+
+	// Durability policies of the server and of the namespaces overriding it
+	durabilityLock	sync.Mutex
+	durability	Durability
+	nsDurability	map[string]Durability
+
+	// Background verification of the blocks, see ScrubStart
+	scrub		*scrubber
+	ioOps		uint64		// Client block operations so far, updated atomically
+
+	// Lifecycle of the server
+	stateLock	sync.Mutex
+	started		bool
+	closeOnce	sync.Once	// The store is closed once, when nothing uses it anymore
+	stopping	chan struct{}	// Closed when the server is asked to stop
+	done		chan struct{}	// Closed when the server is fully stopped
+	status		err.SysError	// Terminal status of the server
 }
 
-type Namespace struct {
-        path string
+/**
+ * Configuration of a data server
+ */
+type ServerConfig struct {
+	Basedir		string	// Path to the basedir directory that the server must use; can be empty with a volatile Store
+	BlockSize	uint64	// Cannonical size of a block
+	URL		string	// URL that will be used by the server
+	BlockCacheSize	int	// Maximum number of block files kept open (FileStore)
+	AutoCreateNamespaces	bool	// Create unknown namespaces upon write instead of failing
+	Durability	Durability	// Default durability policy of the namespaces
+	SyncInterval	time.Duration	// Interval between group commits (periodic durability)
+	Force		bool	// Mount the basedir even if it was created with a different configuration
+	Store		BlockStore	// Storage backend; a FileStore if nil
+	Checksum	Checksum	// Checksum algorithm of the new namespaces, see ChecksumStore
+	ChecksumChunkSize	uint64	// Size of the checksummed chunks; DefaultChecksumChunkSize if 0
+	Compression	Compression	// Compression of the new namespaces, see CompressionStore
+	CompressionChunkSize	uint64	// Size of the chunks compressed independently; DefaultCompressionChunkSize if 0
+	Encrypt		bool	// Encrypt the new namespaces, see EncryptionStore
+	Keys		KeyProvider	// Keys of the encrypted namespaces, e.g., a KeyFile; required to encrypt
+	Dedup		bool	// Deduplicate the blocks of the new namespaces, see DedupStore
+	ScrubInterval	time.Duration	// Time between two scrubs of all the blocks; 0 to scrub only upon request
+	ScrubRate	uint64	// Maximum amount of data scrubbed per second; DefaultScrubRate if 0
+	ScrubMaxLoad	uint64	// Client operations per second above which scrubbing pauses; DefaultScrubMaxLoad if 0
 }
 
-var server_done int = 0
+type Namespace struct {
+        block_size uint64
+}
 
 /* Functions specific to the implementation of servers */
 
-func IsServerDone () int {
-	return server_done
+/**
+ * Check whether the server has been asked to stop.
+ * @param[in]	server	Structure representing the server
+ * @return	true if the server is stopping or stopped; false otherwise
+ */
+func isStopping (server *Server) bool {
+	select {
+	case <-server.stopping:
+		return true
+	default:
+		return false
+	}
 }
 
-func runCommServer (server *Server) err.SysError {
-	var errorStatus err.SysError = err.NoErr
-	info := server.info
+/**
+ * Ask the server to stop. Only the first call has an effect, which means the terminal
+ * status of the server is the one of the first reason to stop.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	status	Terminal status of the server
+ */
+func requestStop (server *Server, status err.SysError) {
+	server.stateLock.Lock()
+	defer server.stateLock.Unlock()
+
+	if (isStopping (server)) { return }
+	server.status = status
+	close (server.stopping)
+	if (!server.started) {
+		// No client, only the background tasks have to complete
+		go finalizeServer (server)
+		return
+	}
+	go wakeAcceptLoop (server)
+}
 
-	mycommerr := comm.CreateServer (info)
-	if (mycommerr != err.NoErr) { fmt.Println ("error creating comm server"); return mycommerr }
+/**
+ * Close the block store of the server, only the first time the function is called.
+ * Nothing may use the store anymore.
+ * @param[in]	server	Structure representing the server
+ */
+func closeStore (server *Server) {
+	server.closeOnce.Do (func () {
+		if (server.store.Close () != err.NoErr) { setStatus (server, err.ErrFatal) }
+	})
+}
+
+/**
+ * Wait for the requests and the background tasks in progress, then close the block
+ * store and mark the server as stopped
+ * @param[in]	server	Structure representing the server
+ */
+func finalizeServer (server *Server) {
+	server.handlers.Wait()
+	server.background.Wait()
+	closeStore (server)
+	close (server.done)
+}
 
-	conn, commerr := comm.GetConnFromInfo (info)
-	if (conn == nil || commerr != err.NoErr) { return commerr }
+func addConn (server *Server, conn net.Conn) {
+	server.connsLock.Lock()
+	server.conns[conn] = false
+	server.connsLock.Unlock()
+}
+
+/**
+ * Mark a connection as busy, i.e., processing a request. New requests are refused
+ * once the server is stopping.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	conn	Connection to the client
+ * @return	true if the request can be processed; false otherwise
+ */
+func markConnBusy (server *Server, conn net.Conn) bool {
+	server.connsLock.Lock()
+	defer server.connsLock.Unlock()
+
+	if (isStopping (server)) { return false }
+	server.conns[conn] = true
+	return true
+}
+
+func markConnIdle (server *Server, conn net.Conn) {
+	server.connsLock.Lock()
+	server.conns[conn] = false
+	server.connsLock.Unlock()
+}
+
+func removeConn (server *Server, conn net.Conn) {
+	server.connsLock.Lock()
+	delete (server.conns, conn)
+	server.connsLock.Unlock()
+}
+
+/**
+ * Close client connections so that the associated handlers return.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	force	Also close the connections with a request in progress
+ * @return	Number of connections closed while a request was in progress
+ */
+func closeConns (server *Server, force bool) int {
+	server.connsLock.Lock()
+	defer server.connsLock.Unlock()
+
+	interrupted := 0
+	for conn, busy := range server.conns {
+		if (busy && !force) { continue }
+		if (busy) { interrupted += 1 }
+		conn.Close()
+	}
+	return interrupted
+}
+
+/**
+ * Wake up the accept loop, which is blocked until a new client connects, so it can
+ * notice that the server is done.
+ * @param[in]	server	Structure representing the server
+ */
+func wakeAcceptLoop (server *Server) {
+	conn, myerr := net.Dial ("tcp", server.url)
+	if (myerr == nil) { conn.Close() }
+}
+
+/**
+ * Receive and handle a DATAMSG, a DATAACKMSG or a DATACKMSG. The message header has
+ * already been received. DATAMSG is not answered, for clients sending several of them
+ * before reading anything back: a failure of the write is only logged. With the other
+ * messages, the outcome of the write, including a failure, is reported to the client
+ * with a write acknowledgement. Only communication errors and data or names too large
+ * to be received, after which the connection is closed, are returned.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	conn	Connection to the client
+ * @param[in]	checksummed	Whether the data comes with a checksum (DATACKMSG)
+ * @param[in]	ack	Whether the client expects a write acknowledgement
+ * @return	System error handle
+ */
+func handleDataMsg (server *Server, conn net.Conn, checksummed bool, ack bool) err.SysError {
+	// Recv the namespace
+	namespace, nserr := recvString (conn, maxRequestNameLen)
+	if (nserr == err.ErrDataOverflow) { return refuseOverflow (conn, ack) }
+	if (nserr != err.NoErr) { return err.ErrFatal }
+
+	// Recv blockid
+	blockid, berr := comm.RecvUint64 (conn)
+	if (berr != err.NoErr) { return err.ErrFatal }
+
+	// Recv offset
+	offset, oerr := comm.RecvUint64 (conn)
+	if (oerr != err.NoErr) { return err.ErrFatal }
+
+	// Recv data size
+	size, serr := comm.RecvUint64 (conn)
+	if (serr != err.NoErr) { return err.ErrFatal }
+
+	// The data must fit in a block, which also bounds what is allocated to receive it
+	blocksize, bserr := GetNamespaceBlocksize (server, namespace)
+	if (bserr != err.NoErr) { blocksize = server.block_size } // Created upon write, if at all
+	if (size > blocksize) { return refuseOverflow (conn, ack) }
+
+	// Recv the actual data
+	data, derr := comm.DoRecvData (conn, size)
+	if (derr != err.NoErr) { return err.ErrFatal }
+
+	var algo Checksum = ChecksumNone
+	var sum uint64 = 0
+	if (checksummed) {
+		code, cerr := comm.RecvUint64 (conn)
+		if (cerr != err.NoErr) { return err.ErrFatal }
+		sum, cerr = comm.RecvUint64 (conn)
+		if (cerr != err.NoErr) { return err.ErrFatal }
+		algo = Checksum (code)
+		if (algo == ChecksumNone || algo.String () == "unknown") { return sendWriteAck (conn, err.ErrNotAvailable, 0, false) }
+	}
+
+	status := checkNamespace (server, namespace, true)
+	if (status != StatusOK) {
+		fmt.Println ("Write refused, invalid namespace", namespace)
+		if (!ack) { return err.NoErr }
+		return sendWriteAckStatus (conn, status, 0, false)
+	}
+	if (checksummed && algo.Sum (data) != sum) {
+		fmt.Println ("Checksum mismatch, data of block", blockid, "corrupted in transit")
+		return sendWriteAckStatus (conn, StatusChecksumMismatch, 0, false)
+	}
+
+	// Actually save the data
+	ws, synced, we := blockWrite (server, namespace, blockid, offset, data)
+	if (we != err.NoErr) {
+		fmt.Println ("Write failed:", we.Error())
+		if (ws < 0) { ws = 0 }
+	}
+
+	if (!ack) { return err.NoErr }
+	return sendWriteAck (conn, we, uint64 (ws), synced)
+}
+
+/**
+ * Receive and handle a READREQ, a READXREQ or a READCKREQ. The message header has
+ * already been received. A failure of the read itself is reported to the client with
+ * an error reply instead of the data; only communication errors are returned.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	conn	Connection to the client
+ * @param[in]	msghdr	Header of the message
+ * @return	System error handle
+ */
+func handleReadReq (server *Server, conn net.Conn, msghdr string) err.SysError {
+	namespace, recverr := recvString (conn, maxRequestNameLen)
+	if (recverr == err.ErrDataOverflow) { return refuseOverflow (conn, false) }
+	if (recverr != err.NoErr) { return err.ErrFatal }
+	blockid, berr := comm.RecvUint64 (conn)
+	if (berr != err.NoErr) { return err.ErrFatal }
+	offset, oerr := comm.RecvUint64 (conn)
+	if (oerr != err.NoErr) { return err.ErrFatal }
+	// Checked against the block size before anything is allocated, see BlockRead
+	size, serr := comm.RecvUint64 (conn)
+	if (serr != err.NoErr) { return err.ErrFatal }
+	var algo Checksum = ChecksumNone
+	if (msghdr == READCKREQ) {
+		code, cerr := comm.RecvUint64 (conn)
+		if (cerr != err.NoErr) { return err.ErrFatal }
+		algo = Checksum (code)
+		if (algo == ChecksumNone || algo.String () == "unknown") { return sendErrorReply (conn, err.ErrNotAvailable) }
+	}
+
+	// The blocks of a snapshot are read as "<namespace>@<snapshot>"
+	name, snapshot := splitSnapshotName (namespace)
+	status := checkNamespace (server, name, false)
+	if (status == StatusOK && name != namespace && !ValidSnapshotName (snapshot)) { status = StatusInvalidNamespace }
+	if (status != StatusOK) { return sendStatusReply (conn, status) }
+
+	fmt.Println ("Reading block...", blockid, offset, size)
+	// Upon reception of a read req, we get the data and send it back
+	rs, buff, readerr := BlockRead (server, namespace, blockid, offset, size)
+	if (readerr != err.NoErr) {
+		fmt.Println ("Read failed:", readerr.Error())
+		return sendErrorReply (conn, readerr)
+	}
+
+	fmt.Println ("Sending read data...")
+	var senderr err.SysError
+	if (msghdr == READCKREQ) {
+		senderr = sendChecksumReadReply (conn, algo, uint64 (rs), buff)
+	} else if (msghdr == READXREQ) {
+		senderr = sendReadReply (conn, uint64 (rs), buff)
+	} else {
+		senderr = comm.SendMsg (conn, comm.RDREPLY, buff)
+	}
+	if (senderr != err.NoErr) { return err.ErrFatal }
+
+	return err.NoErr
+}
+
+/**
+ * Receive and handle a FLUSHREQ. The message header has already been received.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	conn	Connection to the client
+ * @return	System error handle
+ */
+func handleFlushReq (server *Server, conn net.Conn) err.SysError {
+	namespace, nserr := recvString (conn, maxRequestNameLen)
+	if (nserr == err.ErrDataOverflow) { return refuseOverflow (conn, true) }
+	if (nserr != err.NoErr) { return err.ErrFatal }
+
+	status := checkNamespace (server, namespace, false)
+	if (status != StatusOK) { return sendWriteAckStatus (conn, status, 0, false) }
+
+	flusherr := NamespaceFlush (server, namespace)
+	return sendWriteAck (conn, flusherr, 0, flusherr == err.NoErr)
+}
+
+/**
+ * Receive and handle a DELETEREQ or a TRUNCATEREQ. The message header has already been
+ * received.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	conn	Connection to the client
+ * @param[in]	truncate	Whether the request is a TRUNCATEREQ
+ * @return	System error handle
+ */
+func handleDeleteReq (server *Server, conn net.Conn, truncate bool) err.SysError {
+	namespace, nserr := recvString (conn, maxRequestNameLen)
+	if (nserr == err.ErrDataOverflow) { return refuseOverflow (conn, true) }
+	if (nserr != err.NoErr) { return err.ErrFatal }
+	blockid, berr := comm.RecvUint64 (conn)
+	if (berr != err.NoErr) { return err.ErrFatal }
+
+	var size uint64 = 0
+	if (truncate) {
+		var serr err.SysError
+		size, serr = comm.RecvUint64 (conn)
+		if (serr != err.NoErr) { return err.ErrFatal }
+	}
+
+	status := checkNamespace (server, namespace, false)
+	if (status != StatusOK) { return sendWriteAckStatus (conn, status, 0, false) }
+
+	var myerr err.SysError
+	if (truncate) {
+		myerr = BlockTruncate (server, namespace, blockid, size)
+	} else {
+		myerr = BlockDelete (server, namespace, blockid)
+	}
+	return sendWriteAck (conn, myerr, 0, false)
+}
+
+/**
+ * Handle all the requests coming from a single client. The function returns when the
+ * client disconnects, when the server is done or when the client sends an invalid
+ * message; only the connection is affected, other clients are still served.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	conn	Connection to the client
+ */
+func handleConnection (server *Server, conn net.Conn) {
+	defer server.handlers.Done()
+	defer removeConn (server, conn)
+	defer conn.Close()
 
 	comm.HandleHandshake (conn)
-	for server_done != 1 {
+	for !isStopping (server) {
 		msghdr, syserr := comm.GetHeader (conn)
-		if (syserr != err.NoErr) { fmt.Println ("ERROR: Cannot get header"); return err.ErrFatal }
+		if (syserr != err.NoErr) {
+			// Most likely the client disconnected
+			return
+		}
+
+		if (!markConnBusy (server, conn)) {
+			fmt.Println ("Server is stopping, request refused")
+			return
+		}
 
+		var errorStatus err.SysError = err.NoErr
 		if (msghdr == comm.TERMMSG) {
-			server_done = 1
+			requestStop (server, err.NoErr)
 		} else if (msghdr == comm.DATAMSG) {
 			fmt.Println ("Handling data message")
-			// Recv the length of the namespace
-			nslen, syserr := comm.RecvUint64 (conn)
-			if (syserr != err.NoErr) {
-				server_done = 1
-				errorStatus = err.ErrFatal
+			errorStatus = handleDataMsg (server, conn, false, false)
+		} else if (msghdr == DATAACKMSG) {
+			errorStatus = handleDataMsg (server, conn, false, true)
+		} else if (msghdr == DATACKMSG) {
+			errorStatus = handleDataMsg (server, conn, true, true)
+		} else if (msghdr == comm.READREQ) {
+			fmt.Println ("Recv'd a READREQ")
+			errorStatus = handleReadReq (server, conn, msghdr)
+		} else if (msghdr == READXREQ || msghdr == READCKREQ) {
+			errorStatus = handleReadReq (server, conn, msghdr)
+		} else if (msghdr == FLUSHREQ) {
+			errorStatus = handleFlushReq (server, conn)
+		} else if (msghdr == DELETEREQ) {
+			errorStatus = handleDeleteReq (server, conn, false)
+		} else if (msghdr == TRUNCATEREQ) {
+			errorStatus = handleDeleteReq (server, conn, true)
+		} else if (msghdr == SCRUBREQ) {
+			errorStatus = handleScrubReq (server, conn)
+		} else if (msghdr == SNAPREQ) {
+			errorStatus = handleSnapshotReq (server, conn)
+		} else if (msghdr == DEDUPREQ) {
+			stats, myerr := GetDedupStats (server)
+			if (myerr != err.NoErr) {
+				errorStatus = sendErrorReply (conn, myerr)
+			} else {
+				errorStatus = sendDedupStats (conn, stats)
 			}
+		} else if (msghdr == NSINITREQ || msghdr == NSINITCREQ || msghdr == NSLISTREQ || msghdr == NSSTATREQ || msghdr == NSDELETEREQ || msghdr == NSRENAMEREQ || msghdr == NSMIGRATEREQ || msghdr == NSROTATEREQ) {
+			errorStatus = handleNamespaceReq (server, conn, msghdr)
+		} else {
+			// We cannot know what follows the header, the connection is unusable
+			fmt.Println ("Unexpected message, closing connection: ", msghdr)
+			sendErrorReply (conn, err.ErrFatal)
+			errorStatus = err.ErrFatal
+		}
+		markConnIdle (server, conn)
 
-			// Recv the namespace
-			namespace, nserr := comm.RecvNamespace (conn, nslen)
-			if (nserr != err.NoErr) {
-				server_done = 1
-				errorStatus = err.ErrFatal
-			}
+		if (errorStatus != err.NoErr) {
+			fmt.Println ("Closing connection:", errorStatus.Error())
+			return
+		}
+	}
+}
 
-			// Recv blockid
-			blockid, berr := comm.RecvUint64 (conn)
-			if (berr != err.NoErr) {
-				server_done = 1
-				errorStatus = err.ErrFatal
-			}
+func runCommServer (server *Server) {
+	info := server.info
 
-			// Recv offset
-			offset, oerr := comm.RecvUint64 (conn)
-			if (oerr != err.NoErr) {
-				server_done = 1
-				errorStatus = err.ErrFatal
+	// Each client gets its own goroutine; we keep accepting new clients until done
+	var delay time.Duration = 0
+	for !isStopping (server) {
+		conn, commerr := comm.GetConnFromInfo (info)
+		if (conn == nil || commerr != err.NoErr) {
+			// E.g., out of file descriptors: retrying right away would only spin
+			delay = 2 * delay
+			if (delay == 0) { delay = 5 * time.Millisecond }
+			if (delay > time.Second) { delay = time.Second }
+			fmt.Println ("ERROR: Cannot accept connection, retrying in", delay)
+			select {
+			case <-server.stopping:
+			case <-time.After (delay):
 			}
+			continue
+		}
+		delay = 0
+		if (isStopping (server)) { conn.Close(); break }
 
-			// Recv data size
-			size, serr := comm.RecvUint64 (conn)
-			if (serr != err.NoErr) {
-				server_done = 1
-				errorStatus = err.ErrFatal
-			}
+		addConn (server, conn)
+		server.handlers.Add (1)
+		go handleConnection (server, conn)
+	}
 
-			// Recv the actual data
-			data, derr := comm.DoRecvData (conn, size)
-			if (derr != err.NoErr) {
-				server_done = 1
-				errorStatus = err.ErrFatal
-			}
+	// Requests in progress are allowed to complete, idle clients are disconnected
+	fmt.Println ("Finalizing server...")
+	closeConns (server, false)
+	server.handlers.Wait()
+	server.background.Wait()
 
-			// Actually save the data
-			_, we := BlockWrite (server, namespace, blockid, offset, data)
-			if (we != err.NoErr) {
-				server_done = 1
-				errorStatus = err.ErrFatal
-			}
-		} else if (msghdr == comm.READREQ) {
-			fmt.Println ("Recv'd a READREQ")
-			namespace, blockid, offset, size, recverr := comm.HandleReadReq (conn)
-			if (recverr != err.NoErr) { server_done = 1; errorStatus = err.ErrFatal }
+	closeStore (server)
+	comm.FiniServer ()
 
-			fmt.Println ("Reading block...", blockid, offset, size)
-			// Upon reception of a read req, we get the data and send it back
-			rs, buff, readerr := BlockRead (server, namespace, blockid, offset, size)
-			if (uint64(rs) != size || readerr != err.NoErr) { server_done = 1; errorStatus = err.ErrFatal }
+	fmt.Println ("All done:", server.Err().Error())
+	close (server.done)
+}
 
-			fmt.Println ("Sending read data...")
-			senderr := comm.SendMsg (conn, comm.RDREPLY, buff)
-			if (senderr != err.NoErr) { server_done = 1; errorStatus = err.ErrFatal }
-		} else {
-			fmt.Println ("Unexpected message, terminating: ", msghdr)
-			errorStatus = err.ErrFatal
-		}
+/**
+ * Start the server: from now on, clients can connect to it.
+ * @return	System error handle
+ */
+func (server *Server) Start () err.SysError {
+	server.stateLock.Lock()
+	defer server.stateLock.Unlock()
 
-		if (server_done == 1) { fmt.Println ("All done:", errorStatus.Error()) }
-	}
+	if (server.started || isStopping (server)) { return err.ErrNotAvailable }
 
-	fmt.Println ("Finalizing server...")
-	comm.FiniServer ()
+	mycommerr := comm.CreateServer (server.info)
+	if (mycommerr != err.NoErr) { fmt.Println ("error creating comm server"); return mycommerr }
+
+	server.started = true
+	go runCommServer (server)
+
+	return err.NoErr
+}
+
+/**
+ * Stop the server and wait for its termination, see ServerFini.
+ * @param[in]	ctx	Context bounding the time given to requests in progress
+ * @return	Terminal status of the server
+ */
+func (server *Server) Stop (ctx context.Context) err.SysError {
+	return ServerFini (server, ctx)
+}
 
-	return errorStatus
+/**
+ * Channel closed when the server is fully stopped, either because Stop was called or
+ * because a client sent a termination message.
+ */
+func (server *Server) Done () <-chan struct{} {
+	return server.done
+}
+
+/**
+ * Return the terminal status of the server. Only meaningful once Done is closed.
+ * @return	System error handle
+ */
+func (server *Server) Err () err.SysError {
+	server.stateLock.Lock()
+	defer server.stateLock.Unlock()
+
+	return server.status
 }
 
 /**
- * Initialize the data server
+ * Record an error as terminal status of the server, unless an error was already recorded.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	status	Error to record
+ */
+func setStatus (server *Server, status err.SysError) {
+	server.stateLock.Lock()
+	defer server.stateLock.Unlock()
+
+	if (server.status == err.NoErr) { server.status = status }
+}
+
+/**
+ * Initialize the data server with the default configuration. The server does not accept
+ * any client until it is started.
  * @param[in]	basedir	Path to the basedir directory that the server must use
  * @param[in]	block_size	Cannonical size of a block
+ * @param[in]	server_url	URL that will be used by the server
  * @return	Pointer to a new Server structure; nil if error
  */
 func ServerInit (basedir string, block_size uint64, server_url string) *Server {
-	// Deal with the server's basedir (we have to make sure it exists)
-	_, myerror := os.Stat (basedir)
-	if (myerror != nil) { return nil }
+	var cfg ServerConfig
+	cfg.Basedir = basedir
+	cfg.BlockSize = block_size
+	cfg.URL = server_url
+	cfg.BlockCacheSize = DefaultBlockCacheSize
+	cfg.Durability = DurabilityPerWrite
+	cfg.SyncInterval = DefaultSyncInterval
+	return ServerInitWithConfig (&cfg)
+}
+
+/**
+ * Initialize the data server. The server does not accept any client until it is started.
+ * @param[in]	cfg	Configuration of the server
+ * @return	Pointer to a new Server structure; nil if error
+ */
+func ServerInitWithConfig (cfg *ServerConfig) *Server {
+	// Deal with the server's basedir (we have to make sure it exists); a store given by
+	// the caller can do without if it does not persist anything
+	volatile := (cfg.Basedir == "" && cfg.Store != nil)
+	if (!volatile) {
+		_, myerror := os.Stat (cfg.Basedir)
+		if (myerror != nil) { return nil }
+	}
 
 	// Check whether the block size is valid
-	if (block_size == 0) { return nil }
-	block_size = block_size
+	bserr := CheckBlockSize (cfg.BlockSize)
+	if (bserr != nil) { fmt.Println (bserr.Error()); return nil }
+
+	if (cfg.BlockCacheSize < 0) { return nil }
+	if (cfg.Durability.String () == "unknown") { return nil }
+	if (cfg.Durability == DurabilityPeriodic && cfg.SyncInterval <= 0) { return nil }
+	if (cfg.Checksum.String () == "unknown") { return nil }
+	if (cfg.ScrubInterval < 0) { return nil }
+	chunkSize := cfg.ChecksumChunkSize
+	if (chunkSize == 0) { chunkSize = DefaultChecksumChunkSize }
+	cserr := CheckChecksumChunkSize (chunkSize)
+	if (cserr != nil) { fmt.Println (cserr.Error()); return nil }
+	if (cfg.Compression.String () == "unknown") { return nil }
+	compressionChunk := cfg.CompressionChunkSize
+	if (compressionChunk == 0) { compressionChunk = DefaultCompressionChunkSize }
+	cserr = CheckCompressionChunkSize (compressionChunk)
+	if (cserr != nil) { fmt.Println (cserr.Error()); return nil }
+	if (cfg.Encrypt && cfg.Keys == nil) { fmt.Println ("Encryption requires keys"); return nil }
 
 	// Create and return the data structure for the new server
 	new_server := new (Server)
-	new_server.basedir = basedir
-	new_server.block_size = block_size
-	new_server.info = comm.CreateServerInfo (server_url, block_size, 60)
+	new_server.basedir = cfg.Basedir
+	new_server.block_size = cfg.BlockSize
+	new_server.url = cfg.URL
+	new_server.blocks = newBlockLockTable ()
+	new_server.namespaces = newBlockLockTable ()
+	new_server.registry = make (map[string]*Namespace)
+	new_server.autoCreate = cfg.AutoCreateNamespaces
+	new_server.conns = make (map[net.Conn]bool)
+	store := cfg.Store
+	if (store == nil) { store = NewFileStore (cfg.BlockCacheSize) }
+	// Even without checksums, the namespaces that have some must keep them up to date.
+	// The checksums are the ones of the data as stored, i.e., compressed then encrypted,
+	// and blocks are deduplicated as stored too. Snapshots copy the blocks as stored.
+	new_server.store = NewSnapshotStore (NewCompressionStore (NewEncryptionStore (NewChecksumStore (NewDedupStore (store), cfg.Checksum, chunkSize), cfg.Keys)))
+	new_server.compression = cfg.Compression
+	new_server.compressionChunk = compressionChunk
+	new_server.encrypt = cfg.Encrypt
+	new_server.dedup = cfg.Dedup
+	new_server.rotations = make (map[string]*KeyRotation)
+	new_server.durability = cfg.Durability
+	new_server.nsDurability = make (map[string]Durability)
+	new_server.stopping = make (chan struct{})
+	new_server.done = make (chan struct{})
+	new_server.status = err.NoErr
+	new_server.scrub = newScrubber (cfg.ScrubInterval, cfg.ScrubRate, cfg.ScrubMaxLoad)
+	new_server.info = comm.CreateServerInfo (cfg.URL, cfg.BlockSize, 60)
+
+	// Make sure the basedir was created for this configuration before touching it
+	var sb superblock
+	var myerr err.SysError
+	if (volatile) {
+		sb.BlockSize = cfg.BlockSize
+		sb.UUID, myerr = newUUID ()
+	} else {
+		sb, myerr = mountSuperblock (cfg.Basedir, cfg.BlockSize, cfg.Force)
+	}
+	if (myerr != err.NoErr) { return nil }
+	new_server.uuid = sb.UUID
+	if (new_server.store.Open (cfg.Basedir) != err.NoErr) { fmt.Println ("Cannot open the block store"); return nil }
+
+	// Namespaces created by previous instances of the server
+	if (loadNamespaces (new_server, sb.BlockSize, cfg.Force) != err.NoErr) { closeStore (new_server); return nil }
+	if (sb.BlockSize != cfg.BlockSize) {
+		// Forced; the existing namespaces keep their block size
+		sb.BlockSize = cfg.BlockSize
+		if (saveSuperblock (cfg.Basedir, sb) != err.NoErr) { closeStore (new_server); return nil }
+	}
 
 	// Initialize the default namespace
-	mydefaultnamespace := NamespaceInit ("default", new_server) // Always use the default namespace by default
-	if (mydefaultnamespace == nil) { fmt.Println ("Cannot initialized the default namespace"); return nil }
+	mydefaultnamespace := NamespaceInit (DefaultNamespace, new_server, 0) // Always use the default namespace by default
+	if (mydefaultnamespace == nil) {
+		fmt.Println ("Cannot initialized the default namespace")
+		closeStore (new_server)
+		return nil
+	}
+
+	// Namespaces can switch to the periodic policy at any time
+	syncInterval := cfg.SyncInterval
+	if (syncInterval <= 0) { syncInterval = DefaultSyncInterval }
+	new_server.background.Add (1)
+	go runPeriodicSync (new_server, syncInterval)
 
-	go runCommServer (new_server)
+	if (loadScrubReport (new_server) != err.NoErr) { fmt.Println ("WARNING: ignoring the report of the last scrub") }
+	new_server.background.Add (1)
+	go runScrubber (new_server)
 
 	return new_server
 }
 
-func ServerFini () {
-	// TODO close all file descriptors associated to blocks
+/**
+ * Gracefully stop the data server: new connections and requests are refused, requests
+ * in progress are given until the deadline of the context to complete. Past that point,
+ * the remaining connections are closed and the interrupted requests are waited for. In
+ * all cases, the block store is then flushed and closed, once nothing uses it anymore,
+ * and the communication layer is finalized.
+ * @param[in]	dataserver	Structure representing the server
+ * @param[in]	ctx	Context bounding the time given to requests in progress
+ * @return	System error handle; ErrFatal if some requests could not be completed or some data could not be flushed
+ */
+func ServerFini (dataserver *Server, ctx context.Context) err.SysError {
+	if (dataserver == nil) { return err.ErrNotAvailable }
+
+	requestStop (dataserver, err.NoErr)
+
+	select {
+	case <-dataserver.done:
+	case <-ctx.Done():
+		// The handlers return once their connection is closed; the store is closed after
+		interrupted := closeConns (dataserver, true)
+		if (interrupted != 0) {
+			fmt.Println ("Shutdown deadline reached,", interrupted, "request(s) interrupted")
+			setStatus (dataserver, err.ErrFatal)
+		}
+		<-dataserver.done
+	}
+
+	return dataserver.Err()
 }
 
 /**
@@ -173,9 +740,9 @@ func GetBasedir (ds *Server) (string, err.SysError) {
 }
 
 /**
- * Return the block size of the data server.
- * This is a server level parameter, not a namespace level parameters, at least not
- * at the moment.
+ * Return the default block size of the data server, used by the namespaces created
+ * without a block size of their own. Each namespace keeps the block size it was
+ * created with, see GetNamespaceBlocksize.
  * @param[in]	ds	Structure representing the server
  * @return	Size of the block
  * @return	System error handle
@@ -190,74 +757,134 @@ func GetBlocksize (ds *Server) (uint64, err.SysError) {
 
 /**
  * Initialize a namespace. The function can safely be called multiple times. If the
- * namespace already exists, the function simply returns successfully.
+ * namespace already exists, the function simply returns successfully, as long as the
+ * requested block size matches the one of the namespace.
  * @param[in]   name    Namespace's name
  * @param[in]   ds      Structure representing the server
+ * @param[in]   block_size      Size of the blocks of the namespace; 0 to use the
+ *                              block size of the server (or the one of the existing
+ *                              namespace)
  * @return      Namespace handle
  */
-func NamespaceInit (name string, dataserver *Server) *Namespace {
-        namespacePath, myerr := GetBasedir (dataserver)
-        if (myerr != err.NoErr) {
-                fmt.Println (myerr.Error())
-                return nil
-        }
-        namespacePath += "/"
-        namespacePath += name
-        _, myerror := os.Stat (namespacePath)
-        if (myerror != nil) {
-                // The path does not exist
-                myerror := os.MkdirAll (namespacePath, 0700)
-                if (myerror != nil) {
-                        log.Fatal (myerror)
-                        return nil
-                }
-        }
+func NamespaceInit (name string, dataserver *Server, block_size uint64) *Namespace {
+        return namespaceInit (name, dataserver, block_size, namespaceOptions {compression: dataserver.compression, encrypt: dataserver.encrypt, dedup: dataserver.dedup})
+}
 
-        new_namespace := new (Namespace)
-        new_namespace.path = namespacePath
-        return new_namespace
+/**
+ * Initialize a namespace with a given compression, see NamespaceInit. If the namespace
+ * already exists, its compression must be the requested one.
+ * @param[in]   name    Namespace's name
+ * @param[in]   ds      Structure representing the server
+ * @param[in]   block_size      Size of the blocks of the namespace; 0 to use the
+ *                              block size of the server
+ * @param[in]   algo    Compression of the blocks of the namespace
+ * @return      Namespace handle
+ */
+func NamespaceInitWithCompression (name string, dataserver *Server, block_size uint64, algo Compression) *Namespace {
+        if (algo.String () == "unknown") { return nil }
+        return namespaceInit (name, dataserver, block_size, namespaceOptions {compression: algo, encrypt: dataserver.encrypt, dedup: dataserver.dedup, checkCompression: true})
 }
 
 /**
- * Get the path to the file where the block is saved. The underlying file will be correctly
- * opened/created.
+ * Initialize a namespace encrypted or not, see NamespaceInit. If the namespace already
+ * exists, it must be encrypted as requested.
+ * @param[in]   name    Namespace's name
  * @param[in]   ds      Structure representing the server
- * @param[in]   namespace       Namespace's namespace we want to write to
- * @param[in]   blockid         Block id to write to
- * @return      File handle that can be used for write operations
+ * @param[in]   block_size      Size of the blocks of the namespace; 0 to use the
+ *                              block size of the server
+ * @param[in]   encrypt Whether the blocks of the namespace are encrypted
+ * @return      Namespace handle
  */
-func getBlockPath (dataserver *Server, namespace string, blockid uint64) (*os.File, string, err.SysError) {
-        block_file, myerr := GetBasedir (dataserver)
+func NamespaceInitWithEncryption (name string, dataserver *Server, block_size uint64, encrypt bool) *Namespace {
+        return namespaceInit (name, dataserver, block_size, namespaceOptions {compression: dataserver.compression, encrypt: encrypt, dedup: dataserver.dedup, checkEncryption: true})
+}
+
+/**
+ * How to create a namespace, and which settings an existing namespace must match
+ */
+type namespaceOptions struct {
+        compression     Compression
+        encrypt         bool
+        dedup           bool
+        checkCompression        bool
+        checkEncryption bool
+}
+
+func namespaceInit (name string, dataserver *Server, block_size uint64, opts namespaceOptions) *Namespace {
+        if (!ValidNamespaceName (name)) {
+                fmt.Println ("Invalid namespace name:", strconv.Quote (name))
+                return nil
+        }
+        if (block_size != 0) {
+                bserr := CheckBlockSize (block_size)
+                if (bserr != nil) { fmt.Println (bserr.Error()); return nil }
+        }
+
+        unlockns := dataserver.namespaces.lockKey (name)
+        defer unlockns()
+
+        // The block size of an existing namespace cannot change, its blocks would be misinterpreted
+        var desc NamespaceDescriptor
+        desc.FormatVersion = FormatVersion
+        desc.BlockSize = block_size
+        if (desc.BlockSize == 0) { desc.BlockSize = dataserver.block_size }
+        if (opts.compression != CompressionNone) {
+                desc.Compression = opts.compression.String ()
+                desc.CompressionChunkSize = dataserver.compressionChunk
+                if (desc.CompressionChunkSize > desc.BlockSize) { desc.CompressionChunkSize = desc.BlockSize }
+        }
+        if (opts.encrypt) {
+                desc.Encryption = EncryptionAESGCM
+                desc.EncryptionChunkSize = DefaultEncryptionChunkSize
+                if (desc.EncryptionChunkSize > desc.BlockSize) { desc.EncryptionChunkSize = desc.BlockSize }
+        }
+        desc.Dedup = opts.dedup
+        desc, myerr := dataserver.store.CreateNamespace (name, desc)
         if (myerr != err.NoErr) {
-                fmt.Println (myerr.Error())
-                return nil, "", myerr
+                // The request may come from a client, the server must keep running
+                fmt.Println ("Cannot create namespace", name, ":", myerr.Error())
+                return nil
         }
-        block_file += namespace + "/block"
-        block_file += strconv.FormatUint (blockid, 10)
-
-	/*
-        _, mystaterror := os.Stat (block_file)
-
-        // Perform the actual write operation
-        var f *os.File
-        var myerror error
-        if (mystaterror != nil) {
-                // The file does not exist yet
-		fmt.Println ("Creating block file")
-                f, myerror = os.Create (block_file)
-        } else {
-                // The file exists, we open it
-		fmt.Println ("Opening block file")
-                f, myerror = os.OpenFile (block_filei, os.O_RDWR|os.O_CREATE, 0755))
+        if (block_size != 0 && block_size != desc.BlockSize) {
+                fmt.Println ("Namespace", name, "already exists with a block size of", desc.BlockSize)
+                return nil
         }
-	*/
-	f, myerror := os.OpenFile (block_file, os.O_RDWR|os.O_CREATE, 0755)
-        if (myerror != nil) {
-                fmt.Println (myerror.Error())
-                return nil, "", err.ErrNotAvailable
+        current, _ := namespaceCompression (desc)
+        if (opts.checkCompression && current != opts.compression) {
+                fmt.Println ("Namespace", name, "already exists with compression", current)
+                return nil
         }
+        encrypted, _ := namespaceEncrypted (desc)
+        if (opts.checkEncryption && encrypted != opts.encrypt) {
+                fmt.Println ("Namespace", name, "already exists with encryption set to", encrypted)
+                return nil
+        }
+
+        dataserver.registryLock.Lock()
+        defer dataserver.registryLock.Unlock()
+
+        new_namespace, ok := dataserver.registry[name]
+        if (!ok) {
+                new_namespace = new (Namespace)
+                new_namespace.block_size = desc.BlockSize
+                dataserver.registry[name] = new_namespace
+        }
+        return new_namespace
+}
+
+/**
+ * Change the maximum number of block files the server keeps open.
+ * @param[in]	ds	Structure representing the server
+ * @param[in]	size	Maximum number of open block files; 0 to disable caching
+ * @return	System error handle; ErrNotAvailable if the block store of the server
+ *		does not keep files open
+ */
+func SetBlockCacheSize (dataserver *Server, size int) err.SysError {
+	if (dataserver == nil) { return err.ErrNotAvailable }
 
-        return f, block_file, err.NoErr
+	store, ok := baseStore (dataserver.store).(*FileStore)
+	if (!ok) { return err.ErrNotAvailable }
+	return store.SetCacheSize (size)
 }
 
 /**
@@ -271,72 +898,122 @@ func getBlockPath (dataserver *Server, namespace string, blockid uint64) (*os.Fi
  * @return      System error handle
  */
 func BlockWrite (dataserver *Server, namespace string, blockid uint64, offset uint64, data []byte) (int, err.SysError) {
+	s, _, myerr := blockWrite (dataserver, namespace, blockid, offset, data)
+	return s, myerr
+}
+
+/**
+ * Write a data to a block, see BlockWrite.
+ * @return      Amount of data written to the block in bytes
+ * @return      true if the data was synced to disk; false otherwise
+ * @return      System error handle
+ */
+func blockWrite (dataserver *Server, namespace string, blockid uint64, offset uint64, data []byte) (int, bool, err.SysError) {
+        unlockns, myerr := useNamespace (dataserver, namespace, true)
+        if (myerr != err.NoErr) { return -1, false, myerr }
+        defer unlockns()
+        countClientOp (dataserver)
+
         // Making sure that the data to write fits into the block
-        blocksize, dserr := GetBlocksize (dataserver)
-        if (dserr != err.NoErr) { fmt.Println (dserr.Error()); return -1, dserr }
-        if (offset + uint64 (len (data)) > blocksize) {
+        blocksize, dserr := GetNamespaceBlocksize (dataserver, namespace)
+        if (dserr != err.NoErr) { fmt.Println (dserr.Error()); return -1, false, dserr }
+        // Written so that huge offsets cannot wrap around
+        if (offset > blocksize || uint64 (len (data)) > blocksize - offset) {
 		fmt.Println ("Data overflow - Write", len(data), "from", offset, "while blocksize is", blocksize)
-                return -1, err.ErrDataOverflow
+                return -1, false, err.ErrDataOverflow
         }
 
-        // Figure out where to write the data
-        f, _, myerr := getBlockPath (dataserver, namespace, blockid)
-	defer f.Close()
-        if (myerr != err.NoErr) {
-                return -1, myerr
-        }
+        // Concurrent writes to the same block are serialized
+        unlock := dataserver.blocks.lockBlock (namespace, blockid)
+        defer unlock()
 
         // Actually write the data
+	mode := GetNamespaceDurability (dataserver, namespace)
 	fmt.Println ("Actually writing", len (data), "bytes to block", blockid, ", starting at", offset)
-        s, mywriteerr := f.WriteAt (data, int64(offset)) // Unfortunately, Write return an INT
-        if (mywriteerr != nil) {
-		fmt.Println (mywriteerr.Error())
-                return -1, err.ErrFatal
-        }
-        f.Sync()
-
-        // All done
-        return s, err.NoErr
+	return dataserver.store.Write (namespace, blockid, offset, data, mode)
 }
 
 /**
- * Read a data block 
+ * Read a data block. As with a sparse block device, the parts of the block that were
+ * never written, including the ones past the end of the written data, read as zeros.
  * @param[in]   ds      Structure representing the server
  * @param[in]   namespace       Namespace's namespace we want to write to
  * @param[in]   blockid         Block id to write to
  * @param[in]   offset          Write offset
  * @param[in]   size            Amount of data to read
- * @return      Amount of data written to the block in bytes
- * @return      Buffer with the data read from the block
- * @return      System error handle
+ * @return      Amount of valid data, i.e., data that was written to the block, in bytes
+ * @return      Buffer of the requested size with the data read from the block
+ * @return      System error handle; ErrNotAvailable if the block does not exist
  */
 func BlockRead (dataserver *Server, namespace string, blockid uint64, offset uint64, size uint64) (int, []byte, err.SysError) {
-        blocksize, dserr := GetBlocksize (dataserver)
+	// A snapshot shares the locks of its namespace, whose blocks it may read
+	name, _ := splitSnapshotName (namespace)
+        unlockns, myerr := useNamespace (dataserver, name, false)
+        if (myerr != err.NoErr) { return -1, nil, myerr }
+        defer unlockns()
+        countClientOp (dataserver)
+
+        blocksize, dserr := GetNamespaceBlocksize (dataserver, name)
         if (dserr != err.NoErr) {
                 return -1, nil, err.ErrFatal
         }
-        if (offset + size > blocksize) {
+        if (offset > blocksize || size > blocksize - offset) {
                 return -1, nil, err.ErrDataOverflow
         }
 
-        // Figure out from where to read the data
-        f, _, myerr := getBlockPath (dataserver, namespace, blockid)
-	defer f.Close()
-        if (myerr != err.NoErr) {
-                fmt.Println (myerr.Error())
-                return -1, nil, myerr
-        }
+        // Readers can share the block but not with a writer
+        unlock := dataserver.blocks.rlockBlock (name, blockid)
+        defer unlock()
 
         // Actually read the data
         buff := make ([]byte, size)
 	fmt.Println ("Actually reading", size, " bytes from block", blockid, ", starting at", offset)
-        s, myreaderr := f.ReadAt (buff, int64 (offset)) // Unfortunately Read return an INT
-        if (myreaderr != nil) {
-                fmt.Println ("ERRROR: Cannot read from file")
-                return -1, nil, err.ErrFatal
-        }
+        s, myerr := dataserver.store.Read (namespace, blockid, offset, buff)
+        if (myerr != err.NoErr) { return -1, nil, myerr }
 
-        // All done
+        // All done; the rest of the buffer is already zero-filled
         return s, buff, err.NoErr
 }
 
+/**
+ * Delete a block. The block is removed once the operations in progress on the block
+ * are done, so concurrent readers either get the data or a not-found error.
+ * @param[in]   ds      Structure representing the server
+ * @param[in]   namespace       Namespace of the block
+ * @param[in]   blockid         Block id to delete
+ * @return      System error handle; ErrNotAvailable if the block does not exist
+ */
+func BlockDelete (dataserver *Server, namespace string, blockid uint64) err.SysError {
+	unlockns, myerr := useNamespace (dataserver, namespace, false)
+	if (myerr != err.NoErr) { return myerr }
+	defer unlockns()
+	countClientOp (dataserver)
+	unlock := dataserver.blocks.lockBlock (namespace, blockid)
+	defer unlock()
+
+	return dataserver.store.Delete (namespace, blockid)
+}
+
+/**
+ * Truncate a block. The space used by the data past the new size is released; if the
+ * block grows, the new part reads as zeros.
+ * @param[in]   ds      Structure representing the server
+ * @param[in]   namespace       Namespace of the block
+ * @param[in]   blockid         Block id to truncate
+ * @param[in]   size            New size of the block
+ * @return      System error handle; ErrNotAvailable if the block does not exist
+ */
+func BlockTruncate (dataserver *Server, namespace string, blockid uint64, size uint64) err.SysError {
+	unlockns, myerr := useNamespace (dataserver, namespace, false)
+	if (myerr != err.NoErr) { return myerr }
+	defer unlockns()
+	countClientOp (dataserver)
+
+	blocksize, dserr := GetNamespaceBlocksize (dataserver, namespace)
+	if (dserr != err.NoErr) { return dserr }
+	if (size > blocksize) { return err.ErrDataOverflow }
+	unlock := dataserver.blocks.lockBlock (namespace, blockid)
+	defer unlock()
+
+	return dataserver.store.Truncate (namespace, blockid, size, GetNamespaceDurability (dataserver, namespace))
+}
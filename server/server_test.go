@@ -6,9 +6,13 @@
 package server
 
 import ("testing"
+	"bytes"
         "fmt"
 	"log"
 	"strconv"
+	"context"
+	"sync"
+	"time"
 	"os")
 
 import err "github.com/gvallee/syserror"
@@ -49,6 +53,7 @@ func TestServerCreate (t *testing.T) {
 	valid_url := "127.0.0.1:4455"
 	s4 := ServerInit (validTestPath, 1024 * 1024, valid_url)
 	if (s4 == nil) { log.Fatal ("Test with valid basedir failed") }
+	if (s4.Start () != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start the server") }
 
 	basedir, mysyserror := GetBasedir (s4)
 	if (mysyserror != err.NoErr || basedir != validTestPath) { log.Fatal ("FATAL ERROR: Cannot get the server's basedir") }
@@ -65,10 +70,9 @@ func TestServerCreate (t *testing.T) {
         senderr := comm.SendMsg (conn, comm.TERMMSG, nil)
 	if (senderr != err.NoErr) { log.Fatal ("Cannot send termination message") }
 
-	// Message successfully sent, we poll for the server termination and let things happen
-	for {
-		if (IsServerDone () == 1) { break }
-	}
+	// Message successfully sent, we wait for the server termination
+	<-s4.Done()
+	if (s4.Err () != err.NoErr) { log.Fatal ("FATAL ERROR: Server terminated with an error: ", s4.Err().Error()) }
 
 	// We clean up again
 	fmt.Println ("\tAll done, cleaning...")
@@ -90,8 +94,8 @@ func checkNamespaceDir (myserver *Server, name string) {
 }
 
 func writeTest (myserver *Server, ns string, id uint64, size uint64, offset uint64) (uint64, err.SysError) {
-        // Convert size from MB to bytes
-        size = size
+        // Convert size from MB to bytes, as readTest does: callers pass MB
+        size = size * 1024 * 1024
 
         // Create an initialized buffer
         var c int = 0
@@ -176,6 +180,7 @@ func TestNamespaceCreation (t *testing.T) {
 	valid_url := "127.0.0.1:8888"
         myserver := ServerInit (validTestPath, 1024 * 1024, valid_url) // 1MB block size
         if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+        if (myserver.Start () != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start the data server") }
 	fmt.Println ("YES!!!")
 
         // We check whether the directory is really there
@@ -183,7 +188,7 @@ func TestNamespaceCreation (t *testing.T) {
         fmt.Println ("PASS")
 
         fmt.Print ("Testing a custom namespace... ")
-        ns2 := NamespaceInit ("my_namespace_2", myserver)
+        ns2 := NamespaceInit ("my_namespace_2", myserver, 0)
         if (ns2 == nil) { log.Fatal ("FATAL ERROR: Cannot create custom namespace") }
 
         // We check whether the directory is really there
@@ -239,10 +244,223 @@ func TestNamespaceCreation (t *testing.T) {
         senderr := comm.SendMsg (conn, comm.TERMMSG, nil)
         if (senderr != err.NoErr) { log.Fatal ("Cannot send termination message") }
 
-        // Message successfully sent, we poll for the server termination and let things happen
-        for {
-                if (IsServerDone () == 1) { break }
-        }
+        // Message successfully sent, we wait for the server termination
+        <-myserver.Done()
+
+}
 
+
+// Wait until the server is handling a request
+func waitConnBusy (myserver *Server) {
+	for i := 0; i < 500; i++ {
+		myserver.connsLock.Lock()
+		busy := false
+		for _, b := range myserver.conns { busy = busy || b }
+		myserver.connsLock.Unlock()
+		if (busy) { return }
+		time.Sleep (10 * time.Millisecond)
+	}
+	log.Fatal ("FATAL ERROR: Request not received")
 }
 
+func TestServerStop (t *testing.T) {
+	validTestPath := "/tmp/ns_test_stop/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing finalizing an invalid server... ")
+	if (ServerFini (nil, context.Background ()) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Finalized a nil server") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing stopping a server that was never started... ")
+	s1 := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8890")
+	if (s1 == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	if (s1.Stop (context.Background ()) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot stop server") }
+	<-s1.Done()
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing stopping a running server... ")
+	s2 := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8891")
+	if (s2 == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	if (s2.Start () != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start the data server") }
+	if (s2.Start () == err.NoErr) { log.Fatal ("FATAL ERROR: Server started twice") }
+
+	// An idle client must not prevent the server from stopping
+	conn, _, myerr := comm.Connect2Server ("127.0.0.1:8891")
+	if (conn == nil || myerr != err.NoErr) { log.Fatal ("ERROR: Cannot connect to the server") }
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout (context.Background (), 10 * time.Second)
+	defer cancel()
+	if (s2.Stop (ctx) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot stop server") }
+	<-s2.Done()
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing completing a request while stopping... ")
+	s3 := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8921")
+	if (s3 == nil || s3.Start () != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start the data server") }
+	busy := dialServer ("127.0.0.1:8921")
+	defer busy.Close()
+	// Half of the request is sent before stopping, the rest once the server is stopping
+	sendRequest (busy, DATAACKMSG, "default", uint64 (0), uint64 (0), uint64 (4))
+	waitConnBusy (s3)
+	stopped := make (chan err.SysError)
+	go func () {
+		ctx, cancel := context.WithTimeout (context.Background (), 10 * time.Second)
+		defer cancel()
+		stopped <- s3.Stop (ctx)
+	}()
+	time.Sleep (100 * time.Millisecond)
+	select {
+	case <-s3.Done():
+		log.Fatal ("FATAL ERROR: Server stopped with a request in progress")
+	default:
+	}
+	busy.Write ([]byte ("data"))
+	written, myerr := recvWriteAck (busy)
+	if (written != 4 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Request in progress not completed") }
+	if (<-stopped != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot stop server") }
+	checkConnClosed (busy)
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing reaching the shutdown deadline... ")
+	s4 := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8922")
+	if (s4 == nil || s4.Start () != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start the data server") }
+	stuck := dialServer ("127.0.0.1:8922")
+	defer stuck.Close()
+	// The rest of the request never comes
+	sendRequest (stuck, DATAACKMSG, "default", uint64 (0), uint64 (0), uint64 (4))
+	waitConnBusy (s4)
+	ctx, cancel = context.WithTimeout (context.Background (), 200 * time.Millisecond)
+	defer cancel()
+	if (s4.Stop (ctx) != err.ErrFatal) { log.Fatal ("FATAL ERROR: Interrupted request not reported") }
+	checkConnClosed (stuck)
+	fmt.Println ("PASS")
+}
+
+func TestShortRead (t *testing.T) {
+	validTestPath := "/tmp/ns_test_read/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	myserver := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8893")
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing reading a block that does not exist... ")
+	_, _, myerr := BlockRead (myserver, "default", 42, 0, 4096)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Read of a missing block did not fail correctly") }
+	_, myerror = os.Stat (validTestPath + "default/block42")
+	if (!os.IsNotExist (myerror)) { log.Fatal ("FATAL ERROR: Read created the block") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing reading past the written data... ")
+	data := make ([]byte, 100)
+	for i := range data { data[i] = 0xff }
+	ws, myerr := BlockWrite (myserver, "default", 42, 0, data)
+	if (ws != 100 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	rs, buff, myerr := BlockRead (myserver, "default", 42, 50, 4096)
+	if (rs != 50 || len (buff) != 4096 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Invalid short read - Read ", rs, " bytes") }
+	for i := range buff {
+		if ((i < 50 && buff[i] != 0xff) || (i >= 50 && buff[i] != 0)) { log.Fatal ("FATAL ERROR: Invalid data at ", i) }
+	}
+	rs, buff, myerr = BlockRead (myserver, "default", 42, 8192, 4096)
+	if (rs != 0 || len (buff) != 4096 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Invalid read past the end of the block") }
+	fmt.Println ("PASS")
+}
+
+func TestBlockDelete (t *testing.T) {
+	validTestPath := "/tmp/ns_test_delete/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	myserver := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8894")
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+
+	data := make ([]byte, 8192)
+	ws, myerr := BlockWrite (myserver, "default", 1, 0, data)
+	if (ws != 8192 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+
+	fmt.Print ("Testing block truncation... ")
+	if (BlockTruncate (myserver, "default", 1, 2 * 1024 * 1024) != err.ErrDataOverflow) { log.Fatal ("FATAL ERROR: Truncation past the block size accepted") }
+	if (BlockTruncate (myserver, "default", 2, 0) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Truncation of a missing block accepted") }
+	if (BlockTruncate (myserver, "default", 1, 100) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot truncate block") }
+	rs, _, myerr := BlockRead (myserver, "default", 1, 0, 8192)
+	if (rs != 100 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Block was not truncated") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing block deletion... ")
+	if (BlockDelete (myserver, "default", 1) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete block") }
+	_, myerror = os.Stat (validTestPath + "default/block1")
+	if (!os.IsNotExist (myerror)) { log.Fatal ("FATAL ERROR: Block file is still there") }
+	_, _, myerr = BlockRead (myserver, "default", 1, 0, 8192)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Deleted block can still be read") }
+	if (BlockDelete (myserver, "default", 1) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Deleted a missing block") }
+	fmt.Println ("PASS")
+}
+
+func TestConcurrentClients (t *testing.T) {
+	var cfg ServerConfig
+	cfg.Basedir = "/tmp/ds_test_concurrent/"
+	cfg.BlockSize = 4096
+	cfg.URL = "127.0.0.1:8915"
+	myserver := startWireServer (&cfg)
+	defer os.RemoveAll (cfg.Basedir)
+	defer myserver.Stop (context.Background ())
+
+	fmt.Print ("Testing concurrent clients on the same and different blocks... ")
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add (1)
+		go func (c int) {
+			defer wg.Done()
+			conn := dialServer (cfg.URL)
+			defer conn.Close()
+			mine := bytes.Repeat ([]byte {byte (c + 1)}, 4096)
+			for i := 0; i < 20; i++ {
+				// Whole blocks are written at once, a reader never sees a mix of them
+				written, myerr := writeBlockWire (conn, "default", 0, 0, mine)
+				if (written != 4096 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write the shared block") }
+				valid, data, myerr := readBlockWire (conn, "default", 0, 0, 4096)
+				if (valid != 4096 || myerr != err.NoErr || !bytes.Equal (data, bytes.Repeat (data[:1], 4096))) { log.Fatal ("FATAL ERROR: Torn read of the shared block") }
+
+				written, myerr = writeBlockWire (conn, "default", uint64 (c + 1), uint64 (i), mine[:100])
+				if (written != 100 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block ", c + 1) }
+				valid, data, myerr = readBlockWire (conn, "default", uint64 (c + 1), 0, uint64 (i + 100))
+				if (valid != uint64 (i + 100) || myerr != err.NoErr || data[i + 99] != byte (c + 1)) { log.Fatal ("FATAL ERROR: Invalid data in block ", c + 1) }
+			}
+		}(c)
+	}
+	wg.Wait()
+	myserver.blocks.lock.Lock()
+	left := len (myserver.blocks.locks)
+	myserver.blocks.lock.Unlock()
+	if (left != 0) { log.Fatal ("FATAL ERROR: Block locks left behind: ", left) }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing a client disconnecting in the middle of a message... ")
+	partial := dialServer (cfg.URL)
+	sendRequest (partial, DATAACKMSG, "default", uint64 (42), uint64 (0), uint64 (100))
+	partial.Write (make ([]byte, 10))
+	// The other clients do not wait for the rest of the message
+	conn := dialServer (cfg.URL)
+	defer conn.Close()
+	written, myerr := writeBlockWire (conn, "default", 43, 0, []byte ("served"))
+	if (written != 6 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Client blocked by a partial message") }
+	partial.Close()
+	valid, data, myerr := readBlockWire (conn, "default", 43, 0, 6)
+	if (valid != 6 || myerr != err.NoErr || string (data) != "served") { log.Fatal ("FATAL ERROR: Client not served after a disconnection") }
+	_, _, myerr = readBlockWire (conn, "default", 42, 0, 6)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Partial message written") }
+	fmt.Println ("PASS")
+}
@@ -0,0 +1,639 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("net"
+	"fmt"
+	"sort"
+	"sync"
+	"strings")
+
+import err "github.com/gvallee/syserror"
+import comm "github.com/gvallee/fscomm"
+
+// Suffixes of the namespaces holding the snapshots of another namespace
+const (
+	snapshotSuffix = ".snap"
+	snapshotMapSuffix = ".snapmap"
+)
+
+// Separator between the names of a namespace and of one of its snapshots, to read the
+// blocks of the snapshot, e.g., "results@before-cleanup"
+const SnapshotSeparator = "@"
+
+// Maximum length of a snapshot's name. The namespaces holding the snapshot, e.g.,
+// "ns.s.snapmap", are only checked by the stores, against maxStoreNameLen.
+const MaxSnapshotNameLen = 64
+
+// Actions of a SNAPREQ
+const (
+	// Take a snapshot of a namespace
+	SnapshotActionCreate uint64 = iota
+	// List the snapshots of a namespace
+	SnapshotActionList
+	// Delete a snapshot
+	SnapshotActionDelete
+	// Bring a namespace back to one of its snapshots
+	SnapshotActionRollback
+)
+
+/**
+ * Block store decorator keeping read-only, point-in-time snapshots of namespaces.
+ * Snapshots are copy-on-write at the block level: taking a snapshot "s" of namespace
+ * "ns" only records which blocks the namespace has, as empty blocks of the namespace
+ * "ns.s.snapmap" of the wrapped store; a block is copied to the namespace "ns.s.snap",
+ * which has the descriptor of "ns", the first time it is written, truncated or deleted
+ * after the snapshot, and its empty block is dropped. Copies are cheap when the
+ * wrapped store supports it, e.g., shared data on disk (see FileStore.CloneBlock) or a
+ * new reference to a deduplicated block (see DedupStore). The blocks of a snapshot are
+ * read as namespace "ns@s": from "ns" while they are shared, from "ns.s.snap" once
+ * copied. A snapshot exists once "ns.s.snap" exists, which is created last; a
+ * "ns.s.snapmap" left alone by a crash is deleted when the store is opened. Snapshots
+ * go away with their namespace, which cannot be renamed while it has some. Namespaces
+ * names ending with ".snap" or ".snapmap" are reserved.
+ */
+type SnapshotStore struct {
+	store	BlockStore
+	lock	sync.Mutex
+	snapshots	map[string][]string	// Names of the snapshots by namespace, sorted
+}
+
+/**
+ * Create a snapshot store
+ * @param[in]	store	Block store actually storing the blocks and the snapshots
+ * @return	Pointer to a new SnapshotStore structure
+ */
+func NewSnapshotStore (store BlockStore) *SnapshotStore {
+	ss := new (SnapshotStore)
+	ss.store = store
+	ss.snapshots = make (map[string][]string)
+	return ss
+}
+
+/**
+ * Get the block store wrapped by the snapshot store
+ * @return	Wrapped block store
+ */
+func (store *SnapshotStore) Unwrap () BlockStore {
+	return store.store
+}
+
+/**
+ * Find the snapshot store in a stack of decorators
+ * @param[in]	store	Block store, possibly decorated
+ * @return	Snapshot store; nil if the stack has none
+ */
+func snapshotStore (store BlockStore) *SnapshotStore {
+	for {
+		ss, ok := store.(*SnapshotStore)
+		if (ok) { return ss }
+		decorator, ok := store.(interface { Unwrap () BlockStore })
+		if (!ok) { return nil }
+		store = decorator.Unwrap ()
+	}
+}
+
+/**
+ * Check whether a snapshot's name is valid: the rules of the namespaces' names (see
+ * ValidNamespaceName) without '.', and at most MaxSnapshotNameLen characters
+ * @param[in]	name	Snapshot's name
+ * @return	true if the name is valid; false otherwise
+ */
+func ValidSnapshotName (name string) bool {
+	return len (name) <= MaxSnapshotNameLen && !strings.Contains (name, ".") && ValidNamespaceName (name)
+}
+
+func snapshotNamespaceName (namespace string, snapshot string) string {
+	return namespace + "." + snapshot + snapshotSuffix
+}
+
+func snapshotMapName (namespace string, snapshot string) string {
+	return namespace + "." + snapshot + snapshotMapSuffix
+}
+
+func snapshotReserved (namespace string) bool {
+	return strings.HasSuffix (namespace, snapshotSuffix) || strings.HasSuffix (namespace, snapshotMapSuffix)
+}
+
+/**
+ * Get the namespace and the snapshot of a namespace of the wrapped store holding a
+ * snapshot
+ * @param[in]	name	Name of the namespace in the wrapped store
+ * @return	Namespace's name
+ * @return	Snapshot's name
+ * @return	true if the namespace holds a snapshot; false otherwise
+ */
+func parseSnapshotNamespace (name string) (string, string, bool) {
+	if (!snapshotReserved (name)) { return name, "", false }
+	name = strings.TrimSuffix (strings.TrimSuffix (name, snapshotMapSuffix), snapshotSuffix)
+	i := strings.LastIndex (name, ".")
+	if (i <= 0) { return name, "", false }
+	return name[:i], name[i + 1:], true
+}
+
+/**
+ * Split the name of the blocks of a snapshot, e.g., "ns@s"
+ * @param[in]	name	Name as received from the client
+ * @return	Namespace's name
+ * @return	Snapshot's name; empty if the name is a namespace's
+ */
+func splitSnapshotName (name string) (string, string) {
+	i := strings.Index (name, SnapshotSeparator)
+	if (i < 0) { return name, "" }
+	return name[:i], name[i + 1:]
+}
+
+/**
+ * Get the snapshots of a namespace
+ * @param[in]	namespace	Namespace's name
+ * @return	Names of the snapshots, sorted
+ */
+func (store *SnapshotStore) list (namespace string) []string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return append ([]string {}, store.snapshots[namespace]...)
+}
+
+func (store *SnapshotStore) hasSnapshot (namespace string, snapshot string) bool {
+	for _, s := range store.list (namespace) {
+		if (s == snapshot) { return true }
+	}
+	return false
+}
+
+func (store *SnapshotStore) addSnapshot (namespace string, snapshot string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	snapshots := append (store.snapshots[namespace], snapshot)
+	sort.Strings (snapshots)
+	store.snapshots[namespace] = snapshots
+}
+
+func (store *SnapshotStore) forgetSnapshot (namespace string, snapshot string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var snapshots []string
+	for _, s := range store.snapshots[namespace] {
+		if (s != snapshot) { snapshots = append (snapshots, s) }
+	}
+	if (len (snapshots) == 0) {
+		delete (store.snapshots, namespace)
+		return
+	}
+	store.snapshots[namespace] = snapshots
+}
+
+/**
+ * Load the snapshots of the wrapped store, deleting the ones not fully created
+ * @return	System error handle
+ */
+func (store *SnapshotStore) load () err.SysError {
+	names, myerr := store.store.ListNamespaces ()
+	if (myerr != err.NoErr) { return myerr }
+
+	store.lock.Lock()
+	store.snapshots = make (map[string][]string)
+	store.lock.Unlock()
+	complete := make (map[string]bool)
+	for _, name := range names {
+		namespace, snapshot, ok := parseSnapshotNamespace (name)
+		if (ok && strings.HasSuffix (name, snapshotSuffix)) {
+			store.addSnapshot (namespace, snapshot)
+			complete[snapshotMapName (namespace, snapshot)] = true
+		}
+	}
+	for _, name := range names {
+		if (!strings.HasSuffix (name, snapshotMapSuffix) || complete[name]) { continue }
+		fmt.Println ("Deleting incomplete snapshot", name)
+		myerr = store.store.DeleteNamespace (name)
+		if (myerr != err.NoErr) { return myerr }
+	}
+	return err.NoErr
+}
+
+/**
+ * Copy a block of a namespace to the snapshots still sharing it, before it changes
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	System error handle
+ */
+func (store *SnapshotStore) preserve (namespace string, blockid uint64, mode Durability) err.SysError {
+	for _, snapshot := range store.list (namespace) {
+		shared := snapshotMapName (namespace, snapshot)
+		_, myerr := store.store.Stat (shared, blockid)
+		if (myerr == err.ErrNotAvailable) { continue } // Already copied, or created after the snapshot
+		if (myerr != err.NoErr) { return myerr }
+
+		// A crash before the block is marked as copied only leads to copying it again
+		myerr = cloneBlock (store.store, namespace, snapshotNamespaceName (namespace, snapshot), blockid, mode)
+		if (myerr != err.NoErr && myerr != err.ErrNotAvailable) { return myerr }
+		myerr = store.store.Delete (shared, blockid)
+		if (myerr != err.NoErr && myerr != err.ErrNotAvailable) { return myerr }
+	}
+	return err.NoErr
+}
+
+/**
+ * Get the blocks of a snapshot copied when its namespace changed, i.e., the ones not
+ * shared with the namespace
+ * @param[in]	namespace	Namespace's name
+ * @param[in]	snapshot	Snapshot's name
+ * @return	Block ids, in no particular order
+ * @return	System error handle; ErrNotAvailable if the snapshot does not exist
+ */
+func (store *SnapshotStore) copies (namespace string, snapshot string) ([]uint64, err.SysError) {
+	if (!store.hasSnapshot (namespace, snapshot)) { return nil, err.ErrNotAvailable }
+	return store.store.List (snapshotNamespaceName (namespace, snapshot))
+}
+
+/**
+ * Get the namespace of the wrapped store holding a block of a snapshot
+ * @param[in]	name	Name of the snapshot, e.g., "ns@s"
+ * @param[in]	blockid	Block id
+ * @return	Namespace holding the block
+ * @return	System error handle; ErrNotAvailable if the snapshot does not exist
+ */
+func (store *SnapshotStore) snapshotBlock (name string, blockid uint64) (string, err.SysError) {
+	namespace, snapshot := splitSnapshotName (name)
+	if (!store.hasSnapshot (namespace, snapshot)) { return "", err.ErrNotAvailable }
+
+	_, myerr := store.store.Stat (snapshotMapName (namespace, snapshot), blockid)
+	if (myerr == err.NoErr) { return namespace, err.NoErr }
+	if (myerr != err.ErrNotAvailable) { return "", myerr }
+	return snapshotNamespaceName (namespace, snapshot), err.NoErr
+}
+
+/**
+ * Take a snapshot of a namespace. The namespace must be idle.
+ * @param[in]	namespace	Namespace's name
+ * @param[in]	snapshot	Snapshot's name
+ * @return	System error handle; ErrNotAvailable if the namespace does not exist or
+ *		already has a snapshot with that name
+ */
+func (store *SnapshotStore) CreateSnapshot (namespace string, snapshot string) err.SysError {
+	if (snapshotReserved (namespace) || !ValidSnapshotName (snapshot) || store.hasSnapshot (namespace, snapshot)) { return err.ErrNotAvailable }
+	desc, myerr := store.store.GetNamespace (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	blocks, myerr := store.store.List (namespace)
+	if (myerr != err.NoErr) { return myerr }
+
+	// Left over by a snapshot that could not be created
+	shared := snapshotMapName (namespace, snapshot)
+	_, myerr = store.store.GetNamespace (shared)
+	if (myerr == err.NoErr) { store.store.DeleteNamespace (shared) }
+
+	var markers NamespaceDescriptor
+	markers.FormatVersion = FormatVersion
+	markers.BlockSize = BlockSizeAlignment
+	_, myerr = store.store.CreateNamespace (shared, markers)
+	if (myerr != err.NoErr) { return myerr }
+	for _, blockid := range blocks {
+		_, _, myerr = store.store.Write (shared, blockid, 0, []byte {}, DurabilityNone)
+		if (myerr != err.NoErr) { break }
+	}
+	if (myerr == err.NoErr) { myerr = store.store.Flush (shared) }
+
+	// The snapshot exists from now on
+	if (myerr == err.NoErr) {
+		desc.Layout = ""
+		desc.LayoutVersion = 0
+		desc.MigratingFrom = 0
+		_, myerr = store.store.CreateNamespace (snapshotNamespaceName (namespace, snapshot), desc)
+	}
+	if (myerr != err.NoErr) {
+		fmt.Println ("Cannot create snapshot", snapshot, "of namespace", namespace)
+		store.store.DeleteNamespace (shared)
+		return myerr
+	}
+	store.addSnapshot (namespace, snapshot)
+	return err.NoErr
+}
+
+/**
+ * Get the snapshots of a namespace
+ * @param[in]	namespace	Namespace's name
+ * @return	Names of the snapshots, sorted
+ */
+func (store *SnapshotStore) ListSnapshots (namespace string) []string {
+	return store.list (namespace)
+}
+
+/**
+ * Delete a snapshot. The namespace must be idle.
+ * @param[in]	namespace	Namespace's name
+ * @param[in]	snapshot	Snapshot's name
+ * @return	System error handle; ErrNotAvailable if the snapshot does not exist
+ */
+func (store *SnapshotStore) DeleteSnapshot (namespace string, snapshot string) err.SysError {
+	if (!store.hasSnapshot (namespace, snapshot)) { return err.ErrNotAvailable }
+
+	// The snapshot does not exist anymore once its copied blocks are gone
+	store.forgetSnapshot (namespace, snapshot)
+	myerr := store.store.DeleteNamespace (snapshotNamespaceName (namespace, snapshot))
+	if (myerr != err.NoErr && myerr != err.ErrNotAvailable) { return myerr }
+	myerr = store.store.DeleteNamespace (snapshotMapName (namespace, snapshot))
+	if (myerr == err.ErrNotAvailable) { return err.NoErr }
+	return myerr
+}
+
+/**
+ * Bring a namespace back to one of its snapshots, which is kept. The blocks created
+ * since the snapshot are deleted and the blocks changed since the snapshot get their
+ * content back, the other snapshots preserving the current content first. An
+ * interrupted rollback completes when called again. The namespace must be idle.
+ * @param[in]	namespace	Namespace's name
+ * @param[in]	snapshot	Snapshot's name
+ * @param[in]	mode	Durability policy of the namespace
+ * @return	System error handle; ErrNotAvailable if the snapshot does not exist
+ */
+func (store *SnapshotStore) RollbackSnapshot (namespace string, snapshot string, mode Durability) err.SysError {
+	if (!store.hasSnapshot (namespace, snapshot)) { return err.ErrNotAvailable }
+	data := snapshotNamespaceName (namespace, snapshot)
+	shared := snapshotMapName (namespace, snapshot)
+
+	inSnapshot := make (map[uint64]bool)
+	sharedBlocks, myerr := store.store.List (shared)
+	if (myerr != err.NoErr) { return myerr }
+	for _, blockid := range sharedBlocks { inSnapshot[blockid] = true }
+	copied, myerr := store.store.List (data)
+	if (myerr != err.NoErr) { return myerr }
+	for _, blockid := range copied { inSnapshot[blockid] = true }
+
+	blocks, myerr := store.store.List (namespace)
+	if (myerr != err.NoErr) { return myerr }
+	for _, blockid := range blocks {
+		if (inSnapshot[blockid]) { continue }
+		myerr = store.Delete (namespace, blockid)
+		if (myerr != err.NoErr && myerr != err.ErrNotAvailable) { return myerr }
+	}
+
+	isShared := make (map[uint64]bool)
+	for _, blockid := range sharedBlocks { isShared[blockid] = true }
+	for _, blockid := range copied {
+		// Copied by a write interrupted by a crash, the block did not change
+		if (!isShared[blockid]) {
+			myerr = store.preserve (namespace, blockid, mode)
+			if (myerr != err.NoErr) { return myerr }
+			myerr = cloneBlock (store.store, data, namespace, blockid, mode)
+			if (myerr != err.NoErr) { return myerr }
+			_, _, myerr = store.store.Write (shared, blockid, 0, []byte {}, mode)
+			if (myerr != err.NoErr) { return myerr }
+		}
+		myerr = store.store.Delete (data, blockid)
+		if (myerr != err.NoErr && myerr != err.ErrNotAvailable) { return myerr }
+	}
+	return err.NoErr
+}
+
+func (store *SnapshotStore) Open (basedir string) err.SysError {
+	myerr := store.store.Open (basedir)
+	if (myerr != err.NoErr) { return myerr }
+	return store.load ()
+}
+
+func (store *SnapshotStore) Close () err.SysError {
+	return store.store.Close ()
+}
+
+func (store *SnapshotStore) Read (namespace string, blockid uint64, offset uint64, buff []byte) (int, err.SysError) {
+	if (strings.Contains (namespace, SnapshotSeparator)) {
+		var myerr err.SysError
+		namespace, myerr = store.snapshotBlock (namespace, blockid)
+		if (myerr != err.NoErr) { return -1, myerr }
+	}
+	return store.store.Read (namespace, blockid, offset, buff)
+}
+
+func (store *SnapshotStore) Write (namespace string, blockid uint64, offset uint64, data []byte, mode Durability) (int, bool, err.SysError) {
+	if (strings.Contains (namespace, SnapshotSeparator)) { return -1, false, err.ErrNotAvailable }
+	myerr := store.preserve (namespace, blockid, mode)
+	if (myerr != err.NoErr) { return -1, false, myerr }
+	return store.store.Write (namespace, blockid, offset, data, mode)
+}
+
+func (store *SnapshotStore) Truncate (namespace string, blockid uint64, size uint64, mode Durability) err.SysError {
+	if (strings.Contains (namespace, SnapshotSeparator)) { return err.ErrNotAvailable }
+	myerr := store.preserve (namespace, blockid, mode)
+	if (myerr != err.NoErr) { return myerr }
+	return store.store.Truncate (namespace, blockid, size, mode)
+}
+
+func (store *SnapshotStore) Delete (namespace string, blockid uint64) err.SysError {
+	if (strings.Contains (namespace, SnapshotSeparator)) { return err.ErrNotAvailable }
+	// Nothing brings the block back if the copy is lost, it is synced
+	myerr := store.preserve (namespace, blockid, DurabilityPerWrite)
+	if (myerr != err.NoErr) { return myerr }
+	return store.store.Delete (namespace, blockid)
+}
+
+func (store *SnapshotStore) List (namespace string) ([]uint64, err.SysError) {
+	if (!strings.Contains (namespace, SnapshotSeparator)) { return store.store.List (namespace) }
+
+	name, snapshot := splitSnapshotName (namespace)
+	if (!store.hasSnapshot (name, snapshot)) { return nil, err.ErrNotAvailable }
+	blocks, myerr := store.store.List (snapshotMapName (name, snapshot))
+	if (myerr != err.NoErr) { return nil, myerr }
+	copied, myerr := store.store.List (snapshotNamespaceName (name, snapshot))
+	if (myerr != err.NoErr) { return nil, myerr }
+	listed := make (map[uint64]bool)
+	for _, blockid := range blocks { listed[blockid] = true }
+	for _, blockid := range copied {
+		if (!listed[blockid]) { blocks = append (blocks, blockid) }
+	}
+	return blocks, err.NoErr
+}
+
+func (store *SnapshotStore) Stat (namespace string, blockid uint64) (uint64, err.SysError) {
+	if (strings.Contains (namespace, SnapshotSeparator)) {
+		var myerr err.SysError
+		namespace, myerr = store.snapshotBlock (namespace, blockid)
+		if (myerr != err.NoErr) { return 0, myerr }
+	}
+	return store.store.Stat (namespace, blockid)
+}
+
+func (store *SnapshotStore) Flush (namespace string) err.SysError {
+	myerr := store.store.Flush (namespace)
+	for _, snapshot := range store.list (namespace) {
+		if (store.store.Flush (snapshotNamespaceName (namespace, snapshot)) != err.NoErr) { myerr = err.ErrFatal }
+		if (store.store.Flush (snapshotMapName (namespace, snapshot)) != err.NoErr) { myerr = err.ErrFatal }
+	}
+	return myerr
+}
+
+func (store *SnapshotStore) SyncDirty (match func (namespace string) bool) int {
+	return store.store.SyncDirty (func (namespace string) bool {
+		name, _, _ := parseSnapshotNamespace (namespace)
+		return match (name)
+	})
+}
+
+func (store *SnapshotStore) CreateNamespace (namespace string, desc NamespaceDescriptor) (NamespaceDescriptor, err.SysError) {
+	if (snapshotReserved (namespace)) { return desc, err.ErrNotAvailable }
+	return store.store.CreateNamespace (namespace, desc)
+}
+
+func (store *SnapshotStore) GetNamespace (namespace string) (NamespaceDescriptor, err.SysError) {
+	if (snapshotReserved (namespace)) { return NamespaceDescriptor {}, err.ErrNotAvailable }
+	name, snapshot := splitSnapshotName (namespace)
+	if (snapshot != "" && !store.hasSnapshot (name, snapshot)) { return NamespaceDescriptor {}, err.ErrNotAvailable }
+	return store.store.GetNamespace (name)
+}
+
+func (store *SnapshotStore) ListNamespaces () ([]string, err.SysError) {
+	names, myerr := store.store.ListNamespaces ()
+	if (myerr != err.NoErr) { return nil, myerr }
+
+	var visible []string
+	for _, name := range names {
+		if (!snapshotReserved (name)) { visible = append (visible, name) }
+	}
+	return visible, err.NoErr
+}
+
+func (store *SnapshotStore) DeleteNamespace (namespace string) err.SysError {
+	if (snapshotReserved (namespace)) { return err.ErrNotAvailable }
+
+	for _, snapshot := range store.list (namespace) {
+		myerr := store.DeleteSnapshot (namespace, snapshot)
+		if (myerr != err.NoErr) { return myerr }
+	}
+	return store.store.DeleteNamespace (namespace)
+}
+
+func (store *SnapshotStore) RenameNamespace (oldname string, newname string) err.SysError {
+	if (snapshotReserved (oldname) || snapshotReserved (newname)) { return err.ErrNotAvailable }
+	if (len (store.list (oldname)) > 0) {
+		fmt.Println ("Cannot rename namespace", oldname, "while it has snapshots")
+		return err.ErrNotAvailable
+	}
+	return store.store.RenameNamespace (oldname, newname)
+}
+
+/**
+ * Take a snapshot of a namespace, e.g., before running a risky job. The operations in
+ * progress on the namespace complete first; taking the snapshot only records the
+ * blocks of the namespace, which are copied when they change (see SnapshotStore). The
+ * blocks of the snapshot are read as namespace "<namespace>@<snapshot>".
+ * @param[in]	dataserver	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @param[in]	snapshot	Snapshot's name, see ValidSnapshotName
+ * @return	System error handle; ErrNotAvailable if the namespace does not exist or
+ *		already has a snapshot with that name
+ */
+func SnapshotCreate (dataserver *Server, name string, snapshot string) err.SysError {
+	if (dataserver == nil || !ValidNamespaceName (name) || !ValidSnapshotName (snapshot)) { return err.ErrNotAvailable }
+	ss := snapshotStore (dataserver.store)
+	if (ss == nil) { return err.ErrNotAvailable }
+
+	unlockns := dataserver.namespaces.lockKey (name)
+	defer unlockns()
+	if (!namespaceKnown (dataserver, name)) { return err.ErrNotAvailable }
+	return ss.CreateSnapshot (name, snapshot)
+}
+
+/**
+ * Get the snapshots of a namespace
+ * @param[in]	dataserver	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @return	Names of the snapshots, sorted
+ * @return	System error handle; ErrNotAvailable if the namespace does not exist
+ */
+func SnapshotList (dataserver *Server, name string) ([]string, err.SysError) {
+	if (dataserver == nil) { return nil, err.ErrNotAvailable }
+	ss := snapshotStore (dataserver.store)
+	if (ss == nil) { return nil, err.ErrNotAvailable }
+
+	unlockns, myerr := useNamespace (dataserver, name, false)
+	if (myerr != err.NoErr) { return nil, myerr }
+	defer unlockns()
+	return ss.ListSnapshots (name), err.NoErr
+}
+
+/**
+ * Delete a snapshot. The reads in progress on the snapshot complete first.
+ * @param[in]	dataserver	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @param[in]	snapshot	Snapshot's name
+ * @return	System error handle; ErrNotAvailable if the snapshot does not exist
+ */
+func SnapshotDelete (dataserver *Server, name string, snapshot string) err.SysError {
+	if (dataserver == nil) { return err.ErrNotAvailable }
+	ss := snapshotStore (dataserver.store)
+	if (ss == nil) { return err.ErrNotAvailable }
+
+	unlockns := dataserver.namespaces.lockKey (name)
+	defer unlockns()
+	if (!namespaceKnown (dataserver, name)) { return err.ErrNotAvailable }
+	return ss.DeleteSnapshot (name, snapshot)
+}
+
+/**
+ * Bring a namespace back to one of its snapshots, e.g., after a job failed. The
+ * operations in progress on the namespace complete first. The snapshot is kept.
+ * @param[in]	dataserver	Structure representing the server
+ * @param[in]	name	Namespace's name
+ * @param[in]	snapshot	Snapshot's name
+ * @return	System error handle; ErrNotAvailable if the snapshot does not exist
+ */
+func SnapshotRollback (dataserver *Server, name string, snapshot string) err.SysError {
+	if (dataserver == nil) { return err.ErrNotAvailable }
+	ss := snapshotStore (dataserver.store)
+	if (ss == nil) { return err.ErrNotAvailable }
+
+	unlockns := dataserver.namespaces.lockKey (name)
+	defer unlockns()
+	if (!namespaceKnown (dataserver, name)) { return err.ErrNotAvailable }
+	mode := GetNamespaceDurability (dataserver, name)
+	myerr := ss.RollbackSnapshot (name, snapshot, mode)
+	if (myerr != err.NoErr || mode == DurabilityNone) { return myerr }
+	return dataserver.store.Flush (name)
+}
+
+/**
+ * Receive and handle a SNAPREQ. The message header has already been received.
+ * @param[in]	server	Structure representing the server
+ * @param[in]	conn	Connection to the client
+ * @return	System error handle
+ */
+func handleSnapshotReq (server *Server, conn net.Conn) err.SysError {
+	action, syserr := comm.RecvUint64 (conn)
+	if (syserr != err.NoErr) { return err.ErrFatal }
+	name, recverr := recvString (conn, maxRequestNameLen)
+	if (recverr == err.ErrDataOverflow) { return refuseOverflow (conn, action != SnapshotActionList) }
+	if (recverr != err.NoErr) { return recverr }
+	snapshot := ""
+	if (action != SnapshotActionList) {
+		snapshot, recverr = recvString (conn, maxRequestNameLen)
+		if (recverr == err.ErrDataOverflow) { return refuseOverflow (conn, true) }
+		if (recverr != err.NoErr) { return recverr }
+	}
+
+	status := checkNamespace (server, name, false)
+	if (status == StatusOK && action != SnapshotActionList && !ValidSnapshotName (snapshot)) { status = StatusInvalidNamespace }
+	if (status != StatusOK) {
+		if (action == SnapshotActionList) { return sendStatusReply (conn, status) }
+		return sendWriteAckStatus (conn, status, 0, false)
+	}
+
+	switch action {
+	case SnapshotActionCreate:
+		return sendWriteAck (conn, SnapshotCreate (server, name, snapshot), 0, false)
+	case SnapshotActionList:
+		snapshots, myerr := SnapshotList (server, name)
+		if (myerr != err.NoErr) { return sendErrorReply (conn, myerr) }
+		return sendNamespaceList (conn, snapshots)
+	case SnapshotActionDelete:
+		return sendWriteAck (conn, SnapshotDelete (server, name, snapshot), 0, false)
+	case SnapshotActionRollback:
+		return sendWriteAck (conn, SnapshotRollback (server, name, snapshot), 0, false)
+	}
+	return sendErrorReply (conn, err.ErrNotAvailable)
+}
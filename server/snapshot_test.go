@@ -0,0 +1,197 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings")
+
+import err "github.com/gvallee/syserror"
+
+func checkSnapshotBlock (store BlockStore, namespace string, blockid uint64, expected []byte) {
+	buff := make ([]byte, 4096)
+	rs, myerr := store.Read (namespace, blockid, 0, buff)
+	if (expected == nil) {
+		if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Unexpected block ", blockid, " in ", namespace) }
+		return
+	}
+	if (myerr != err.NoErr || !bytes.Equal (buff[:rs], expected)) { log.Fatal ("FATAL ERROR: Invalid block ", blockid, " in ", namespace) }
+}
+
+func TestSnapshotStore (t *testing.T) {
+	fmt.Print ("Testing snapshots of namespaces... ")
+	mem := NewMemoryStore (0)
+	store := NewSnapshotStore (NewDedupStore (mem))
+	if (store.Open ("") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot open store") }
+	desc := NamespaceDescriptor {FormatVersion: FormatVersion, BlockSize: 4096}
+	_, myerr := store.CreateNamespace ("job", desc)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	v1 := bytes.Repeat ([]byte ("v1"), 100)
+	v2 := bytes.Repeat ([]byte ("v2"), 100)
+	for id := uint64 (0); id < 3; id++ {
+		store.Write ("job", id, 0, v1, DurabilityNone)
+	}
+	if (store.CreateSnapshot ("job", "before") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create snapshot") }
+	if (store.CreateSnapshot ("job", "before") != err.ErrNotAvailable || store.CreateSnapshot ("job", "a.b") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Created an invalid snapshot") }
+	_, myerr = store.CreateNamespace ("x.before.snap", desc)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Created a reserved namespace") }
+	names, _ := store.ListNamespaces ()
+	if (len (names) != 1) { log.Fatal ("FATAL ERROR: Snapshots visible as namespaces: ", names) }
+
+	store.Write ("job", 0, 0, v2, DurabilityNone)
+	store.Delete ("job", 1)
+	store.Truncate ("job", 2, 10, DurabilityNone)
+	store.Write ("job", 3, 0, v2, DurabilityNone)
+	checkSnapshotBlock (store, "job", 0, v2)
+	checkSnapshotBlock (store, "job", 1, nil)
+	for id := uint64 (0); id < 3; id++ {
+		checkSnapshotBlock (store, "job@before", id, v1)
+	}
+	checkSnapshotBlock (store, "job@before", 3, nil)
+	checkSnapshotBlock (store, "job@unknown", 0, nil)
+	blocks, _ := store.List ("job@before")
+	size, _ := store.Stat ("job@before", 2)
+	if (len (blocks) != 3 || size != 200) { log.Fatal ("FATAL ERROR: Invalid snapshot blocks: ", blocks, " ", size) }
+	_, _, myerr = store.Write ("job@before", 0, 0, v2, DurabilityNone)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Wrote to a snapshot") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing rolling back namespaces... ")
+	if (store.CreateSnapshot ("job", "after") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create snapshot") }
+	store.Write ("job", 0, 0, []byte ("v3"), DurabilityNone)
+	if (store.RollbackSnapshot ("job", "before", DurabilityNone) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot roll back namespace") }
+	for id := uint64 (0); id < 3; id++ {
+		checkSnapshotBlock (store, "job", id, v1)
+	}
+	checkSnapshotBlock (store, "job", 3, nil)
+	checkSnapshotBlock (store, "job@after", 0, v2)
+	checkSnapshotBlock (store, "job@after", 1, nil)
+	checkSnapshotBlock (store, "job@after", 3, v2)
+	checkSnapshotBlock (store, "job@before", 0, v1)
+	// Nothing left to copy: the namespace is back to the snapshot
+	copied, _ := mem.List (snapshotNamespaceName ("job", "before"))
+	if (len (copied) != 0) { log.Fatal ("FATAL ERROR: Blocks still copied after rollback: ", copied) }
+	if (store.RenameNamespace ("job", "renamed") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Renamed a namespace with snapshots") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing reloading and deleting snapshots... ")
+	// As left by a crash while a snapshot was taken
+	mem.CreateNamespace (snapshotMapName ("job", "crash"), desc)
+	store = NewSnapshotStore (NewDedupStore (mem))
+	if (store.Open ("") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot open store") }
+	snapshots := store.ListSnapshots ("job")
+	if (len (snapshots) != 2 || snapshots[0] != "after" || snapshots[1] != "before") { log.Fatal ("FATAL ERROR: Invalid snapshots: ", snapshots) }
+	_, myerr = mem.GetNamespace (snapshotMapName ("job", "crash"))
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Incomplete snapshot left behind") }
+	checkSnapshotBlock (store, "job@after", 3, v2)
+	if (store.DeleteSnapshot ("job", "after") != err.NoErr || store.DeleteSnapshot ("job", "after") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Cannot delete snapshot") }
+	checkSnapshotBlock (store, "job@after", 0, nil)
+	if (store.DeleteNamespace ("job") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	names, _ = mem.ListNamespaces ()
+	if (len (names) != 0 || len (store.ListSnapshots ("job")) != 0) { log.Fatal ("FATAL ERROR: Snapshots left behind: ", names) }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing snapshots of deduplicated namespaces... ")
+	desc.Dedup = true
+	store.CreateNamespace ("dedup", desc)
+	store.Write ("dedup", 0, 0, v1, DurabilityNone)
+	store.CreateSnapshot ("dedup", "s")
+	store.Write ("dedup", 0, 0, v2, DurabilityNone)
+	stats, _ := dedupStore (store).Stats ()
+	if (stats.UniqueBlocks != 2 || stats.References != 2) { log.Fatal ("FATAL ERROR: Invalid deduplication statistics: ", stats) }
+	// Bringing the content back only moves references around
+	store.RollbackSnapshot ("dedup", "s", DurabilityNone)
+	checkSnapshotBlock (store, "dedup", 0, v1)
+	stats, _ = dedupStore (store).Stats ()
+	if (stats.UniqueBlocks != 1 || stats.References != 1) { log.Fatal ("FATAL ERROR: Invalid deduplication statistics: ", stats) }
+	fmt.Println ("PASS")
+}
+
+func TestSnapshotServer (t *testing.T) {
+	validTestPath := "/tmp/ds_test_snapshot/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing a server with snapshots... ")
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 8192
+	cfg.URL = "127.0.0.1:8912"
+	cfg.Checksum = ChecksumCRC32C
+	cfg.Compression = CompressionLZ4
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+
+	data := bytes.Repeat ([]byte ("checkpoint "), 700)
+	if (NamespaceInit ("results", myserver, 0) == nil) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	for id := uint64 (0); id < 4; id++ {
+		_, myerr := BlockWrite (myserver, "results", id, 0, data)
+		if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	}
+	if (SnapshotCreate (myserver, "results", "nightly") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create snapshot") }
+	if (SnapshotCreate (myserver, "unknown", "nightly") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Created a snapshot of an unknown namespace") }
+	BlockWrite (myserver, "results", 1, 0, []byte ("overwritten"))
+	BlockDelete (myserver, "results", 2)
+	rs, buff, myerr := BlockRead (myserver, "results@nightly", 1, 0, 8192)
+	if (rs != len (data) || myerr != err.NoErr || !bytes.Equal (buff[:rs], data)) { log.Fatal ("FATAL ERROR: Invalid snapshot data") }
+	rs, buff, _ = BlockRead (myserver, "results", 1, 0, 11)
+	if (string (buff[:rs]) != "overwritten") { log.Fatal ("FATAL ERROR: Invalid namespace data") }
+	names, _ := NamespaceList (myserver)
+	if (len (names) != 2) { log.Fatal ("FATAL ERROR: Snapshots visible as namespaces: ", names) }
+	if (NamespaceRename (myserver, "results", "renamed") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Renamed a namespace with snapshots") }
+
+	// Only the copied blocks of the snapshot are scrubbed on their own
+	if (ScrubStart (myserver) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start scrubbing") }
+	report := waitScrub (myserver, 1)
+	if (report.Namespaces != 2 || report.Blocks != 5 || report.Errors != 0) { log.Fatal ("FATAL ERROR: Invalid scrub report: ", report) }
+	base := baseStore (myserver.store)
+	saved := make ([]byte, 1)
+	base.Read (snapshotNamespaceName ("results", "nightly"), 2, 20, saved)
+	base.Write (snapshotNamespaceName ("results", "nightly"), 2, 20, []byte {saved[0] ^ 0xff}, DurabilityPerWrite)
+	if (ScrubStart (myserver) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot start scrubbing") }
+	report = waitScrub (myserver, 2)
+	if (report.Errors != 1 || report.Findings[0].Namespace != "results@nightly" || report.Findings[0].BlockID != 2) { log.Fatal ("FATAL ERROR: Corrupted snapshot not detected: ", report) }
+	base.Write (snapshotNamespaceName ("results", "nightly"), 2, 20, saved, DurabilityPerWrite)
+	if (myserver.Stop (context.Background ()) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot stop server") }
+
+	myserver = ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+	snapshots, myerr := SnapshotList (myserver, "results")
+	if (myerr != err.NoErr || len (snapshots) != 1 || snapshots[0] != "nightly") { log.Fatal ("FATAL ERROR: Invalid snapshots: ", snapshots) }
+	rs, buff, myerr = BlockRead (myserver, "results@nightly", 2, 0, 8192)
+	if (rs != len (data) || myerr != err.NoErr || !bytes.Equal (buff[:rs], data)) { log.Fatal ("FATAL ERROR: Invalid snapshot data after restart") }
+	if (SnapshotRollback (myserver, "results", "nightly") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot roll back namespace") }
+	for id := uint64 (0); id < 4; id++ {
+		rs, buff, myerr = BlockRead (myserver, "results", id, 0, 8192)
+		if (rs != len (data) || myerr != err.NoErr || !bytes.Equal (buff[:rs], data)) { log.Fatal ("FATAL ERROR: Invalid data after rollback") }
+	}
+	if (SnapshotDelete (myserver, "results", "nightly") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete snapshot") }
+	_, _, myerr = BlockRead (myserver, "results@nightly", 0, 0, 8192)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Read a deleted snapshot") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing snapshots with the longest names... ")
+	name := strings.Repeat ("n", MaxNamespaceNameLen)
+	snapshot := strings.Repeat ("s", MaxSnapshotNameLen)
+	if (NamespaceInit (name, myserver, 0) == nil) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	BlockWrite (myserver, name, 0, 0, data)
+	if (SnapshotCreate (myserver, name, snapshot) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create snapshot") }
+	if (SnapshotCreate (myserver, name, snapshot + "s") != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Created a snapshot with a name too long") }
+	BlockWrite (myserver, name, 0, 0, []byte ("overwritten"))
+	rs, buff, myerr = BlockRead (myserver, name + SnapshotSeparator + snapshot, 0, 0, 8192)
+	if (rs != len (data) || myerr != err.NoErr || !bytes.Equal (buff[:rs], data)) { log.Fatal ("FATAL ERROR: Invalid snapshot data") }
+	if (SnapshotRollback (myserver, name, snapshot) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot roll back namespace") }
+	if (SnapshotDelete (myserver, name, snapshot) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete snapshot") }
+	fmt.Println ("PASS")
+}
@@ -0,0 +1,306 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import err "github.com/gvallee/syserror"
+
+/**
+ * Description of a namespace, persisted by the block store along with the namespace
+ */
+type NamespaceDescriptor struct {
+	FormatVersion	int	`json:"format_version"`
+	BlockSize	uint64	`json:"block_size"`
+	Layout		string	`json:"layout,omitempty"`	// How the blocks are stored; LayoutFile if empty
+	LayoutVersion	int	`json:"layout_version,omitempty"`	// Variant of the layout; FileLayoutFlat if 0
+	MigratingFrom	int	`json:"migrating_from,omitempty"`	// Previous variant while the blocks are moved
+	Checksum	string	`json:"checksum,omitempty"`	// Checksum algorithm, see ChecksumStore
+	ChecksumChunkSize	uint64	`json:"checksum_chunk_size,omitempty"`
+	Compression	string	`json:"compression,omitempty"`	// Compression algorithm, see CompressionStore
+	CompressionChunkSize	uint64	`json:"compression_chunk_size,omitempty"`
+	Encryption	string	`json:"encryption,omitempty"`	// Encryption algorithm, see EncryptionStore
+	EncryptionChunkSize	uint64	`json:"encryption_chunk_size,omitempty"`
+	Dedup		bool	`json:"dedup,omitempty"`	// Blocks stored once across namespaces, see DedupStore
+}
+
+// Layouts of the namespaces on disk
+const (
+	// One file per block, see FileStore
+	LayoutFile = "file"
+	// Blocks packed in container files, see ExtentStore
+	LayoutExtent = "extent"
+)
+
+// Variants of the file layout
+const (
+	// All the block files directly in the namespace's directory
+	FileLayoutFlat = 1
+	// Block files spread over two levels of subdirectories by hash of the block id,
+	// e.g., <namespace>/ab/cd/block123
+	FileLayoutSharded = 2
+)
+
+/**
+ * Get the layout of a namespace
+ * @param[in]	desc	Descriptor of the namespace
+ * @return	Layout of the namespace
+ */
+func namespaceLayout (desc NamespaceDescriptor) string {
+	if (desc.Layout == "") { return LayoutFile }
+	return desc.Layout
+}
+
+/**
+ * Storage backend of a data server, i.e., where and how the blocks are actually stored.
+ * Namespaces' names and block sizes are checked by the server before reaching the store.
+ * The server also serializes the operations on a given block and never runs a namespace
+ * operation (create, delete, rename) concurrently with other operations on the same
+ * namespace; the store must however support concurrent operations on different blocks.
+ * Errors follow the server's conventions: ErrNotAvailable when the namespace or block
+ * does not exist, ErrFatal when the underlying storage fails.
+ */
+type BlockStore interface {
+	/**
+	 * Get the store ready to be used, before any other call.
+	 * @param[in]	basedir	Basedir of the server
+	 * @return	System error handle
+	 */
+	Open (basedir string) err.SysError
+
+	/**
+	 * Flush all the data and release the resources of the store. The store can be
+	 * closed more than once, e.g., when the server is stopped before it is started.
+	 * @return	System error handle; ErrFatal if some data could not be flushed
+	 */
+	Close () err.SysError
+
+	/**
+	 * Read data from a block.
+	 * @param[in]	namespace	Namespace of the block
+	 * @param[in]	blockid	Block id
+	 * @param[in]	offset	Offset of the data in the block
+	 * @param[in]	buff	Buffer to fill; the part past the end of the block's data is
+	 *			left untouched
+	 * @return	Amount of data read, i.e., data that was written to the block
+	 * @return	System error handle
+	 */
+	Read (namespace string, blockid uint64, offset uint64, buff []byte) (int, err.SysError)
+
+	/**
+	 * Write data to a block, creating the block if it does not exist.
+	 * @param[in]	namespace	Namespace of the block
+	 * @param[in]	blockid	Block id
+	 * @param[in]	offset	Offset of the data in the block
+	 * @param[in]	data	Data to write
+	 * @param[in]	mode	Durability policy of the namespace
+	 * @return	Amount of data written
+	 * @return	true if the data reached stable storage; false otherwise
+	 * @return	System error handle
+	 */
+	Write (namespace string, blockid uint64, offset uint64, data []byte, mode Durability) (int, bool, err.SysError)
+
+	/**
+	 * Change the size of a block.
+	 * @param[in]	namespace	Namespace of the block
+	 * @param[in]	blockid	Block id
+	 * @param[in]	size	New size of the block
+	 * @param[in]	mode	Durability policy of the namespace
+	 * @return	System error handle
+	 */
+	Truncate (namespace string, blockid uint64, size uint64, mode Durability) err.SysError
+
+	/**
+	 * Delete a block.
+	 * @param[in]	namespace	Namespace of the block
+	 * @param[in]	blockid	Block id
+	 * @return	System error handle
+	 */
+	Delete (namespace string, blockid uint64) err.SysError
+
+	/**
+	 * List the blocks of a namespace.
+	 * @param[in]	namespace	Namespace's name
+	 * @return	Block ids, in no particular order
+	 * @return	System error handle
+	 */
+	List (namespace string) ([]uint64, err.SysError)
+
+	/**
+	 * Get the size of a block.
+	 * @param[in]	namespace	Namespace of the block
+	 * @param[in]	blockid	Block id
+	 * @return	Size of the block's data
+	 * @return	System error handle
+	 */
+	Stat (namespace string, blockid uint64) (uint64, err.SysError)
+
+	/**
+	 * Make sure all the data written to a namespace reached stable storage.
+	 * @param[in]	namespace	Namespace's name
+	 * @return	System error handle; ErrFatal if some data, including data synced in
+	 *		the background since the previous flush, was lost
+	 */
+	Flush (namespace string) err.SysError
+
+	/**
+	 * Sync the data not synced yet of some namespaces, in the background.
+	 * @param[in]	match	Function selecting the namespaces to sync
+	 * @return	Number of blocks that could not be synced
+	 */
+	SyncDirty (match func (namespace string) bool) int
+
+	/**
+	 * Create a namespace, or get the descriptor of an existing namespace. A namespace
+	 * that exists without descriptor (e.g., created by an old server) gets the one
+	 * passed in.
+	 * @param[in]	namespace	Namespace's name
+	 * @param[in]	desc	Descriptor of the namespace to create
+	 * @return	Descriptor of the namespace
+	 * @return	System error handle
+	 */
+	CreateNamespace (namespace string, desc NamespaceDescriptor) (NamespaceDescriptor, err.SysError)
+
+	/**
+	 * Get the descriptor of a namespace.
+	 * @param[in]	namespace	Namespace's name
+	 * @return	Descriptor of the namespace
+	 * @return	System error handle; ErrNotAvailable if the namespace does not exist or
+	 *		has no descriptor, ErrFatal if the descriptor is invalid
+	 */
+	GetNamespace (namespace string) (NamespaceDescriptor, err.SysError)
+
+	/**
+	 * List the namespaces in the store.
+	 * @return	Names of the namespaces, in no particular order
+	 * @return	System error handle
+	 */
+	ListNamespaces () ([]string, err.SysError)
+
+	/**
+	 * Delete a namespace and all its blocks.
+	 * @param[in]	namespace	Namespace's name
+	 * @return	System error handle
+	 */
+	DeleteNamespace (namespace string) err.SysError
+
+	/**
+	 * Rename a namespace.
+	 * @param[in]	oldname	Current name of the namespace
+	 * @param[in]	newname	New name of the namespace; ErrNotAvailable if it already exists
+	 * @return	System error handle
+	 */
+	RenameNamespace (oldname string, newname string) err.SysError
+}
+
+/**
+ * Get the block store at the bottom of a stack of decorators (e.g., ChecksumStore), for
+ * the features specific to a given store
+ * @param[in]	store	Block store, possibly decorated
+ * @return	Block store actually storing the blocks
+ */
+func baseStore (store BlockStore) BlockStore {
+	for {
+		decorator, ok := store.(interface { Unwrap () BlockStore })
+		if (!ok) { return store }
+		store = decorator.Unwrap ()
+	}
+}
+
+/**
+ * Get the amount of storage used by a block, which differs from its size when the block
+ * store (or one of its decorators) transforms the data, e.g., CompressionStore
+ * @param[in]	store	Block store, possibly decorated
+ * @param[in]	namespace	Namespace of the block
+ * @param[in]	blockid	Block id
+ * @param[in]	size	Size of the block
+ * @return	Amount of storage used by the block
+ * @return	System error handle
+ */
+func physicalSize (store BlockStore, namespace string, blockid uint64, size uint64) (uint64, err.SysError) {
+	for {
+		sizer, ok := store.(interface { PhysicalSize (string, uint64) (uint64, err.SysError) })
+		if (ok) { return sizer.PhysicalSize (namespace, blockid) }
+		decorator, ok := store.(interface { Unwrap () BlockStore })
+		if (!ok) { return size, err.NoErr }
+		store = decorator.Unwrap ()
+	}
+}
+
+/**
+ * Check that a namespace descriptor can be used by this version of the server
+ * @param[in]	desc	Descriptor of the namespace
+ * @return	true if the descriptor is valid; false otherwise
+ */
+func validNamespaceDescriptor (desc NamespaceDescriptor) bool {
+	return desc.FormatVersion >= 1 && desc.FormatVersion <= FormatVersion && CheckBlockSize (desc.BlockSize) == nil
+}
+
+/**
+ * Copy a block to another namespace, cheaply when the store supports it, e.g., by
+ * sharing the data on disk (see FileStore.CloneBlock). The caller must have exclusive
+ * access to both blocks.
+ * @param[in]	store	Block store, possibly decorated
+ * @param[in]	src	Namespace of the block to copy
+ * @param[in]	dst	Namespace of the copy
+ * @param[in]	blockid	Block id, the same in both namespaces
+ * @param[in]	mode	Durability policy of the copy
+ * @return	System error handle; ErrNotAvailable if the block to copy does not exist,
+ *		in which case the block of the destination namespace is deleted
+ */
+func cloneBlock (store BlockStore, src string, dst string, blockid uint64, mode Durability) err.SysError {
+	cloner, ok := store.(interface { CloneBlock (string, string, uint64, Durability) err.SysError })
+	if (ok) { return cloner.CloneBlock (src, dst, blockid, mode) }
+	return copyBlock (store, src, dst, blockid, mode)
+}
+
+/**
+ * Copy a block to another namespace by reading and writing its data, see cloneBlock
+ * @param[in]	store	Block store, possibly decorated
+ * @param[in]	src	Namespace of the block to copy
+ * @param[in]	dst	Namespace of the copy
+ * @param[in]	blockid	Block id, the same in both namespaces
+ * @param[in]	mode	Durability policy of the copy
+ * @return	System error handle; ErrNotAvailable if the block to copy does not exist
+ */
+func copyBlock (store BlockStore, src string, dst string, blockid uint64, mode Durability) err.SysError {
+	size, myerr := store.Stat (src, blockid)
+	if (myerr == err.ErrNotAvailable) {
+		myerr = store.Delete (dst, blockid)
+		if (myerr == err.NoErr || myerr == err.ErrNotAvailable) { return err.ErrNotAvailable }
+		return myerr
+	}
+	if (myerr != err.NoErr) { return myerr }
+	data := make ([]byte, size)
+	n, myerr := store.Read (src, blockid, 0, data)
+	if (myerr != err.NoErr) { return myerr }
+	if (uint64 (n) != size) { return err.ErrFatal }
+
+	// The copy must not keep data past the end of the block
+	myerr = store.Delete (dst, blockid)
+	if (myerr != err.NoErr && myerr != err.ErrNotAvailable) { return myerr }
+	_, _, myerr = store.Write (dst, blockid, 0, data, mode)
+	return myerr
+}
+
+/**
+ * Clone a block and its block in a companion namespace (e.g., its checksums) with the
+ * store wrapped by a decorator, for decorators storing the block the same way in both
+ * namespaces. A block may have no companion block, e.g., blocks written before the
+ * checksums were enabled.
+ * @param[in]	store	Block store wrapped by the decorator
+ * @param[in]	src	Namespace of the block to copy
+ * @param[in]	dst	Namespace of the copy
+ * @param[in]	companion	Name of the companion namespace of a namespace
+ * @param[in]	blockid	Block id, the same in both namespaces
+ * @param[in]	mode	Durability policy of the copy
+ * @return	System error handle; ErrNotAvailable if the block to copy does not exist
+ */
+func cloneBlockWithCompanion (store BlockStore, src string, dst string, companion func (string) string, blockid uint64, mode Durability) err.SysError {
+	myerr := cloneBlock (store, src, dst, blockid, mode)
+	if (myerr != err.NoErr && myerr != err.ErrNotAvailable) { return myerr }
+	companionerr := cloneBlock (store, companion (src), companion (dst), blockid, mode)
+	if (companionerr != err.NoErr && companionerr != err.ErrNotAvailable) { return companionerr }
+	return myerr
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"io/ioutil"
+	"path/filepath")
+
+import err "github.com/gvallee/syserror"
+
+/**
+ * Block store counting the writes reaching the store it wraps
+ */
+type countingStore struct {
+	BlockStore
+	writes	int
+}
+
+func (store *countingStore) Write (namespace string, blockid uint64, offset uint64, data []byte, mode Durability) (int, bool, err.SysError) {
+	store.writes += 1
+	return store.BlockStore.Write (namespace, blockid, offset, data, mode)
+}
+
+func TestFileStore (t *testing.T) {
+	validTestPath := "/tmp/ds_test_filestore/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing the file store... ")
+	store := NewFileStore (2)
+	if (store.Open (validTestPath) != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot open the store") }
+	defer store.Close ()
+
+	desc := NamespaceDescriptor {FormatVersion: FormatVersion, BlockSize: 4096}
+	_, myerr := store.CreateNamespace ("../x", desc)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Created a namespace outside of the basedir") }
+	_, myerr = store.CreateNamespace ("ns", desc)
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot create namespace") }
+	desc.BlockSize = 8192
+	got, myerr := store.CreateNamespace ("ns", desc)
+	if (myerr != err.NoErr || got.BlockSize != 4096) { log.Fatal ("FATAL ERROR: Descriptor of an existing namespace replaced") }
+
+	for blockid := uint64 (0); blockid < 4; blockid++ {
+		ws, _, myerr := store.Write ("ns", blockid, 0, make ([]byte, 10 * (blockid + 1)), DurabilityPerWrite)
+		if (ws != int (10 * (blockid + 1)) || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	}
+	blocks, myerr := store.List ("ns")
+	if (myerr != err.NoErr || len (blocks) != 4) { log.Fatal ("FATAL ERROR: Invalid list of blocks: ", blocks) }
+	size, myerr := store.Stat ("ns", 3)
+	if (myerr != err.NoErr || size != 40) { log.Fatal ("FATAL ERROR: Invalid block size: ", size) }
+	_, myerr = store.Stat ("ns", 4)
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Got the size of a missing block") }
+
+	if (store.RenameNamespace ("ns", "renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot rename namespace") }
+	buff := make ([]byte, 100)
+	rs, myerr := store.Read ("renamed", 1, 0, buff)
+	if (rs != 20 || myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot read renamed namespace") }
+	names, _ := store.ListNamespaces ()
+	if (len (names) != 1 || names[0] != "renamed") { log.Fatal ("FATAL ERROR: Invalid list of namespaces: ", names) }
+	if (store.DeleteNamespace ("renamed") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot delete namespace") }
+	_, myerr = store.GetNamespace ("renamed")
+	if (myerr != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Deleted namespace still there") }
+	fmt.Println ("PASS")
+}
+
+func TestCustomStore (t *testing.T) {
+	validTestPath := "/tmp/ds_test_customstore/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath, 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing a server with a custom store... ")
+	store := &countingStore {BlockStore: NewFileStore (DefaultBlockCacheSize)}
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 1024 * 1024
+	cfg.URL = "127.0.0.1:8902"
+	cfg.Store = store
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+
+	_, myerr := BlockWrite (myserver, "default", 0, 0, make ([]byte, 10))
+	if (myerr != err.NoErr || store.writes != 1) { log.Fatal ("FATAL ERROR: Write did not go through the store") }
+	if (SetBlockCacheSize (myserver, 10) != err.ErrNotAvailable) { log.Fatal ("FATAL ERROR: Resized the cache of a custom store") }
+	fmt.Println ("PASS")
+}
+
+func TestFileLayouts (t *testing.T) {
+	validTestPath := "/tmp/ds_test_filelayouts/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath + "legacy", 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+	for blockid := 0; blockid < 10; blockid++ {
+		myerror = ioutil.WriteFile (validTestPath + "legacy/block" + strconv.Itoa (blockid), make ([]byte, blockid + 1), 0600)
+		if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create block file") }
+	}
+
+	fmt.Print ("Testing the sharded layout of new namespaces... ")
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 4096
+	cfg.URL = "127.0.0.1:8905"
+	myserver := ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	defer myserver.Stop (context.Background ())
+	_, myerr := BlockWrite (myserver, "default", 42, 0, make ([]byte, 10))
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	_, myerror = os.Stat (filepath.Join (validTestPath, "default", shardDir (42), "block42"))
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Block not in its shard") }
+	stats, myerr := NamespaceStat (myserver, "default")
+	if (myerr != err.NoErr || stats.Blocks != 1 || stats.BytesUsed != 10) { log.Fatal ("FATAL ERROR: Invalid statistics: ", stats) }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing the flat layout of existing namespaces... ")
+	rs, _, myerr := BlockRead (myserver, "legacy", 3, 0, 100)
+	if (myerr != err.NoErr || rs != 4) { log.Fatal ("FATAL ERROR: Cannot read a legacy block") }
+	_, myerr = BlockWrite (myserver, "legacy", 10, 0, make ([]byte, 11))
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	_, myerror = os.Stat (validTestPath + "legacy/block10")
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: New block of a flat namespace not in place") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing the migration of a namespace in use... ")
+	// Interrupted migration: the blocks are moved upon access
+	store := baseStore (myserver.store).(*FileStore)
+	todo, myerr := store.startMigration ("legacy")
+	if (myerr != err.NoErr || !todo) { log.Fatal ("FATAL ERROR: Cannot start migration") }
+	rs, _, myerr = BlockRead (myserver, "legacy", 5, 0, 100)
+	if (myerr != err.NoErr || rs != 6) { log.Fatal ("FATAL ERROR: Cannot read a block being migrated") }
+	_, myerror = os.Stat (filepath.Join (validTestPath, "legacy", shardDir (5), "block5"))
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Block not moved upon access") }
+	_, myerr = BlockWrite (myserver, "legacy", 11, 0, make ([]byte, 12))
+	if (myerr != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot write block") }
+	stats, myerr = NamespaceStat (myserver, "legacy")
+	if (myerr != err.NoErr || stats.Blocks != 12 || stats.BytesUsed != 78) { log.Fatal ("FATAL ERROR: Invalid statistics: ", stats) }
+	if (NamespaceMigrate (myserver, "legacy") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot migrate namespace") }
+	files, _ := filepath.Glob (validTestPath + "legacy/block*")
+	if (len (files) != 0) { log.Fatal ("FATAL ERROR: Blocks left behind: ", files) }
+	desc, myerr := store.GetNamespace ("legacy")
+	if (myerr != err.NoErr || desc.LayoutVersion != FileLayoutSharded || desc.MigratingFrom != 0) { log.Fatal ("FATAL ERROR: Invalid descriptor: ", desc) }
+	for blockid := uint64 (0); blockid < 12; blockid++ {
+		rs, _, myerr = BlockRead (myserver, "legacy", blockid, 0, 100)
+		if (myerr != err.NoErr || rs != int (blockid + 1)) { log.Fatal ("FATAL ERROR: Invalid block ", blockid, " after migration") }
+	}
+	if (NamespaceMigrate (myserver, "legacy") != err.NoErr) { log.Fatal ("FATAL ERROR: Cannot migrate a sharded namespace") }
+	fmt.Println ("PASS")
+}
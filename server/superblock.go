@@ -0,0 +1,153 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+package server
+
+import ("os"
+	"fmt"
+	"time"
+	"io/ioutil"
+	"crypto/rand"
+	"encoding/json"
+	"path/filepath")
+
+import err "github.com/gvallee/syserror"
+
+// Version of the on-disk layout (superblock and namespace descriptors) of the server
+const FormatVersion = 1
+
+// Name of the superblock file, in the basedir
+const superblockName = ".superblock"
+
+/**
+ * Description of a basedir, persisted in the basedir itself
+ */
+type superblock struct {
+	FormatVersion	int		`json:"format_version"`
+	BlockSize	uint64		`json:"block_size"`	// Default block size of the namespaces
+	UUID		string		`json:"uuid"`
+	Created		time.Time	`json:"created"`
+}
+
+/**
+ * Create a random (version 4) UUID
+ * @return	UUID
+ * @return	System error handle
+ */
+func newUUID () (string, err.SysError) {
+	b := make ([]byte, 16)
+	_, myerror := rand.Read (b)
+	if (myerror != nil) { return "", err.ErrFatal }
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf ("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), err.NoErr
+}
+
+/**
+ * Write a JSON file. The file is replaced atomically, readers see either the old or the
+ * new content.
+ * @param[in]	path	Path to the file
+ * @param[in]	v	Value to store
+ * @return	System error handle
+ */
+func writeJSONFile (path string, v interface{}) err.SysError {
+	content, myerror := json.Marshal (v)
+	if (myerror != nil) { return err.ErrFatal }
+
+	tmp := path + ".tmp"
+	f, myerror := os.OpenFile (tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if (myerror == nil) {
+		_, myerror = f.Write (content)
+		if (myerror == nil) { myerror = f.Sync() }
+		closeerr := f.Close()
+		if (myerror == nil) { myerror = closeerr }
+	}
+	if (myerror == nil) { myerror = os.Rename (tmp, path) }
+	if (myerror != nil) {
+		fmt.Println ("Cannot write", path, ":", myerror.Error())
+		os.Remove (tmp)
+		return err.ErrFatal
+	}
+	return err.NoErr
+}
+
+/**
+ * Read a JSON file
+ * @param[in]	path	Path to the file
+ * @param[out]	v	Value to fill
+ * @return	System error handle; ErrNotAvailable if the file does not exist, ErrFatal
+ *		if it cannot be read or decoded
+ */
+func readJSONFile (path string, v interface{}) err.SysError {
+	content, myerror := ioutil.ReadFile (path)
+	if (os.IsNotExist (myerror)) { return err.ErrNotAvailable }
+	if (myerror == nil) { myerror = json.Unmarshal (content, v) }
+	if (myerror != nil) {
+		fmt.Println ("Cannot read", path, ":", myerror.Error())
+		return err.ErrFatal
+	}
+	return err.NoErr
+}
+
+/**
+ * Read the superblock of a basedir, creating it if the basedir does not have one yet
+ * (new basedir or basedir created before superblocks existed). A basedir whose
+ * superblock does not match the configuration of the server is refused, unless force
+ * is set.
+ * @param[in]	basedir	Path to the basedir
+ * @param[in]	blocksize	Block size the server is configured with
+ * @param[in]	force	Mount the basedir even if it does not match the configuration
+ * @return	Superblock of the basedir, as found on disk
+ * @return	System error handle
+ */
+func mountSuperblock (basedir string, blocksize uint64, force bool) (superblock, err.SysError) {
+	var sb superblock
+
+	myerr := readJSONFile (filepath.Join (basedir, superblockName), &sb)
+	if (myerr == err.ErrNotAvailable) {
+		sb.FormatVersion = FormatVersion
+		sb.BlockSize = blocksize
+		sb.Created = time.Now ().UTC ()
+		sb.UUID, myerr = newUUID ()
+		if (myerr != err.NoErr) { return sb, myerr }
+		return sb, saveSuperblock (basedir, sb)
+	}
+	if (myerr != err.NoErr) { return sb, myerr }
+
+	// Nothing can be done with a layout we do not know, even when forced
+	if (sb.FormatVersion < 1 || sb.FormatVersion > FormatVersion) {
+		fmt.Println ("Unsupported format version", sb.FormatVersion, "for basedir", basedir)
+		return sb, err.ErrFatal
+	}
+	if (sb.BlockSize == 0 || sb.UUID == "") {
+		fmt.Println ("Invalid superblock for basedir", basedir)
+		return sb, err.ErrFatal
+	}
+
+	if (sb.BlockSize != blocksize) {
+		if (!force) {
+			fmt.Println ("Basedir", basedir, "was created with a block size of", sb.BlockSize, "not", blocksize)
+			return sb, err.ErrFatal
+		}
+		fmt.Println ("WARNING: changing the block size of basedir", basedir, "from", sb.BlockSize, "to", blocksize)
+	}
+	return sb, err.NoErr
+}
+
+func saveSuperblock (basedir string, sb superblock) err.SysError {
+	return writeJSONFile (filepath.Join (basedir, superblockName), sb)
+}
+
+/**
+ * Get the UUID of a server, which identifies its basedir
+ * @param[in]	ds	Structure representing the server
+ * @return	UUID of the server
+ * @return	System error handle
+ */
+func GetUUID (ds *Server) (string, err.SysError) {
+	if (ds == nil) { return "", err.ErrNotAvailable }
+
+	return ds.uuid, err.NoErr
+}
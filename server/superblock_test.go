@@ -0,0 +1,70 @@
+/*
+ * Copyright(c)		Geoffroy Vallee
+ *			All rights reserved
+ */
+
+package server
+
+import ("testing"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"io/ioutil")
+
+import err "github.com/gvallee/syserror"
+
+func TestSuperblock (t *testing.T) {
+	validTestPath := "/tmp/ds_test_superblock/"
+	myerror := os.RemoveAll (validTestPath)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot remove basedir required for testing") }
+	myerror = os.MkdirAll (validTestPath + "legacy", 0700)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot create the server's basedir") }
+	defer os.RemoveAll (validTestPath)
+
+	fmt.Print ("Testing superblock creation... ")
+	myserver := ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8900")
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot create data server") }
+	uuid, myerr := GetUUID (myserver)
+	if (myerr != err.NoErr || len (uuid) != 36) { log.Fatal ("FATAL ERROR: Invalid server UUID: ", uuid) }
+	bs, _ := GetNamespaceBlocksize (myserver, "legacy")
+	if (bs != 1024 * 1024) { log.Fatal ("FATAL ERROR: Invalid block size for a namespace without descriptor") }
+	myserver.Stop (context.Background ())
+	_, myerror = os.Stat (validTestPath + "legacy/" + namespaceDescriptorName)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Descriptor of an existing namespace was not created") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing basedir validation... ")
+	myserver = ServerInit (validTestPath, 1024 * 1024, "127.0.0.1:8900")
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot restart data server") }
+	sameuuid, _ := GetUUID (myserver)
+	if (sameuuid != uuid) { log.Fatal ("FATAL ERROR: UUID changed upon restart") }
+	myserver.Stop (context.Background ())
+	if (ServerInit (validTestPath, 4096, "127.0.0.1:8900") != nil) { log.Fatal ("FATAL ERROR: Mounted a basedir with a different block size") }
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing forced mount... ")
+	var cfg ServerConfig
+	cfg.Basedir = validTestPath
+	cfg.BlockSize = 4096
+	cfg.URL = "127.0.0.1:8900"
+	cfg.Force = true
+	myserver = ServerInitWithConfig (&cfg)
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Cannot force the mount of the basedir") }
+	bs, _ = GetNamespaceBlocksize (myserver, "legacy")
+	if (bs != 1024 * 1024) { log.Fatal ("FATAL ERROR: Block size of an existing namespace changed") }
+	myserver.Stop (context.Background ())
+	myserver = ServerInit (validTestPath, 4096, "127.0.0.1:8900")
+	if (myserver == nil) { log.Fatal ("FATAL ERROR: Forced block size was not recorded") }
+	myserver.Stop (context.Background ())
+	fmt.Println ("PASS")
+
+	fmt.Print ("Testing unsupported layouts... ")
+	myerror = ioutil.WriteFile (validTestPath + superblockName, []byte (`{"format_version":99,"block_size":4096,"uuid":"x"}`), 0600)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot write superblock") }
+	if (ServerInitWithConfig (&cfg) != nil) { log.Fatal ("FATAL ERROR: Mounted a basedir with an unknown format") }
+	myerror = ioutil.WriteFile (validTestPath + superblockName, []byte ("garbage"), 0600)
+	if (myerror != nil) { log.Fatal ("FATAL ERROR: Cannot write superblock") }
+	if (ServerInitWithConfig (&cfg) != nil) { log.Fatal ("FATAL ERROR: Mounted a basedir with a corrupted superblock") }
+	fmt.Println ("PASS")
+}
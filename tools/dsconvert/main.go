@@ -0,0 +1,35 @@
+/*
+ * Copyright(c)         Geoffroy Vallee
+ *                      All rights reserved
+ */
+
+/*
+ * Offline conversion of the namespaces of a basedir from one file per block to blocks
+ * packed in container files (extent layout). No server may use the basedir during the
+ * conversion. An interrupted conversion can be run again.
+ */
+
+package main
+
+import (
+	"fmt"
+	"flag"
+	"os"
+	"log"
+	)
+
+import ds "../../server"
+import err "github.com/gvallee/syserror"
+
+func main() {
+	basedir := flag.String ("basedir", "", "Base directory of the data server to convert")
+	namespace := flag.String ("namespace", "", "Namespace to convert; all the namespaces if not specified")
+
+	flag.Parse()
+
+	_, myerror := os.Stat (*basedir)
+	if (myerror != nil) { log.Fatal (myerror) }
+
+	if (ds.ConvertToExtents (*basedir, *namespace) != err.NoErr) { log.Fatal ("Conversion failed") }
+	fmt.Println ("Conversion done, start the server with -store extent")
+}